@@ -0,0 +1,91 @@
+// Package adminapi defines the node daemon's local admin API: the interface
+// the CNI shim, the diagnose/vnidctl-style tooling and anything else running
+// on the same host use to ask a live k8s-ovs node to set up or tear down a
+// pod, report status, or trigger a reconcile, instead of poking etcd or OVS
+// directly.
+//
+// The API is JSON-over-HTTP served on a unix socket, the same choice
+// cniserver already made for the CNI shim's own socket -- there's no
+// cross-host or cross-language client to justify gRPC's extra machinery
+// here, and every existing local caller already speaks HTTP+JSON. Filesystem
+// permissions on the socket (root-only directory, 0600 socket) are the
+// authentication boundary; anything that can reach the socket is trusted.
+//
+// The API is versioned by URL prefix ("/v1/..."). Backward compatibility
+// within a version means: existing routes and response fields never change
+// meaning or disappear, and new fields are additive (zero value if unset).
+// A change that can't be made that way gets a new prefix ("/v2/...") served
+// alongside "/v1/" rather than replacing it, so old clients keep working.
+package adminapi
+
+import "time"
+
+const (
+	// AdminServerSocketPath is the default unix domain socket the admin API
+	// listens on.
+	AdminServerSocketPath = "/var/run/k8s-ovs/admin.sock"
+
+	// Version is the current admin API version, and the URL prefix every
+	// route below is served under.
+	Version = "v1"
+)
+
+// PodStatus is the admin API's view of a single local pod, returned by the
+// pod status route.
+type PodStatus struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Phase     string `json:"phase"`
+	PodIP     string `json:"podIp,omitempty"`
+	VNID      uint32 `json:"vnid"`
+}
+
+// PodSetupResult is the response to a pod setup or teardown call: the same
+// CNI result payload the CNI shim's own socket would have returned, so a
+// caller of either socket gets identical bytes back.
+type PodSetupResult struct {
+	Response []byte `json:"response,omitempty"`
+}
+
+// FlowState is the admin API's flow-table diagnostic snapshot: per-table
+// flow counts, keyed by OpenFlow table number as a string (JSON object keys
+// must be strings).
+type FlowState struct {
+	TableCounts map[string]uint64 `json:"tableCounts"`
+}
+
+// ReconcileResult reports whether a triggered reconcile changed the node's
+// network configuration.
+type ReconcileResult struct {
+	NetworkChanged bool `json:"networkChanged"`
+}
+
+// ServiceRulesResult reports whether service rules ended up enabled after a
+// set-service-rules-mode call.
+type ServiceRulesResult struct {
+	Enabled bool `json:"enabled"`
+}
+
+// DryRunMutation mirrors ovs.DryRunMutation for the simulate-VNID-change
+// route, so callers of this API don't need to import package ovs.
+type DryRunMutation struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Feature     string `json:"feature"`
+	Description string `json:"description"`
+}
+
+// DryRunResult is the response to a simulate-VNID-change call: every OVS
+// flow mutation that would have been made, in the order they'd have been
+// made.
+type DryRunResult struct {
+	Mutations []DryRunMutation `json:"mutations"`
+}
+
+// MirrorInfo describes one namespace's active on-demand traffic mirror (see
+// ksdn/mirror.go), returned by the create- and list-mirrors routes.
+type MirrorInfo struct {
+	Namespace        string    `json:"namespace"`
+	VNID             uint32    `json:"vnid"`
+	CaptureInterface string    `json:"captureInterface"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+}
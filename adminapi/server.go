@@ -0,0 +1,260 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	utilruntime "k8s.io/kubernetes/pkg/util/runtime"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// podSetupRequest is the JSON body of a pod setup/teardown call.
+type podSetupRequest struct {
+	ContainerId string `json:"containerId"`
+	Netns       string `json:"netns,omitempty"`
+}
+
+// Handlers are the node-side implementations the admin API dispatches to.
+// Every field is required; NewServer's caller is expected to wire them to
+// the same functions the daemon's watch-driven code paths already use, not
+// separate copies of the logic.
+type Handlers struct {
+	// PodSetup and PodTeardown run CNI ADD/DEL for a pod and return the same
+	// result payload the CNI shim's own socket would.
+	PodSetup    func(namespace, name, containerID, netns string) ([]byte, error)
+	PodTeardown func(namespace, name, containerID, netns string) ([]byte, error)
+
+	// PodStatus looks up a local pod's current phase, IP and VNID.
+	PodStatus func(namespace, name string) (*PodStatus, error)
+
+	// VNIDs returns the node's full namespace-to-VNID map.
+	VNIDs func() map[string]uint32
+
+	// FlowTableCounts returns the current per-table flow counts.
+	FlowTableCounts func() (map[int]uint64, error)
+
+	// Reconcile re-runs SDN setup and reports whether anything changed.
+	Reconcile func() (bool, error)
+
+	// SimulateVNIDChange dry-runs the OVS side effects of namespace moving
+	// to netID -- the same per-pod and per-service flow updates a real VNID
+	// change would make -- without touching the real bridge or deleting any
+	// pods, and returns every flow mutation that would have been made.
+	SimulateVNIDChange func(namespace string, netID uint32) (*DryRunResult, error)
+
+	// SetServiceRulesMode re-resolves the node's --service-rules mode
+	// (enabled/disabled/auto) and cleanly starts or stops service rule
+	// programming to match, returning the resolved enabled state. This is
+	// the "flip service-rules at runtime" reload path.
+	SetServiceRulesMode func(mode string) (bool, error)
+
+	// CreateMirror starts (or restarts) an on-demand traffic mirror of
+	// namespace's VNID to the node's capture interface, expiring after
+	// ttlSeconds.
+	CreateMirror func(namespace string, ttlSeconds int) (*MirrorInfo, error)
+
+	// ListMirrors returns every currently active traffic mirror.
+	ListMirrors func() ([]MirrorInfo, error)
+
+	// DeleteMirror stops namespace's traffic mirror early, if it has one.
+	DeleteMirror func(namespace string) error
+}
+
+// Server serves the admin API on a unix domain socket.
+type Server struct {
+	http.Server
+	handlers Handlers
+	path     string
+}
+
+// NewServer returns a Server for handlers, listening on socketPath once
+// started.
+func NewServer(socketPath string, handlers Handlers) *Server {
+	router := mux.NewRouter()
+
+	s := &Server{
+		Server:   http.Server{Handler: router},
+		handlers: handlers,
+		path:     socketPath,
+	}
+
+	router.NotFoundHandler = http.HandlerFunc(http.NotFound)
+	prefix := "/" + Version
+	router.HandleFunc(prefix+"/pods/{namespace}/{name}/setup", s.handlePodSetup).Methods("POST")
+	router.HandleFunc(prefix+"/pods/{namespace}/{name}/teardown", s.handlePodTeardown).Methods("POST")
+	router.HandleFunc(prefix+"/pods/{namespace}/{name}/status", s.handlePodStatus).Methods("GET")
+	router.HandleFunc(prefix+"/vnids", s.handleVNIDs).Methods("GET")
+	router.HandleFunc(prefix+"/flows", s.handleFlows).Methods("GET")
+	router.HandleFunc(prefix+"/reconcile", s.handleReconcile).Methods("POST")
+	router.HandleFunc(prefix+"/namespaces/{namespace}/vnid/simulate", s.handleSimulateVNIDChange).Methods("POST")
+	router.HandleFunc(prefix+"/service-rules", s.handleSetServiceRulesMode).Methods("POST")
+	router.HandleFunc(prefix+"/namespaces/{namespace}/mirror", s.handleCreateMirror).Methods("POST")
+	router.HandleFunc(prefix+"/mirrors", s.handleListMirrors).Methods("GET")
+	router.HandleFunc(prefix+"/namespaces/{namespace}/mirror", s.handleDeleteMirror).Methods("DELETE")
+	return s
+}
+
+// Start creates the admin socket, with the same root-only directory and
+// 0600 socket permissions cniserver.CNIServer.Start uses, and begins
+// serving requests in the background.
+func (s *Server) Start() error {
+	dirName := path.Dir(s.path)
+	if err := os.RemoveAll(dirName); err != nil {
+		return fmt.Errorf("failed to remove old admin socket dir: %v", err)
+	}
+	if err := os.MkdirAll(dirName, 0700); err != nil {
+		return fmt.Errorf("failed to create admin socket directory: %v", err)
+	}
+
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin socket: %v", err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to set admin socket mode: %v", err)
+	}
+
+	s.SetKeepAlivesEnabled(false)
+	go utilwait.Forever(func() {
+		if err := s.Serve(l); err != nil {
+			utilruntime.HandleError(fmt.Errorf("admin API Serve() failed: %v", err))
+		}
+	}, 0)
+	return nil
+}
+
+func (s *Server) handlePodSetup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var req podSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.handlers.PodSetup(vars["namespace"], vars["name"], req.ContainerId, req.Netns)
+	writeResult(w, PodSetupResult{Response: resp}, err)
+}
+
+func (s *Server) handlePodTeardown(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var req podSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.handlers.PodTeardown(vars["namespace"], vars["name"], req.ContainerId, req.Netns)
+	writeResult(w, PodSetupResult{Response: resp}, err)
+}
+
+func (s *Server) handlePodStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	status, err := s.handlers.PodStatus(vars["namespace"], vars["name"])
+	writeResult(w, status, err)
+}
+
+func (s *Server) handleVNIDs(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, s.handlers.VNIDs(), nil)
+}
+
+func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
+	counts, err := s.handlers.FlowTableCounts()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	state := FlowState{TableCounts: make(map[string]uint64, len(counts))}
+	for table, count := range counts {
+		state.TableCounts[fmt.Sprintf("%d", table)] = count
+	}
+	writeResult(w, state, nil)
+}
+
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	networkChanged, err := s.handlers.Reconcile()
+	writeResult(w, ReconcileResult{NetworkChanged: networkChanged}, err)
+}
+
+// simulateVNIDChangeRequest is the JSON body of a simulate-VNID-change call.
+type simulateVNIDChangeRequest struct {
+	NetID uint32 `json:"netID"`
+}
+
+func (s *Server) handleSimulateVNIDChange(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	var req simulateVNIDChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.handlers.SimulateVNIDChange(namespace, req.NetID)
+	writeResult(w, result, err)
+}
+
+// setServiceRulesModeRequest is the JSON body of a set-service-rules-mode call.
+type setServiceRulesModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+func (s *Server) handleSetServiceRulesMode(w http.ResponseWriter, r *http.Request) {
+	var req setServiceRulesModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	enabled, err := s.handlers.SetServiceRulesMode(req.Mode)
+	writeResult(w, ServiceRulesResult{Enabled: enabled}, err)
+}
+
+// createMirrorRequest is the JSON body of a create-mirror call.
+type createMirrorRequest struct {
+	TTLSeconds int `json:"ttlSeconds"`
+}
+
+func (s *Server) handleCreateMirror(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	var req createMirrorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.handlers.CreateMirror(namespace, req.TTLSeconds)
+	writeResult(w, result, err)
+}
+
+func (s *Server) handleListMirrors(w http.ResponseWriter, r *http.Request) {
+	mirrors, err := s.handlers.ListMirrors()
+	writeResult(w, mirrors, err)
+}
+
+func (s *Server) handleDeleteMirror(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	err := s.handlers.DeleteMirror(namespace)
+	writeResult(w, struct{}{}, err)
+}
+
+func writeResult(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Warningf("Error writing admin API response: %v", err)
+	}
+}
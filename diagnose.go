@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+
+	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	kexec "k8s.io/kubernetes/pkg/util/exec"
+
+	"k8s-ovs/ksdn"
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/etcdmanager/etcdv2"
+	"k8s-ovs/pkg/ovs"
+)
+
+// diagnoseCheck is the PASS/FAIL result of a single invariant check.
+type diagnoseCheck struct {
+	Name    string   `json:"name"`
+	Pass    bool     `json:"pass"`
+	Details []string `json:"details,omitempty"`
+}
+
+// diagnoseReport is the full output of "k8s-ovs diagnose": the state that
+// was read plus the invariant checks run against it.
+type diagnoseReport struct {
+	VNIDs               map[string]uint32 `json:"vnids"`
+	UnmanagedNamespaces []string          `json:"unmanagedNamespaces,omitempty"`
+	LocalSubnet         string            `json:"localSubnet,omitempty"`
+	PeerSubnets         []string          `json:"peerSubnets"`
+	LocalPods           []diagnosePod     `json:"localPods"`
+	Checks              []diagnoseCheck   `json:"checks"`
+}
+
+type diagnosePod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+}
+
+// runDiagnose implements "k8s-ovs diagnose": a read-only tool support
+// engineers can run on a node to gather and sanity-check SDN state in one
+// shot. It never mutates etcd, the API server or OVS state.
+func runDiagnose(args []string) {
+	fs := pflag.NewFlagSet("diagnose", pflag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print results as JSON instead of human-readable text")
+	network := fs.String("network", "", "network name, ex: (--network=test)")
+	hostname := fs.String("hostname", "", "hostname to diagnose (defaults to the local hostname)")
+	unmanagedNamespaces := fs.String("unmanaged-namespaces", "", "comma-separated list of namespaces excluded from SDN management, matching the node/master's --unmanaged-namespaces (used only to mark statically-unmanaged namespaces that aren't already carrying the k8s-ovs/unmanaged annotation)")
+
+	clientConfig := kubectl_util.DefaultClientConfig(fs)
+	fs.Parse(args)
+
+	host := *hostname
+	if host == "" {
+		if h, err := os.Hostname(); err == nil {
+			host = strings.ToLower(strings.TrimSpace(h))
+		}
+	}
+
+	cfg, err := clientConfig.ClientConfig()
+	if err != nil {
+		glog.Fatalf("Get kube config failed: %v", err)
+	}
+	kubeClient := client.NewOrDie(cfg)
+
+	eClient, err := etcdv2.NewManager(&etcdv2.EtcdConfig{
+		Endpoints: strings.Split(*opts.etcdEndpoints, ","),
+		Keyfile:   *opts.etcdKeyfile,
+		Certfile:  *opts.etcdCertfile,
+		CAFile:    *opts.etcdCAFile,
+		Prefix:    *opts.etcdPrefix,
+		Username:  *opts.etcdUsername,
+		Password:  *opts.etcdPassword,
+	})
+	if err != nil {
+		glog.Fatalf("Create etcd client failed: %v", err)
+	}
+
+	ovsif, err := ovs.New(kexec.New(), "br0")
+	if err != nil {
+		glog.Fatalf("Create ovs interface failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var staticUnmanaged []string
+	if *unmanagedNamespaces != "" {
+		staticUnmanaged = strings.Split(*unmanagedNamespaces, ",")
+	}
+	report := buildDiagnoseReport(ctx, eClient, kubeClient, ovsif, *network, host, staticUnmanaged)
+
+	if *jsonOutput {
+		raw, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(raw))
+	} else {
+		printDiagnoseReport(report)
+	}
+
+	for _, c := range report.Checks {
+		if !c.Pass {
+			os.Exit(1)
+		}
+	}
+}
+
+func buildDiagnoseReport(ctx context.Context, eClient etcdmanager.EtcdManager, kubeClient *client.Client, ovsif *ovs.Interface, network, hostname string, staticUnmanaged []string) *diagnoseReport {
+	report := &diagnoseReport{VNIDs: map[string]uint32{}}
+
+	unmanagedStatic := map[string]bool{}
+	for _, ns := range staticUnmanaged {
+		unmanagedStatic[ns] = true
+	}
+
+	netNSs, err := eClient.GetNetNamespaces(ctx, network)
+	if err != nil {
+		glog.Errorf("Failed to read NetNamespaces from etcd: %v", err)
+	}
+	for _, n := range netNSs {
+		report.VNIDs[n.NetName] = n.NetID
+		if unmanagedStatic[n.NetName] || ksdn.NamespaceUnmanaged(n.Annotations) {
+			report.UnmanagedNamespaces = append(report.UnmanagedNamespaces, n.NetName)
+		}
+	}
+
+	subnets, err := eClient.GetSubnets(ctx, network)
+	if err != nil {
+		glog.Errorf("Failed to read subnets from etcd: %v", err)
+	}
+	for _, s := range subnets {
+		if s.Host == hostname {
+			report.LocalSubnet = s.Subnet
+		} else {
+			report.PeerSubnets = append(report.PeerSubnets, s.Subnet)
+		}
+	}
+
+	fieldSelector := fields.Set{"spec.nodeName": hostname}.AsSelector()
+	podList, err := kubeClient.Pods(kapi.NamespaceAll).List(kapi.ListOptions{
+		LabelSelector: labels.Everything(),
+		FieldSelector: fieldSelector,
+	})
+	if err != nil {
+		glog.Errorf("Failed to list local pods: %v", err)
+	} else {
+		for _, pod := range podList.Items {
+			if pod.Status.Phase != kapi.PodRunning || pod.Status.PodIP == "" {
+				continue
+			}
+			report.LocalPods = append(report.LocalPods, diagnosePod{
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				IP:        pod.Status.PodIP,
+			})
+		}
+	}
+
+	flows, err := ovsif.DumpFlows()
+	if err != nil {
+		glog.Errorf("Failed to dump flows: %v", err)
+		flows = nil
+	}
+
+	report.Checks = append(report.Checks, checkLocalPodFlows(report.LocalPods, flows))
+	report.Checks = append(report.Checks, checkPeerSubnetFlows(report.PeerSubnets, flows))
+	report.Checks = append(report.Checks, checkFlowVNIDsKnown(flows, report.VNIDs))
+
+	return report
+}
+
+// checkLocalPodFlows verifies every local pod has an output flow in table 7
+// (IP to container) keyed by its pod IP.
+func checkLocalPodFlows(pods []diagnosePod, flows []string) diagnoseCheck {
+	check := diagnoseCheck{Name: "every local pod has a table 7 flow", Pass: true}
+	for _, pod := range pods {
+		if !flowsContain(flows, "table=7,", fmt.Sprintf("nw_dst=%s", pod.IP)) {
+			check.Pass = false
+			check.Details = append(check.Details, fmt.Sprintf("no table=7 flow for pod %s/%s (%s)", pod.Namespace, pod.Name, pod.IP))
+		}
+	}
+	return check
+}
+
+// checkPeerSubnetFlows verifies every peer hostsubnet has a tunnel flow in
+// table 8 (to remote container) keyed by its subnet CIDR.
+func checkPeerSubnetFlows(peerSubnets []string, flows []string) diagnoseCheck {
+	check := diagnoseCheck{Name: "every peer hostsubnet has a table 8 tunnel flow", Pass: true}
+	for _, subnet := range peerSubnets {
+		if !flowsContain(flows, "table=8,", fmt.Sprintf("nw_dst=%s", subnet)) {
+			check.Pass = false
+			check.Details = append(check.Details, fmt.Sprintf("no table=8 flow for peer subnet %s", subnet))
+		}
+	}
+	return check
+}
+
+// checkFlowVNIDsKnown verifies every reg0 (tenant id) value referenced by a
+// flow corresponds to a VNID in the vnid map; a flow referencing an unknown
+// tenant id usually means a namespace was deleted without its flows being
+// cleaned up.
+func checkFlowVNIDsKnown(flows []string, vnids map[string]uint32) diagnoseCheck {
+	known := map[uint32]bool{}
+	for _, id := range vnids {
+		known[id] = true
+	}
+
+	check := diagnoseCheck{Name: "every flow's tenant id is a known VNID", Pass: true}
+	for _, flow := range flows {
+		idx := strings.Index(flow, "reg0=0x")
+		if idx < 0 {
+			continue
+		}
+		rest := flow[idx+len("reg0=0x"):]
+		if end := strings.IndexAny(rest, ", "); end >= 0 {
+			rest = rest[:end]
+		}
+		var id uint32
+		if _, err := fmt.Sscanf(rest, "%x", &id); err != nil {
+			continue
+		}
+		if !known[id] {
+			check.Pass = false
+			check.Details = append(check.Details, fmt.Sprintf("flow references unknown tenant id %d: %s", id, strings.TrimSpace(flow)))
+		}
+	}
+	return check
+}
+
+func flowsContain(flows []string, substrs ...string) bool {
+	for _, flow := range flows {
+		matched := true
+		for _, s := range substrs {
+			if !strings.Contains(flow, s) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func printDiagnoseReport(report *diagnoseReport) {
+	unmanaged := map[string]bool{}
+	for _, ns := range report.UnmanagedNamespaces {
+		unmanaged[ns] = true
+	}
+
+	fmt.Printf("VNIDs (%d):\n", len(report.VNIDs))
+	for ns, id := range report.VNIDs {
+		marker := ""
+		if unmanaged[ns] {
+			marker = " [unmanaged]"
+		}
+		fmt.Printf("  %s: %d%s\n", ns, id, marker)
+	}
+
+	fmt.Printf("\nLocal subnet: %s\n", report.LocalSubnet)
+	fmt.Printf("Peer subnets (%d):\n", len(report.PeerSubnets))
+	for _, s := range report.PeerSubnets {
+		fmt.Printf("  %s\n", s)
+	}
+
+	fmt.Printf("\nLocal pods (%d):\n", len(report.LocalPods))
+	for _, pod := range report.LocalPods {
+		fmt.Printf("  %s/%s: %s\n", pod.Namespace, pod.Name, pod.IP)
+	}
+
+	fmt.Println("\nChecks:")
+	for _, c := range report.Checks {
+		status := "PASS"
+		if !c.Pass {
+			status = "FAIL"
+		}
+		fmt.Printf("  [%s] %s\n", status, c.Name)
+		for _, d := range c.Details {
+			fmt.Printf("      - %s\n", d)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+
+	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/etcdmanager/crd"
+	"k8s-ovs/pkg/etcdmanager/etcdv2"
+	"k8s-ovs/pkg/etcdmanager/flannelimport"
+	"k8s-ovs/pkg/kubeclient"
+	"k8s-ovs/pkg/utils"
+)
+
+// runImportFlannelSubnets implements "k8s-ovs import-flannel-subnets": a
+// one-shot offline tool that seeds k8s-ovs's HostSubnet records from an
+// existing flannel installation's subnet leases (see
+// pkg/etcdmanager/flannelimport), so a cluster moving off flannel doesn't
+// have to re-IP every node's pod subnet. It always prints a dry-run report
+// first; pass --dry-run=false to actually write, and --overwrite to replace
+// records that already exist under the target network but disagree with the
+// import. It's safe to re-run: applying a plan only ever touches records
+// that are new or (with --overwrite) different from the import.
+func runImportFlannelSubnets(args []string) {
+	fs := pflag.NewFlagSet("import-flannel-subnets", pflag.ExitOnError)
+	network := fs.String("network", "", "network name to import into, ex: (--network=test)")
+	flannelEndpoints := fs.String("flannel-etcd-endpoints", "http://127.0.0.1:2379", "a comma-delimited list of flannel's etcd endpoints")
+	flannelPrefix := fs.String("flannel-etcd-prefix", "/coreos.com/network", "flannel's etcd prefix")
+	flannelKeyfile := fs.String("flannel-etcd-keyfile", "", "SSL key file used to secure the flannel etcd connection")
+	flannelCertfile := fs.String("flannel-etcd-certfile", "", "SSL certification file used to secure the flannel etcd connection")
+	flannelCAFile := fs.String("flannel-etcd-cafile", "", "SSL Certificate Authority file used to secure the flannel etcd connection")
+	dryRun := fs.Bool("dry-run", true, "print the import plan without writing anything")
+	overwrite := fs.Bool("overwrite", false, "replace existing records that disagree with the import (default is to fail and list them)")
+	etcdBackend := fs.String("etcd-backend", "etcd", "backend to import into: \"etcd\" or \"crd\"")
+	crdNamespace := fs.String("crd-namespace", utils.SdnNamespace, "Kubernetes namespace to store records in when --etcd-backend=crd")
+	etcdEndpoints := fs.String("etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
+	etcdPrefix := fs.String("etcd-prefix", "/k8s.ovs.com/ovs/network", "etcd prefix")
+	etcdKeyfile := fs.String("etcd-keyfile", "", "SSL key file used to secure etcd communication")
+	etcdCertfile := fs.String("etcd-certfile", "", "SSL certification file used to secure etcd communication")
+	etcdCAFile := fs.String("etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
+	etcdUsername := fs.String("etcd-username", "", "Username for BasicAuth to etcd")
+	etcdPassword := fs.String("etcd-password", "", "Password for BasicAuth to etcd")
+
+	clientConfig := kubectl_util.DefaultClientConfig(fs)
+	fs.Parse(args)
+
+	if *network == "" {
+		glog.Fatalf("--network is required")
+	}
+
+	ctx := context.Background()
+
+	leases, err := flannelimport.ReadLeases(ctx, &flannelimport.EtcdConfig{
+		Endpoints: strings.Split(*flannelEndpoints, ","),
+		Prefix:    *flannelPrefix,
+		Keyfile:   *flannelKeyfile,
+		Certfile:  *flannelCertfile,
+		CAFile:    *flannelCAFile,
+	})
+	if err != nil {
+		glog.Fatalf("Reading flannel leases failed: %v", err)
+	}
+
+	var eClient etcdmanager.EtcdManager
+	switch *etcdBackend {
+	case "crd":
+		kubeCfg, err := kubeclient.BuildConfig(clientConfig)
+		if err != nil {
+			glog.Fatalf("Get kube config failed: %v", err)
+		}
+		kubeClient, err := kubeclient.NewClient(kubeCfg)
+		if err != nil {
+			glog.Fatalf("Create kube client failed: %v", err)
+		}
+		eClient, err = crd.NewManager(kubeCfg, kubeClient, *crdNamespace)
+		if err != nil {
+			glog.Fatalf("Create CRD backend failed: %v", err)
+		}
+	case "etcd":
+		eClient, err = etcdv2.NewManager(&etcdv2.EtcdConfig{
+			Endpoints: strings.Split(*etcdEndpoints, ","),
+			Keyfile:   *etcdKeyfile,
+			Certfile:  *etcdCertfile,
+			CAFile:    *etcdCAFile,
+			Prefix:    *etcdPrefix,
+			Username:  *etcdUsername,
+			Password:  *etcdPassword,
+		})
+		if err != nil {
+			glog.Fatalf("Create etcd client failed: %v", err)
+		}
+	default:
+		glog.Fatalf("Unknown --etcd-backend %q, must be \"etcd\" or \"crd\"", *etcdBackend)
+	}
+
+	plan, err := flannelimport.BuildPlan(ctx, eClient, *network, leases)
+	if err != nil {
+		glog.Fatalf("Building import plan failed: %v", err)
+	}
+
+	glog.Infof("Import plan:\n%s", plan.Report())
+
+	if *dryRun {
+		glog.Infof("Dry run: nothing written. Pass --dry-run=false to apply.")
+		return
+	}
+
+	if err := plan.Apply(ctx, eClient, *overwrite); err != nil {
+		glog.Fatalf("Applying import plan failed: %v", err)
+	}
+
+	glog.Infof("Imported %d flannel lease(s) into network %q", len(leases), *network)
+}
@@ -0,0 +1,45 @@
+// Command k8s-ovs-privhelper is the privileged helper process split out of
+// the node daemon: it listens on a unix socket and executes the narrow,
+// validated set of OVS/iptables/ip/k8s-sdn-ovs commands privhelper.Config
+// allows, so the daemon itself can run with reduced capabilities. See
+// package k8s-ovs/pkg/privhelper.
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+
+	"k8s-ovs/pkg/privhelper"
+)
+
+var (
+	socketPath     = pflag.String("socket", privhelper.DefaultSocketPath, "unix socket to listen on")
+	bridge         = pflag.String("bridge", "br0", "the only OVS bridge this helper will operate on")
+	sdnScriptPath  = pflag.String("sdn-script", "k8s-sdn-ovs", "path of the veth setup script this helper is willing to run")
+	iptablesTables = pflag.String("iptables-tables", "nat,filter,mangle", "comma-separated list of iptables tables this helper will edit")
+	iptablesChains = pflag.String("iptables-chains", "PREROUTING,POSTROUTING,INPUT,FORWARD", "comma-separated list of iptables chains this helper will edit")
+)
+
+func main() {
+	flag.Set("logtostderr", "true")
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+
+	cfg := privhelper.Config{
+		Bridge:                *bridge,
+		SDNScriptPath:         *sdnScriptPath,
+		AllowedIPTablesTables: strings.Split(*iptablesTables, ","),
+		AllowedIPTablesChains: strings.Split(*iptablesChains, ","),
+	}
+
+	server := privhelper.NewServer(*socketPath, cfg)
+	if err := server.Start(); err != nil {
+		glog.Fatalf("Failed to start privileged helper: %v", err)
+	}
+	glog.Infof("Privileged helper listening on %s for bridge %q", *socketPath, cfg.Bridge)
+
+	select {}
+}
@@ -0,0 +1,29 @@
+package ksdn
+
+import (
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/sets"
+)
+
+// accessibleFromAnnotation lets a service opt its VIP/port flows out of
+// tenant isolation without making its whole namespace global -- e.g. a
+// shared artifact registry or internal auth service every tenant needs to
+// reach, in a namespace that should otherwise stay isolated. Only
+// accessibleFromGlobal is a recognized value; anything else is ignored.
+// Honored only for namespaces on the cluster's accessible-from allowlist
+// (see WithGloballyAccessibleServicesNamespaces); a service in any other
+// namespace has the annotation silently ignored.
+const accessibleFromAnnotation = "k8s-ovs/accessible-from"
+
+// accessibleFromGlobal is the only accessibleFromAnnotation value that does
+// anything.
+const accessibleFromGlobal = "global"
+
+// serviceAccessibleFromAllVNIDs reports whether svc's AddServiceRules flows
+// should be programmed without a tenant restriction, per accessibleFromAnnotation.
+func serviceAccessibleFromAllVNIDs(svc *kapi.Service, allowedNamespaces sets.String) bool {
+	if svc.Annotations[accessibleFromAnnotation] != accessibleFromGlobal {
+		return false
+	}
+	return allowedNamespaces.Has(svc.Namespace)
+}
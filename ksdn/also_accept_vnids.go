@@ -0,0 +1,139 @@
+package ksdn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/sets"
+
+	"k8s-ovs/pkg/ovs"
+)
+
+// alsoAcceptVNIDsAnnotation lists additional VNIDs -- or namespace names,
+// resolved through nodeVNIDMap -- a pod accepts ingress traffic from without
+// joining them, e.g. a service-mesh gateway that needs several tenants'
+// traffic without being on any of their VNIDs. It's a comma-separated list,
+// e.g. "12,45" or "tenant-a,tenant-b". Only pods in a namespace on the
+// cluster's also-accept-vnids allowlist (see WithAlsoAcceptVNIDsNamespaces)
+// may use it; on any other pod the annotation is ignored and a warning is
+// logged.
+const alsoAcceptVNIDsAnnotation = "k8s-ovs/also-accept-vnids"
+
+// alsoAcceptVNIDs parses pod's alsoAcceptVNIDsAnnotation into the VNIDs it
+// names, resolving namespace names through vnids. It returns no VNIDs and no
+// error if the annotation isn't set; it's an error if pod's namespace isn't
+// on allowedNamespaces or a named namespace has no known VNID yet.
+func alsoAcceptVNIDs(pod *kapi.Pod, allowedNamespaces sets.String, vnids *nodeVNIDMap) ([]uint32, error) {
+	value, ok := pod.Annotations[alsoAcceptVNIDsAnnotation]
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	if !allowedNamespaces.Has(pod.Namespace) {
+		return nil, fmt.Errorf("namespace %q is not on the also-accept-vnids allowlist", pod.Namespace)
+	}
+
+	var vnidIDs []uint32
+	for _, token := range strings.Split(value, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		if id, err := strconv.ParseUint(token, 10, 32); err == nil {
+			vnidIDs = append(vnidIDs, uint32(id))
+			continue
+		}
+		id, err := vnids.GetVNID(token)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve namespace %q: %v", token, err)
+		}
+		vnidIDs = append(vnidIDs, id)
+	}
+	return vnidIDs, nil
+}
+
+// alsoAcceptVNIDsSourceReferenced reports whether pod's alsoAcceptVNIDsAnnotation
+// names source, either by namespace name or by oldID, source's VNID before
+// the change that's asking.
+func alsoAcceptVNIDsSourceReferenced(pod kapi.Pod, source string, oldID uint32) bool {
+	value, ok := pod.Annotations[alsoAcceptVNIDsAnnotation]
+	if !ok {
+		return false
+	}
+	for _, token := range strings.Split(value, ",") {
+		token = strings.TrimSpace(token)
+		if token == source {
+			return true
+		}
+		if id, err := strconv.ParseUint(token, 10, 32); err == nil && uint32(id) == oldID {
+			return true
+		}
+	}
+	return false
+}
+
+// installAlsoAcceptVNIDFlows adds the ingress-accept flows for pod's
+// alsoAcceptVNIDsAnnotation, if any, once its base OVS port and flows are up.
+// Failures are logged and swallowed rather than failing pod setup/update:
+// the annotation is a best-effort extra, and a namespace failing its
+// allowlist check or VNID resolution shouldn't take down a pod's ordinary
+// networking.
+func (m *podManager) installAlsoAcceptVNIDFlows(pod *kapi.Pod, hostVethName, podIP string) {
+	if m.ovs == nil {
+		return
+	}
+
+	vnidIDs, err := alsoAcceptVNIDs(pod, m.alsoAcceptVNIDsNamespaces, m.vnids)
+	if err != nil {
+		glog.Warningf("Ignoring %s annotation on pod %s/%s: %v", alsoAcceptVNIDsAnnotation, pod.Namespace, pod.Name, err)
+		return
+	}
+	if len(vnidIDs) == 0 {
+		return
+	}
+
+	ofport, err := m.ovs.GetOfPort(hostVethName)
+	if err != nil {
+		glog.Warningf("Could not resolve OVS port %s for pod %s/%s, skipping %s flows: %v", hostVethName, pod.Namespace, pod.Name, alsoAcceptVNIDsAnnotation, err)
+		return
+	}
+
+	mods := make([]ovs.FlowMod, 0, len(vnidIDs))
+	for _, vnid := range vnidIDs {
+		mods = append(mods, ovs.FlowMod{
+			Table:     7,
+			Priority:  100,
+			Namespace: pod.Namespace,
+			Match:     fmt.Sprintf("reg0=%d, ip, nw_dst=%s", vnid, podIP),
+			Actions:   fmt.Sprintf("output:%d", ofport),
+		})
+	}
+	if err := m.ovs.AddFlows(mods...); err != nil {
+		glog.Warningf("Could not add %s flows for pod %s/%s: %v", alsoAcceptVNIDsAnnotation, pod.Namespace, pod.Name, err)
+	}
+}
+
+// refreshAlsoAcceptVNIDPods re-runs UpdatePod for every local pod whose
+// alsoAcceptVNIDsAnnotation names namespace -- by name or by its VNID before
+// this change -- after namespace's VNID changes from oldID to newID, so
+// those pods' ingress-accept flows get moved onto the new VNID. Registered
+// with node.vnids.OnVNIDChanged by VnidStartNode.
+func (node *KsdnNode) refreshAlsoAcceptVNIDPods(namespace string, oldID, newID uint32) {
+	pods, err := node.pods.Pods(kapi.NamespaceAll)
+	if err != nil {
+		glog.Errorf("Could not list local pods while refreshing %s flows for namespace %q: %v", alsoAcceptVNIDsAnnotation, namespace, err)
+		return
+	}
+
+	for _, pod := range pods {
+		if !alsoAcceptVNIDsSourceReferenced(pod, namespace, oldID) {
+			continue
+		}
+		if err := node.UpdatePod(pod); err != nil {
+			glog.Warningf("Could not refresh %s flows for pod %s/%s: %v", alsoAcceptVNIDsAnnotation, pod.Namespace, pod.Name, err)
+		}
+	}
+}
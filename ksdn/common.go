@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
 	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/metrics"
 
 	kapi "k8s.io/kubernetes/pkg/api"
 	kcache "k8s.io/kubernetes/pkg/client/cache"
@@ -16,6 +18,53 @@ import (
 	kcontainer "k8s.io/kubernetes/pkg/kubelet/container"
 )
 
+// eventQueueStallWarnThreshold is how long an event queue may stay non-empty
+// before we start warning that a watcher is falling behind.
+const eventQueueStallWarnThreshold = 30 * time.Second
+
+// maxRecentEventsPerWatcher bounds the per-resource ring buffer of recently
+// processed deltas, kept for crash diagnostics.
+const maxRecentEventsPerWatcher = 50
+
+type recentEvent struct {
+	Time time.Time
+	Type string
+	Key  string
+}
+
+var (
+	recentEventsLock sync.Mutex
+	recentEvents     = map[string][]recentEvent{}
+)
+
+func recordRecentEvent(label string, delta kcache.Delta) {
+	key, err := DeletionHandlingMetaNamespaceKeyFunc(delta.Object)
+	if err != nil {
+		key = "<unknown>"
+	}
+
+	recentEventsLock.Lock()
+	defer recentEventsLock.Unlock()
+	buf := append(recentEvents[label], recentEvent{Time: time.Now(), Type: string(delta.Type), Key: key})
+	if len(buf) > maxRecentEventsPerWatcher {
+		buf = buf[len(buf)-maxRecentEventsPerWatcher:]
+	}
+	recentEvents[label] = buf
+}
+
+// RecentEvents returns a snapshot of the last few processed deltas for every
+// watcher, keyed by resource name, for use by crash diagnostics.
+func RecentEvents() map[string][]recentEvent {
+	recentEventsLock.Lock()
+	defer recentEventsLock.Unlock()
+
+	snapshot := make(map[string][]recentEvent, len(recentEvents))
+	for label, buf := range recentEvents {
+		snapshot[label] = append([]recentEvent(nil), buf...)
+	}
+	return snapshot
+}
+
 func getPodContainerID(pod *kapi.Pod) string {
 	if len(pod.Status.ContainerStatuses) > 0 {
 		return kcontainer.ParseContainerID(pod.Status.ContainerStatuses[0].ContainerID).ID
@@ -98,9 +147,38 @@ func runEventQueueForResource(client kcache.Getter, resourceName ResourceName, e
 	// Existing items in the event queue will have watch.Modified event type
 	kcache.NewReflector(lw, expectedType, eventQueue, 30*time.Minute).Run()
 
+	label := string(resourceName)
+	instrumented := func(delta kcache.Delta) error {
+		recordRecentEvent(label, delta)
+
+		start := time.Now()
+		err := process(delta)
+		metrics.EventQueueHandlerLatency.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		deltaType := string(delta.Type)
+		if err != nil {
+			metrics.EventQueueErrors.WithLabelValues(label, deltaType).Inc()
+		} else {
+			metrics.EventQueueProcessed.WithLabelValues(label, deltaType).Inc()
+		}
+		return err
+	}
+
+	var stalledSince time.Time
 	// Run the queue
 	for {
-		eventQueue.Pop(process, expectedType)
+		depth := len(eventQueue.ListKeys())
+		metrics.EventQueueDepth.WithLabelValues(label).Set(float64(depth))
+		if depth > 0 {
+			if stalledSince.IsZero() {
+				stalledSince = time.Now()
+			} else if since := time.Since(stalledSince); since > eventQueueStallWarnThreshold {
+				glog.Warningf("Event queue for %s has been backed up (%d pending) for %v", label, depth, since.Truncate(time.Second))
+			}
+		} else {
+			stalledSince = time.Time{}
+		}
+
+		eventQueue.Pop(instrumented, expectedType)
 	}
 }
 
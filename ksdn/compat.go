@@ -0,0 +1,136 @@
+package ksdn
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/pkg/etcdmanager"
+)
+
+const (
+	// maxVersionSkew bounds how many flow table versions apart a node's own
+	// compiled VERSION may be from the cluster's negotiated compatibility
+	// window before it refuses to start. Beyond this, the flow formats
+	// aren't assumed to have anything left in common.
+	maxVersionSkew = 1
+
+	dataplaneCompatSyncPeriod = 30 * time.Second
+)
+
+// resolveFlowVersion reads the cluster's dataplane compatibility window and
+// picks which flow table version this node should generate flows as: the
+// rollout's Target once the master has observed every node converge on it
+// (AllNodesUpgraded), or Min otherwise so this node's flows keep
+// interoperating with older peers still mid-rollout. A fresh cluster with no
+// window recorded yet just runs its own compiled VERSION.
+//
+// It errors out -- which fails node startup -- if this node's compiled
+// VERSION falls outside [Min-maxVersionSkew, Target+maxVersionSkew], since a
+// node that far from the cluster's window can't be assumed to interoperate
+// with anyone in it.
+func (node *KsdnNode) resolveFlowVersion(ctx context.Context) (int, error) {
+	compat, err := node.eClient.GetDataplaneCompat(ctx, node.networkInfo.name)
+	if err != nil {
+		return 0, fmt.Errorf("get dataplane compatibility window: %v", err)
+	}
+	if compat == nil {
+		return VERSION, nil
+	}
+	if VERSION < compat.Min-maxVersionSkew || VERSION > compat.Target+maxVersionSkew {
+		return 0, fmt.Errorf("this node's flow table version %d is outside the cluster's supported compatibility window [%d, %d]; upgrade or downgrade k8s-ovs before letting it join", VERSION, compat.Min, compat.Target)
+	}
+	if compat.AllNodesUpgraded {
+		return compat.Target, nil
+	}
+	return compat.Min, nil
+}
+
+// ensureDataplaneCompat runs once on master startup. If no compatibility
+// window has ever been recorded, it seeds one pinned to this master's own
+// VERSION (nothing to negotiate). If one exists but this master's compiled
+// VERSION has moved past its Target, that's a new rollout starting: the old
+// Target becomes the new Min (nodes already converged on it can be relied on
+// as the interoperability floor) unless the previous rollout hadn't finished
+// yet, in which case the previous Min is kept so straggling old nodes aren't
+// stranded outside the window.
+func (master *KsdnMaster) ensureDataplaneCompat(ctx context.Context) error {
+	compat, err := master.eClient.GetDataplaneCompat(ctx, master.networkInfo.name)
+	if err != nil {
+		return fmt.Errorf("get dataplane compatibility window: %v", err)
+	}
+
+	if compat == nil {
+		return master.eClient.SetDataplaneCompat(ctx, master.networkInfo.name, &etcdmanager.DataplaneCompat{
+			Min:              VERSION,
+			Target:           VERSION,
+			AllNodesUpgraded: true,
+		})
+	}
+
+	if VERSION < compat.Min-maxVersionSkew || VERSION > compat.Target+maxVersionSkew {
+		return fmt.Errorf("this master's flow table version %d is outside the cluster's supported compatibility window [%d, %d]; upgrade or downgrade k8s-ovs before starting it", VERSION, compat.Min, compat.Target)
+	}
+
+	if compat.Target == VERSION {
+		// Either steady state (AllNodesUpgraded already true) or an
+		// in-progress rollout this master already knows about; the sync
+		// loop below drives it the rest of the way. Nothing to do.
+		return nil
+	}
+
+	min := compat.Min
+	if compat.AllNodesUpgraded {
+		min = compat.Target
+	}
+	glog.Infof("Starting dataplane rollout to flow table version %d (compatibility floor %d)", VERSION, min)
+	return master.eClient.SetDataplaneCompat(ctx, master.networkInfo.name, &etcdmanager.DataplaneCompat{
+		Min:              min,
+		Target:           VERSION,
+		AllNodesUpgraded: false,
+	})
+}
+
+// startDataplaneCompatSync starts a goroutine that periodically checks
+// whether every node has finished converging on the cluster's target flow
+// table version and, once true, flips AllNodesUpgraded so nodes drop their
+// compatibility shims on their next reconcile.
+func (master *KsdnMaster) startDataplaneCompatSync() {
+	go utilwait.Until(master.syncDataplaneCompat, dataplaneCompatSyncPeriod, master.ctx.Done())
+}
+
+func (master *KsdnMaster) syncDataplaneCompat() {
+	compat, err := master.eClient.GetDataplaneCompat(master.ctx, master.networkInfo.name)
+	if err != nil {
+		glog.Errorf("Failed to get dataplane compatibility window: %v", err)
+		return
+	}
+	if compat == nil || compat.AllNodesUpgraded {
+		return
+	}
+
+	nodes, err := master.kClient.Nodes().List(kapi.ListOptions{})
+	if err != nil {
+		glog.Errorf("Failed to list nodes for dataplane compatibility check: %v", err)
+		return
+	}
+	for i := range nodes.Items {
+		status, ok := parseNodeStatus(&nodes.Items[i])
+		if !ok || status.DataplaneVersion != compat.Target {
+			// At least one node hasn't reported the target version yet.
+			return
+		}
+	}
+
+	compat.AllNodesUpgraded = true
+	if err := master.eClient.SetDataplaneCompat(master.ctx, master.networkInfo.name, compat); err != nil {
+		glog.Errorf("Failed to record that all nodes converged on dataplane version %d: %v", compat.Target, err)
+		return
+	}
+	glog.Infof("All nodes now report dataplane version %d; compatibility shims can be dropped on next reconcile", compat.Target)
+}
@@ -0,0 +1,262 @@
+package ksdn
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s-ovs/pkg/metrics"
+	netutils "k8s-ovs/pkg/utils"
+
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+const (
+	// defaultConnectivityProbeInterval is how often the connectivity prober
+	// samples peer gateways, absent WithConnectivityProbeInterval.
+	defaultConnectivityProbeInterval = 30 * time.Second
+
+	// defaultConnectivityProbeSampleSize caps how many peer gateways a
+	// single sync probes, absent WithConnectivityProbeSampleSize. Peers are
+	// sampled round-robin across syncs (see (*connectivityProber).sample),
+	// so every peer eventually gets probed even on a cluster too large to
+	// probe in full each interval.
+	defaultConnectivityProbeSampleSize = 5
+
+	// connectivityProbePort is the UDP port the responder listens on and
+	// probes are sent to. See controller.go's table 1 bypass flow: traffic
+	// on this port always reaches table 5 regardless of tenant isolation,
+	// so a probe failure reflects a real overlay problem rather than a
+	// NetworkPolicy or tenant rule getting in the way.
+	connectivityProbePort = 4790
+
+	// connectivityProbeTimeout bounds how long probe waits for a peer's
+	// echo before counting the attempt as a failure.
+	connectivityProbeTimeout = 2 * time.Second
+
+	// connectivityProbeMagic tags a probe/echo payload so the responder can
+	// tell a connectivity probe apart from anything else that might land on
+	// connectivityProbePort.
+	connectivityProbeMagic = "k8s-ovs-connectivity-probe-v1"
+)
+
+// PeerConnectivity is one peer node's most recently probed overlay
+// connectivity, as recorded by connectivityProber; see
+// NodeStatus.ConnectivityProbes.
+type PeerConnectivity struct {
+	HostIP      string    `json:"hostIP"`
+	Gateway     string    `json:"gateway"`
+	Success     bool      `json:"success"`
+	LatencyMS   int64     `json:"latencyMs,omitempty"`
+	LastAttempt time.Time `json:"lastAttempt"`
+}
+
+// connectivityProber periodically sends a small UDP echo through the
+// overlay to a rotating sample of peer HostSubnet gateways, to catch silent
+// overlay breakage (an MTU mismatch, a firewall eating VXLAN, a stale
+// tunnel flow) faster than a service or pod ever would surface it. Every
+// node also runs the responder half, replying to probes addressed to its
+// own localSubnetGateway.
+type connectivityProber struct {
+	node *KsdnNode
+
+	interval   time.Duration
+	sampleSize int
+
+	conn *net.UDPConn
+
+	lock    sync.Mutex
+	cursor  int                         // round-robin offset into the sorted peer list, across syncs
+	results map[string]PeerConnectivity // HostIP -> last result
+}
+
+func newConnectivityProber(node *KsdnNode) *connectivityProber {
+	interval := node.connectivityProbeInterval
+	if interval == 0 {
+		interval = defaultConnectivityProbeInterval
+	}
+	sampleSize := node.connectivityProbeSampleSize
+	if sampleSize == 0 {
+		sampleSize = defaultConnectivityProbeSampleSize
+	}
+	return &connectivityProber{
+		node:       node,
+		interval:   interval,
+		sampleSize: sampleSize,
+		results:    make(map[string]PeerConnectivity),
+	}
+}
+
+// run binds the responder socket and starts the prober's periodic sync. It
+// returns immediately; both stop when stopCh is closed. A responder bind
+// failure disables probing for this node rather than failing startup --
+// overlay connectivity monitoring is a diagnostic aid, not a dependency the
+// rest of the node needs to come up.
+func (p *connectivityProber) run(stopCh <-chan struct{}) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(p.node.localSubnetGateway), Port: connectivityProbePort})
+	if err != nil {
+		glog.Errorf("Connectivity prober failed to bind responder on %s:%d, disabling: %v", p.node.localSubnetGateway, connectivityProbePort, err)
+		return
+	}
+	p.conn = conn
+
+	go func() {
+		<-stopCh
+		conn.Close()
+	}()
+	go p.respond()
+	go utilwait.Until(p.sync, p.interval, stopCh)
+}
+
+// respond echoes every packet the responder socket receives straight back
+// to its sender, until conn is closed by run's stopCh goroutine.
+func (p *connectivityProber) respond() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if _, err := p.conn.WriteToUDP(buf[:n], addr); err != nil {
+			glog.Warningf("Connectivity prober responder failed to echo to %s: %v", addr, err)
+		}
+	}
+}
+
+// connectivityPeer is a peer node's identity and overlay gateway, as
+// derived from a HostSubnet record.
+type connectivityPeer struct {
+	HostIP  string
+	Gateway string
+}
+
+// sync samples up to sampleSize peer gateways and probes each in turn,
+// recording the outcome and exporting it as a metric.
+func (p *connectivityProber) sync() {
+	peers, err := p.peerGateways()
+	if err != nil {
+		glog.Errorf("Connectivity prober failed to list peer subnets: %v", err)
+		return
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	for _, peer := range p.sample(peers) {
+		result := p.probe(peer)
+
+		p.lock.Lock()
+		p.results[peer.HostIP] = result
+		p.lock.Unlock()
+
+		if result.Success {
+			metrics.ConnectivityProbeSuccess.WithLabelValues(peer.HostIP).Set(1)
+			metrics.ConnectivityProbeLatencySeconds.WithLabelValues(peer.HostIP).Set(float64(result.LatencyMS) / 1000)
+		} else {
+			metrics.ConnectivityProbeSuccess.WithLabelValues(peer.HostIP).Set(0)
+			metrics.ConnectivityProbeFailuresTotal.WithLabelValues(peer.HostIP).Inc()
+		}
+	}
+}
+
+// peerGateways lists every other node's HostSubnet gateway address, sorted
+// by HostIP so sample's round-robin cursor is stable across syncs even as
+// the sample size or set membership shifts slightly.
+func (p *connectivityProber) peerGateways() ([]connectivityPeer, error) {
+	node := p.node
+	subnets, err := node.eClient.GetSubnets(node.ctx, node.networkInfo.name)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]connectivityPeer, 0, len(subnets))
+	for _, sub := range subnets {
+		if sub.HostIP == node.localIP {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(sub.Subnet)
+		if err != nil {
+			glog.Warningf("Connectivity prober ignoring peer %s with unparseable subnet %q: %v", sub.HostIP, sub.Subnet, err)
+			continue
+		}
+		peers = append(peers, connectivityPeer{HostIP: sub.HostIP, Gateway: netutils.GenerateDefaultGateway(ipnet).String()})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].HostIP < peers[j].HostIP })
+	return peers, nil
+}
+
+// sample returns up to sampleSize entries from peers, starting at the
+// prober's rotating cursor, so every peer gets probed in turn across enough
+// syncs even when there are more peers than sampleSize.
+func (p *connectivityProber) sample(peers []connectivityPeer) []connectivityPeer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n := p.sampleSize
+	if n > len(peers) {
+		n = len(peers)
+	}
+	sample := make([]connectivityPeer, 0, n)
+	for i := 0; i < n; i++ {
+		sample = append(sample, peers[(p.cursor+i)%len(peers)])
+	}
+	p.cursor = (p.cursor + n) % len(peers)
+	return sample
+}
+
+// probe sends a single UDP echo to peer's gateway and waits up to
+// connectivityProbeTimeout for the reply.
+func (p *connectivityProber) probe(peer connectivityPeer) PeerConnectivity {
+	result := PeerConnectivity{HostIP: peer.HostIP, Gateway: peer.Gateway, LastAttempt: time.Now()}
+
+	laddr := &net.UDPAddr{IP: net.ParseIP(p.node.localSubnetGateway)}
+	raddr := &net.UDPAddr{IP: net.ParseIP(peer.Gateway), Port: connectivityProbePort}
+	conn, err := net.DialUDP("udp4", laddr, raddr)
+	if err != nil {
+		glog.Warningf("Connectivity prober failed to dial peer %s (%s): %v", peer.HostIP, peer.Gateway, err)
+		return result
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.Write([]byte(connectivityProbeMagic)); err != nil {
+		glog.Warningf("Connectivity prober failed to send probe to peer %s (%s): %v", peer.HostIP, peer.Gateway, err)
+		return result
+	}
+
+	if err := conn.SetReadDeadline(start.Add(connectivityProbeTimeout)); err != nil {
+		glog.Warningf("Connectivity prober failed to set read deadline for peer %s (%s): %v", peer.HostIP, peer.Gateway, err)
+		return result
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		// Timeout or ICMP unreachable -- either way, no confirmed echo.
+		return result
+	}
+	if string(buf[:n]) != connectivityProbeMagic {
+		glog.Warningf("Connectivity prober got a malformed echo from peer %s (%s)", peer.HostIP, peer.Gateway)
+		return result
+	}
+
+	result.Success = true
+	result.LatencyMS = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	return result
+}
+
+// snapshot returns every peer result the prober currently has recorded, for
+// NodeStatus.
+func (p *connectivityProber) snapshot() []PeerConnectivity {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	out := make([]PeerConnectivity, 0, len(p.results))
+	for _, r := range p.results {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].HostIP < out[j].HostIP })
+	return out
+}
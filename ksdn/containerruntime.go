@@ -0,0 +1,117 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+
+	internalapi "k8s.io/kubernetes/pkg/kubelet/api"
+	kcontainer "k8s.io/kubernetes/pkg/kubelet/container"
+	"k8s.io/kubernetes/pkg/kubelet/dockertools"
+	"k8s.io/kubernetes/pkg/kubelet/remote"
+)
+
+// criProbeSockets are the well-known CRI socket paths tried, in order, when
+// no --cri-endpoint override is configured. The first one that accepts a
+// connection is used; if none do, the node falls back to talking to Docker
+// directly, matching every existing deployment's behavior today.
+var criProbeSockets = []string{
+	"/run/containerd/containerd.sock",
+	"/var/run/crio/crio.sock",
+}
+
+// criConnectTimeout bounds the CRI client connection to the chosen
+// endpoint. The socket probe in probeUnixSocket uses its own one-second
+// dial timeout.
+const criConnectTimeout = 5 * time.Second
+
+// containerRuntime resolves a container's network namespace path. It's the
+// only runtime-specific knowledge pod setup/teardown/update needs, so it's
+// the whole surface a new container runtime has to implement.
+type containerRuntime interface {
+	GetNetNS(containerID string) (string, error)
+}
+
+// dockerRuntime resolves netns paths the way every existing dockershim-based
+// deployment already does: inspect the container and format its PID into
+// Docker's /proc/<pid>/ns/net convention.
+type dockerRuntime struct {
+	dClient dockertools.DockerInterface
+}
+
+func (r *dockerRuntime) GetNetNS(containerID string) (string, error) {
+	inspectResult, err := r.dClient.InspectContainer(kcontainer.DockerID(containerID).ContainerID().ID)
+	if err != nil {
+		return "", fmt.Errorf("error inspecting container: %v", err)
+	}
+	return fmt.Sprintf(dockertools.DockerNetnsFmt, inspectResult.State.Pid), nil
+}
+
+// criRuntime resolves netns paths through a CRI runtime endpoint (containerd,
+// cri-o, ...). containerID is expected to be a pod sandbox ID, which is what
+// kubelet sets CNI_CONTAINERID to for CRI-managed pods, so no separate
+// sandbox lookup by pod name/namespace is needed.
+type criRuntime struct {
+	svc internalapi.RuntimeService
+}
+
+func newCRIRuntime(endpoint string) (*criRuntime, error) {
+	svc, err := remote.NewRemoteRuntimeService(endpoint, criConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &criRuntime{svc: svc}, nil
+}
+
+func (r *criRuntime) GetNetNS(containerID string) (string, error) {
+	status, err := r.svc.PodSandboxStatus(containerID)
+	if err != nil {
+		return "", fmt.Errorf("error getting pod sandbox status: %v", err)
+	}
+	if status.Linux == nil || status.Linux.Namespaces == nil || status.Linux.Namespaces.Network == nil {
+		return "", fmt.Errorf("pod sandbox %s has no network namespace path", containerID)
+	}
+	return *status.Linux.Namespaces.Network, nil
+}
+
+// resolveContainerRuntime picks the containerRuntime pod setup/teardown/update
+// resolve network namespaces through. If criEndpoint is set, it's used, and
+// a failure to connect is an error. Otherwise every path in criProbeSockets
+// is tried in turn, and the docker runtime is used if none respond, so a
+// node that never configures a CRI endpoint behaves exactly as before.
+func resolveContainerRuntime(dClient dockertools.DockerInterface, criEndpoint string) (containerRuntime, error) {
+	if criEndpoint != "" {
+		rt, err := newCRIRuntime(criEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("connect to configured CRI endpoint %q: %v", criEndpoint, err)
+		}
+		glog.Infof("Using configured CRI endpoint %q for pod network namespace resolution", criEndpoint)
+		return rt, nil
+	}
+
+	for _, socketPath := range criProbeSockets {
+		if !probeUnixSocket(socketPath) {
+			continue
+		}
+		rt, err := newCRIRuntime("unix://" + socketPath)
+		if err != nil {
+			glog.Warningf("Found CRI socket %s but failed to connect: %v", socketPath, err)
+			continue
+		}
+		glog.Infof("Detected CRI socket %s, using it for pod network namespace resolution", socketPath)
+		return rt, nil
+	}
+
+	return &dockerRuntime{dClient: dClient}, nil
+}
+
+func probeUnixSocket(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
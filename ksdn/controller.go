@@ -21,6 +21,7 @@ import (
 	"k8s-ovs/pkg/etcdmanager"
 	"k8s-ovs/pkg/etcdmanager/etcdv2"
 	"k8s-ovs/pkg/ipcmd"
+	"k8s-ovs/pkg/ovs"
 	netutils "k8s-ovs/pkg/utils"
 )
 
@@ -37,16 +38,20 @@ const (
 	VXLAN_PORT = "4789"
 )
 
-func getPluginVersion(multitenant bool) []string {
-	if VERSION > 254 {
+// getPluginVersion encodes the flow table version this node is actually
+// generating flows as -- ordinarily VERSION, but see resolveFlowVersion in
+// compat.go for how a rolling upgrade can pin it to an older value for a
+// while so old and new nodes keep interoperating.
+func getPluginVersion(multitenant bool, version int) []string {
+	if version > 254 {
 		panic("Version too large!")
 	}
-	version := fmt.Sprintf("%02X", VERSION)
+	versionHex := fmt.Sprintf("%02X", version)
 	if multitenant {
-		return []string{"01", version}
+		return []string{"01", versionHex}
 	}
 	// single-tenant
-	return []string{"00", version}
+	return []string{"00", versionHex}
 }
 
 func (plugin *KsdnNode) getLocalSubnet() (string, error) {
@@ -81,7 +86,7 @@ func (plugin *KsdnNode) getLocalSubnet() (string, error) {
 func (plugin *KsdnNode) alreadySetUp(localSubnetGatewayCIDR, clusterNetworkCIDR string) bool {
 	var found bool
 
-	exec := kexec.New()
+	exec := plugin.execer
 	itx := ipcmd.NewTransaction(exec, TUN)
 	addrs, err := itx.GetAddresses()
 	itx.EndTransaction()
@@ -116,7 +121,11 @@ func (plugin *KsdnNode) alreadySetUp(localSubnetGatewayCIDR, clusterNetworkCIDR
 		return false
 	}
 
-	flows, err := plugin.ovs.DumpFlows()
+	rd, ok := plugin.ovs.(ovs.RawDumper)
+	if !ok {
+		return false
+	}
+	flows, err := rd.DumpFlows()
 	if err != nil {
 		return false
 	}
@@ -133,7 +142,7 @@ func (plugin *KsdnNode) alreadySetUp(localSubnetGatewayCIDR, clusterNetworkCIDR
 		// OVS note action format hex bytes separated by '.'; first
 		// byte is plugin type (multi-tenant/single-tenant) and second
 		// byte is flow rule version
-		expected := getPluginVersion(plugin.multitenant)
+		expected := getPluginVersion(plugin.multitenant, plugin.flowVersion)
 		existing := strings.Split(flow[idx+len(VERSION_ACTION):], ".")
 		if len(existing) >= 2 && existing[0] == expected[0] && existing[1] == expected[1] {
 			found = true
@@ -147,14 +156,86 @@ func (plugin *KsdnNode) alreadySetUp(localSubnetGatewayCIDR, clusterNetworkCIDR
 	return true
 }
 
-func deleteLocalSubnetRoute(device, localSubnetCIDR string) {
+// installedServiceCIDR scans raw dump-flows output for Table 3's per-cluster
+// service classification flow (see SetupSDN) and returns the CIDR it's
+// currently matching on. It returns ok == false if no such flow is
+// installed yet, which is normal on a brand new bridge.
+func installedServiceCIDR(flows []string) (cidr string, ok bool) {
+	for _, flow := range flows {
+		if !strings.Contains(flow, "table=3") || !strings.Contains(flow, "priority=100") || !strings.Contains(flow, "goto_table:4") {
+			continue
+		}
+		idx := strings.Index(flow, "nw_dst=")
+		if idx < 0 {
+			continue
+		}
+		rest := flow[idx+len("nw_dst="):]
+		end := strings.IndexAny(rest, ", ")
+		if end < 0 {
+			end = len(rest)
+		}
+		return rest[:end], true
+	}
+	return "", false
+}
+
+// checkServiceCIDR compares serviceNetworkCIDR, the service network from the
+// cluster's current configuration, against the CIDR Table 3's classification
+// flow is actually installed with (see installedServiceCIDR). We once
+// changed the configured service network without realizing running nodes
+// still had flows classifying the old range, and the mismatch was
+// maddening to debug -- this is the safety net for that.
+//
+// It returns reprogram == true when the two differ but it's safe to just
+// replace the stale flow: the configured range fully encompasses the
+// installed one, so every service IP the old flow was already classifying
+// stays classified under the new one. Otherwise -- the ranges are
+// unrelated, or the configured range is narrower -- it returns an error
+// naming both CIDRs rather than risk silently dropping already-configured
+// services out of table 4.
+func (plugin *KsdnNode) checkServiceCIDR(serviceNetworkCIDR string) (reprogram bool, err error) {
+	rd, ok := plugin.ovs.(ovs.RawDumper)
+	if !ok {
+		return false, nil
+	}
+	flows, err := rd.DumpFlows()
+	if err != nil {
+		return false, fmt.Errorf("could not check installed service network: %v", err)
+	}
+	installed, ok := installedServiceCIDR(flows)
+	if !ok || installed == serviceNetworkCIDR {
+		return false, nil
+	}
+
+	_, installedNet, err := net.ParseCIDR(installed)
+	if err != nil {
+		return false, fmt.Errorf("could not parse installed service network %q: %v", installed, err)
+	}
+	_, configuredNet, err := net.ParseCIDR(serviceNetworkCIDR)
+	if err != nil {
+		return false, fmt.Errorf("could not parse configured service network %q: %v", serviceNetworkCIDR, err)
+	}
+	configuredOnes, _ := configuredNet.Mask.Size()
+	installedOnes, _ := installedNet.Mask.Size()
+	if configuredOnes > installedOnes || !configuredNet.Contains(installedNet.IP) {
+		return false, fmt.Errorf("configured service network %s does not encompass %s, the service network this node's flows are still classifying; refusing to reprogram automatically since already-classified service traffic could stop reaching table 4 -- reconcile the configuration, or clear this node's OVS bridge to force a clean setup", serviceNetworkCIDR, installed)
+	}
+
+	glog.Warningf("Configured service network %s differs from %s, the service network this node's flows are still classifying; %s encompasses %s so reprogramming automatically", serviceNetworkCIDR, installed, serviceNetworkCIDR, installed)
+	if err := plugin.ovs.DelFlows(ovs.FlowMod{Table: 3, Match: fmt.Sprintf("ip, nw_dst=%s", installed)}); err != nil {
+		return false, fmt.Errorf("could not remove stale service network classification flow for %s: %v", installed, err)
+	}
+	return true, nil
+}
+
+func deleteLocalSubnetRoute(execer kexec.Interface, device, localSubnetCIDR string) {
 	backoff := utilwait.Backoff{
 		Duration: 100 * time.Millisecond,
 		Factor:   1.25,
 		Steps:    6,
 	}
 	err := utilwait.ExponentialBackoff(backoff, func() (bool, error) {
-		itx := ipcmd.NewTransaction(kexec.New(), device)
+		itx := ipcmd.NewTransaction(execer, device)
 		routes, err := itx.GetRoutes()
 		if err != nil {
 			return false, fmt.Errorf("could not get routes: %v", err)
@@ -185,13 +266,19 @@ func (plugin *KsdnNode) SetupSDN() (bool, error) {
 	_, ipnet, err := net.ParseCIDR(localSubnetCIDR)
 	localSubnetMaskLength, _ := ipnet.Mask.Size()
 	localSubnetGateway := netutils.GenerateDefaultGateway(ipnet).String()
+	plugin.localSubnetGateway = localSubnetGateway
 
 	glog.Infof("[SDN setup] node pod subnet %s gateway %s", ipnet.String(), localSubnetGateway)
 
-	exec := kexec.New()
+	exec := plugin.execer
+
+	reprogramServiceCIDR, err := plugin.checkServiceCIDR(serviceNetworkCIDR)
+	if err != nil {
+		return false, err
+	}
 
 	gwCIDR := fmt.Sprintf("%s/%d", localSubnetGateway, localSubnetMaskLength)
-	if plugin.alreadySetUp(gwCIDR, clusterNetworkCIDR) {
+	if !reprogramServiceCIDR && plugin.alreadySetUp(gwCIDR, clusterNetworkCIDR) {
 		glog.V(5).Infof("[SDN setup] no SDN setup required")
 		return false, nil
 	}
@@ -210,87 +297,115 @@ func (plugin *KsdnNode) SetupSDN() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	_ = plugin.ovs.DeletePort(VXLAN)
-	_, err = plugin.ovs.AddPort(VXLAN, 1, "type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`)
+	// tos=inherit copies the encapsulated packet's DSCP marking onto the
+	// outer VXLAN header instead of always encapsulating at a fixed ToS, so
+	// syncEgressDSCP's Table 5 markings actually reach the underlay's QoS
+	// classifier instead of being dropped at the tunnel boundary.
+	vxlanOptions := []string{"type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`, `options:tos=inherit`}
+	if plugin.tunnelSourceIP != "" {
+		// Pin the tunnel's source address instead of letting OVS pick
+		// whichever local address the kernel's route to remote_ip would
+		// choose, for multi-NIC nodes where that's not the interface meant
+		// to carry SDN traffic; see resolveTunnelSourceIP.
+		vxlanOptions = append(vxlanOptions, fmt.Sprintf(`options:local_ip="%s"`, plugin.tunnelSourceIP))
+	}
+	_ = plugin.ovs.DelPort(VXLAN)
+	_, err = plugin.ovs.AddPort(VXLAN, 1, vxlanOptions...)
 	if err != nil {
 		return false, err
 	}
-	_ = plugin.ovs.DeletePort(TUN)
+	_ = plugin.ovs.DelPort(TUN)
 	_, err = plugin.ovs.AddPort(TUN, 2, "type=internal")
 	if err != nil {
 		return false, err
 	}
+	if plugin.trafficMirrorInterface != "" {
+		_ = plugin.ovs.DelPort(plugin.trafficMirrorInterface)
+		plugin.trafficMirrorOfPort, err = plugin.ovs.AddPort(plugin.trafficMirrorInterface, 0, "type=internal")
+		if err != nil {
+			return false, err
+		}
+	}
 
-	otx := plugin.ovs.NewTransaction()
-	// Table 0: initial dispatch based on in_port
-	// vxlan0
-	otx.AddFlow("table=0, priority=200, in_port=1, arp, nw_src=%s, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1", clusterNetworkCIDR, localSubnetCIDR)
-	otx.AddFlow("table=0, priority=200, in_port=1, ip, nw_src=%s, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1", clusterNetworkCIDR, localSubnetCIDR)
-	otx.AddFlow("table=0, priority=150, in_port=1, actions=drop")
-	// tun0
-	otx.AddFlow("table=0, priority=200, in_port=2, arp, nw_src=%s, nw_dst=%s, actions=goto_table:5", localSubnetGateway, clusterNetworkCIDR)
-	otx.AddFlow("table=0, priority=200, in_port=2, ip, actions=goto_table:5")
-	otx.AddFlow("table=0, priority=150, in_port=2, actions=drop")
-	// else, from a container
-	otx.AddFlow("table=0, priority=100, arp, actions=goto_table:2")
-	otx.AddFlow("table=0, priority=100, ip, actions=goto_table:2")
-	otx.AddFlow("table=0, priority=0, actions=drop")
-
-	// Table 1: VXLAN ingress filtering; filled in by AddHostSubnetRules()
-	// eg, "table=1, priority=100, tun_src=${remote_node_ip}, actions=goto_table:5"
-	otx.AddFlow("table=1, priority=0, actions=drop")
-
-	// Table 2: from container; validate IP/MAC, assign tenant-id; filled in by k8s-ovs
-	// eg, "table=2, priority=100, in_port=${ovs_port}, arp, nw_src=${ipaddr}, arp_sha=${macaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:5"
-	//     "table=2, priority=100, in_port=${ovs_port}, ip, nw_src=${ipaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:3"
-	// (${tenant_id} is always 0 for single-tenant)
-	otx.AddFlow("table=2, priority=0, actions=drop")
-
-	// Table 3: from container; service vs non-service
-	otx.AddFlow("table=3, priority=100, ip, nw_dst=%s, actions=goto_table:4", serviceNetworkCIDR)
-	otx.AddFlow("table=3, priority=0, actions=goto_table:5")
-
-	// Table 4: from container; service dispatch; filled in by AddServiceRules()
-	otx.AddFlow("table=4, priority=200, reg0=0, actions=output:2")
-	// eg, "table=4, priority=100, reg0=${tenant_id}, ${service_proto}, nw_dst=${service_ip}, tp_dst=${service_port}, actions=output:2"
-	otx.AddFlow("table=4, priority=0, actions=drop")
-
-	// Table 5: general routing
-	otx.AddFlow("table=5, priority=300, arp, nw_dst=%s, actions=output:2", localSubnetGateway)
-	otx.AddFlow("table=5, priority=300, ip, nw_dst=%s, actions=output:2", localSubnetGateway)
-	otx.AddFlow("table=5, priority=200, arp, nw_dst=%s, actions=goto_table:6", localSubnetCIDR)
-	otx.AddFlow("table=5, priority=200, ip, nw_dst=%s, actions=goto_table:7", localSubnetCIDR)
-	otx.AddFlow("table=5, priority=100, arp, nw_dst=%s, actions=goto_table:8", clusterNetworkCIDR)
-	otx.AddFlow("table=5, priority=100, ip, nw_dst=%s, actions=goto_table:8", clusterNetworkCIDR)
-	otx.AddFlow("table=5, priority=0, ip, actions=goto_table:9")
-	otx.AddFlow("table=5, priority=0, arp, actions=drop")
-
-	// Table 6: ARP to container, filled in by k8s-ovs
-	// eg, "table=6, priority=100, arp, nw_dst=${container_ip}, actions=output:${ovs_port}"
-	otx.AddFlow("table=6, priority=0, actions=drop")
-
-	// Table 7: IP to container; filled in by k8s-ovs
-	// eg, "table=7, priority=100, reg0=0, ip, nw_dst=${ipaddr}, actions=output:${ovs_port}"
-	// eg, "table=7, priority=100, reg0=${tenant_id}, ip, nw_dst=${ipaddr}, actions=output:${ovs_port}"
-	otx.AddFlow("table=7, priority=0, actions=drop")
-
-	// Table 8: to remote container; filled in by AddHostSubnetRules()
-	// eg, "table=8, priority=100, arp, nw_dst=${remote_subnet_cidr}, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${remote_node_ip}->tun_dst,output:1"
-	// eg, "table=8, priority=100, ip, nw_dst=${remote_subnet_cidr}, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${remote_node_ip}->tun_dst,output:1"
-	otx.AddFlow("table=8, priority=0, actions=drop")
-
-	// Table 9: egress network policy dispatch; edited by updateEgressNetworkPolicyRules()
-	// eg, "table=9, reg0=${tenant_id}, priority=2, ip, nw_dst=${external_cidr}, actions=drop
-	otx.AddFlow("table=9, priority=0, actions=output:2")
-
-	err = otx.EndTransaction()
+	err = plugin.ovs.AddFlows(
+		// Table 0: initial dispatch based on in_port
+		// vxlan0
+		ovs.FlowMod{Table: 0, Priority: 200, Match: fmt.Sprintf("in_port=1, arp, nw_src=%s, nw_dst=%s", clusterNetworkCIDR, localSubnetCIDR), Actions: "move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1"},
+		ovs.FlowMod{Table: 0, Priority: 200, Match: fmt.Sprintf("in_port=1, ip, nw_src=%s, nw_dst=%s", clusterNetworkCIDR, localSubnetCIDR), Actions: "move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1"},
+		ovs.FlowMod{Table: 0, Priority: 150, Match: "in_port=1", Actions: "drop"},
+		// tun0
+		ovs.FlowMod{Table: 0, Priority: 200, Match: fmt.Sprintf("in_port=2, arp, nw_src=%s, nw_dst=%s", localSubnetGateway, clusterNetworkCIDR), Actions: "goto_table:5"},
+		ovs.FlowMod{Table: 0, Priority: 200, Match: "in_port=2, ip", Actions: "goto_table:5"},
+		ovs.FlowMod{Table: 0, Priority: 150, Match: "in_port=2", Actions: "drop"},
+		// else, from a container
+		ovs.FlowMod{Table: 0, Priority: 100, Match: "arp", Actions: "goto_table:2"},
+		ovs.FlowMod{Table: 0, Priority: 100, Match: "ip", Actions: "goto_table:2"},
+		ovs.FlowMod{Table: 0, Priority: 0, Actions: "drop"},
+
+		// Table 1: VXLAN ingress filtering; filled in by AddHostSubnetRules()
+		// eg, "table=1, priority=100, tun_src=${remote_node_ip}, actions=goto_table:5"
+		// The default (no match) action is drop unless vxlanIngressFilter is
+		// disabled as a break-glass measure, in which case unrecognized
+		// tunnel sources are let through unfiltered.
+		//
+		// connectivityProbePort is exempted ahead of the per-host tun_src
+		// rules below (higher priority) so a probe still gets through even
+		// from a peer whose HostSubnet hasn't been learned yet, or after
+		// vxlanIngressFilter has dropped everything else; see
+		// connectivity_probe.go.
+		ovs.FlowMod{Table: 1, Priority: 200, Match: fmt.Sprintf("udp, tp_dst=%d", connectivityProbePort), Actions: "goto_table:5"},
+		ovs.FlowMod{Table: 1, Priority: 0, Actions: vxlanIngressDefaultAction(plugin.vxlanIngressFilter)},
+
+		// Table 2: from container; validate IP/MAC, assign tenant-id; filled in by k8s-ovs
+		// eg, "table=2, priority=100, in_port=${ovs_port}, arp, nw_src=${ipaddr}, arp_sha=${macaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:5"
+		//     "table=2, priority=100, in_port=${ovs_port}, ip, nw_src=${ipaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:3"
+		// (${tenant_id} is always 0 for single-tenant)
+		ovs.FlowMod{Table: 2, Priority: 0, Actions: "drop"},
+
+		// Table 3: from container; service vs non-service
+		ovs.FlowMod{Table: 3, Priority: 100, Match: fmt.Sprintf("ip, nw_dst=%s", serviceNetworkCIDR), Actions: "goto_table:4"},
+		ovs.FlowMod{Table: 3, Priority: 0, Actions: "goto_table:5"},
+
+		// Table 4: from container; service dispatch; filled in by AddServiceRules()
+		ovs.FlowMod{Table: 4, Priority: 200, Match: "reg0=0", Actions: "output:2"},
+		// eg, "table=4, priority=100, reg0=${tenant_id}, ${service_proto}, nw_dst=${service_ip}, tp_dst=${service_port}, actions=output:2"
+		ovs.FlowMod{Table: 4, Priority: 0, Actions: "drop"},
+
+		// Table 5: general routing
+		ovs.FlowMod{Table: 5, Priority: 300, Match: fmt.Sprintf("arp, nw_dst=%s", localSubnetGateway), Actions: "output:2"},
+		ovs.FlowMod{Table: 5, Priority: 300, Match: fmt.Sprintf("ip, nw_dst=%s", localSubnetGateway), Actions: "output:2"},
+		ovs.FlowMod{Table: 5, Priority: 200, Match: fmt.Sprintf("arp, nw_dst=%s", localSubnetCIDR), Actions: "goto_table:6"},
+		ovs.FlowMod{Table: 5, Priority: 200, Match: fmt.Sprintf("ip, nw_dst=%s", localSubnetCIDR), Actions: "goto_table:7"},
+		ovs.FlowMod{Table: 5, Priority: 100, Match: fmt.Sprintf("arp, nw_dst=%s", clusterNetworkCIDR), Actions: "goto_table:8"},
+		ovs.FlowMod{Table: 5, Priority: 100, Match: fmt.Sprintf("ip, nw_dst=%s", clusterNetworkCIDR), Actions: "goto_table:8"},
+		ovs.FlowMod{Table: 5, Priority: 0, Match: "ip", Actions: "goto_table:9"},
+		ovs.FlowMod{Table: 5, Priority: 0, Match: "arp", Actions: "drop"},
+
+		// Table 6: ARP to container, filled in by k8s-ovs
+		// eg, "table=6, priority=100, arp, nw_dst=${container_ip}, actions=output:${ovs_port}"
+		ovs.FlowMod{Table: 6, Priority: 0, Actions: "drop"},
+
+		// Table 7: IP to container; filled in by k8s-ovs
+		// eg, "table=7, priority=100, reg0=0, ip, nw_dst=${ipaddr}, actions=output:${ovs_port}"
+		// eg, "table=7, priority=100, reg0=${tenant_id}, ip, nw_dst=${ipaddr}, actions=output:${ovs_port}"
+		ovs.FlowMod{Table: 7, Priority: 0, Actions: "drop"},
+
+		// Table 8: to remote container; filled in by AddHostSubnetRules()
+		// eg, "table=8, priority=100, arp, nw_dst=${remote_subnet_cidr}, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${remote_node_ip}->tun_dst,output:1"
+		// eg, "table=8, priority=100, ip, nw_dst=${remote_subnet_cidr}, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${remote_node_ip}->tun_dst,output:1"
+		ovs.FlowMod{Table: 8, Priority: 0, Actions: "drop"},
+
+		// Table 9: egress network policy dispatch; edited by updateEgressNetworkPolicyRules()
+		// eg, "table=9, reg0=${tenant_id}, priority=2, ip, nw_dst=${external_cidr}, actions=drop
+		ovs.FlowMod{Table: 9, Priority: 0, Actions: "output:2"},
+	)
 	if err != nil {
 		return false, err
 	}
 
 	itx := ipcmd.NewTransaction(exec, TUN)
 	itx.AddAddress(gwCIDR)
-	defer deleteLocalSubnetRoute(TUN, localSubnetCIDR)
+	defer deleteLocalSubnetRoute(exec, TUN, localSubnetCIDR)
 	itx.SetLink("mtu", fmt.Sprint(plugin.mtu))
 	itx.SetLink("up")
 	itx.AddRoute(clusterNetworkCIDR, "proto", "kernel", "scope", "link")
@@ -313,10 +428,8 @@ func (plugin *KsdnNode) SetupSDN() (bool, error) {
 	}
 
 	// Table 253: rule version; note action is hex bytes separated by '.'
-	otx = plugin.ovs.NewTransaction()
-	pluginVersion := getPluginVersion(plugin.multitenant)
-	otx.AddFlow("%s, %s%s.%s", VERSION_TABLE, VERSION_ACTION, pluginVersion[0], pluginVersion[1])
-	err = otx.EndTransaction()
+	pluginVersion := getPluginVersion(plugin.multitenant, plugin.flowVersion)
+	err = plugin.ovs.AddFlows(ovs.FlowMod{Table: 253, Actions: fmt.Sprintf("note:%s.%s", pluginVersion[0], pluginVersion[1])})
 	if err != nil {
 		return false, err
 	}
@@ -324,23 +437,31 @@ func (plugin *KsdnNode) SetupSDN() (bool, error) {
 	return true, nil
 }
 
+// vxlanIngressDefaultAction returns Table 1's no-match action: drop
+// encapsulated traffic from unrecognized tunnel sources when enabled is
+// true, or let it through to Table 5 unfiltered when the operator has
+// disabled the filter as a break-glass measure.
+func vxlanIngressDefaultAction(enabled bool) string {
+	if enabled {
+		return "drop"
+	}
+	return "goto_table:5"
+}
+
 func (plugin *KsdnNode) AddHostSubnetRules(subnet *etcdmanager.HostSubnet) error {
 	glog.Infof("AddHostSubnetRules for %v", subnet)
-	otx := plugin.ovs.NewTransaction()
-
-	otx.AddFlow("table=1, priority=100, tun_src=%s, actions=goto_table:5", subnet.HostIP)
-	/*	if vnid, ok := subnet.Annotations[osapi.FixedVnidHost]; ok {
-			otx.AddFlow("table=8, priority=100, arp, nw_dst=%s, actions=load:%s->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, vnid, subnet.HostIP)
-			otx.AddFlow("table=8, priority=100, ip, nw_dst=%s, actions=load:%s->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, vnid, subnet.HostIP)
-		} else {
-			otx.AddFlow("table=8, priority=100, arp, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, subnet.HostIP)
-			otx.AddFlow("table=8, priority=100, ip, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, subnet.HostIP)
-		}
-	*/
-	otx.AddFlow("table=8, priority=100, arp, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, subnet.HostIP)
-	otx.AddFlow("table=8, priority=100, ip, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, subnet.HostIP)
 
-	err := otx.EndTransaction()
+	err := plugin.ovs.AddFlows(
+		ovs.FlowMod{Table: 1, Priority: 100, Match: fmt.Sprintf("tun_src=%s", subnet.HostIP), Actions: "goto_table:5"},
+		/*	if vnid, ok := subnet.Annotations[osapi.FixedVnidHost]; ok {
+				... actions=load:%s->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1 ...
+			} else {
+				... actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1 ...
+			}
+		*/
+		ovs.FlowMod{Table: 8, Priority: 100, Match: fmt.Sprintf("arp, nw_dst=%s", subnet.Subnet), Actions: fmt.Sprintf("move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.HostIP)},
+		ovs.FlowMod{Table: 8, Priority: 100, Match: fmt.Sprintf("ip, nw_dst=%s", subnet.Subnet), Actions: fmt.Sprintf("move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.HostIP)},
+	)
 	if err != nil {
 		return fmt.Errorf("Error adding OVS flows for subnet: %v, %v", subnet, err)
 	}
@@ -350,11 +471,11 @@ func (plugin *KsdnNode) AddHostSubnetRules(subnet *etcdmanager.HostSubnet) error
 func (plugin *KsdnNode) DeleteHostSubnetRules(subnet *etcdmanager.HostSubnet) error {
 	glog.Infof("DeleteHostSubnetRules for %s", subnet.Subnet)
 
-	otx := plugin.ovs.NewTransaction()
-	otx.DeleteFlows("table=1, tun_src=%s", subnet.HostIP)
-	otx.DeleteFlows("table=8, ip, nw_dst=%s", subnet.Subnet)
-	otx.DeleteFlows("table=8, arp, nw_dst=%s", subnet.Subnet)
-	err := otx.EndTransaction()
+	err := plugin.ovs.DelFlows(
+		ovs.FlowMod{Table: 1, Match: fmt.Sprintf("tun_src=%s", subnet.HostIP)},
+		ovs.FlowMod{Table: 8, Match: fmt.Sprintf("ip, nw_dst=%s", subnet.Subnet)},
+		ovs.FlowMod{Table: 8, Match: fmt.Sprintf("arp, nw_dst=%s", subnet.Subnet)},
+	)
 	if err != nil {
 		return fmt.Errorf("Error deleting OVS flows for subnet: %v, %v", subnet, err)
 	}
@@ -366,13 +487,16 @@ func (plugin *KsdnNode) AddServiceRules(service *kapi.Service, netID uint32) err
 		return nil
 	}
 
+	if serviceAccessibleFromAllVNIDs(service, plugin.globallyAccessibleServicesNamespaces) {
+		netID = 0
+	}
+
 	glog.V(5).Infof("AddServiceRules for %v", service)
 
-	otx := plugin.ovs.NewTransaction()
 	for _, port := range service.Spec.Ports {
-		otx.AddFlow(generateAddServiceRule(netID, service.Spec.ClusterIP, port.Protocol, int(port.Port)))
-		err := otx.EndTransaction()
-		if err != nil {
+		mod := generateAddServiceMod(netID, service.Spec.ClusterIP, port.Protocol, int(port.Port))
+		mod.Namespace = service.Namespace
+		if err := plugin.ovs.AddFlows(mod); err != nil {
 			return fmt.Errorf("Error adding OVS flows for service: %v, netid: %d, %v", service, netID, err)
 		}
 	}
@@ -386,30 +510,406 @@ func (plugin *KsdnNode) DeleteServiceRules(service *kapi.Service) error {
 
 	glog.V(5).Infof("DeleteServiceRules for %v", service)
 
-	otx := plugin.ovs.NewTransaction()
 	for _, port := range service.Spec.Ports {
-		otx.DeleteFlows(generateDeleteServiceRule(service.Spec.ClusterIP, port.Protocol, int(port.Port)))
-		err := otx.EndTransaction()
-		if err != nil {
+		mod := generateDeleteServiceMod(service.Spec.ClusterIP, port.Protocol, int(port.Port))
+		mod.Namespace = service.Namespace
+		if err := plugin.ovs.DelFlows(mod); err != nil {
 			return fmt.Errorf("Error deleting OVS flows for service: %v, %v", service, err)
 		}
 	}
 	return nil
 }
 
-func generateBaseServiceRule(IP string, protocol kapi.Protocol, port int) string {
-	return fmt.Sprintf("table=4, %s, nw_dst=%s, tp_dst=%d", strings.ToLower(string(protocol)), IP, port)
+// DeleteServiceRulesForNetID removes only service's rules tagged with
+// netID, leaving any rules for the same VIP tagged with a different netID
+// in place. It's used during a make-before-break VNID transition (see
+// updatePodNetwork) to tear down the old tenant's service rules once pods
+// have been re-tagged, without disturbing the new tenant's rules that were
+// already installed additively; DeleteServiceRules can't be reused for
+// this, since its match omits reg0 entirely and would remove both.
+func (plugin *KsdnNode) DeleteServiceRulesForNetID(service *kapi.Service, netID uint32) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	if serviceAccessibleFromAllVNIDs(service, plugin.globallyAccessibleServicesNamespaces) {
+		// Globally-accessible services are always tagged netID 0, regardless
+		// of their namespace's VNID, so they're never part of a transition.
+		return nil
+	}
+
+	glog.V(5).Infof("DeleteServiceRulesForNetID for %v, netid %d", service, netID)
+
+	for _, port := range service.Spec.Ports {
+		mod := generateDeleteServiceModForNetID(netID, service.Spec.ClusterIP, port.Protocol, int(port.Port))
+		mod.Namespace = service.Namespace
+		if err := plugin.ovs.DelFlows(mod); err != nil {
+			return fmt.Errorf("Error deleting OVS flows for service: %v, netid: %d, %v", service, netID, err)
+		}
+	}
+	return nil
+}
+
+// serviceRulesBypassPriority sits above ordinary per-service flows (100) but
+// below table 4's existing reg0=0 global-tenant rule (200), so with service
+// rules disabled every tenant's service traffic reaches the host network
+// stack (e.g. a coexisting kube-proxy) the same way global-tenant traffic
+// already does, instead of falling through to table 4's default drop.
+const serviceRulesBypassPriority = 150
+
+func generateServiceRulesBypassMod() ovs.FlowMod {
+	return ovs.FlowMod{Table: 4, Priority: serviceRulesBypassPriority, Actions: "output:2"}
+}
+
+// AddServiceRulesBypass installs the table 4 catch-all that lets every
+// tenant's service traffic reach the host network stack once this node has
+// stopped programming its own per-service flows; see WithServiceRulesMode.
+func (plugin *KsdnNode) AddServiceRulesBypass() error {
+	if !plugin.multitenant {
+		return nil
+	}
+	if err := plugin.ovs.AddFlows(generateServiceRulesBypassMod()); err != nil {
+		return fmt.Errorf("Error adding service rules bypass flow: %v", err)
+	}
+	return nil
+}
+
+// DeleteServiceRulesBypass removes the table 4 catch-all added by
+// AddServiceRulesBypass.
+func (plugin *KsdnNode) DeleteServiceRulesBypass() error {
+	if !plugin.multitenant {
+		return nil
+	}
+	if err := plugin.ovs.DelFlows(generateServiceRulesBypassMod()); err != nil {
+		return fmt.Errorf("Error deleting service rules bypass flow: %v", err)
+	}
+	return nil
+}
+
+// dnsPort is the only port the DNS exemption flows below unblock, so
+// granting every VNID access to the DNS service/pods can't be turned into
+// access to anything else they're running.
+const dnsPort = 53
+
+// dnsExemptionPriority is higher than any hand-written table 3 flow (the
+// highest today is 100), so a DNS-bound packet always hits these rules
+// before the ordinary service-vs-non-service dispatch, regardless of the
+// sender's own tenant reg0.
+const dnsExemptionPriority = 300
+
+func generateDNSMatch(protocol, ip string) string {
+	return fmt.Sprintf("%s, nw_dst=%s, tp_dst=%d", protocol, ip, dnsPort)
+}
+
+// generateDNSServiceAddMods forces reg0 to the global tenant for traffic
+// bound for the DNS service VIP before it reaches table 4's per-tenant
+// service dispatch, so every VNID's queries hit table 4's existing
+// reg0=0 rule instead of needing a per-tenant flow of their own.
+func generateDNSServiceAddMods(vip string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 3, Priority: dnsExemptionPriority, Match: generateDNSMatch("udp", vip), Actions: "load:0->NXM_NX_REG0[],goto_table:4"},
+		{Table: 3, Priority: dnsExemptionPriority, Match: generateDNSMatch("tcp", vip), Actions: "load:0->NXM_NX_REG0[],goto_table:4"},
+	}
+}
+
+func generateDNSServiceDeleteMods(vip string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 3, Match: generateDNSMatch("udp", vip)},
+		{Table: 3, Match: generateDNSMatch("tcp", vip)},
+	}
+}
+
+// generateDNSEndpointAddMods does the same reg0 override for traffic bound
+// directly for a DNS pod's own IP (not just the service VIP), routing
+// straight to table 5 since a pod IP never matches table 4's service
+// dispatch. That leaves delivery to the DNS pod's own table 7 reg0=0 flow,
+// installed for it like any other isolated pod's global-tenant exemption.
+func generateDNSEndpointAddMods(ip string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 3, Priority: dnsExemptionPriority, Match: generateDNSMatch("udp", ip), Actions: "load:0->NXM_NX_REG0[],goto_table:5"},
+		{Table: 3, Priority: dnsExemptionPriority, Match: generateDNSMatch("tcp", ip), Actions: "load:0->NXM_NX_REG0[],goto_table:5"},
+	}
+}
+
+func generateDNSEndpointDeleteMods(ip string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 3, Match: generateDNSMatch("udp", ip)},
+		{Table: 3, Match: generateDNSMatch("tcp", ip)},
+	}
+}
+
+// AddDNSServiceRules installs the table 3 bypass flows that let every VNID
+// reach the DNS service's VIP on UDP/TCP port 53, no matter the sender's own
+// tenant. See dnsController, which calls this as the DNS service's VIP
+// changes.
+func (plugin *KsdnNode) AddDNSServiceRules(vip, namespace string) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	mods := generateDNSServiceAddMods(vip)
+	for i := range mods {
+		mods[i].Namespace = namespace
+	}
+	if err := plugin.ovs.AddFlows(mods...); err != nil {
+		return fmt.Errorf("Error adding DNS OVS flows for service VIP %s: %v", vip, err)
+	}
+	return nil
+}
+
+// DeleteDNSServiceRules removes the flows AddDNSServiceRules installed for vip.
+func (plugin *KsdnNode) DeleteDNSServiceRules(vip string) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	if err := plugin.ovs.DelFlows(generateDNSServiceDeleteMods(vip)...); err != nil {
+		return fmt.Errorf("Error deleting DNS OVS flows for service VIP %s: %v", vip, err)
+	}
+	return nil
+}
+
+// AddDNSEndpointRules installs the table 3 bypass flows that let every VNID
+// reach a DNS pod directly by its own IP on UDP/TCP port 53. See
+// dnsController, which calls this as the DNS service's endpoints change.
+func (plugin *KsdnNode) AddDNSEndpointRules(ip, namespace string) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	mods := generateDNSEndpointAddMods(ip)
+	for i := range mods {
+		mods[i].Namespace = namespace
+	}
+	if err := plugin.ovs.AddFlows(mods...); err != nil {
+		return fmt.Errorf("Error adding DNS OVS flows for endpoint %s: %v", ip, err)
+	}
+	return nil
+}
+
+// DeleteDNSEndpointRules removes the flows AddDNSEndpointRules installed for ip.
+func (plugin *KsdnNode) DeleteDNSEndpointRules(ip string) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	if err := plugin.ovs.DelFlows(generateDNSEndpointDeleteMods(ip)...); err != nil {
+		return fmt.Errorf("Error deleting DNS OVS flows for endpoint %s: %v", ip, err)
+	}
+	return nil
+}
+
+// hostAccessPriority is higher than Table 0's in_port=2 base dispatch rules
+// (200), so a packet from the node's own address bound for a known service
+// endpoint gets its tenant tag before falling through to the ordinary
+// untagged goto_table:5.
+const hostAccessPriority = 250
+
+// generateHostAccessMatch matches ip traffic arriving from tun0 that the
+// node's own network stack originated (nw_src is this node's local subnet
+// gateway, the address the kernel picks for anything it sends out tun0
+// itself) and is bound for ip, a service endpoint's own pod IP. It has to
+// match on the endpoint's IP rather than the service's VIP because
+// kube-proxy's DNAT already rewrote the destination by the time a
+// host-originated packet reaches tun0; see host_access.go.
+func generateHostAccessMatch(localSubnetGateway, ip string) string {
+	return fmt.Sprintf("ip, in_port=2, nw_src=%s, nw_dst=%s", localSubnetGateway, ip)
+}
+
+// generateHostAccessAddMods tags host-originated traffic bound for ip with
+// netID before Table 5's routing dispatch, so it lands on that service's
+// namespace's own Table 7 delivery flow instead of the default reg0=0.
+func generateHostAccessAddMods(localSubnetGateway, ip string, netID uint32) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 0, Priority: hostAccessPriority, Match: generateHostAccessMatch(localSubnetGateway, ip), Actions: fmt.Sprintf("load:%d->NXM_NX_REG0[],goto_table:5", netID)},
+	}
+}
+
+func generateHostAccessDeleteMods(localSubnetGateway, ip string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 0, Match: generateHostAccessMatch(localSubnetGateway, ip)},
+	}
+}
+
+// AddHostAccessRules installs the Table 0 exemption flow that lets the
+// node's own addresses reach the service endpoint at ip, tagged with netID,
+// regardless of tenant isolation. See hostAccessController, which calls
+// this as services' endpoints change.
+func (plugin *KsdnNode) AddHostAccessRules(ip string, netID uint32, namespace string) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	mods := generateHostAccessAddMods(plugin.localSubnetGateway, ip, netID)
+	for i := range mods {
+		mods[i].Namespace = namespace
+	}
+	if err := plugin.ovs.AddFlows(mods...); err != nil {
+		return fmt.Errorf("Error adding host-access OVS flow for endpoint %s: %v", ip, err)
+	}
+	return nil
+}
+
+// DeleteHostAccessRules removes the flow AddHostAccessRules installed for ip.
+func (plugin *KsdnNode) DeleteHostAccessRules(ip string) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	if err := plugin.ovs.DelFlows(generateHostAccessDeleteMods(plugin.localSubnetGateway, ip)...); err != nil {
+		return fmt.Errorf("Error deleting host-access OVS flow for endpoint %s: %v", ip, err)
+	}
+	return nil
+}
+
+// healthCheckAccessPriority sits below hostAccessPriority (250, the node's
+// own addresses) but above Table 0's plain in_port=2 base dispatch rules
+// (200), so an external health check gets its target service's VNID tag
+// ahead of falling through to the ordinary untagged goto_table:5, without
+// ever outranking the node's own host-access exemption for the same IP.
+const healthCheckAccessPriority = 240
+
+// generateHealthCheckAccessMatch matches protocol traffic arriving from
+// tun0 whose source falls in cidr, a configured load-balancer health-check
+// source range, whose destination is ip, a NodePort/LoadBalancer service
+// endpoint's own pod IP, and whose destination port is port, that endpoint's
+// own target port -- so the exemption reaches only the service's declared
+// port, not the whole pod. As with generateHostAccessMatch, it has to match
+// on the endpoint's IP rather than the service's VIP or node port, since
+// kube-proxy's DNAT already rewrote the destination by the time the probe
+// reaches tun0; see health_check_access.go.
+func generateHealthCheckAccessMatch(cidr, ip string, protocol kapi.Protocol, port int) string {
+	return fmt.Sprintf("%s, in_port=2, nw_src=%s, nw_dst=%s, tp_dst=%d", strings.ToLower(string(protocol)), cidr, ip, port)
 }
 
-func generateAddServiceRule(netID uint32, IP string, protocol kapi.Protocol, port int) string {
-	baseRule := generateBaseServiceRule(IP, protocol, port)
-	if netID == 0 {
-		return fmt.Sprintf("%s, priority=100, actions=output:2", baseRule)
-	} else {
-		return fmt.Sprintf("%s, priority=100, reg0=%d, actions=output:2", baseRule, netID)
+func generateHealthCheckAccessAddMods(cidr, ip string, protocol kapi.Protocol, port int, netID uint32) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 0, Priority: healthCheckAccessPriority, Match: generateHealthCheckAccessMatch(cidr, ip, protocol, port), Actions: fmt.Sprintf("load:%d->NXM_NX_REG0[],goto_table:5", netID)},
 	}
 }
 
-func generateDeleteServiceRule(IP string, protocol kapi.Protocol, port int) string {
-	return generateBaseServiceRule(IP, protocol, port)
+func generateHealthCheckAccessDeleteMods(cidr, ip string, protocol kapi.Protocol, port int) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 0, Match: generateHealthCheckAccessMatch(cidr, ip, protocol, port)},
+	}
+}
+
+// AddHealthCheckAccessRules installs the Table 0 exemption flow that lets a
+// health check from cidr reach endpoint ip's port, protocol-tagged with
+// netID, regardless of tenant isolation. See healthCheckAccessController,
+// which calls this as services' endpoints and the cluster's
+// HealthCheckSourceRanges setting change.
+func (plugin *KsdnNode) AddHealthCheckAccessRules(cidr, ip string, protocol kapi.Protocol, port int, netID uint32, namespace string) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	mods := generateHealthCheckAccessAddMods(cidr, ip, protocol, port, netID)
+	for i := range mods {
+		mods[i].Namespace = namespace
+	}
+	if err := plugin.ovs.AddFlows(mods...); err != nil {
+		return fmt.Errorf("Error adding health-check access OVS flow for endpoint %s:%d, source range %s: %v", ip, port, cidr, err)
+	}
+	return nil
+}
+
+// DeleteHealthCheckAccessRules removes the flow AddHealthCheckAccessRules
+// installed for cidr, ip and port.
+func (plugin *KsdnNode) DeleteHealthCheckAccessRules(cidr, ip string, protocol kapi.Protocol, port int) error {
+	if !plugin.multitenant {
+		return nil
+	}
+
+	if err := plugin.ovs.DelFlows(generateHealthCheckAccessDeleteMods(cidr, ip, protocol, port)...); err != nil {
+		return fmt.Errorf("Error deleting health-check access OVS flow for endpoint %s:%d, source range %s: %v", ip, port, cidr, err)
+	}
+	return nil
+}
+
+// egressDSCPTunnelPriority sits above Table 5's plain cluster-network
+// dispatch rule (100), so a marked VNID's tunnel-bound traffic picks up its
+// DSCP tag before falling through to the ordinary goto_table:8.
+const egressDSCPTunnelPriority = 150
+
+// egressDSCPGatewayPriority sits above Table 5's default catch-all (0), so a
+// marked VNID's everything-else traffic (destined off-cluster, via the
+// gateway) picks up its DSCP tag before falling through to goto_table:9. It
+// stays below every other Table 5 rule, including egressDSCPTunnelPriority,
+// so cluster-bound traffic is only ever marked once, by the tunnel rule.
+const egressDSCPGatewayPriority = 50
+
+// generateEgressDSCPAddMods marks netID's traffic with dscp as it leaves
+// Table 5 toward the tunnel (bound for another node's pods, table 8) or the
+// external gateway (everything else, table 9). Local pod-to-pod delivery
+// (tables 6/7) is untouched, since that traffic never leaves the node for
+// the underlay QoS to see. See syncEgressDSCP, which is the only caller and
+// is responsible for only calling this when every namespace sharing netID
+// agrees on dscp.
+func generateEgressDSCPAddMods(netID uint32, dscp int, clusterNetworkCIDR string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 5, Priority: egressDSCPTunnelPriority, Match: fmt.Sprintf("ip, reg0=%d, nw_dst=%s", netID, clusterNetworkCIDR), Actions: fmt.Sprintf("set_field:%d->ip_dscp,goto_table:8", dscp)},
+		{Table: 5, Priority: egressDSCPGatewayPriority, Match: fmt.Sprintf("ip, reg0=%d", netID), Actions: fmt.Sprintf("set_field:%d->ip_dscp,goto_table:9", dscp)},
+	}
+}
+
+func generateEgressDSCPDeleteMods(netID uint32, clusterNetworkCIDR string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 5, Match: fmt.Sprintf("ip, reg0=%d, nw_dst=%s", netID, clusterNetworkCIDR)},
+		{Table: 5, Match: fmt.Sprintf("ip, reg0=%d", netID)},
+	}
+}
+
+// AddEgressDSCPRules installs netID's Table 5 DSCP marking flows; see
+// generateEgressDSCPAddMods and syncEgressDSCP in egress_dscp.go.
+func (plugin *KsdnNode) AddEgressDSCPRules(netID uint32, dscp int) error {
+	clusterNetworkCIDR := plugin.networkInfo.ClusterNetwork.String()
+	if err := plugin.ovs.AddFlows(generateEgressDSCPAddMods(netID, dscp, clusterNetworkCIDR)...); err != nil {
+		return fmt.Errorf("Error adding egress DSCP OVS flow for netid %d: %v", netID, err)
+	}
+	return nil
+}
+
+// DeleteEgressDSCPRules removes the flows AddEgressDSCPRules installed for
+// netID.
+func (plugin *KsdnNode) DeleteEgressDSCPRules(netID uint32) error {
+	clusterNetworkCIDR := plugin.networkInfo.ClusterNetwork.String()
+	if err := plugin.ovs.DelFlows(generateEgressDSCPDeleteMods(netID, clusterNetworkCIDR)...); err != nil {
+		return fmt.Errorf("Error deleting egress DSCP OVS flow for netid %d: %v", netID, err)
+	}
+	return nil
+}
+
+func generateBaseServiceMatch(IP string, protocol kapi.Protocol, port int) string {
+	return fmt.Sprintf("%s, nw_dst=%s, tp_dst=%d", strings.ToLower(string(protocol)), IP, port)
+}
+
+func generateAddServiceMod(netID uint32, IP string, protocol kapi.Protocol, port int) ovs.FlowMod {
+	match := generateBaseServiceMatch(IP, protocol, port)
+	mod := ovs.FlowMod{Table: 4, Priority: 100, Match: match, Actions: "output:2"}
+	if netID != 0 {
+		// netID 0 (a globally-accessible service) matches every tenant's
+		// traffic, not one namespace's, so it's left untagged; see
+		// vnidFlowCookie and ksdn.trafficAccountant.
+		mod.Match = fmt.Sprintf("%s, reg0=%d", match, netID)
+		mod.Cookie = vnidFlowCookie(netID)
+	}
+	return mod
+}
+
+func generateDeleteServiceMod(IP string, protocol kapi.Protocol, port int) ovs.FlowMod {
+	return ovs.FlowMod{Table: 4, Match: generateBaseServiceMatch(IP, protocol, port)}
+}
+
+// generateDeleteServiceModForNetID is generateDeleteServiceMod, scoped to
+// only the flow tagged with netID, so it doesn't disturb a same-VIP flow
+// tagged with a different netID; see DeleteServiceRulesForNetID.
+func generateDeleteServiceModForNetID(netID uint32, IP string, protocol kapi.Protocol, port int) ovs.FlowMod {
+	match := generateBaseServiceMatch(IP, protocol, port)
+	mod := ovs.FlowMod{Table: 4, Match: match}
+	if netID != 0 {
+		mod.Match = fmt.Sprintf("%s, reg0=%d", match, netID)
+		mod.Cookie = vnidFlowCookie(netID)
+	}
+	return mod
 }
@@ -0,0 +1,135 @@
+package ksdn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/golang/glog"
+
+	"k8s-ovs/pkg/crashdump"
+	"k8s-ovs/pkg/ovs"
+)
+
+// crashDumpDir is where diagnostics bundles are written; empty disables
+// bundle creation entirely.
+var crashDumpDir string
+
+// SetCrashDumpDir configures where diagnostics bundles are written on fatal
+// errors and panics. Called once during daemon startup from the parsed
+// --crashdump-dir flag.
+func SetCrashDumpDir(dir string) {
+	crashDumpDir = dir
+}
+
+// InstallPanicHandler recovers a panic in the calling goroutine, writes a
+// best-effort diagnostics bundle, then re-panics so normal crash behavior
+// (stack trace on stderr, non-zero exit) is unaffected. It only guards
+// panics in the goroutine it's deferred in, so it must be deferred at the
+// top of every long-running goroutine the node daemon starts.
+func InstallPanicHandler() {
+	if r := recover(); r != nil {
+		WriteCrashDump("panic", fmt.Sprintf("%v\n\n%s", r, debug.Stack()))
+		panic(r)
+	}
+}
+
+// WriteCrashDump collects and writes a diagnostics bundle for the current
+// node. It is safe to call with a nil node (e.g. before StartNode finishes
+// setting up), in which case only goroutine and process-wide state is
+// captured. extra, if non-empty, is included as its own section (e.g. a
+// panic value and stack).
+func (node *KsdnNode) WriteCrashDump(reason string, extra string) {
+	collectors := []crashdump.Collector{
+		{Name: "goroutines", Collect: dumpGoroutines},
+		{Name: "recent-events", Collect: node.dumpRecentEvents},
+	}
+	if extra != "" {
+		collectors = append(collectors, crashdump.Collector{
+			Name:    "trigger",
+			Collect: func() (string, error) { return extra, nil },
+		})
+	}
+	if node != nil {
+		collectors = append(collectors,
+			crashdump.Collector{Name: "vnid-map", Collect: node.dumpVNIDMap},
+			crashdump.Collector{Name: "flows", Collect: node.dumpFlows},
+			crashdump.Collector{Name: "iptables", Collect: node.dumpIPTables},
+		)
+	}
+
+	crashdump.Write(crashDumpDir, reason, collectors)
+}
+
+// WriteCrashDump is a package-level convenience for call sites (like early
+// startup failures) that don't have a fully-initialized *KsdnNode yet.
+func WriteCrashDump(reason string, extra string) {
+	(*KsdnNode)(nil).WriteCrashDump(reason, extra)
+}
+
+// fatalf writes a diagnostics bundle capturing the node's current state,
+// then delegates to glog.Fatalf, so the state needed to debug a bad startup
+// isn't gone once the process dies. Nothing in this package calls it; main
+// handles a failed Start by calling WriteCrashDump and then glog.Fatalf.
+func (node *KsdnNode) fatalf(format string, args ...interface{}) {
+	node.WriteCrashDump("fatal", fmt.Sprintf(format, args...))
+	glog.Fatalf(format, args...)
+}
+
+func dumpGoroutines() (string, error) {
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	return string(buf[:n]), nil
+}
+
+func (node *KsdnNode) dumpRecentEvents() (string, error) {
+	raw, err := json.MarshalIndent(RecentEvents(), "", "  ")
+	return string(raw), err
+}
+
+func (node *KsdnNode) dumpVNIDMap() (string, error) {
+	if node.vnids == nil {
+		return "", nil
+	}
+	raw, err := json.MarshalIndent(node.vnids.Snapshot(), "", "  ")
+	return string(raw), err
+}
+
+func (node *KsdnNode) dumpFlows() (string, error) {
+	if node.ovs == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+
+	rd, ok := node.ovs.(ovs.RawDumper)
+	if !ok {
+		return "", fmt.Errorf("flow backend does not support raw dumps")
+	}
+
+	show, err := rd.Show()
+	if err != nil {
+		fmt.Fprintf(&buf, "ovs-ofctl show failed: %v\n", err)
+	} else {
+		buf.WriteString(show)
+		buf.WriteString("\n")
+	}
+
+	flows, err := rd.DumpFlows()
+	if err != nil {
+		return buf.String(), err
+	}
+	for _, flow := range flows {
+		buf.WriteString(flow)
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
+
+func (node *KsdnNode) dumpIPTables() (string, error) {
+	if node.iptables == nil {
+		return "", nil
+	}
+	return node.iptables.Dump()
+}
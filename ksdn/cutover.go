@@ -0,0 +1,242 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/ipcmd"
+	"k8s-ovs/pkg/ovs"
+	netutils "k8s-ovs/pkg/utils"
+
+	"k8s.io/kubernetes/pkg/util/sysctl"
+)
+
+// nextBridgeSuffix names the bridge a blue/green cutover builds its new
+// configuration on, so as not to disturb BR (br0) until the cutover
+// finishes and it's safe to remove.
+const nextBridgeSuffix = "-next"
+
+// RunBridgeCutover moves the node's dataplane from BR to a freshly built
+// br0-next bridge without a whole-node pod outage, for upgrades that need a
+// datapath rebuild (a datapath type change, or an incompatible flow table
+// layout) that can't be done in place. Pod veths and the tunnel port are
+// re-plumbed onto the new bridge one at a time, so an individual pod's
+// outage is however long a single ovs-vsctl del-port/add-port pair takes --
+// milliseconds -- rather than however long it takes to flush and rebuild
+// br0 itself.
+//
+// Progress is persisted after every step (see etcdmanager.BridgeCutoverState),
+// so a crash or restart mid-cutover resumes from wherever it left off instead
+// of leaving pods split across two bridges. It's only safe to call this
+// again to resume, or RollbackBridgeCutover to abandon, while the persisted
+// state still exists; both stop existing once the old bridge is removed at
+// the end of a successful cutover.
+func (node *KsdnNode) RunBridgeCutover(ctx context.Context) error {
+	state, err := node.eClient.GetBridgeCutoverState(ctx, node.networkInfo.name, node.localIP)
+	if err != nil {
+		return fmt.Errorf("get bridge cutover state: %v", err)
+	}
+
+	newBridge := BR + nextBridgeSuffix
+	if state == nil {
+		state = &etcdmanager.BridgeCutoverState{NewBridge: newBridge, Phase: etcdmanager.BridgeCutoverBuilding}
+		if err := node.saveCutoverState(ctx, state); err != nil {
+			return err
+		}
+	}
+	newBridge = state.NewBridge
+
+	newOvs, err := ovs.New(node.execer, newBridge)
+	if err != nil {
+		return err
+	}
+
+	if state.Phase == etcdmanager.BridgeCutoverBuilding {
+		glog.Infof("Bridge cutover: building %s", newBridge)
+		if err := newOvs.AddBridge(); err != nil {
+			return fmt.Errorf("create bridge %s: %v", newBridge, err)
+		}
+		if err := cloneFlows(node.ovs, newOvs); err != nil {
+			return fmt.Errorf("clone flow table onto %s: %v", newBridge, err)
+		}
+		state.Phase = etcdmanager.BridgeCutoverMigratingPorts
+		if err := node.saveCutoverState(ctx, state); err != nil {
+			return err
+		}
+	}
+
+	if state.Phase == etcdmanager.BridgeCutoverMigratingPorts {
+		if err := node.migratePodPorts(ctx, newOvs, state); err != nil {
+			return err
+		}
+		state.Phase = etcdmanager.BridgeCutoverMigratingTunnel
+		if err := node.saveCutoverState(ctx, state); err != nil {
+			return err
+		}
+	}
+
+	if state.Phase == etcdmanager.BridgeCutoverMigratingTunnel {
+		if err := node.migrateTunnelPorts(newOvs); err != nil {
+			return err
+		}
+	}
+
+	glog.Infof("Bridge cutover: removing old bridge %s", BR)
+	if err := node.ovs.DeleteBridge(); err != nil {
+		return fmt.Errorf("delete old bridge %s: %v", BR, err)
+	}
+	node.ovs = newOvs
+	if node.podManager != nil {
+		node.podManager.ovs = newOvs
+	}
+
+	if err := node.eClient.DeleteBridgeCutoverState(ctx, node.networkInfo.name, node.localIP); err != nil {
+		return fmt.Errorf("clear bridge cutover state: %v", err)
+	}
+	glog.Infof("Bridge cutover complete")
+	return nil
+}
+
+// RollbackBridgeCutover abandons an in-progress cutover, moving any ports
+// already migrated back to the old bridge and removing the new one. It only
+// works while the old bridge still exists -- once RunBridgeCutover has
+// removed it, the cutover is done and there's nothing left to roll back.
+func (node *KsdnNode) RollbackBridgeCutover(ctx context.Context) error {
+	state, err := node.eClient.GetBridgeCutoverState(ctx, node.networkInfo.name, node.localIP)
+	if err != nil {
+		return fmt.Errorf("get bridge cutover state: %v", err)
+	}
+	if state == nil {
+		return fmt.Errorf("no bridge cutover is in progress")
+	}
+
+	newOvs, err := ovs.New(node.execer, state.NewBridge)
+	if err != nil {
+		return err
+	}
+
+	for i := len(state.MigratedPorts) - 1; i >= 0; i-- {
+		port := state.MigratedPorts[i]
+		if err := movePort(newOvs, node.ovs, port); err != nil {
+			return fmt.Errorf("move %s back to %s: %v", port, BR, err)
+		}
+		glog.Infof("Bridge cutover rollback: moved %s back to %s", port, BR)
+	}
+
+	if err := newOvs.DeleteBridge(); err != nil {
+		return fmt.Errorf("delete %s: %v", state.NewBridge, err)
+	}
+	if err := node.eClient.DeleteBridgeCutoverState(ctx, node.networkInfo.name, node.localIP); err != nil {
+		return fmt.Errorf("clear bridge cutover state: %v", err)
+	}
+	glog.Infof("Bridge cutover rolled back")
+	return nil
+}
+
+func (node *KsdnNode) saveCutoverState(ctx context.Context, state *etcdmanager.BridgeCutoverState) error {
+	return node.eClient.SetBridgeCutoverState(ctx, node.networkInfo.name, node.localIP, state)
+}
+
+// cloneFlows copies every flow currently on src onto dst verbatim. Match and
+// action syntax don't reference the bridge they're installed on, so a flow
+// table built this way behaves identically on the new bridge once its ports
+// come up with the same ofport numbers the flows expect (see movePort).
+func cloneFlows(src, dst ovs.FlowBackend) error {
+	var mods []ovs.FlowMod
+	err := src.StreamFlows(func(f ovs.Flow) bool {
+		mods = append(mods, ovs.FlowMod{Table: f.Table, Cookie: f.Cookie, Priority: f.Priority, Match: f.Match, Actions: f.Actions})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return dst.AddFlows(mods...)
+}
+
+// movePort detaches port from src and reattaches it to dst, requesting the
+// same ofport number it had on src so flows cloned from src keep matching.
+// The port is unreachable for the brief gap between the two ovs-vsctl calls.
+func movePort(src, dst ovs.FlowBackend, port string) error {
+	ofport, err := src.GetOfPort(port)
+	if err != nil {
+		return fmt.Errorf("get ofport: %v", err)
+	}
+	if err := src.DelPort(port); err != nil {
+		return fmt.Errorf("detach from old bridge: %v", err)
+	}
+	if _, err := dst.AddPort(port, ofport); err != nil {
+		return fmt.Errorf("attach to new bridge: %v", err)
+	}
+	return nil
+}
+
+// migratePodPorts moves every pod veth port from node.ovs to newOvs one at a
+// time, skipping ports already migrated (state.MigratedPorts, for resuming
+// after a crash) and the tunnel ports (handled separately, last, by
+// migrateTunnelPorts).
+func (node *KsdnNode) migratePodPorts(ctx context.Context, newOvs ovs.FlowBackend, state *etcdmanager.BridgeCutoverState) error {
+	ports, err := node.ovs.ListPorts()
+	if err != nil {
+		return fmt.Errorf("list ports on %s: %v", BR, err)
+	}
+
+	done := make(map[string]bool, len(state.MigratedPorts))
+	for _, port := range state.MigratedPorts {
+		done[port] = true
+	}
+
+	for _, port := range ports {
+		if port == TUN || port == VXLAN || done[port] {
+			continue
+		}
+		if err := movePort(node.ovs, newOvs, port); err != nil {
+			return fmt.Errorf("migrate pod port %s: %v", port, err)
+		}
+		state.MigratedPorts = append(state.MigratedPorts, port)
+		if err := node.saveCutoverState(ctx, state); err != nil {
+			return err
+		}
+		glog.V(4).Infof("Bridge cutover: migrated pod port %s", port)
+	}
+	return nil
+}
+
+// migrateTunnelPorts moves the vxlan0 and tun0 ports to newOvs, then
+// reapplies the address/routes/MTU/IP-forwarding tun0 carries -- all of
+// which are lost when the OVS internal port backing it is recreated on the
+// new bridge.
+func (node *KsdnNode) migrateTunnelPorts(newOvs ovs.FlowBackend) error {
+	if err := movePort(node.ovs, newOvs, VXLAN); err != nil {
+		return fmt.Errorf("migrate %s: %v", VXLAN, err)
+	}
+	if err := movePort(node.ovs, newOvs, TUN); err != nil {
+		return fmt.Errorf("migrate %s: %v", TUN, err)
+	}
+
+	_, ipnet, err := net.ParseCIDR(node.localSubnetCIDR)
+	if err != nil {
+		return fmt.Errorf("parse local subnet %s: %v", node.localSubnetCIDR, err)
+	}
+	localSubnetMaskLength, _ := ipnet.Mask.Size()
+	gwCIDR := fmt.Sprintf("%s/%d", netutils.GenerateDefaultGateway(ipnet).String(), localSubnetMaskLength)
+
+	itx := ipcmd.NewTransaction(node.execer, TUN)
+	itx.AddAddress(gwCIDR)
+	itx.SetLink("mtu", fmt.Sprint(node.mtu))
+	itx.SetLink("up")
+	itx.AddRoute(node.networkInfo.ClusterNetwork.String(), "proto", "kernel", "scope", "link")
+	itx.AddRoute(node.networkInfo.ServiceNetwork.String())
+	if err := itx.EndTransaction(); err != nil {
+		return fmt.Errorf("reconfigure %s on new bridge: %v", TUN, err)
+	}
+
+	sc := sysctl.New()
+	if err := sc.SetSysctl(fmt.Sprintf("net/ipv4/conf/%s/forwarding", TUN), 1); err != nil {
+		return fmt.Errorf("enable IPv4 forwarding on %s: %v", TUN, err)
+	}
+	return nil
+}
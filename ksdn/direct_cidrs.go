@@ -0,0 +1,143 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/pkg/ovs"
+)
+
+// directCIDRPriority sits between table 5's local-subnet-to-container
+// dispatch (200) and its cluster-network-to-tunnel dispatch (100), and
+// sends a direct CIDR to the local gateway path (table 9). ParseDirectCIDRs
+// rejects any CIDR that overlaps the cluster network, so neither of those
+// two rules ever matches a direct CIDR's destination.
+const directCIDRPriority = 150
+
+// directCIDRSyncPeriod is how often a node re-reads the cluster's
+// DirectCIDRs setting and reconciles both its table 5 flows and its
+// iptables MASQUERADE exemptions against it, so a change to
+// ClusterNetwork.DirectCIDRs takes effect on running nodes without a
+// restart.
+const directCIDRSyncPeriod = 30 * time.Second
+
+// ParseDirectCIDRs parses ClusterNetwork.DirectCIDRs -- a comma-separated
+// list of external CIDRs (e.g. on-prem ranges reachable from the node's
+// own network) that should be routed out the node's local gateway (table
+// 9, the same path table 5's default rule gives any non-cluster
+// destination) and exempted from source NAT -- rejecting anything that
+// overlaps the cluster or service network, since those already have their
+// own table 5 dispatch and must keep going through it.
+func ParseDirectCIDRs(spec string, clusterNet, serviceNet *net.IPNet) ([]*net.IPNet, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var cidrs []*net.IPNet
+	for _, token := range strings.Split(spec, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid direct CIDR %q: %v", token, err)
+		}
+		if cidrsOverlap(cidr, clusterNet) {
+			return nil, fmt.Errorf("direct CIDR %s overlaps the cluster network %s", cidr, clusterNet)
+		}
+		if cidrsOverlap(cidr, serviceNet) {
+			return nil, fmt.Errorf("direct CIDR %s overlaps the service network %s", cidr, serviceNet)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+func cidrsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func generateDirectCIDRAddMods(cidr string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 5, Priority: directCIDRPriority, Match: fmt.Sprintf("arp, nw_dst=%s", cidr), Actions: "goto_table:9"},
+		{Table: 5, Priority: directCIDRPriority, Match: fmt.Sprintf("ip, nw_dst=%s", cidr), Actions: "goto_table:9"},
+	}
+}
+
+func generateDirectCIDRDeleteMods(cidr string) []ovs.FlowMod {
+	return []ovs.FlowMod{
+		{Table: 5, Match: fmt.Sprintf("arp, nw_dst=%s", cidr)},
+		{Table: 5, Match: fmt.Sprintf("ip, nw_dst=%s", cidr)},
+	}
+}
+
+// startDirectCIDRSync reconciles table 5 and the node's iptables rules
+// against the cluster's DirectCIDRs setting once, then starts a goroutine
+// that repeats the reconcile every directCIDRSyncPeriod so a later edit to
+// DirectCIDRs takes effect without a node restart. Return traffic from a
+// direct CIDR to a local pod needs no flow of its own: it arrives on tun0
+// (in_port=2) and already unconditionally hits table 5 like any other
+// tunnel-facing packet, from where the ordinary local-subnet rules deliver
+// it.
+func (node *KsdnNode) startDirectCIDRSync() {
+	node.syncDirectCIDRs()
+	go utilwait.Until(node.syncDirectCIDRs, directCIDRSyncPeriod, node.ctx.Done())
+}
+
+func (node *KsdnNode) syncDirectCIDRs() {
+	networkConfig, err := node.eClient.GetNetworkConfig(node.ctx, node.network)
+	if err != nil {
+		glog.Errorf("Failed to get network config for direct CIDR sync: %v", err)
+		return
+	}
+
+	cidrs, err := ParseDirectCIDRs(networkConfig.DirectCIDRs, node.networkInfo.ClusterNetwork, node.networkInfo.ServiceNetwork)
+	if err != nil {
+		glog.Errorf("Failed to parse DirectCIDRs %q: %v", networkConfig.DirectCIDRs, err)
+		return
+	}
+
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr.String()] = true
+	}
+
+	node.directCIDRsLock.Lock()
+	defer node.directCIDRsLock.Unlock()
+
+	for cidr := range wanted {
+		if node.directCIDRs[cidr] {
+			continue
+		}
+		if err := node.ovs.AddFlows(generateDirectCIDRAddMods(cidr)...); err != nil {
+			glog.Errorf("Failed to add direct route flows for %s: %v", cidr, err)
+			continue
+		}
+		node.directCIDRs[cidr] = true
+		glog.Infof("Routing %s directly instead of through the VXLAN tunnel", cidr)
+	}
+
+	for cidr := range node.directCIDRs {
+		if wanted[cidr] {
+			continue
+		}
+		if err := node.ovs.DelFlows(generateDirectCIDRDeleteMods(cidr)...); err != nil {
+			glog.Errorf("Failed to remove direct route flows for %s: %v", cidr, err)
+			continue
+		}
+		delete(node.directCIDRs, cidr)
+		glog.Infof("No longer routing %s directly", cidr)
+	}
+
+	if node.iptables != nil {
+		node.iptables.SetDirectCIDRs(cidrs)
+	}
+}
@@ -0,0 +1,117 @@
+package ksdn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/util/sets"
+)
+
+// dnsResyncPeriod is how often the DNS service/endpoints informers re-list,
+// matching serviceResyncPeriod/podCacheResyncPeriod.
+const dnsResyncPeriod = 30 * time.Minute
+
+// dnsController keeps the table 3 DNS exemption flows (see
+// AddDNSServiceRules/AddDNSEndpointRules in controller.go) in sync with one
+// configured cluster DNS service's VIP and endpoint pod IPs, so every VNID
+// can resolve DNS through it without that service's namespace needing to be
+// made global. It's only started in multitenant mode, and only when
+// WithDNSService named a service.
+type dnsController struct {
+	node      *KsdnNode
+	namespace string
+	name      string
+
+	lock        sync.Mutex
+	vip         string
+	endpointIPs sets.String
+}
+
+func newDNSController(node *KsdnNode, namespace, name string) *dnsController {
+	return &dnsController{
+		node:        node,
+		namespace:   namespace,
+		name:        name,
+		endpointIPs: sets.NewString(),
+	}
+}
+
+// Run starts dc's Service and Endpoints informers. It does not block.
+func (dc *dnsController) Run(stopCh <-chan struct{}) {
+	selector := fields.Set{"metadata.name": dc.name}.AsSelector()
+
+	svcLW := kcache.NewListWatchFromClient(dc.node.kClient, "services", dc.namespace, selector)
+	_, svcController := framework.NewInformer(svcLW, &kapi.Service{}, dnsResyncPeriod, framework.ResourceEventHandlerFuncs{
+		AddFunc:    dc.syncService,
+		UpdateFunc: func(old, cur interface{}) { dc.syncService(cur) },
+		DeleteFunc: func(obj interface{}) { dc.syncService(nil) },
+	})
+	go svcController.Run(stopCh)
+
+	epLW := kcache.NewListWatchFromClient(dc.node.kClient, "endpoints", dc.namespace, selector)
+	_, epController := framework.NewInformer(epLW, &kapi.Endpoints{}, dnsResyncPeriod, framework.ResourceEventHandlerFuncs{
+		AddFunc:    dc.syncEndpoints,
+		UpdateFunc: func(old, cur interface{}) { dc.syncEndpoints(cur) },
+		DeleteFunc: func(obj interface{}) { dc.syncEndpoints(nil) },
+	})
+	go epController.Run(stopCh)
+}
+
+func (dc *dnsController) syncService(obj interface{}) {
+	var vip string
+	if svc, ok := obj.(*kapi.Service); ok && kapi.IsServiceIPSet(svc) {
+		vip = svc.Spec.ClusterIP
+	}
+
+	dc.lock.Lock()
+	oldVIP := dc.vip
+	dc.vip = vip
+	dc.lock.Unlock()
+
+	if oldVIP == vip {
+		return
+	}
+	if oldVIP != "" {
+		if err := dc.node.DeleteDNSServiceRules(oldVIP); err != nil {
+			glog.Errorf("Error removing DNS service rules for old VIP %s: %v", oldVIP, err)
+		}
+	}
+	if vip != "" {
+		if err := dc.node.AddDNSServiceRules(vip, dc.namespace); err != nil {
+			glog.Errorf("Error adding DNS service rules for VIP %s: %v", vip, err)
+		}
+	}
+}
+
+func (dc *dnsController) syncEndpoints(obj interface{}) {
+	current := sets.NewString()
+	if ep, ok := obj.(*kapi.Endpoints); ok {
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				current.Insert(addr.IP)
+			}
+		}
+	}
+
+	dc.lock.Lock()
+	previous := dc.endpointIPs
+	dc.endpointIPs = current
+	dc.lock.Unlock()
+
+	for _, ip := range previous.Difference(current).List() {
+		if err := dc.node.DeleteDNSEndpointRules(ip); err != nil {
+			glog.Errorf("Error removing DNS endpoint rules for %s: %v", ip, err)
+		}
+	}
+	for _, ip := range current.Difference(previous).List() {
+		if err := dc.node.AddDNSEndpointRules(ip, dc.namespace); err != nil {
+			glog.Errorf("Error adding DNS endpoint rules for %s: %v", ip, err)
+		}
+	}
+}
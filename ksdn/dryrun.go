@@ -0,0 +1,117 @@
+package ksdn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"k8s-ovs/adminapi"
+	"k8s-ovs/pkg/ovs"
+)
+
+// formatDryRunMutations renders mutations grouped by namespace, then in the
+// order they were recorded within each namespace, for the startup dry-run
+// summary logged at the end of Start.
+func formatDryRunMutations(mutations []ovs.DryRunMutation) string {
+	byNamespace := make(map[string][]ovs.DryRunMutation)
+	for _, m := range mutations {
+		byNamespace[m.Namespace] = append(byNamespace[m.Namespace], m)
+	}
+
+	namespaces := make([]string, 0, len(byNamespace))
+	for ns := range byNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	var b strings.Builder
+	for _, ns := range namespaces {
+		label := ns
+		if label == "" {
+			label = "(cluster-wide)"
+		}
+		fmt.Fprintf(&b, "namespace %s:\n", label)
+		for _, m := range byNamespace[ns] {
+			fmt.Fprintf(&b, "  [%s] %s\n", m.Feature, m.Description)
+		}
+	}
+	return b.String()
+}
+
+// SimulateVNIDChange dry-runs the OVS side effects of namespace moving to
+// netID -- the same per-pod and per-service flow updates the real VNID
+// change event path (updatePodNetwork) would make -- without touching the
+// real bridge or deleting any pods, and returns every flow mutation that
+// would have been made.
+//
+// It swaps node.ovs and node.vnids' record of namespace's VNID for a
+// DryRunFlowBackend and the simulated netID for the call's duration, calling
+// only the same read and flow-mutating helpers updatePodNetwork does; unlike
+// updatePodNetwork it never deletes pods, since there's nothing to reconcile
+// them against in a simulation. simulateLock keeps concurrent simulate calls
+// from stepping on each other's swapped-in state.
+func (node *KsdnNode) SimulateVNIDChange(namespace string, netID uint32) ([]ovs.DryRunMutation, error) {
+	node.simulateLock.Lock()
+	defer node.simulateLock.Unlock()
+
+	realBackend := node.ovs
+	dryRunBackend := ovs.NewDryRunFlowBackend()
+	node.ovs = dryRunBackend
+	defer func() { node.ovs = realBackend }()
+
+	realNetID, err := node.vnids.GetVNID(namespace)
+	hadNetID := err == nil
+	node.vnids.setVNID(namespace, netID)
+	defer func() {
+		if hadNetID {
+			node.vnids.setVNID(namespace, realNetID)
+		} else {
+			node.vnids.unsetVNID(namespace)
+		}
+	}()
+
+	runPods, _, err := node.GetLocalPods(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not get list of local pods in namespace %q: %v", namespace, err)
+	}
+	for _, pod := range runPods {
+		if err := node.UpdatePod(pod); err != nil {
+			return nil, fmt.Errorf("could not update pod %q in namespace %q: %v", pod.Name, namespace, err)
+		}
+	}
+
+	services, err := node.kClient.Services(namespace).List(kapi.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get list of services in namespace %q: %v", namespace, err)
+	}
+	for _, svc := range services.Items {
+		if !kapi.IsServiceIPSet(&svc) {
+			continue
+		}
+		if err := node.DeleteServiceRules(&svc); err != nil {
+			return nil, fmt.Errorf("error deleting OVS flows for service %v: %v", svc, err)
+		}
+		if err := node.AddServiceRules(&svc, netID); err != nil {
+			return nil, fmt.Errorf("error adding OVS flows for service %v, netid %d: %v", svc, netID, err)
+		}
+	}
+
+	return dryRunBackend.Mutations, nil
+}
+
+// adminSimulateVNIDChange implements the admin API's simulate-VNID-change
+// call.
+func (node *KsdnNode) adminSimulateVNIDChange(namespace string, netID uint32) (*adminapi.DryRunResult, error) {
+	mutations, err := node.SimulateVNIDChange(namespace, netID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &adminapi.DryRunResult{Mutations: make([]adminapi.DryRunMutation, len(mutations))}
+	for i, m := range mutations {
+		result.Mutations[i] = adminapi.DryRunMutation{Namespace: m.Namespace, Feature: m.Feature, Description: m.Description}
+	}
+	return result, nil
+}
@@ -0,0 +1,168 @@
+package ksdn
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// egressDSCPAnnotation is a NetNamespace annotation requesting that this
+// namespace's traffic be marked with the given IP DSCP value as it leaves
+// the node toward the tunnel or the external gateway path; see Table 5's
+// marking flows in controller.go and syncEgressDSCP, which installs them.
+const egressDSCPAnnotation = "k8s-ovs/egress-dscp"
+
+// egressDSCPInvalidReason and egressDSCPConflictReason are the Event
+// reasons recorded when a namespace's annotation can't be applied: the
+// value itself is invalid, or it disagrees with another namespace sharing
+// the same (joined) VNID.
+const egressDSCPInvalidReason = "InvalidEgressDSCP"
+const egressDSCPConflictReason = "EgressDSCPConflict"
+
+// maxDSCP is the largest value the IP header's 6-bit DSCP field can hold.
+const maxDSCP = 63
+
+// egressDSCPState tracks, per VNID, which DSCP value (if any) this node
+// currently has Table 5 marking flows installed for, so syncEgressDSCP only
+// touches OVS when the effective value actually changes.
+type egressDSCPState struct {
+	lock   sync.Mutex
+	marked map[uint32]int
+}
+
+func newEgressDSCPState() *egressDSCPState {
+	return &egressDSCPState{marked: make(map[uint32]int)}
+}
+
+// parseEgressDSCP parses annotations' egress-dscp value, if present. ok is
+// false if the annotation is absent; err is non-nil if it's present but not
+// a valid DSCP class.
+func parseEgressDSCP(annotations map[string]string) (dscp int, ok bool, err error) {
+	raw, present := annotations[egressDSCPAnnotation]
+	if !present {
+		return 0, false, nil
+	}
+	dscp, err = strconv.Atoi(raw)
+	if err != nil {
+		return 0, true, fmt.Errorf("%s annotation must be an integer between 0 and %d, got %q", egressDSCPAnnotation, maxDSCP, raw)
+	}
+	if dscp < 0 || dscp > maxDSCP {
+		return 0, true, fmt.Errorf("%s annotation must be between 0 and %d, got %d", egressDSCPAnnotation, maxDSCP, dscp)
+	}
+	return dscp, true, nil
+}
+
+// syncEgressDSCP reconciles netID's Table 5 marking flows against every
+// namespace node.vnids currently has mapped to it. Table 5 dispatches
+// purely on VNID, so it can't distinguish between namespaces that share a
+// joined VNID -- marking is only ever applied if every one of them requests
+// the exact same DSCP value. Any disagreement, or nobody requesting
+// marking, is treated the same: any previously installed flows are removed,
+// and a disagreement is additionally recorded via Event against every
+// namespace that did request one, so an operator can see why their
+// annotation isn't taking effect. Called from nodeHandleNetnsEvent, so a
+// namespace add, update or removal always re-derives netID's marking from
+// scratch instead of trying to patch it incrementally.
+func (node *KsdnNode) syncEgressDSCP(netID uint32) {
+	namespaces := node.vnids.GetNamespaces(netID)
+
+	var wantDSCP int
+	requested, agreed := false, true
+	var requesters []string
+	for _, name := range namespaces {
+		netns, err := node.eClient.GetNetNamespace(node.ctx, node.networkInfo.name, name)
+		if err != nil {
+			glog.Warningf("Could not read NetNamespace %q while syncing egress DSCP marking: %v", name, err)
+			continue
+		}
+		dscp, ok, err := parseEgressDSCP(netns.Annotations)
+		if err != nil {
+			node.recordEgressDSCPEvent(name, egressDSCPInvalidReason, err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+		requesters = append(requesters, name)
+		if !requested {
+			wantDSCP, requested = dscp, true
+		} else if dscp != wantDSCP {
+			agreed = false
+		}
+	}
+
+	node.egressDSCP.lock.Lock()
+	current, alreadyMarked := node.egressDSCP.marked[netID]
+	node.egressDSCP.lock.Unlock()
+
+	if !requested || !agreed {
+		if !agreed {
+			message := fmt.Sprintf("namespaces sharing netid %d request conflicting %s values; marking disabled for all of them until they agree", netID, egressDSCPAnnotation)
+			for _, name := range requesters {
+				node.recordEgressDSCPEvent(name, egressDSCPConflictReason, message)
+			}
+		}
+		if alreadyMarked {
+			if err := node.DeleteEgressDSCPRules(netID); err != nil {
+				glog.Errorf("Failed to remove egress DSCP marking for netid %d: %v", netID, err)
+				return
+			}
+			node.egressDSCP.lock.Lock()
+			delete(node.egressDSCP.marked, netID)
+			node.egressDSCP.lock.Unlock()
+		}
+		return
+	}
+
+	if alreadyMarked && current == wantDSCP {
+		return
+	}
+	if alreadyMarked {
+		if err := node.DeleteEgressDSCPRules(netID); err != nil {
+			glog.Errorf("Failed to remove stale egress DSCP marking for netid %d: %v", netID, err)
+			return
+		}
+	}
+	if err := node.AddEgressDSCPRules(netID, wantDSCP); err != nil {
+		glog.Errorf("Failed to install egress DSCP marking for netid %d: %v", netID, err)
+		return
+	}
+	node.egressDSCP.lock.Lock()
+	node.egressDSCP.marked[netID] = wantDSCP
+	node.egressDSCP.lock.Unlock()
+}
+
+// recordEgressDSCPEvent records a Warning Event against namespace so an
+// operator can see why its egress-dscp annotation isn't in effect. Best
+// effort, same as recordVNIDConflictEvent: logged on failure, never fails
+// the caller.
+func (node *KsdnNode) recordEgressDSCPEvent(namespace, reason, message string) {
+	now := unversioned.NewTime(time.Now())
+	event := &kapi.Event{
+		ObjectMeta: kapi.ObjectMeta{
+			GenerateName: "k8s-ovs-egress-dscp.",
+			Namespace:    namespace,
+		},
+		InvolvedObject: kapi.ObjectReference{
+			Kind:      "Namespace",
+			Name:      namespace,
+			Namespace: namespace,
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         kapi.EventSource{Component: "k8s-ovs"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           kapi.EventTypeWarning,
+	}
+	if _, err := node.kClient.Events(namespace).Create(event); err != nil {
+		glog.Warningf("Could not record egress DSCP event for namespace %q: %v", namespace, err)
+	}
+}
@@ -0,0 +1,267 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kexec "k8s.io/kubernetes/pkg/util/exec"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// The egress-router annotations configure the classic egress-router
+// pattern: a pod that presents a dedicated external source IP and forwards
+// a fixed set of ports to an external host, instead of going through the
+// cluster's normal (masqueraded) egress path. sourceIP and gateway are
+// required together; destinations lists what gets forwarded where. A pod
+// missing sourceIP is an ordinary pod -- the other two annotations are
+// ignored on it.
+const (
+	egressRouterSourceIPAnnotation     = "k8s-ovs/egress-router-source-ip"
+	egressRouterGatewayAnnotation      = "k8s-ovs/egress-router-gateway"
+	egressRouterDestinationsAnnotation = "k8s-ovs/egress-router-destinations"
+)
+
+// egressRouterInterfaceName is the macvlan device this plugin creates
+// inside an egress router pod's netns; the pod's ordinary cluster-network
+// leg (podInterfaceName) is untouched, so the namespace's tenants keep
+// reaching it exactly as they would any other pod.
+const egressRouterInterfaceName = "egress0"
+
+// egressRouterDestination is one forwarded port out of an egress router
+// pod's egressRouterDestinationsAnnotation.
+type egressRouterDestination struct {
+	Protocol   string // "tcp" or "udp"
+	ListenPort int
+	DestIP     net.IP
+	DestPort   int
+}
+
+// egressRouterConfig is a pod's fully parsed and validated egress-router
+// annotations.
+type egressRouterConfig struct {
+	SourceNet    *net.IPNet // the address and prefix length assigned to egressRouterInterfaceName
+	Gateway      net.IP
+	Destinations []egressRouterDestination
+}
+
+// parseEgressRouterDestinations parses egressRouterDestinationsAnnotation's
+// value: one destination per line or comma-separated entry, each
+// "<listenPort>[/tcp|udp] <destIP> [destPort]". destPort defaults to
+// listenPort when omitted, matching the common case of forwarding a port to
+// the same port on the destination.
+func parseEgressRouterDestinations(value string) ([]egressRouterDestination, error) {
+	var destinations []egressRouterDestination
+	for _, line := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("invalid destination %q: expected \"<port> <ip> [destport]\"", line)
+		}
+
+		portSpec := strings.SplitN(fields[0], "/", 2)
+		listenPort, err := strconv.Atoi(portSpec[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %q: invalid port %q: %v", line, portSpec[0], err)
+		}
+		protocol := "tcp"
+		if len(portSpec) == 2 {
+			protocol = strings.ToLower(portSpec[1])
+			if protocol != "tcp" && protocol != "udp" {
+				return nil, fmt.Errorf("invalid destination %q: unknown protocol %q", line, portSpec[1])
+			}
+		}
+
+		destIP := net.ParseIP(fields[1])
+		if destIP == nil {
+			return nil, fmt.Errorf("invalid destination %q: invalid destination IP %q", line, fields[1])
+		}
+
+		destPort := listenPort
+		if len(fields) == 3 {
+			destPort, err = strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid destination %q: invalid destination port %q: %v", line, fields[2], err)
+			}
+		}
+
+		destinations = append(destinations, egressRouterDestination{
+			Protocol:   protocol,
+			ListenPort: listenPort,
+			DestIP:     destIP,
+			DestPort:   destPort,
+		})
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("no destinations found")
+	}
+	return destinations, nil
+}
+
+// resolveEgressRouterConfig parses and validates pod's egress-router
+// annotations against allowedSourceCIDRs. It returns ok == false, with no
+// error, for an ordinary pod that isn't requesting an egress router at all.
+func resolveEgressRouterConfig(pod *kapi.Pod, allowedSourceCIDRs []*net.IPNet) (cfg *egressRouterConfig, ok bool, err error) {
+	sourceSpec, ok := pod.Annotations[egressRouterSourceIPAnnotation]
+	if !ok || strings.TrimSpace(sourceSpec) == "" {
+		return nil, false, nil
+	}
+
+	sourceIP, sourceNet, err := net.ParseCIDR(sourceSpec)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid %s %q: %v", egressRouterSourceIPAnnotation, sourceSpec, err)
+	}
+	sourceNet.IP = sourceIP
+
+	if !egressRouterSourceIPAllowed(sourceIP, allowedSourceCIDRs) {
+		return nil, true, fmt.Errorf("source IP %s is not within the egress router allowed source CIDRs", sourceIP)
+	}
+
+	gatewaySpec, ok := pod.Annotations[egressRouterGatewayAnnotation]
+	if !ok || strings.TrimSpace(gatewaySpec) == "" {
+		return nil, true, fmt.Errorf("%s is set but %s is missing", egressRouterSourceIPAnnotation, egressRouterGatewayAnnotation)
+	}
+	gateway := net.ParseIP(gatewaySpec)
+	if gateway == nil {
+		return nil, true, fmt.Errorf("invalid %s %q", egressRouterGatewayAnnotation, gatewaySpec)
+	}
+
+	destSpec, ok := pod.Annotations[egressRouterDestinationsAnnotation]
+	if !ok || strings.TrimSpace(destSpec) == "" {
+		return nil, true, fmt.Errorf("%s is set but %s is missing", egressRouterSourceIPAnnotation, egressRouterDestinationsAnnotation)
+	}
+	destinations, err := parseEgressRouterDestinations(destSpec)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid %s: %v", egressRouterDestinationsAnnotation, err)
+	}
+
+	return &egressRouterConfig{SourceNet: sourceNet, Gateway: gateway, Destinations: destinations}, true, nil
+}
+
+// egressRouterSourceIPAllowed reports whether ip falls within one of
+// allowed's CIDRs. An empty allowlist allows nothing, so the feature is
+// opt-in per node via WithEgressRouterAllowedCIDRs even once a pod requests it.
+func egressRouterSourceIPAllowed(ip net.IP, allowed []*net.IPNet) bool {
+	for _, cidr := range allowed {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setUpEgressRouter creates and configures pod's macvlan leg and forwarding
+// rules if it carries egress-router annotations, and no-ops otherwise.
+// Failures are logged and swallowed rather than failing pod setup: an
+// egress router misconfiguration shouldn't take down the pod's ordinary
+// cluster-network connectivity, which is already up by the time this runs.
+func (m *podManager) setUpEgressRouter(pod *kapi.Pod, netnsPath string) {
+	cfg, ok, err := resolveEgressRouterConfig(pod, m.egressRouterAllowedCIDRs)
+	if err != nil {
+		glog.Warningf("Ignoring egress router annotations on pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if m.egressRouterInterface == "" {
+		glog.Warningf("Pod %s/%s requests an egress router, but this node has no --egress-router-interface configured", pod.Namespace, pod.Name)
+		return
+	}
+
+	if err := configureEgressRouter(m.execer, netnsPath, m.egressRouterInterface, cfg); err != nil {
+		glog.Errorf("Could not configure egress router for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+	metrics.EgressRouterPodsActive.Inc()
+}
+
+// configureEgressRouter creates a macvlan device off uplink, moves it into
+// the netns at netnsPath, and brings it up there with cfg's address, route
+// and port-forwarding rules. The macvlan device, its address and its
+// iptables rules all live inside the pod's own network namespace, so
+// nothing on the node needs cleaning up when the pod is deleted -- the
+// namespace's teardown reclaims all of it, the same way pod teardown
+// already relies on veth/OVS port removal following netns deletion.
+func configureEgressRouter(execer kexec.Interface, netnsPath, uplink string, cfg *egressRouterConfig) error {
+	parent, err := netlink.LinkByName(uplink)
+	if err != nil {
+		return fmt.Errorf("egress router uplink %q: %v", uplink, err)
+	}
+
+	macvlan := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        egressRouterInterfaceName,
+			ParentIndex: parent.Attrs().Index,
+			MTU:         parent.Attrs().MTU,
+		},
+		Mode: netlink.MACVLAN_MODE_PRIVATE,
+	}
+	if err := netlink.LinkAdd(macvlan); err != nil {
+		return fmt.Errorf("create macvlan device: %v", err)
+	}
+	link, err := netlink.LinkByName(egressRouterInterfaceName)
+	if err != nil {
+		return fmt.Errorf("look up macvlan device: %v", err)
+	}
+
+	podNS, err := ns.GetNS(netnsPath)
+	if err != nil {
+		netlink.LinkDel(link)
+		return fmt.Errorf("open pod netns: %v", err)
+	}
+	defer podNS.Close()
+
+	if err := netlink.LinkSetNsFd(link, int(podNS.Fd())); err != nil {
+		netlink.LinkDel(link)
+		return fmt.Errorf("move macvlan device into pod netns: %v", err)
+	}
+
+	return ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(egressRouterInterfaceName)
+		if err != nil {
+			return fmt.Errorf("look up macvlan device in pod netns: %v", err)
+		}
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: cfg.SourceNet}); err != nil {
+			return fmt.Errorf("assign address %s: %v", cfg.SourceNet, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("bring up macvlan device: %v", err)
+		}
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: cfg.Gateway}); err != nil {
+			return fmt.Errorf("add default route via %s: %v", cfg.Gateway, err)
+		}
+
+		return applyEgressRouterIptablesRules(execer, cfg)
+	})
+}
+
+// applyEgressRouterIptablesRules installs, in the caller's current network
+// namespace, one DNAT rule per destination redirecting traffic arriving on
+// listenPort to destIP:destPort, plus one SNAT rule making that forwarded
+// traffic leave with cfg's source address rather than whatever address
+// egressRouterInterfaceName's route would otherwise pick.
+func applyEgressRouterIptablesRules(execer kexec.Interface, cfg *egressRouterConfig) error {
+	for _, dest := range cfg.Destinations {
+		args := []string{"-t", "nat", "-A", "PREROUTING",
+			"-p", dest.Protocol, "--dport", strconv.Itoa(dest.ListenPort),
+			"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", dest.DestIP, dest.DestPort)}
+		if out, err := execer.Command("iptables", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("add DNAT rule for port %d: %v: %s", dest.ListenPort, err, out)
+		}
+	}
+
+	snatArgs := []string{"-t", "nat", "-A", "POSTROUTING",
+		"-o", egressRouterInterfaceName, "-j", "SNAT", "--to-source", cfg.SourceNet.IP.String()}
+	if out, err := execer.Command("iptables", snatArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("add SNAT rule: %v: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/ovs"
+)
+
+// flowExportSyncPeriod is how often a node re-reads the cluster's sFlow/
+// NetFlow settings and re-applies them to the bridge, matching
+// directCIDRSyncPeriod. Unlike DirectCIDRs' per-CIDR flows, SetFlowExport is
+// a single cheap OVSDB write, so it's simplest to just re-apply the whole
+// desired configuration every tick rather than diff it -- that has the
+// added benefit of repairing a record an operator deleted by hand.
+const flowExportSyncPeriod = 30 * time.Second
+
+// maxSFlowSampling and maxNetFlowActiveTimeout bound the corresponding
+// config values against obvious operator typos (e.g. a sampling rate of
+// 100000000, effectively "never sample"); OVS itself imposes no such limit.
+const maxSFlowSampling = 1000000
+const maxNetFlowActiveTimeout = 3600
+
+// ParseFlowExportConfig parses ClusterNetwork's sFlow/NetFlow settings into
+// the ovs.SFlowConfig/ovs.NetFlowConfig SetFlowExport expects, validating
+// collector addresses and the sampling rate/timeout bounds along the way.
+// Either return value is nil if its export is disabled (its Targets field
+// left empty).
+func ParseFlowExportConfig(networkConfig *etcdmanager.ClusterNetwork) (*ovs.SFlowConfig, *ovs.NetFlowConfig, error) {
+	var sflow *ovs.SFlowConfig
+	if strings.TrimSpace(networkConfig.SFlowTargets) != "" {
+		targets, err := parseFlowExportTargets(networkConfig.SFlowTargets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid SFlowTargets: %v", err)
+		}
+		if networkConfig.SFlowSampling < 1 || networkConfig.SFlowSampling > maxSFlowSampling {
+			return nil, nil, fmt.Errorf("SFlowSampling must be between 1 and %d, got %d", maxSFlowSampling, networkConfig.SFlowSampling)
+		}
+		if networkConfig.SFlowPollingInterval < 0 {
+			return nil, nil, fmt.Errorf("SFlowPollingInterval must not be negative, got %d", networkConfig.SFlowPollingInterval)
+		}
+		sflow = &ovs.SFlowConfig{
+			Targets:         targets,
+			Sampling:        networkConfig.SFlowSampling,
+			PollingInterval: networkConfig.SFlowPollingInterval,
+			AgentInterface:  strings.TrimSpace(networkConfig.SFlowAgentInterface),
+		}
+	}
+
+	var netflow *ovs.NetFlowConfig
+	if strings.TrimSpace(networkConfig.NetFlowTargets) != "" {
+		targets, err := parseFlowExportTargets(networkConfig.NetFlowTargets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid NetFlowTargets: %v", err)
+		}
+		if networkConfig.NetFlowActiveTimeout < 1 || networkConfig.NetFlowActiveTimeout > maxNetFlowActiveTimeout {
+			return nil, nil, fmt.Errorf("NetFlowActiveTimeout must be between 1 and %d, got %d", maxNetFlowActiveTimeout, networkConfig.NetFlowActiveTimeout)
+		}
+		netflow = &ovs.NetFlowConfig{
+			Targets:       targets,
+			ActiveTimeout: networkConfig.NetFlowActiveTimeout,
+		}
+	}
+
+	return sflow, netflow, nil
+}
+
+// parseFlowExportTargets parses a comma-separated list of "host:port"
+// collector addresses.
+func parseFlowExportTargets(spec string) ([]string, error) {
+	var targets []string
+	for _, token := range strings.Split(spec, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid collector address %q: %v", token, err)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid collector address %q: missing host", token)
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid collector address %q: invalid port: %v", token, err)
+		}
+		targets = append(targets, token)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no collector addresses given")
+	}
+	return targets, nil
+}
+
+// startFlowExportSync reconciles the bridge's sFlow/NetFlow export against
+// the cluster's configured settings once, then starts a goroutine that
+// repeats the reconcile every flowExportSyncPeriod so a later edit takes
+// effect on running nodes without a restart.
+func (node *KsdnNode) startFlowExportSync() {
+	node.syncFlowExport()
+	go utilwait.Until(node.syncFlowExport, flowExportSyncPeriod, node.ctx.Done())
+}
+
+func (node *KsdnNode) syncFlowExport() {
+	networkConfig, err := node.eClient.GetNetworkConfig(node.ctx, node.network)
+	if err != nil {
+		glog.Errorf("Failed to get network config for flow export sync: %v", err)
+		return
+	}
+
+	sflow, netflow, err := ParseFlowExportConfig(networkConfig)
+	if err != nil {
+		glog.Errorf("Failed to parse flow export config: %v", err)
+		return
+	}
+
+	if err := node.ovs.SetFlowExport(sflow, netflow); err != nil {
+		glog.Errorf("Failed to apply flow export config: %v", err)
+		node.recordFlowExportStatus(sflow, netflow, err)
+		return
+	}
+	node.recordFlowExportStatus(sflow, netflow, nil)
+}
@@ -0,0 +1,135 @@
+package ksdn
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s-ovs/pkg/metrics"
+	"k8s-ovs/pkg/ovs"
+
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+const (
+	flowStatsSyncPeriod = 30 * time.Second
+
+	// flowTableWarnThreshold is the per-table flow count above which we log a
+	// warning; a healthy table should never come close to this. This is meant
+	// to catch leaks like unbounded learned-flow growth, not to be a hard cap.
+	flowTableWarnThreshold = 5000
+)
+
+// flowTables lists the OpenFlow tables that make up the k8s-ovs pipeline (see
+// SetupSDN in controller.go), plus VERSION_TABLE which holds a single marker
+// flow.
+var flowTables = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 253}
+
+// startFlowStatsSync starts a goroutine that periodically collects per-table
+// flow counts via the OVS flow backend and exports them as metrics.
+func (node *KsdnNode) startFlowStatsSync() {
+	go utilwait.Until(node.syncFlowStats, flowStatsSyncPeriod, node.ctx.Done())
+}
+
+// syncFlowStats collects per-table flow counts (via dump-aggregate, which is
+// cheap) and the total flow count broken down by cookie ownership (via
+// dump-flows), and exports them as gauges.
+func (node *KsdnNode) syncFlowStats() {
+	var total uint64
+	for _, table := range flowTables {
+		count, err := node.ovs.DumpTableAggregate(table)
+		if err != nil {
+			glog.Errorf("Failed to collect flow count for table %d: %v", table, err)
+			node.recordStatusError(fmt.Sprintf("flow count for table %d: %v", table, err))
+			continue
+		}
+		metrics.FlowTableCount.WithLabelValues(strconv.Itoa(table)).Set(float64(count))
+		total += count
+		if count > flowTableWarnThreshold {
+			glog.Warningf("OpenFlow table %d has %d flows, over the warning threshold of %d", table, count, flowTableWarnThreshold)
+		}
+	}
+
+	ours, foreign, err := node.countFlowsByCookie()
+	if err != nil {
+		glog.Errorf("Failed to collect flow counts by cookie: %v", err)
+		return
+	}
+	metrics.FlowCount.WithLabelValues("ours").Set(float64(ours))
+	metrics.FlowCount.WithLabelValues("foreign").Set(float64(foreign))
+
+	dropped, err := node.countVXLANIngressDropped()
+	if err != nil {
+		glog.Errorf("Failed to collect VXLAN ingress filter drop count: %v", err)
+		return
+	}
+	metrics.VXLANIngressDropped.Set(float64(dropped))
+}
+
+// countVXLANIngressDropped returns the cumulative packet count of Table 1's
+// default (no-match) flow, i.e. how many encapsulated packets have been
+// dropped for arriving from a tunnel source outside the HostSubnet
+// allowlist. It's 0 when the VXLAN ingress filter is disabled (see
+// WithVXLANIngressFilter): that default flow then passes traffic on instead
+// of dropping it, so its packet count is not a drop count.
+func (node *KsdnNode) countVXLANIngressDropped() (uint64, error) {
+	if !node.vxlanIngressFilter {
+		return 0, nil
+	}
+	var dropped uint64
+	err := node.ovs.StreamFlows(func(flow ovs.Flow) bool {
+		if flow.Table == 1 && flow.Priority == 0 {
+			dropped = flow.NPackets
+			return false
+		}
+		return true
+	})
+	return dropped, err
+}
+
+// ourCookie is the cookie AddFlow installs flows with by default (it never
+// sets one explicitly, so this is OVS's own default). vnidCookieFlag marks
+// the other cookie value this plugin assigns on purpose, set on table 4's
+// per-tenant service rules so a caller can cheaply scope a dump-flows read
+// to a single VNID's flows via cookie= instead of parsing every flow's
+// match string; see vnidFlowCookie and traffic_accounting.go.
+const (
+	ourCookie      = 0
+	vnidCookieFlag = uint64(1) << 63
+)
+
+// vnidFlowCookie returns the cookie tag applied to a table 4 service rule
+// scoped to netID; see AddServiceRules. netID fits comfortably in the low 32
+// bits, well clear of vnidCookieFlag.
+func vnidFlowCookie(netID uint32) uint64 {
+	return vnidCookieFlag | uint64(netID)
+}
+
+// isVNIDCookie reports whether cookie was assigned by vnidFlowCookie.
+func isVNIDCookie(cookie uint64) bool {
+	return cookie&vnidCookieFlag != 0
+}
+
+// vnidFromCookie extracts the netID a vnidFlowCookie cookie was tagged with.
+// It's only meaningful when isVNIDCookie(cookie) is true.
+func vnidFromCookie(cookie uint64) uint32 {
+	return uint32(cookie &^ vnidCookieFlag)
+}
+
+// countFlowsByCookie streams the full flow table and splits the count
+// between flows carrying one of our own cookies (the default, or a
+// vnidFlowCookie tag) and everything else, which is either left over from a
+// previous plugin version or installed by hand.
+func (node *KsdnNode) countFlowsByCookie() (ours, foreign uint64, err error) {
+	err = node.ovs.StreamFlows(func(flow ovs.Flow) bool {
+		if flow.Cookie == ourCookie || isVNIDCookie(flow.Cookie) {
+			ours++
+		} else {
+			foreign++
+		}
+		return true
+	})
+	return ours, foreign, err
+}
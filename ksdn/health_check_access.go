@@ -0,0 +1,320 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// healthCheckAccessResyncPeriod is how often the Endpoints informer
+// re-lists, matching hostAccessResyncPeriod.
+const healthCheckAccessResyncPeriod = 30 * time.Minute
+
+// healthCheckSourceRangeSyncPeriod is how often a node re-reads the
+// cluster's HealthCheckSourceRanges setting, matching directCIDRSyncPeriod.
+const healthCheckSourceRangeSyncPeriod = 30 * time.Second
+
+// ParseHealthCheckSourceRanges parses ClusterNetwork.HealthCheckSourceRanges
+// -- a comma-separated list of external CIDRs (e.g. a cloud load balancer's
+// well-known health-check ranges) that should be admitted to NodePort/
+// LoadBalancer service endpoints regardless of tenant isolation -- rejecting
+// anything that overlaps the cluster or service network, the same
+// restriction ParseDirectCIDRs applies, since a health-check source range
+// has no business claiming an address a pod or service could already have.
+func ParseHealthCheckSourceRanges(spec string, clusterNet, serviceNet *net.IPNet) ([]*net.IPNet, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var cidrs []*net.IPNet
+	for _, token := range strings.Split(spec, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health-check source CIDR %q: %v", token, err)
+		}
+		if cidrsOverlap(cidr, clusterNet) {
+			return nil, fmt.Errorf("health-check source CIDR %s overlaps the cluster network %s", cidr, clusterNet)
+		}
+		if cidrsOverlap(cidr, serviceNet) {
+			return nil, fmt.Errorf("health-check source CIDR %s overlaps the service network %s", cidr, serviceNet)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// healthCheckAccessEndpoint is one NodePort/LoadBalancer service endpoint's
+// installed health-check exemption state: the VNID its flows are tagged
+// with, the ports the exemption is scoped to, and which of the currently-
+// configured source CIDRs it has flows for.
+type healthCheckAccessEndpoint struct {
+	netID     uint32
+	namespace string
+	ports     []kapi.EndpointPort
+	cidrs     map[string]bool
+}
+
+// portsEqual reports whether a and b name the same set of ports, ignoring
+// order -- used to detect a service's declared ports changing under an
+// endpoint IP that's otherwise unchanged.
+func portsEqual(a, b []kapi.EndpointPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	want := make(map[kapi.EndpointPort]int, len(a))
+	for _, p := range a {
+		want[p]++
+	}
+	for _, p := range b {
+		want[p]--
+	}
+	for _, n := range want {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// healthCheckAccessController keeps the Table 0 exemption flows (see
+// AddHealthCheckAccessRules/DeleteHealthCheckAccessRules in controller.go)
+// in sync with two independently-changing inputs: which pods currently back
+// a NodePort or LoadBalancer service (tracked the same way
+// hostAccessController tracks Endpoints), and the cluster's configured
+// HealthCheckSourceRanges (tracked the same way syncDirectCIDRs tracks
+// DirectCIDRs). A health check from one of those ranges reaches a backend
+// pod's own IP the same way a real client's traffic would -- kube-proxy's
+// NodePort/LoadBalancer DNAT already ran by the time it reaches tun0 -- so
+// it's exempted the same way host_access.go exempts the node's own address,
+// except gated on source CIDR instead of source address, and only for
+// externally-reachable service types. ClusterIP-only services are left
+// alone: nothing outside the cluster can address them in the first place.
+type healthCheckAccessController struct {
+	node *KsdnNode
+
+	lock sync.Mutex
+
+	// endpoints tracks, per NodePort/LoadBalancer service, the pod IPs
+	// backing it and the ports it exposes on each -- empty or absent once a
+	// service is deleted or is no longer externally reachable.
+	endpoints map[string]map[string][]kapi.EndpointPort // namespace/name -> endpoint IP -> ports
+
+	// installed tracks the exemption flows actually on the bridge, by
+	// endpoint IP, so both syncEndpoints and syncSourceRanges can reconcile
+	// against the same state without stepping on each other.
+	installed map[string]*healthCheckAccessEndpoint // endpoint IP -> installed state
+
+	sourceCIDRs []*net.IPNet
+}
+
+func newHealthCheckAccessController(node *KsdnNode) *healthCheckAccessController {
+	return &healthCheckAccessController{
+		node:      node,
+		endpoints: make(map[string]map[string][]kapi.EndpointPort),
+		installed: make(map[string]*healthCheckAccessEndpoint),
+	}
+}
+
+// Run starts hc's Endpoints informer and its HealthCheckSourceRanges sync
+// loop. It does not block.
+func (hc *healthCheckAccessController) Run(stopCh <-chan struct{}) {
+	lw := kcache.NewListWatchFromClient(hc.node.kClient, "endpoints", kapi.NamespaceAll, fields.Everything())
+	_, controller := framework.NewInformer(lw, &kapi.Endpoints{}, healthCheckAccessResyncPeriod, framework.ResourceEventHandlerFuncs{
+		AddFunc:    hc.syncEndpoints,
+		UpdateFunc: func(old, cur interface{}) { hc.syncEndpoints(cur) },
+		DeleteFunc: hc.syncEndpoints,
+	})
+	go controller.Run(stopCh)
+
+	hc.syncSourceRanges()
+	go utilwait.Until(hc.syncSourceRanges, healthCheckSourceRangeSyncPeriod, stopCh)
+}
+
+// isExternallyReachable reports whether svc is a type kube-proxy programs
+// DNAT for on every node, not just ones running its pods -- the same test
+// serviceController.shouldInstall uses to decide whether a service's rules
+// belong on this node regardless of local pods.
+func isExternallyReachable(svc *kapi.Service) bool {
+	return svc.Spec.Type == kapi.ServiceTypeNodePort || svc.Spec.Type == kapi.ServiceTypeLoadBalancer
+}
+
+func (hc *healthCheckAccessController) syncEndpoints(obj interface{}) {
+	ep, ok := obj.(*kapi.Endpoints)
+	if !ok {
+		return
+	}
+	key := ep.Namespace + "/" + ep.Name
+
+	current := make(map[string][]kapi.EndpointPort)
+	svc, err := hc.node.kClient.Services(ep.Namespace).Get(ep.Name)
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			glog.Warningf("Could not look up service %s for health-check access sync: %v", key, err)
+		}
+	} else if isExternallyReachable(svc) {
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				current[addr.IP] = append(current[addr.IP], subset.Ports...)
+			}
+		}
+	}
+
+	hc.lock.Lock()
+	previous := hc.endpoints[key]
+	if len(current) == 0 {
+		delete(hc.endpoints, key)
+	} else {
+		hc.endpoints[key] = current
+	}
+	hc.lock.Unlock()
+
+	var toRemove, toAdd []string
+	for ip := range previous {
+		if _, ok := current[ip]; !ok {
+			toRemove = append(toRemove, ip)
+		}
+	}
+	for ip, ports := range current {
+		oldPorts, existed := previous[ip]
+		if !existed {
+			toAdd = append(toAdd, ip)
+		} else if !portsEqual(oldPorts, ports) {
+			// Same endpoint, different declared ports -- reinstall so the
+			// exemption tracks the new port set instead of the stale one.
+			toRemove = append(toRemove, ip)
+			toAdd = append(toAdd, ip)
+		}
+	}
+
+	for _, ip := range toRemove {
+		hc.removeEndpoint(ip)
+	}
+	if len(toAdd) == 0 {
+		return
+	}
+	netID, err := hc.node.vnids.WaitAndGetVNID(ep.Namespace)
+	if err != nil {
+		glog.Warningf("Could not resolve VNID for namespace %q, skipping health-check access flows for %s: %v", ep.Namespace, key, err)
+		return
+	}
+	for _, ip := range toAdd {
+		hc.addEndpoint(ip, current[ip], netID, ep.Namespace)
+	}
+}
+
+// addEndpoint installs a flow for each of ip's ports against every
+// currently-configured source CIDR.
+func (hc *healthCheckAccessController) addEndpoint(ip string, ports []kapi.EndpointPort, netID uint32, namespace string) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	e := &healthCheckAccessEndpoint{netID: netID, namespace: namespace, ports: ports, cidrs: make(map[string]bool)}
+	hc.installed[ip] = e
+	for _, cidr := range hc.sourceCIDRs {
+		if !hc.addEndpointCIDR(ip, e, cidr.String()) {
+			continue
+		}
+	}
+}
+
+// addEndpointCIDR installs the flow for every one of e's ports against
+// cidr, and marks cidr installed for e only if all of them succeed.
+func (hc *healthCheckAccessController) addEndpointCIDR(ip string, e *healthCheckAccessEndpoint, cidr string) bool {
+	ok := true
+	for _, port := range e.ports {
+		if err := hc.node.AddHealthCheckAccessRules(cidr, ip, port.Protocol, int(port.Port), e.netID, e.namespace); err != nil {
+			glog.Errorf("Error adding health-check access flow for endpoint %s:%d, source range %s: %v", ip, port.Port, cidr, err)
+			ok = false
+		}
+	}
+	if ok {
+		e.cidrs[cidr] = true
+	}
+	return ok
+}
+
+// removeEndpoint removes every flow installed for ip.
+func (hc *healthCheckAccessController) removeEndpoint(ip string) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	e, ok := hc.installed[ip]
+	if !ok {
+		return
+	}
+	for cidr := range e.cidrs {
+		for _, port := range e.ports {
+			if err := hc.node.DeleteHealthCheckAccessRules(cidr, ip, port.Protocol, int(port.Port)); err != nil {
+				glog.Errorf("Error removing health-check access flow for endpoint %s:%d, source range %s: %v", ip, port.Port, cidr, err)
+			}
+		}
+	}
+	delete(hc.installed, ip)
+}
+
+// syncSourceRanges reconciles every tracked endpoint's flows against the
+// cluster's current HealthCheckSourceRanges setting, so a later edit takes
+// effect on running nodes without a restart.
+func (hc *healthCheckAccessController) syncSourceRanges() {
+	networkConfig, err := hc.node.eClient.GetNetworkConfig(hc.node.ctx, hc.node.network)
+	if err != nil {
+		glog.Errorf("Failed to get network config for health-check source range sync: %v", err)
+		return
+	}
+
+	cidrs, err := ParseHealthCheckSourceRanges(networkConfig.HealthCheckSourceRanges, hc.node.networkInfo.ClusterNetwork, hc.node.networkInfo.ServiceNetwork)
+	if err != nil {
+		glog.Errorf("Failed to parse HealthCheckSourceRanges %q: %v", networkConfig.HealthCheckSourceRanges, err)
+		return
+	}
+
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr.String()] = true
+	}
+
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	hc.sourceCIDRs = cidrs
+	for ip, e := range hc.installed {
+		for cidr := range wanted {
+			if e.cidrs[cidr] {
+				continue
+			}
+			hc.addEndpointCIDR(ip, e, cidr)
+		}
+		for cidr := range e.cidrs {
+			if wanted[cidr] {
+				continue
+			}
+			ok := true
+			for _, port := range e.ports {
+				if err := hc.node.DeleteHealthCheckAccessRules(cidr, ip, port.Protocol, int(port.Port)); err != nil {
+					glog.Errorf("Error removing health-check access flow for endpoint %s:%d, source range %s: %v", ip, port.Port, cidr, err)
+					ok = false
+				}
+			}
+			if ok {
+				delete(e.cidrs, cidr)
+			}
+		}
+	}
+}
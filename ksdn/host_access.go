@@ -0,0 +1,96 @@
+package ksdn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/util/sets"
+)
+
+// hostAccessResyncPeriod is how often the Endpoints informer re-lists,
+// matching dnsResyncPeriod/serviceResyncPeriod.
+const hostAccessResyncPeriod = 30 * time.Minute
+
+// hostAccessController keeps the Table 0 exemption flows (see
+// AddHostAccessRules/DeleteHostAccessRules in controller.go) in sync with
+// every service's Endpoints, so traffic the node's own network stack sends
+// to a ClusterIP -- which never passes through a container OVS port and so
+// never picks up a tenant VNID -- gets tagged with that service's own
+// namespace's VNID, looked up through node.vnids, and reaches it the same
+// way a pod in that namespace could. It's only started in multitenant mode,
+// and only when WithHostNetworkAccess hasn't disabled it.
+type hostAccessController struct {
+	node *KsdnNode
+
+	lock     sync.Mutex
+	services map[string]sets.String // namespace/name -> endpoint IPs
+}
+
+func newHostAccessController(node *KsdnNode) *hostAccessController {
+	return &hostAccessController{
+		node:     node,
+		services: make(map[string]sets.String),
+	}
+}
+
+// Run starts hc's Endpoints informer. It does not block.
+func (hc *hostAccessController) Run(stopCh <-chan struct{}) {
+	lw := kcache.NewListWatchFromClient(hc.node.kClient, "endpoints", kapi.NamespaceAll, fields.Everything())
+	_, controller := framework.NewInformer(lw, &kapi.Endpoints{}, hostAccessResyncPeriod, framework.ResourceEventHandlerFuncs{
+		AddFunc:    hc.syncEndpoints,
+		UpdateFunc: func(old, cur interface{}) { hc.syncEndpoints(cur) },
+		DeleteFunc: hc.syncEndpoints,
+	})
+	go controller.Run(stopCh)
+}
+
+func (hc *hostAccessController) syncEndpoints(obj interface{}) {
+	ep, ok := obj.(*kapi.Endpoints)
+	if !ok {
+		return
+	}
+	key := ep.Namespace + "/" + ep.Name
+
+	current := sets.NewString()
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			current.Insert(addr.IP)
+		}
+	}
+
+	hc.lock.Lock()
+	previous := hc.services[key]
+	if current.Len() == 0 {
+		delete(hc.services, key)
+	} else {
+		hc.services[key] = current
+	}
+	hc.lock.Unlock()
+
+	for _, ip := range previous.Difference(current).List() {
+		if err := hc.node.DeleteHostAccessRules(ip); err != nil {
+			glog.Errorf("Error removing host-access rules for endpoint %s of %s: %v", ip, key, err)
+		}
+	}
+
+	added := current.Difference(previous)
+	if added.Len() == 0 {
+		return
+	}
+	netID, err := hc.node.vnids.WaitAndGetVNID(ep.Namespace)
+	if err != nil {
+		glog.Warningf("Could not resolve VNID for namespace %q, skipping host-access flows for %s: %v", ep.Namespace, key, err)
+		return
+	}
+	for _, ip := range added.List() {
+		if err := hc.node.AddHostAccessRules(ip, netID, ep.Namespace); err != nil {
+			glog.Errorf("Error adding host-access rules for endpoint %s of %s: %v", ip, key, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package ksdn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/pkg/metrics"
+	"k8s-ovs/pkg/ovs"
+)
+
+// maintenanceFreezeSyncPeriod is how often a node re-reads the cluster's
+// maintenance freeze flag: often enough that an operator-initiated freeze or
+// unfreeze takes effect promptly, without turning it into a de facto watch.
+const maintenanceFreezeSyncPeriod = 10 * time.Second
+
+// maintenanceFreezeEventReason is the Event reason recorded against a
+// namespace whose VNID transition was deferred by a maintenance freeze.
+const maintenanceFreezeEventReason = "MaintenanceFreezeDeferred"
+
+// maintenanceFreezeState tracks whether this node currently considers the
+// dataplane frozen for maintenance, and collapses namespace VNID transitions
+// that arrive while it's frozen so they can be replayed through the normal
+// reconciliation path once it lifts. See transitionPodNetwork, which checks
+// Frozen() before ever calling updatePodNetwork, and syncMaintenanceFreeze,
+// which polls the cluster-wide flag and drains pending on unfreeze.
+type maintenanceFreezeState struct {
+	lock    sync.Mutex
+	frozen  bool
+	pending map[string]podNetworkTransition // namespace -> latest deferred transition
+}
+
+func newMaintenanceFreezeState() *maintenanceFreezeState {
+	return &maintenanceFreezeState{
+		pending: make(map[string]podNetworkTransition),
+	}
+}
+
+func (s *maintenanceFreezeState) Frozen() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.frozen
+}
+
+// add records namespace's transition to be replayed once the freeze lifts,
+// replacing any earlier transition still pending for the same namespace:
+// only the most recent one is still meaningful to converge on.
+func (s *maintenanceFreezeState) add(namespace string, oldNetID, netID uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending[namespace] = podNetworkTransition{oldNetID: oldNetID, netID: netID}
+	metrics.MaintenanceFreezePendingNamespaces.Set(float64(len(s.pending)))
+}
+
+// drain removes and returns every transition deferred while frozen, for the
+// caller to replay through transitionPodNetwork now that it's safe to.
+func (s *maintenanceFreezeState) drain() map[string]podNetworkTransition {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pending := s.pending
+	s.pending = make(map[string]podNetworkTransition)
+	metrics.MaintenanceFreezePendingNamespaces.Set(0)
+	return pending
+}
+
+// startMaintenanceFreezeSync starts a goroutine that periodically checks the
+// cluster's maintenance freeze flag and applies it to this node's flow
+// backend, draining any deferred VNID transitions once it lifts.
+func (node *KsdnNode) startMaintenanceFreezeSync() {
+	node.syncMaintenanceFreeze()
+	go utilwait.Until(node.syncMaintenanceFreeze, maintenanceFreezeSyncPeriod, node.ctx.Done())
+}
+
+func (node *KsdnNode) syncMaintenanceFreeze() {
+	freeze, err := node.eClient.GetMaintenanceFreeze(node.ctx, node.networkInfo.name)
+	if err != nil {
+		glog.Errorf("Failed to get maintenance freeze state: %v", err)
+		return
+	}
+
+	frozen := freeze != nil && freeze.Frozen
+	if frozen && !freeze.ExpiresAt.IsZero() && time.Now().After(freeze.ExpiresAt) {
+		glog.Warningf("Maintenance freeze (reason: %q, set by %q) exceeded its expiry of %v; treating it as lifted locally", freeze.Reason, freeze.SetBy, freeze.ExpiresAt)
+		frozen = false
+	}
+
+	wasFrozen := node.maintenanceFreeze.Frozen()
+	if frozen == wasFrozen {
+		return
+	}
+
+	node.maintenanceFreeze.lock.Lock()
+	node.maintenanceFreeze.frozen = frozen
+	node.maintenanceFreeze.lock.Unlock()
+
+	if fb, ok := node.ovs.(*ovs.FreezeFlowBackend); ok {
+		fb.SetFrozen(frozen)
+	}
+	if frozen {
+		metrics.MaintenanceFreezeActive.Set(1)
+		glog.Warningf("Maintenance freeze active (reason: %q, set by %q); dataplane mutations refused until it lifts", freeze.Reason, freeze.SetBy)
+		return
+	}
+
+	metrics.MaintenanceFreezeActive.Set(0)
+	glog.Infof("Maintenance freeze lifted; replaying deferred VNID transitions")
+	for namespace, transition := range node.maintenanceFreeze.drain() {
+		node.transitionPodNetwork(namespace, transition.oldNetID, transition.netID)
+	}
+}
+
+// recordMaintenanceFreezeEvent records a Warning Event against namespace so
+// an operator watching `kubectl get events` sees that its VNID transition is
+// deferred rather than lost. Failures here are logged but otherwise ignored:
+// this is best-effort diagnostics.
+func (node *KsdnNode) recordMaintenanceFreezeEvent(namespace string, oldNetID, netID uint32) {
+	now := unversioned.NewTime(time.Now())
+	event := &kapi.Event{
+		ObjectMeta: kapi.ObjectMeta{
+			GenerateName: "k8s-ovs-maintenance-freeze.",
+			Namespace:    namespace,
+		},
+		InvolvedObject: kapi.ObjectReference{
+			Kind:      "Namespace",
+			Name:      namespace,
+			Namespace: namespace,
+		},
+		Reason:         maintenanceFreezeEventReason,
+		Message:        fmt.Sprintf("Deferred VNID transition (%d -> %d) until the cluster's maintenance freeze lifts", oldNetID, netID),
+		Source:         kapi.EventSource{Component: "k8s-ovs"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           kapi.EventTypeWarning,
+	}
+	if _, err := node.kClient.Events(namespace).Create(event); err != nil {
+		glog.Warningf("Could not record maintenance freeze deferral event for namespace %q: %v", namespace, err)
+	}
+}
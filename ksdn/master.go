@@ -18,14 +18,26 @@ type KsdnMaster struct {
 	networkInfo     *NetworkInfo
 	subnetAllocator *snalloc.SubnetAllocator
 	vnids           *masterVNIDMap
+
+	// unmanaged and skipVNIDForUnmanaged configure whether the master still
+	// allocates a VNID for a namespace excluded from SDN management; see
+	// unmanaged_namespaces.go and masterVNIDMap.assignVNID. unmanaged carries
+	// only the static --unmanaged-namespaces list here -- the master learns
+	// about the live k8s-ovs/unmanaged annotation straight off the Namespace
+	// object in watchNamespaces, with no need to track transitions the way
+	// the node does off the netns watch.
+	unmanaged            *unmanagedNamespaces
+	skipVNIDForUnmanaged bool
 }
 
-func StartMaster(kClient *kclient.Client, eClient etcdmanager.EtcdManager, network string, ctx context.Context) error {
+func StartMaster(kClient *kclient.Client, eClient etcdmanager.EtcdManager, network string, vnidAPIBindAddress string, unmanagedNamespaces []string, skipVNIDForUnmanaged bool, ctx context.Context) error {
 
 	master := &KsdnMaster{
-		kClient: kClient,
-		eClient: eClient,
-		ctx:     ctx,
+		kClient:              kClient,
+		eClient:              eClient,
+		ctx:                  ctx,
+		unmanaged:            newUnmanagedNamespaces(unmanagedNamespaces),
+		skipVNIDForUnmanaged: skipVNIDForUnmanaged,
 	}
 
 	networkConfig, err := master.eClient.GetNetworkConfig(ctx, network)
@@ -44,16 +56,29 @@ func StartMaster(kClient *kclient.Client, eClient etcdmanager.EtcdManager, netwo
 		return err
 	}
 
+	if err = master.ensureDataplaneCompat(ctx); err != nil {
+		return err
+	}
+	master.startDataplaneCompatSync()
+
 	if err = master.SubnetStartMaster(master.networkInfo.ClusterNetwork, networkConfig.HostSubnetLength); err != nil {
 		return err
 	}
+	master.startServiceCIDRSync()
 
 	if nettype.IsKovsCloudMultitenantNetworkPlugin(networkConfig.PluginName) {
-		master.vnids = newMasterVNIDMap()
+		master.vnids, err = newMasterVNIDMap(networkConfig.ReservedVNIDs)
+		if err != nil {
+			return err
+		}
 
 		if err = master.VnidStartMaster(); err != nil {
 			return err
 		}
+
+		if err = master.StartVNIDAPI(vnidAPIBindAddress); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,77 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/pkg/etcdmanager"
+)
+
+// masterServiceCIDRSyncPeriod is how often the master re-reads the
+// cluster's configured service network and validates any change to it
+// against the cluster network and every currently allocated HostSubnet,
+// refusing to adopt anything that overlaps either; see
+// validateServiceNetworkChange. The node side of this same problem --
+// flows still classifying a stale service range -- is handled by
+// checkServiceCIDR in controller.go.
+const masterServiceCIDRSyncPeriod = 30 * time.Second
+
+// startServiceCIDRSync starts a goroutine that periodically validates the
+// cluster's configured service network.
+func (master *KsdnMaster) startServiceCIDRSync() {
+	go utilwait.Until(master.syncServiceCIDR, masterServiceCIDRSyncPeriod, master.ctx.Done())
+}
+
+func (master *KsdnMaster) syncServiceCIDR() {
+	networkConfig, err := master.eClient.GetNetworkConfig(master.ctx, master.networkInfo.name)
+	if err != nil {
+		glog.Errorf("Failed to get network config for service network validation: %v", err)
+		return
+	}
+
+	_, configuredNet, err := net.ParseCIDR(networkConfig.ServiceNetwork)
+	if err != nil {
+		glog.Errorf("Failed to parse configured service network %q: %v", networkConfig.ServiceNetwork, err)
+		return
+	}
+	if configuredNet.String() == master.networkInfo.ServiceNetwork.String() {
+		return
+	}
+
+	subnets, err := master.eClient.GetSubnets(master.ctx, master.networkInfo.name)
+	if err != nil {
+		glog.Errorf("Failed to list host subnets for service network validation: %v", err)
+		return
+	}
+	if err := validateServiceNetworkChange(configuredNet, master.networkInfo.ClusterNetwork, subnets); err != nil {
+		glog.Errorf("Rejecting service network change to %s: %v", configuredNet, err)
+		return
+	}
+
+	glog.Infof("Adopting service network change from %s to %s", master.networkInfo.ServiceNetwork, configuredNet)
+	master.networkInfo.ServiceNetwork = configuredNet
+}
+
+// validateServiceNetworkChange reports an error if candidate overlaps
+// clusterNetwork or any already allocated HostSubnet -- either would leave
+// traffic meant for a pod or the cluster network getting classified as
+// service traffic (or vice versa) once nodes reprogram to match.
+func validateServiceNetworkChange(candidate, clusterNetwork *net.IPNet, subnets []etcdmanager.HostSubnet) error {
+	if cidrsOverlap(candidate, clusterNetwork) {
+		return fmt.Errorf("service network %s overlaps the cluster network %s", candidate, clusterNetwork)
+	}
+	for _, sub := range subnets {
+		_, subnet, err := net.ParseCIDR(sub.Subnet)
+		if err != nil {
+			continue
+		}
+		if cidrsOverlap(candidate, subnet) {
+			return fmt.Errorf("service network %s overlaps existing host subnet %s (node %s)", candidate, subnet, sub.Host)
+		}
+	}
+	return nil
+}
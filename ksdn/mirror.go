@@ -0,0 +1,215 @@
+package ksdn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s-ovs/adminapi"
+	"k8s-ovs/pkg/ovs"
+)
+
+// mirrorFlowPriorities are table 5's mirror-tap priorities, one per branch
+// of the routing dispatch a mirror needs to shadow: to the local subnet, to
+// the cluster network (a remote node's subnet), and the default/egress
+// case. Each sits just above the static flow it shadows (see controller.go)
+// so a mirror flow never changes which branch a packet actually takes --
+// it only adds an extra output to the capture port before the packet
+// carries on to the same next table the static flow would have sent it to.
+//
+// Mirroring is deliberately scoped to table 5, after both local-origin
+// (tagged in table 2) and VXLAN-origin (tagged in table 0) traffic has
+// already converged on a single reg0-tagged pipeline, and before it
+// diverges into per-destination tables 6/7/8/9 that would each need their
+// own tap. That misses three things: traffic to the node's own gateway
+// (table 5 priority 300, e.g. host-network/service replies, already
+// visible on tun0 without a mirror), traffic to a direct CIDR (table 5
+// priority 150, see direct_cidrs.go, above the default-case mirror flow)
+// and ARP.
+const (
+	mirrorFlowPriorityLocalSubnet    = 250
+	mirrorFlowPriorityClusterNetwork = 150
+	mirrorFlowPriorityDefault        = 50
+)
+
+// maxMirrorTTL bounds how long a mirror may run for; CreateMirror rejects
+// any longer request outright rather than silently clamping it, so an
+// operator asking for "a week" notices immediately instead of finding out
+// when the capture stops.
+const maxMirrorTTL = 1 * time.Hour
+
+// namespaceMirror is one namespace's active traffic mirror.
+type namespaceMirror struct {
+	namespace string
+	netID     uint32
+	expiresAt time.Time
+	timer     *time.Timer
+}
+
+// mirrorController manages the node's on-demand, per-namespace traffic
+// mirrors: OVS flows that duplicate a VNID's table 5 traffic to
+// trafficMirrorInterface for debugging, alongside whatever the flow would
+// otherwise have done. Mirrors are kept purely in memory -- unlike
+// vnidDrainQueue's transition state, there's no correctness reason for one
+// to survive a daemon restart, and its mandatory TTL already bounds how
+// long a missed one could linger.
+type mirrorController struct {
+	node *KsdnNode
+
+	lock    sync.Mutex
+	mirrors map[string]*namespaceMirror // by namespace
+}
+
+func newMirrorController(node *KsdnNode) *mirrorController {
+	return &mirrorController{
+		node:    node,
+		mirrors: make(map[string]*namespaceMirror),
+	}
+}
+
+// CreateMirror starts (or restarts, if one is already running) a mirror of
+// namespace's traffic to the node's capture interface, expiring after ttl.
+// It fails if no capture interface was configured with
+// WithTrafficMirrorInterface, if ttl is non-positive or exceeds
+// maxMirrorTTL, or if namespace has no known VNID yet.
+func (c *mirrorController) CreateMirror(namespace string, ttl time.Duration) (*namespaceMirror, error) {
+	if c.node.trafficMirrorInterface == "" {
+		return nil, fmt.Errorf("traffic mirroring is disabled (no --traffic-mirror-interface configured)")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("a mirror must have a positive TTL")
+	}
+	if ttl > maxMirrorTTL {
+		return nil, fmt.Errorf("TTL %s exceeds the maximum mirror lifetime of %s", ttl, maxMirrorTTL)
+	}
+	netID, err := c.node.vnids.GetVNID(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve namespace %q to a VNID: %v", namespace, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if existing, ok := c.mirrors[namespace]; ok {
+		c.stopLocked(existing)
+	}
+
+	if err := c.node.ovs.AddFlows(c.mirrorFlows(netID)...); err != nil {
+		return nil, fmt.Errorf("could not install mirror flows for namespace %q: %v", namespace, err)
+	}
+
+	m := &namespaceMirror{namespace: namespace, netID: netID, expiresAt: time.Now().Add(ttl)}
+	m.timer = time.AfterFunc(ttl, func() { c.expire(namespace) })
+	c.mirrors[namespace] = m
+	glog.Infof("Started traffic mirror for namespace %q (VNID %d) to %s, expiring at %s", namespace, netID, c.node.trafficMirrorInterface, m.expiresAt.Format(time.RFC3339))
+	return m, nil
+}
+
+// ListMirrors returns every currently active mirror.
+func (c *mirrorController) ListMirrors() []*namespaceMirror {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	mirrors := make([]*namespaceMirror, 0, len(c.mirrors))
+	for _, m := range c.mirrors {
+		mirrors = append(mirrors, m)
+	}
+	return mirrors
+}
+
+// DeleteMirror stops namespace's mirror early, if it has one.
+func (c *mirrorController) DeleteMirror(namespace string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	m, ok := c.mirrors[namespace]
+	if !ok {
+		return fmt.Errorf("namespace %q has no active mirror", namespace)
+	}
+	c.stopLocked(m)
+	delete(c.mirrors, namespace)
+	return nil
+}
+
+// expire is the timer callback that ends a mirror once its TTL elapses.
+func (c *mirrorController) expire(namespace string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	m, ok := c.mirrors[namespace]
+	if !ok {
+		return
+	}
+	glog.Infof("Traffic mirror for namespace %q (VNID %d) expired", namespace, m.netID)
+	if err := c.node.ovs.DelFlows(c.mirrorFlows(m.netID)...); err != nil {
+		glog.Errorf("Could not remove expired mirror flows for namespace %q: %v", namespace, err)
+	}
+	delete(c.mirrors, namespace)
+}
+
+// stopLocked cancels m's timer and removes its flows. c.lock must be held.
+func (c *mirrorController) stopLocked(m *namespaceMirror) {
+	m.timer.Stop()
+	if err := c.node.ovs.DelFlows(c.mirrorFlows(m.netID)...); err != nil {
+		glog.Errorf("Could not remove mirror flows for namespace %q: %v", m.namespace, err)
+	}
+}
+
+// mirrorFlows returns the table 5 flow mods that tap netID's traffic to the
+// node's capture port. They're never given a cookie, so
+// trafficAccountant's isVNIDCookie filter -- which only ever looks at
+// table 4's vnidFlowCookie-tagged service flows -- skips them entirely: a
+// mirror never inflates a tenant's accounted traffic.
+func (c *mirrorController) mirrorFlows(netID uint32) []ovs.FlowMod {
+	match := fmt.Sprintf("reg0=%d, ip", netID)
+	output := fmt.Sprintf("output:%d", c.node.trafficMirrorOfPort)
+	return []ovs.FlowMod{
+		{Table: 5, Priority: mirrorFlowPriorityLocalSubnet, Match: fmt.Sprintf("%s, nw_dst=%s", match, c.node.localSubnetCIDR), Actions: fmt.Sprintf("%s,goto_table:7", output)},
+		{Table: 5, Priority: mirrorFlowPriorityClusterNetwork, Match: fmt.Sprintf("%s, nw_dst=%s", match, c.node.networkInfo.ClusterNetwork.String()), Actions: fmt.Sprintf("%s,goto_table:8", output)},
+		{Table: 5, Priority: mirrorFlowPriorityDefault, Match: match, Actions: fmt.Sprintf("%s,goto_table:9", output)},
+	}
+}
+
+// adminCreateMirror implements the admin API's create-mirror call.
+func (node *KsdnNode) adminCreateMirror(namespace string, ttlSeconds int) (*adminapi.MirrorInfo, error) {
+	if node.mirrors == nil {
+		return nil, fmt.Errorf("traffic mirroring is disabled (no --traffic-mirror-interface configured)")
+	}
+	m, err := node.mirrors.CreateMirror(namespace, time.Duration(ttlSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return node.mirrorInfo(m), nil
+}
+
+// adminListMirrors implements the admin API's list-mirrors call.
+func (node *KsdnNode) adminListMirrors() ([]adminapi.MirrorInfo, error) {
+	if node.mirrors == nil {
+		return nil, nil
+	}
+	mirrors := node.mirrors.ListMirrors()
+	result := make([]adminapi.MirrorInfo, len(mirrors))
+	for i, m := range mirrors {
+		result[i] = *node.mirrorInfo(m)
+	}
+	return result, nil
+}
+
+// adminDeleteMirror implements the admin API's delete-mirror call.
+func (node *KsdnNode) adminDeleteMirror(namespace string) error {
+	if node.mirrors == nil {
+		return fmt.Errorf("traffic mirroring is disabled (no --traffic-mirror-interface configured)")
+	}
+	return node.mirrors.DeleteMirror(namespace)
+}
+
+func (node *KsdnNode) mirrorInfo(m *namespaceMirror) *adminapi.MirrorInfo {
+	return &adminapi.MirrorInfo{
+		Namespace:        m.namespace,
+		VNID:             m.netID,
+		CaptureInterface: node.trafficMirrorInterface,
+		ExpiresAt:        m.expiresAt,
+	}
+}
@@ -0,0 +1,144 @@
+package ksdn
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+
+	. "k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/ovs"
+)
+
+// AdditionalNetwork configures one secondary overlay network for
+// WithAdditionalNetworks. Name must match the network name namespaces are
+// assigned to via EtcdManager.SetNamespaceNetwork, and must be distinct from
+// both the primary network (WithNetwork) and every other AdditionalNetwork.
+type AdditionalNetwork struct {
+	// Name is the etcd network name this network's HostSubnet/NetNamespace
+	// records and watches live under, same as the primary network's
+	// WithNetwork value.
+	Name string
+	// BridgeName is the OVS bridge this network gets, distinct from the
+	// primary network's bridge so the two are never patched together.
+	BridgeName string
+}
+
+// additionalNetworkState is the runtime counterpart of an AdditionalNetwork:
+// its own bridge and VNID map, kept in sync from its own slice of etcd.
+type additionalNetworkState struct {
+	config AdditionalNetwork
+	ovs    ovs.FlowBackend
+	vnids  *nodeVNIDMap
+}
+
+// startAdditionalNetworks brings up the bridge and VNID tracking for every
+// configured AdditionalNetwork. It is a no-op, and changes nothing about the
+// primary network's behavior, when none are configured.
+//
+// This wires up VNID tracking and an isolated bridge per additional network,
+// and podManager.vnidsForNamespace consults EtcdManager.GetNamespaceNetwork
+// to resolve which one a pod's namespace belongs to -- but pod setup still
+// can't attach a pod's veth to an additional network's own bridge, since the
+// k8s-sdn-ovs script it shells out to (see pod_linux.go) takes no bridge
+// argument; that's a script-contract change, not just a Go one. Until it
+// lands, vnidsForNamespace refuses to set up a pod in an assigned additional
+// network rather than silently running it on the primary bridge under the
+// wrong VNID space. That's the remaining piece of the request this was
+// built against (see requests.jsonl synth-690); tracking it here rather
+// than claiming full pod-dataplane multi-network support this doesn't yet
+// have.
+func (node *KsdnNode) startAdditionalNetworks() error {
+	if len(node.additionalNetworks) == 0 {
+		return nil
+	}
+
+	node.additionalNetworkState = make(map[string]*additionalNetworkState, len(node.additionalNetworks))
+	for _, cfg := range node.additionalNetworks {
+		if cfg.Name == "" || cfg.BridgeName == "" {
+			return fmt.Errorf("additional network config must set both Name and BridgeName (got %+v)", cfg)
+		}
+		if cfg.Name == node.networkInfo.name {
+			return fmt.Errorf("additional network %q collides with the primary network name", cfg.Name)
+		}
+		if _, exists := node.additionalNetworkState[cfg.Name]; exists {
+			return fmt.Errorf("additional network %q configured more than once", cfg.Name)
+		}
+
+		ovsif, err := ovs.New(node.execer, cfg.BridgeName)
+		if err != nil {
+			return fmt.Errorf("create OVS interface for additional network %q: %v", cfg.Name, err)
+		}
+		if err := ovsif.AddBridge(); err != nil {
+			return fmt.Errorf("create bridge %q for additional network %q: %v", cfg.BridgeName, cfg.Name, err)
+		}
+
+		state := &additionalNetworkState{
+			config: cfg,
+			ovs:    ovs.NewFreezeFlowBackend(ovsif),
+			vnids:  newNodeVNIDMap(),
+		}
+		if err := state.vnids.populateVNIDs(node.ctx, cfg.Name, node.eClient); err != nil {
+			return fmt.Errorf("populate VNIDs for additional network %q: %v", cfg.Name, err)
+		}
+
+		node.additionalNetworkState[cfg.Name] = state
+		glog.Infof("Started additional network %q on bridge %q", cfg.Name, cfg.BridgeName)
+
+		go node.watchAdditionalNetworkVNIDs(state)
+	}
+	return nil
+}
+
+// watchAdditionalNetworkVNIDs keeps state's VNID map in sync with its
+// network's NetNamespace records, mirroring the VNID half of
+// KsdnNode.nodeHandleNetnsEvent -- the pod-transition/service-rule/conflict-
+// detection half doesn't apply here since no pods are wired to this network
+// yet (see startAdditionalNetworks).
+func (node *KsdnNode) watchAdditionalNetworkVNIDs(state *additionalNetworkState) {
+	receiver := make(chan []Event)
+	RunNetnsWatch(node.ctx, node.eClient, state.config.Name, receiver, func(batch []Event) {
+		for _, evt := range batch {
+			switch evt.Type {
+			case EventAdded:
+				state.vnids.setVNID(evt.NetNS.NetName, evt.NetNS.NetID)
+			case EventRemoved:
+				state.vnids.unsetVNID(evt.NetNS.NetName)
+			default:
+				glog.Errorf("Internal error: unknown event type %d for additional network %q", int(evt.Type), state.config.Name)
+			}
+		}
+	})
+}
+
+// vnidsForNamespace resolves which network's VNID map namespace's pods
+// should get theirs from. It returns the primary network's map when no
+// AdditionalNetworks are configured or namespace has no assignment, and an
+// error when EtcdManager.SetNamespaceNetwork has assigned it to one of m's
+// AdditionalNetworks or to an unknown network.
+//
+// Pod setup can't yet attach a pod's veth to an additional network's own
+// bridge (see startAdditionalNetworks), so a namespace assigned to one is
+// refused here rather than silently running its pods on the primary
+// network's bridge under the wrong VNID space -- that would look like
+// working tenant isolation across the two networks without the dataplane
+// actually enforcing it.
+func (m *podManager) vnidsForNamespace(namespace string) (*nodeVNIDMap, error) {
+	if len(m.additionalNetworkState) == 0 {
+		return m.vnids, nil
+	}
+
+	network, err := m.eClient.GetNamespaceNetwork(context.Background(), namespace)
+	if err != nil {
+		return nil, fmt.Errorf("look up network assignment for namespace %q: %v", namespace, err)
+	}
+	if network == "" {
+		return m.vnids, nil
+	}
+
+	state, ok := m.additionalNetworkState[network]
+	if !ok {
+		return nil, fmt.Errorf("namespace %q is assigned to unknown network %q", namespace, network)
+	}
+	return nil, fmt.Errorf("namespace %q is assigned to additional network %q, but pod setup cannot yet attach pods to an additional network's bridge (see multinetwork.go); refusing rather than running it on the primary network's bridge under the wrong VNID space", namespace, state.config.Name)
+}
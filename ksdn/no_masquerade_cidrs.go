@@ -0,0 +1,78 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// noMasqueradeSyncPeriod is how often a node re-reads the cluster's
+// NoMasqueradeCIDRs setting and reconciles its iptables exemptions against
+// it, so a later edit takes effect on running nodes without a restart.
+const noMasqueradeSyncPeriod = 30 * time.Second
+
+// ParseNoMasqueradeCIDRs parses ClusterNetwork.NoMasqueradeCIDRs -- a
+// comma-separated list of external CIDRs (e.g. a corporate network with
+// routes back to the pod CIDR) that pod egress traffic should reach with
+// its original pod source IP instead of being masqueraded -- rejecting
+// anything that overlaps the service network, since service traffic is
+// never masqueraded in the first place and listing it here would be
+// misleading.
+func ParseNoMasqueradeCIDRs(spec string, serviceNet *net.IPNet) ([]*net.IPNet, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var cidrs []*net.IPNet
+	for _, token := range strings.Split(spec, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid no-masquerade CIDR %q: %v", token, err)
+		}
+		if cidrsOverlap(cidr, serviceNet) {
+			return nil, fmt.Errorf("no-masquerade CIDR %s overlaps the service network %s", cidr, serviceNet)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// startNoMasqueradeSync reconciles the node's iptables rules against the
+// cluster's NoMasqueradeCIDRs setting once, then starts a goroutine that
+// repeats the reconcile every noMasqueradeSyncPeriod. k8s-ovs has no
+// OVS-level SNAT path today -- all pod egress source NAT happens through
+// the iptables MASQUERADE rule -- so that's the only rule set this needs to
+// keep in sync; an OVS-level SNAT path added later should honor
+// NoMasqueradeCIDRs the same way.
+func (node *KsdnNode) startNoMasqueradeSync() {
+	node.syncNoMasqueradeCIDRs()
+	go utilwait.Until(node.syncNoMasqueradeCIDRs, noMasqueradeSyncPeriod, node.ctx.Done())
+}
+
+func (node *KsdnNode) syncNoMasqueradeCIDRs() {
+	networkConfig, err := node.eClient.GetNetworkConfig(node.ctx, node.network)
+	if err != nil {
+		glog.Errorf("Failed to get network config for no-masquerade CIDR sync: %v", err)
+		return
+	}
+
+	cidrs, err := ParseNoMasqueradeCIDRs(networkConfig.NoMasqueradeCIDRs, node.networkInfo.ServiceNetwork)
+	if err != nil {
+		glog.Errorf("Failed to parse NoMasqueradeCIDRs %q: %v", networkConfig.NoMasqueradeCIDRs, err)
+		return
+	}
+
+	if node.iptables != nil {
+		node.iptables.SetNoMasqueradeCIDRs(cidrs)
+	}
+}
@@ -3,39 +3,54 @@ package ksdn
 import (
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 
+	"k8s-ovs/adminapi"
 	"k8s-ovs/cniserver"
 	"k8s-ovs/pkg/etcdmanager"
 	"k8s-ovs/pkg/nettype"
 	"k8s-ovs/pkg/ovs"
+	"k8s-ovs/pkg/privhelper"
 	netutils "k8s-ovs/pkg/utils"
 
 	kapi "k8s.io/kubernetes/pkg/api"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
-	"k8s.io/kubernetes/pkg/fields"
 	"k8s.io/kubernetes/pkg/kubelet/dockertools"
-	"k8s.io/kubernetes/pkg/labels"
 	kexec "k8s.io/kubernetes/pkg/util/exec"
+	"k8s.io/kubernetes/pkg/util/intstr"
 	kubeutilnet "k8s.io/kubernetes/pkg/util/net"
+	"k8s.io/kubernetes/pkg/util/sets"
 )
 
 const (
 	iptablesSyncPeriod = 30 * time.Second
 	mtu                = 1450
+
+	// maxAcceptableEtcdWatchLagAge is how stale the node's etcd watches may
+	// be (since their last delivered event) before readiness fails. A watch
+	// that has never delivered an event yet (age == 0) is not considered
+	// stale by this check.
+	maxAcceptableEtcdWatchLagAge = 2 * time.Minute
 )
 
 type KsdnNode struct {
 	multitenant        bool
 	kClient            *kclient.Client
 	eClient            etcdmanager.EtcdManager
-	ovs                *ovs.Interface
+	dClient            dockertools.DockerInterface
+	network            string
+	criEndpoint        string
+	ovs                ovs.FlowBackend
 	networkInfo        *NetworkInfo
 	podManager         *podManager
 	localSubnetCIDR    string
+	localSubnetGateway string
 	localIP            string
 	hostName           string
 	podNetworkReady    chan struct{}
@@ -43,141 +58,1035 @@ type KsdnNode struct {
 	iptablesSyncPeriod time.Duration
 	mtu                uint32
 	ctx                context.Context
+	cancel             context.CancelFunc
+	status             statusRecorder
+	iptables           *NodeIPTables
+	pods               *podCache
+	lazyServiceRules   bool
+	adminServer        *adminapi.Server
+	dryRun             bool
+	simulateLock       sync.Mutex
+
+	// additionalNetworks are the secondary overlay networks configured via
+	// WithAdditionalNetworks; additionalNetworkState holds the runtime state
+	// startAdditionalNetworks builds from them. See multinetwork.go.
+	additionalNetworks     []AdditionalNetwork
+	additionalNetworkState map[string]*additionalNetworkState
+
+	// alsoAcceptVNIDsNamespaces is the cluster-level allowlist of namespaces
+	// permitted to use the k8s-ovs/also-accept-vnids pod annotation; see
+	// also_accept_vnids.go.
+	alsoAcceptVNIDsNamespaces sets.String
+
+	// dnsServiceNamespace/dnsServiceName name the cluster DNS service every
+	// VNID is allowed to resolve through despite tenant isolation; see dns.go.
+	// dnsServiceName is empty by default, disabling the feature.
+	dnsServiceNamespace string
+	dnsServiceName      string
+
+	// globallyAccessibleServicesNamespaces is the cluster-level allowlist of
+	// namespaces permitted to use the k8s-ovs/accessible-from annotation; see
+	// accessible_from.go.
+	globallyAccessibleServicesNamespaces sets.String
+
+	// serviceRulesMode is the configured --service-rules value; see
+	// service_rules_mode.go. servicesLock guards it and the two fields below
+	// against a concurrent SetServiceRulesMode call.
+	serviceRulesMode string
+	servicesLock     sync.Mutex
+	servicesEnabled  bool
+	services         *serviceController
+
+	// tcpMSSClamp is the configured --tcp-mss-clamp value; see
+	// resolveMSSClamp in node_iptables.go.
+	tcpMSSClamp string
+
+	// execer runs every privileged ovs-vsctl/ovs-ofctl/iptables/ip/k8s-sdn-ovs
+	// command this node issues. It defaults to a local kexec.New(), but
+	// WithPrivilegedHelperSocket points it at a privhelper.Client instead, so
+	// those commands run out-of-process. That doesn't cover pod netns entry
+	// (pod_linux.go, pod_arp_check.go still call netlink/setns directly), so
+	// this process still needs CAP_SYS_ADMIN/CAP_NET_ADMIN even with a
+	// privileged helper configured; see the privhelper package doc comment.
+	execer kexec.Interface
+
+	// podDeleteSafetyThreshold caps how many of a namespace's pods
+	// updatePodNetwork may delete in one pass before holding back for
+	// operator acknowledgement or reconcile re-verification; see
+	// pod_delete_safety.go. nil disables the check.
+	podDeleteSafetyThreshold *intstr.IntOrString
+	podDeleteGuard           *podDeleteGuard
+
+	// podEvictionGracePeriodSeconds and podEvictionMaxAttempts configure how
+	// updatePodNetwork evicts otherPods (see pod_eviction.go): the grace
+	// period passed on each eviction request, and how many times a
+	// PodDisruptionBudget rejection is retried with backoff before the pod
+	// is left alone.
+	podEvictionGracePeriodSeconds int64
+	podEvictionMaxAttempts        int
+
+	// trafficAccountingInterval and trafficAccountingNamespaceLimit
+	// configure trafficAccountant (see traffic_accounting.go): how often it
+	// re-reads table 4's per-tenant service flows, and how many distinct
+	// VNIDs it will export a namespace-labelled series for. Zero means use
+	// the package defaults.
+	trafficAccountingInterval       time.Duration
+	trafficAccountingNamespaceLimit int
+	trafficAccountant               *trafficAccountant
+
+	// connectivityProbeEnabled, connectivityProbeInterval and
+	// connectivityProbeSampleSize configure connectivityProber (see
+	// connectivity_probe.go): whether it runs at all, how often it samples
+	// peer gateways, and how many it probes per sync. Disabled by default;
+	// interval/sampleSize of zero mean use the package defaults.
+	connectivityProbeEnabled    bool
+	connectivityProbeInterval   time.Duration
+	connectivityProbeSampleSize int
+	connectivityProber          *connectivityProber
+
+	// vnidTransitionGracePeriod configures updatePodNetwork's optional
+	// grace-period transition mode (see vnid_transition_drain.go): how long
+	// a namespace's old-VNID accept flows and service rules stay installed
+	// alongside its new VNID's after a re-tag. Zero (the default) keeps the
+	// original immediate-cleanup behavior. Set by
+	// WithVNIDTransitionGracePeriod.
+	vnidTransitionGracePeriod time.Duration
+	vnidDrain                 *vnidDrainQueue
+
+	// podNetworkRetry retries a namespace's VNID transition with backoff
+	// when updatePodNetwork fails outright; see vnids_node_retry.go. Set by
+	// VnidStartNode, since it needs a fully-constructed node to call back
+	// into.
+	podNetworkRetry *podNetworkRetryQueue
+
+	// vnidConflicts holds a NetNamespace add event for re-verification
+	// against etcd when it looks like corrupt or racing data rather than a
+	// legitimate change; see vnids_node_conflict.go. Set by VnidStartNode,
+	// same as podNetworkRetry.
+	vnidConflicts *vnidConflictDetector
+
+	// vxlanIngressFilter enables Table 1's default-drop of encapsulated
+	// traffic from tunnel endpoints outside the current HostSubnet list (see
+	// AddHostSubnetRules in controller.go). Defaults to true; disabling it is
+	// a break-glass escape hatch for migrations where peer nodes' tunnel
+	// endpoints are briefly not all reflected in the HostSubnet list.
+	vxlanIngressFilter bool
+
+	// flowVersion is the flow table version this node generates flows as,
+	// resolved once at Start from the cluster's DataplaneCompat window; see
+	// resolveFlowVersion in compat.go.
+	flowVersion int
+
+	// directCIDRs is the set of external CIDRs (net.IPNet.String() form)
+	// this node currently has table 5 direct-routing flows installed for,
+	// kept in sync with ClusterNetwork.DirectCIDRs by startDirectCIDRSync;
+	// see direct_cidrs.go. directCIDRsLock guards it against a concurrent
+	// sync tick.
+	directCIDRs     map[string]bool
+	directCIDRsLock sync.Mutex
+
+	// egressDSCP tracks which VNIDs currently have Table 5 egress-DSCP
+	// marking flows installed, and for which value; see egress_dscp.go.
+	egressDSCP *egressDSCPState
+
+	// vxlanSource is the configured --vxlan-source value: an interface
+	// name or CIDR pinning which local address the VXLAN tunnel and this
+	// node's HostSubnet record use, or empty to keep picking whichever
+	// address the route to each peer's tunnel endpoint would use. See
+	// resolveTunnelSourceIP in tunnel_source.go. tunnelSourceIP is the
+	// address it resolved to, once Start has run.
+	vxlanSource    string
+	tunnelSourceIP string
+
+	// vxlanChecksumWorkaroundMode is the configured
+	// --vxlan-checksum-workaround value; see
+	// resolveVXLANChecksumWorkaround in vxlan_checksum_workaround.go.
+	// vxlanChecksumWorkaroundApplied records whether Start actually
+	// disabled tx checksum offload on the underlay interface, for the SDN
+	// status annotation and the vxlan_checksum_workaround_applied metric.
+	vxlanChecksumWorkaroundMode    string
+	vxlanChecksumWorkaroundApplied bool
+
+	// hostNetworkAccess enables the Table 0 exemption flows that let
+	// traffic from the node's own addresses (host-network pods, kubelet,
+	// kube-proxy health checks, ...) reach ClusterIPs in isolated
+	// namespaces, tagged with that service's own VNID; see host_access.go.
+	// Defaults to true. Disable for stricter environments where host
+	// processes should be confined to the same namespaces as any other
+	// untrusted VNID.
+	hostNetworkAccess bool
+
+	// egressRouterAllowedCIDRs and egressRouterInterface configure the
+	// egress-router pod annotation (see egress_router.go): the source IPs a
+	// pod is allowed to request, and the uplink to macvlan them off of.
+	// egressRouterInterface is empty by default, disabling the feature.
+	egressRouterAllowedCIDRs []*net.IPNet
+	egressRouterInterface    string
+
+	// unmanaged tracks which namespaces are currently excluded from SDN
+	// management (service-rule programming, VNID-driven pod updates, and
+	// pod-cache-driven reconciliation); see unmanaged_namespaces.go.
+	unmanaged *unmanagedNamespaces
+
+	// preflightReport is the outcome of the startup preflight checks Start
+	// ran before doing anything else; see preflight.go. Included in the
+	// node's SDN status record.
+	preflightReport *PreflightReport
+
+	// trafficMirrorInterface names the dedicated OVS port SetupSDN creates
+	// for on-demand per-namespace traffic mirrors (see mirror.go). Empty by
+	// default, disabling the feature; mirrors is only created once this is
+	// set.
+	trafficMirrorInterface string
+	trafficMirrorOfPort    int
+	mirrors                *mirrorController
+
+	// duplicateAddressCheck enables the pre-success ARP probe/gratuitous ARP
+	// pod setup does to catch a squatting device on a to-be-assigned pod
+	// address; see pod_arp_check.go. Defaults to true.
+	duplicateAddressCheck bool
+	// duplicateAddressCheckTimeout bounds how long the ARP probe waits for
+	// a conflicting reply. Leave zero for defaultDuplicateAddressCheckTimeout.
+	duplicateAddressCheckTimeout time.Duration
+
+	// maintenanceFreeze tracks whether the cluster's dataplane is currently
+	// frozen for maintenance and, if so, which namespace VNID transitions
+	// have been deferred until it lifts; see maintenance_freeze.go.
+	maintenanceFreeze *maintenanceFreezeState
+	// allowNewPodsWhileFrozen exempts pod setup for genuinely new pods
+	// (which have no existing dataplane state to disturb) from a
+	// maintenance freeze that would otherwise refuse it; see
+	// WithMaintenanceFreezeAllowNewPods.
+	allowNewPodsWhileFrozen bool
+}
+
+// Option configures a KsdnNode built by NewNode. Options are applied in
+// order, so a later option overrides an earlier one setting the same field.
+type Option func(*KsdnNode)
+
+// WithKubeClient sets the Kubernetes API client. Required.
+func WithKubeClient(kClient *kclient.Client) Option {
+	return func(node *KsdnNode) { node.kClient = kClient }
+}
+
+// WithEtcdManager sets the backend used for subnet, netnamespace and network
+// config data. Required.
+func WithEtcdManager(eClient etcdmanager.EtcdManager) Option {
+	return func(node *KsdnNode) { node.eClient = eClient }
+}
+
+// WithDockerClient sets the Docker client used to resolve running
+// containers' network namespaces during pod setup/teardown. Required.
+func WithDockerClient(dClient dockertools.DockerInterface) Option {
+	return func(node *KsdnNode) { node.dClient = dClient }
+}
+
+// WithNetwork sets the SDN network name to read the plugin's configuration
+// from. Required.
+func WithNetwork(network string) Option {
+	return func(node *KsdnNode) { node.network = network }
 }
 
-// Called by higher layers to create the plugin SDN node instance
-func StartNode(kClient *kclient.Client, eClient etcdmanager.EtcdManager, dClient dockertools.DockerInterface, network, hostname string, ctx context.Context) {
+// WithHostname sets the node's hostname, used to look up its allocated
+// HostSubnet and to scope its local pod cache. If unset, Start resolves it
+// from os.Hostname the same way the standalone daemon does.
+func WithHostname(hostname string) Option {
+	return func(node *KsdnNode) { node.hostName = hostname }
+}
+
+// WithLazyServiceRules enables installing a namespace's service OVS rules
+// only once it has a local pod; see serviceController.
+func WithLazyServiceRules(lazy bool) Option {
+	return func(node *KsdnNode) { node.lazyServiceRules = lazy }
+}
+
+// WithCRIEndpoint overrides automatic CRI socket detection, forcing pod
+// network namespace resolution to go through the CRI runtime at endpoint
+// (e.g. "unix:///run/containerd/containerd.sock") instead of Docker. Leave
+// unset to auto-probe for a running CRI runtime, falling back to Docker.
+func WithCRIEndpoint(endpoint string) Option {
+	return func(node *KsdnNode) { node.criEndpoint = endpoint }
+}
+
+// WithAlsoAcceptVNIDsNamespaces sets the cluster-level allowlist of
+// namespaces permitted to use the k8s-ovs/also-accept-vnids pod annotation
+// (see also_accept_vnids.go); pods in any other namespace have the
+// annotation ignored. Leave unset to disable the annotation cluster-wide.
+func WithAlsoAcceptVNIDsNamespaces(namespaces []string) Option {
+	return func(node *KsdnNode) { node.alsoAcceptVNIDsNamespaces = sets.NewString(namespaces...) }
+}
 
+// WithGloballyAccessibleServicesNamespaces sets the cluster-level allowlist
+// of namespaces permitted to use the k8s-ovs/accessible-from annotation (see
+// accessible_from.go); services in any other namespace have the annotation
+// ignored. Leave unset to disable the annotation cluster-wide.
+func WithGloballyAccessibleServicesNamespaces(namespaces []string) Option {
+	return func(node *KsdnNode) { node.globallyAccessibleServicesNamespaces = sets.NewString(namespaces...) }
+}
+
+// WithDNSService names the cluster DNS service (e.g. "kube-dns" in
+// "kube-system") that every VNID is allowed to reach on UDP/TCP port 53
+// regardless of tenant isolation, instead of the previous workaround of
+// making its whole namespace global; see dns.go. Leave name empty to disable
+// the feature. Only takes effect in multitenant mode.
+func WithDNSService(namespace, name string) Option {
+	return func(node *KsdnNode) {
+		node.dnsServiceNamespace = namespace
+		node.dnsServiceName = name
+	}
+}
+
+// WithServiceRulesMode sets whether this node programs its own service OVS
+// rules: ServiceRulesEnabled always does, ServiceRulesDisabled never does
+// (skipping the Services watch entirely, but leaving the per-pod tenant
+// tagging isolation depends on untouched), and ServiceRulesAuto probes for a
+// running kube-proxy at startup and picks accordingly. Defaults to
+// ServiceRulesEnabled, matching this node's historical behavior. See
+// service_rules_mode.go and KsdnNode.SetServiceRulesMode for flipping the
+// mode again once the node is already running.
+func WithServiceRulesMode(mode string) Option {
+	return func(node *KsdnNode) { node.serviceRulesMode = mode }
+}
+
+// WithTCPMSSClamp installs an iptables TCPMSS rule that clamps the MSS of
+// TCP SYNs leaving the cluster network toward non-cluster destinations, to
+// avoid PMTUD blackholes on paths with a smaller MTU (e.g. behind a VPN).
+// setting is empty to disable (the default), "auto" to derive the clamp
+// from the node's pod MTU minus IPv4/TCP header overhead, or an explicit
+// MSS value.
+func WithTCPMSSClamp(setting string) Option {
+	return func(node *KsdnNode) { node.tcpMSSClamp = setting }
+}
+
+// WithPrivilegedHelperSocket routes every privileged OVS/iptables/ip/
+// k8s-sdn-ovs command this node issues through the k8s-ovs-privhelper
+// process listening on socket, instead of running them locally. socket is
+// empty to disable (the default), keeping the current single-process mode.
+//
+// This does not make the node process itself unprivileged: pod netns entry
+// (pod_linux.go, pod_arp_check.go) still runs in-process regardless of this
+// setting, and still needs CAP_SYS_ADMIN/CAP_NET_ADMIN. See the privhelper
+// package doc comment.
+func WithPrivilegedHelperSocket(socket string) Option {
+	return func(node *KsdnNode) {
+		if socket != "" {
+			node.execer = privhelper.NewClient(socket)
+		}
+	}
+}
+
+// WithDryRun makes Start skip verifying/creating the real OVS bridge and use
+// an ovs.DryRunFlowBackend instead, so the startup reconcile records every
+// flow it would install instead of applying it. See
+// KsdnNode.SimulateVNIDChange for dry-running a single VNID change against a
+// node that's already up and running for real.
+func WithDryRun(dryRun bool) Option {
+	return func(node *KsdnNode) { node.dryRun = dryRun }
+}
+
+// WithPodDeleteSafetyThreshold caps how many pods in a namespace
+// updatePodNetwork may delete in response to a single NetNamespace event
+// before holding back and requiring either the k8s-ovs.com/allow-mass-pod-delete
+// namespace annotation or an identical re-verification on the next reconcile;
+// see pod_delete_safety.go. threshold may be an absolute count or a
+// percentage of the namespace's local pods (e.g. intstr.FromString("25%")).
+// Leave nil to disable the check (the historical, unbounded behavior).
+func WithPodDeleteSafetyThreshold(threshold *intstr.IntOrString) Option {
+	return func(node *KsdnNode) { node.podDeleteSafetyThreshold = threshold }
+}
+
+// WithVXLANIngressFilter sets whether Table 1 drops encapsulated traffic
+// from tunnel endpoints not in the current HostSubnet list, instead of
+// accepting it unconditionally. Defaults to true (enabled); disable only as
+// a break-glass measure, e.g. during a migration where peer nodes'
+// HostSubnet records lag their real tunnel endpoints.
+func WithVXLANIngressFilter(enabled bool) Option {
+	return func(node *KsdnNode) { node.vxlanIngressFilter = enabled }
+}
+
+// WithVxlanSource pins the local address the VXLAN tunnel and this node's
+// HostSubnet record use, for multi-NIC nodes where the default (whichever
+// address the route to each peer would pick) lands on the wrong interface.
+// spec is either an interface name (e.g. "eth1") or a CIDR to match an
+// address against (e.g. "10.1.0.0/16"); see resolveTunnelSourceIP. Leave
+// empty for the historical auto-selected behavior.
+func WithVxlanSource(spec string) Option {
+	return func(node *KsdnNode) { node.vxlanSource = spec }
+}
+
+// WithVXLANChecksumWorkaround sets whether Start disables tx checksum
+// offload on the underlay interface to work around known driver/kernel
+// combinations that corrupt or drop VXLAN-encapsulated traffic; mode must
+// be one of ChecksumWorkaroundEnabled, ChecksumWorkaroundDisabled or
+// ChecksumWorkaroundAuto (the default), which probes the interface's
+// driver and the running kernel against knownBadOffloadDrivers. See
+// resolveVXLANChecksumWorkaround in vxlan_checksum_workaround.go.
+func WithVXLANChecksumWorkaround(mode string) Option {
+	return func(node *KsdnNode) { node.vxlanChecksumWorkaroundMode = mode }
+}
+
+// WithHostNetworkAccess sets whether traffic from the node's own addresses
+// is tagged with a service's VNID so it can reach that service even in an
+// isolated namespace; see host_access.go. Defaults to true; disable for
+// stricter environments where host processes shouldn't get an implicit pass
+// through tenant isolation.
+func WithHostNetworkAccess(enabled bool) Option {
+	return func(node *KsdnNode) { node.hostNetworkAccess = enabled }
+}
+
+// WithPodEvictionGracePeriod sets the grace period, in seconds, updatePodNetwork
+// gives an otherPods pod to shut down when evicting it; see pod_eviction.go.
+// Leave zero for defaultPodEvictionGracePeriodSeconds.
+func WithPodEvictionGracePeriod(gracePeriodSeconds int64) Option {
+	return func(node *KsdnNode) { node.podEvictionGracePeriodSeconds = gracePeriodSeconds }
+}
+
+// WithPodEvictionMaxAttempts caps how many times updatePodNetwork retries a
+// pod's eviction after a PodDisruptionBudget rejection before giving up on
+// it; see pod_eviction.go. Leave zero for defaultPodEvictionMaxAttempts.
+func WithPodEvictionMaxAttempts(maxAttempts int) Option {
+	return func(node *KsdnNode) { node.podEvictionMaxAttempts = maxAttempts }
+}
+
+// WithTrafficAccountingInterval sets how often trafficAccountant re-reads
+// table 4's per-tenant service flows for chargeback; see
+// traffic_accounting.go. Leave zero for defaultTrafficAccountingInterval.
+func WithTrafficAccountingInterval(interval time.Duration) Option {
+	return func(node *KsdnNode) { node.trafficAccountingInterval = interval }
+}
+
+// WithTrafficAccountingNamespaceLimit caps how many distinct VNIDs
+// trafficAccountant will export a namespace-labelled series for, so a
+// cluster with many tenants doesn't turn the traffic accounting metrics
+// into an unbounded label set; see traffic_accounting.go. Leave zero for
+// defaultTrafficAccountingNamespaceLimit.
+func WithTrafficAccountingNamespaceLimit(limit int) Option {
+	return func(node *KsdnNode) { node.trafficAccountingNamespaceLimit = limit }
+}
+
+// WithConnectivityProbe enables the cross-node overlay connectivity prober;
+// see connectivity_probe.go. Disabled by default.
+func WithConnectivityProbe(enabled bool) Option {
+	return func(node *KsdnNode) { node.connectivityProbeEnabled = enabled }
+}
+
+// WithConnectivityProbeInterval sets how often the connectivity prober
+// samples peer gateways; see connectivity_probe.go. Leave zero for
+// defaultConnectivityProbeInterval.
+func WithConnectivityProbeInterval(interval time.Duration) Option {
+	return func(node *KsdnNode) { node.connectivityProbeInterval = interval }
+}
+
+// WithConnectivityProbeSampleSize caps how many peer gateways the
+// connectivity prober probes per sync; see connectivity_probe.go. Leave
+// zero for defaultConnectivityProbeSampleSize.
+func WithConnectivityProbeSampleSize(sampleSize int) Option {
+	return func(node *KsdnNode) { node.connectivityProbeSampleSize = sampleSize }
+}
+
+// WithVNIDTransitionGracePeriod sets how long updatePodNetwork keeps a
+// namespace's old-VNID accept flows and service rules installed alongside
+// its new VNID's after a re-tag, instead of removing them immediately; see
+// vnid_transition_drain.go. Leave zero (the default) to keep the original
+// immediate-cleanup behavior.
+func WithVNIDTransitionGracePeriod(d time.Duration) Option {
+	return func(node *KsdnNode) { node.vnidTransitionGracePeriod = d }
+}
+
+// WithEgressRouterAllowedCIDRs sets the CIDRs a pod's
+// k8s-ovs/egress-router-source-ip annotation is allowed to request an
+// address from; see egress_router.go. A pod requesting an address outside
+// every CIDR here has the annotation rejected. Leave empty to reject every
+// request, disabling the feature even once WithEgressRouterInterface is set.
+func WithEgressRouterAllowedCIDRs(cidrs []*net.IPNet) Option {
+	return func(node *KsdnNode) { node.egressRouterAllowedCIDRs = cidrs }
+}
+
+// WithEgressRouterInterface sets the uplink interface egress router pods'
+// macvlan device is created off of; see egress_router.go. Leave empty
+// (the default) to disable the feature, ignoring the annotation on every pod.
+func WithEgressRouterInterface(iface string) Option {
+	return func(node *KsdnNode) { node.egressRouterInterface = iface }
+}
+
+// WithTrafficMirrorInterface names the dedicated OVS port SetupSDN creates
+// for on-demand per-namespace traffic mirrors (see mirror.go), gating the
+// feature: CreateMirror refuses every request until this is set. Leave
+// empty (the default) to disable the feature.
+func WithTrafficMirrorInterface(iface string) Option {
+	return func(node *KsdnNode) { node.trafficMirrorInterface = iface }
+}
+
+// WithDuplicateAddressDetection sets whether pod setup ARP-probes a newly
+// assigned address for a conflicting reply before reporting success, and how
+// long it waits for one; see pod_arp_check.go. Defaults to enabled; leave
+// timeout zero for defaultDuplicateAddressCheckTimeout.
+func WithDuplicateAddressDetection(enabled bool, timeout time.Duration) Option {
+	return func(node *KsdnNode) {
+		node.duplicateAddressCheck = enabled
+		node.duplicateAddressCheckTimeout = timeout
+	}
+}
+
+// WithMaintenanceFreezeAllowNewPods exempts pod setup for genuinely new pods
+// from a cluster-wide maintenance freeze that would otherwise refuse it,
+// since a pod that has never had dataplane state programmed can't cause the
+// churn a freeze is meant to prevent. Defaults to false (new pods wait out
+// the freeze like everything else, relying on kubelet's own CNI ADD retry
+// loop). See maintenance_freeze.go.
+func WithMaintenanceFreezeAllowNewPods(allow bool) Option {
+	return func(node *KsdnNode) { node.allowNewPodsWhileFrozen = allow }
+}
+
+// WithUnmanagedNamespaces sets the static list of namespaces excluded from
+// SDN management: no service-rule programming, no VNID-driven pod updates,
+// and no pod-cache-driven reconciliation for their pods. A namespace can also
+// be excluded at runtime via the k8s-ovs/unmanaged annotation regardless of
+// this list; see unmanaged_namespaces.go.
+func WithUnmanagedNamespaces(namespaces []string) Option {
+	return func(node *KsdnNode) { node.unmanaged = newUnmanagedNamespaces(namespaces) }
+}
+
+// WithFlowBackend sets the OVS flow backend directly, bypassing the
+// ovs.New()-based bridge setup Start otherwise does. Real callers have no
+// reason to use this -- Start always wires up a real bridge -- but it lets
+// a caller hand a node a recording ovs.FakeFlowBackend to call flow-
+// generating methods (e.g. AddServiceRules) directly without going through
+// Start.
+func WithFlowBackend(backend ovs.FlowBackend) Option {
+	return func(node *KsdnNode) { node.ovs = backend }
+}
+
+// WithMultitenant sets the node's multitenant flag, for a caller that uses
+// the node without going through Start. Start always derives the flag from
+// the network's plugin name via GetNetworkConfig, overwriting this value.
+func WithMultitenant(multitenant bool) Option {
+	return func(node *KsdnNode) { node.multitenant = multitenant }
+}
+
+// WithLocalPods seeds the node's local pod cache directly, with no informer
+// behind it, so GetLocalPods (and code built on it, like updatePodNetwork)
+// sees a fixed pod list without a real API server behind it when the node
+// is used without going through Start. Start replaces this cache with its
+// own informer-backed one.
+func WithLocalPods(pods []kapi.Pod) Option {
+	return func(node *KsdnNode) { node.pods = newStaticPodCache(pods) }
+}
+
+// WithAdditionalNetworks configures secondary overlay networks that run
+// alongside the primary one (WithNetwork): each gets its own OVS bridge and
+// nodeVNIDMap, kept in sync from its own slice of etcd. Pod setup does not
+// attach pods to an additional network's bridge: setting up a pod in a
+// namespace assigned to one (via EtcdManager.SetNamespaceNetwork) fails
+// instead of giving it a VNID from that network's space; see
+// podManager.vnidsForNamespace. The two networks share nothing else -- kube client, pod informer -- and
+// since their bridges are never patched together, cross-network traffic is
+// impossible short of the host's own routing tables. See multinetwork.go.
+// Namespaces with no assignment use the primary network, so configuring no
+// additional networks is the zero-config default this replaces.
+func WithAdditionalNetworks(networks []AdditionalNetwork) Option {
+	return func(node *KsdnNode) { node.additionalNetworks = networks }
+}
+
+// NewNode builds a KsdnNode from opts. It touches no global state (flags,
+// env vars) and starts nothing; call Start to bring the node up. WithKubeClient,
+// WithEtcdManager, WithDockerClient and WithNetwork are required.
+func NewNode(opts ...Option) (*KsdnNode, error) {
 	node := &KsdnNode{
-		kClient:            kClient,
-		eClient:            eClient,
-		ctx:                ctx,
-		hostName:           hostname,
-		vnids:              newNodeVNIDMap(),
-		podNetworkReady:    make(chan struct{}),
-		iptablesSyncPeriod: iptablesSyncPeriod,
-		mtu:                mtu,
+		vnids:                 newNodeVNIDMap(),
+		podNetworkReady:       make(chan struct{}),
+		iptablesSyncPeriod:    iptablesSyncPeriod,
+		mtu:                   mtu,
+		serviceRulesMode:      ServiceRulesEnabled,
+		execer:                kexec.New(),
+		podDeleteGuard:        newPodDeleteGuard(),
+		vxlanIngressFilter:    true,
+		directCIDRs:           make(map[string]bool),
+		egressDSCP:            newEgressDSCPState(),
+		hostNetworkAccess:     true,
+		duplicateAddressCheck: true,
+		maintenanceFreeze:     newMaintenanceFreezeState(),
+
+		vxlanChecksumWorkaroundMode: ChecksumWorkaroundAuto,
+
+		podEvictionGracePeriodSeconds: defaultPodEvictionGracePeriodSeconds,
+		podEvictionMaxAttempts:        defaultPodEvictionMaxAttempts,
+
+		unmanaged: newUnmanagedNamespaces(nil),
+	}
+	for _, opt := range opts {
+		opt(node)
+	}
+
+	if node.kClient == nil {
+		return nil, fmt.Errorf("NewNode: WithKubeClient is required")
+	}
+	if node.eClient == nil {
+		return nil, fmt.Errorf("NewNode: WithEtcdManager is required")
+	}
+	if node.dClient == nil {
+		return nil, fmt.Errorf("NewNode: WithDockerClient is required")
+	}
+	if node.network == "" {
+		return nil, fmt.Errorf("NewNode: WithNetwork is required")
 	}
 
-	networkConfig, err := eClient.GetNetworkConfig(ctx, network)
+	return node, nil
+}
+
+// Start reads the node's network config, sets up the local bridge and base
+// flows, and launches every watch and background sync goroutine, all of
+// which run until ctx is done or Stop is called. It blocks until startup
+// population and setup finish, then returns.
+func (node *KsdnNode) Start(ctx context.Context) error {
+	defer InstallPanicHandler()
+
+	node.ctx, node.cancel = context.WithCancel(ctx)
+
+	preflightReport, err := runPreflight(node.execer)
+	node.preflightReport = preflightReport
 	if err != nil {
-		glog.Fatalf("Get network config failed: %v", err)
+		return fmt.Errorf("preflight check failed: %v", err)
+	}
+
+	networkConfig, err := node.eClient.GetNetworkConfig(node.ctx, node.network)
+	if err != nil {
+		return fmt.Errorf("get network config failed: %v", err)
 	}
 
 	if !nettype.IsKovsNetworkPlugin(networkConfig.PluginName) {
-		glog.Fatalf("Not a k8s ovs sdn plugin: %v", networkConfig.PluginName)
+		return fmt.Errorf("not a k8s ovs sdn plugin: %v", networkConfig.PluginName)
 	}
 
 	glog.Infof("Initializing SDN node of type %q", networkConfig.PluginName)
 
 	node.networkInfo, err = parseNetworkInfo(networkConfig)
 	if err != nil {
-		glog.Fatalf("Parse network information failed: %v", err)
+		return fmt.Errorf("parse network information failed: %v", err)
 	}
 
 	node.multitenant = nettype.IsKovsCloudMultitenantNetworkPlugin(networkConfig.PluginName)
 
-	selfIP, err := netutils.GetNodeIP(hostname)
+	node.flowVersion, err = node.resolveFlowVersion(node.ctx)
+	if err != nil {
+		return fmt.Errorf("resolve flow table compatibility version: %v", err)
+	}
+
+	if node.hostName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("get hostname failed: %v", err)
+		}
+		node.hostName = strings.ToLower(strings.TrimSpace(hostname))
+		glog.Infof("Resolved hostname to %q", node.hostName)
+	}
+
+	selfIP, err := netutils.GetNodeIP(node.hostName)
 	if err != nil {
 		var defaultIP net.IP
 		defaultIP, err = kubeutilnet.ChooseHostInterface()
 		if err != nil {
-			glog.Fatalf("Get IP address failed: %v", err)
+			return fmt.Errorf("get IP address failed: %v", err)
 		}
 		selfIP = defaultIP.String()
 		glog.V(5).Infof("Resolved IP address to %q", selfIP)
 	}
 	node.localIP = selfIP
 
-	ovsif, err := ovs.New(kexec.New(), BR)
-	if err != nil {
-		glog.Fatalf("Create ovs interface failed: %v", err)
+	if node.vxlanSource != "" {
+		tunnelIP, err := resolveTunnelSourceIP(node.vxlanSource)
+		if err != nil {
+			return fmt.Errorf("resolve --vxlan-source %q: %v", node.vxlanSource, err)
+		}
+		node.tunnelSourceIP = tunnelIP.String()
+		node.localIP = node.tunnelSourceIP
+		glog.Infof("Pinned VXLAN tunnel source to %s (--vxlan-source=%s)", node.tunnelSourceIP, node.vxlanSource)
+
+		if err := node.publishTunnelSourceIP(node.tunnelSourceIP); err != nil {
+			return fmt.Errorf("publish vxlan source IP to Node object: %v", err)
+		}
 	}
-	node.ovs = ovsif
 
-	nodeIPTables := newNodeIPTables(node.networkInfo.ClusterNetwork.String(), iptablesSyncPeriod)
-	if err = nodeIPTables.Setup(); err != nil {
-		glog.Fatalf("Set up iptables failed: %v", err)
+	if err := node.applyVXLANChecksumWorkaroundIfNeeded(); err != nil {
+		return fmt.Errorf("apply VXLAN checksum offload workaround: %v", err)
 	}
 
-	node.localSubnetCIDR, err = node.getLocalSubnet()
+	// node.pods must exist (even if not yet synced) before newServiceController
+	// runs, since lazy mode registers a listener on it; starting its informer
+	// here lets the sync itself happen concurrently with the rest of startup
+	// population below.
+	node.pods = newPodCache(node.kClient, node.hostName)
+	node.pods.Run(node.ctx.Done())
+
+	var ovsif ovs.FlowBackend
+	var services *serviceController
+	err = populateStartup([]startupStep{
+		{"bridge-verify", func() error {
+			if node.dryRun {
+				glog.Infof("Dry run: recording intended OVS flow changes instead of applying them")
+				ovsif = ovs.NewDryRunFlowBackend()
+				return nil
+			}
+			var err error
+			ovsif, err = ovs.New(node.execer, BR)
+			return err
+		}},
+		{"iptables-setup", func() error {
+			mssClamp, err := resolveMSSClamp(node.tcpMSSClamp, node.mtu)
+			if err != nil {
+				return err
+			}
+			node.iptables = newNodeIPTables(node.networkInfo.ClusterNetwork.String(), iptablesSyncPeriod, mssClamp, node.execer)
+			return node.iptables.Setup()
+		}},
+		{"hostsubnet-fetch", func() error {
+			var err error
+			node.localSubnetCIDR, err = node.getLocalSubnet()
+			return err
+		}},
+		{"pod-cache-sync", func() error {
+			if !node.pods.WaitForSync(node.ctx.Done()) {
+				return fmt.Errorf("local pod cache failed to sync")
+			}
+			return nil
+		}},
+		{"service-cache-warmup", func() error {
+			enabled, err := resolveServiceRulesMode(node.serviceRulesMode)
+			if err != nil {
+				return err
+			}
+			node.servicesEnabled = enabled
+			if !enabled {
+				return nil
+			}
+			services = newServiceController(node)
+			if !services.WaitForSync(node.ctx.Done()) {
+				return fmt.Errorf("service cache failed to sync")
+			}
+			return nil
+		}},
+	})
 	if err != nil {
-		glog.Fatalf("Get subnet for this node failed: %v", err)
+		return fmt.Errorf("node startup population failed: %v", err)
+	}
+	if cb, ok := ovsif.(ovs.CircuitBreakerAware); ok {
+		cb.SetOnRecover(func() {
+			glog.Infof("OVS circuit breaker closed, triggering a reconcile to repair anything missed while it was open")
+			if _, err := node.Reconcile(); err != nil {
+				glog.Errorf("Reconcile after OVS circuit breaker recovery failed: %v", err)
+			}
+		})
 	}
+	node.ovs = ovs.NewFreezeFlowBackend(ovsif)
 
-	networkChanged, err := node.SetupSDN()
+	// Everything below this point may install or delete OVS flows, so it runs
+	// only after every population step above has finished.
+	networkChanged, err := node.Reconcile()
 	if err != nil {
-		glog.Fatalf("Setup network failed: %v", err)
+		return fmt.Errorf("setup network failed: %v", err)
+	}
+
+	if !node.servicesEnabled {
+		if err := node.AddServiceRulesBypass(); err != nil {
+			return fmt.Errorf("add service rules bypass failed: %v", err)
+		}
+	}
+
+	if node.trafficMirrorInterface != "" {
+		node.mirrors = newMirrorController(node)
 	}
 
 	err = node.SubnetStartNode()
 	if err != nil {
-		glog.Fatalf("Start subnet monitor process failed: %v", err)
+		return fmt.Errorf("start subnet monitor process failed: %v", err)
+	}
+
+	if err := node.startAdditionalNetworks(); err != nil {
+		return fmt.Errorf("start additional networks failed: %v", err)
+	}
+
+	if node.connectivityProbeEnabled {
+		node.connectivityProber = newConnectivityProber(node)
+		node.connectivityProber.run(node.ctx.Done())
 	}
 
 	if node.multitenant {
-		if err = node.VnidStartNode(); err != nil {
-			glog.Fatalf("Start node vnid monitor process failed: %v", err)
+		if node.vnidTransitionGracePeriod > 0 {
+			node.vnidDrain = newVNIDDrainQueue(node)
+		}
+		if err = node.VnidStartNode(networkConfig.ReservedVNIDs); err != nil {
+			return fmt.Errorf("start node vnid monitor process failed: %v", err)
 		}
+		if services != nil {
+			services.StartWorkers()
+		}
+		node.services = services
+
+		node.trafficAccountant = newTrafficAccountant(node)
+		node.trafficAccountant.run(node.ctx.Done())
+
+		if node.dnsServiceName != "" {
+			newDNSController(node, node.dnsServiceNamespace, node.dnsServiceName).Run(node.ctx.Done())
+		}
+
+		if node.hostNetworkAccess {
+			newHostAccessController(node).Run(node.ctx.Done())
+		}
+
+		newHealthCheckAccessController(node).Run(node.ctx.Done())
+	}
+
+	runtime, err := resolveContainerRuntime(node.dClient, node.criEndpoint)
+	if err != nil {
+		return fmt.Errorf("resolve container runtime failed: %v", err)
 	}
 
-	node.podManager, err = newPodManager(node.multitenant, node.localSubnetCIDR, node.networkInfo, kClient, dClient, node.vnids, mtu)
+	node.podManager, err = newPodManager(node.multitenant, node.localSubnetCIDR, node.networkInfo, node.kClient, runtime, node.vnids, node.mtu, node.ovs, node.alsoAcceptVNIDsNamespaces, node.egressRouterAllowedCIDRs, node.egressRouterInterface, node.execer, node.vnidDrain, node.duplicateAddressCheck, node.duplicateAddressCheckTimeout, node.maintenanceFreeze, node.allowNewPodsWhileFrozen, node.eClient, node.additionalNetworkState)
 	if err != nil {
-		glog.Fatalf("Create pod manager failed: %v", err)
+		return fmt.Errorf("create pod manager failed: %v", err)
 	}
 	if err := node.podManager.Start(cniserver.CNIServerSocketPath); err != nil {
-		glog.Fatalf("Start pod manager failed: %v", err)
+		return fmt.Errorf("start pod manager failed: %v", err)
 	}
 
+	node.adminServer = adminapi.NewServer(adminapi.AdminServerSocketPath, adminapi.Handlers{
+		PodSetup:            node.adminPodSetup,
+		PodTeardown:         node.adminPodTeardown,
+		PodStatus:           node.adminPodStatus,
+		VNIDs:               node.vnids.Snapshot,
+		FlowTableCounts:     node.FlowTableCounts,
+		Reconcile:           node.Reconcile,
+		SimulateVNIDChange:  node.adminSimulateVNIDChange,
+		SetServiceRulesMode: node.SetServiceRulesMode,
+		CreateMirror:        node.adminCreateMirror,
+		ListMirrors:         node.adminListMirrors,
+		DeleteMirror:        node.adminDeleteMirror,
+	})
+	if err := node.adminServer.Start(); err != nil {
+		return fmt.Errorf("start admin API failed: %v", err)
+	}
+
+	node.startFlowStatsSync()
+	node.startStatusSync()
+	node.startDirectCIDRSync()
+	node.startFlowExportSync()
+	node.startNoMasqueradeSync()
+	node.startServiceCIDRSync()
+	node.startPodTeardownReconcile()
+	node.startMaintenanceFreezeSync()
+
 	if networkChanged {
-		var pods []kapi.Pod
-		pods, _, err = node.GetLocalPods(kapi.NamespaceAll)
+		pods, _, err := node.GetLocalPods(kapi.NamespaceAll)
 		if err != nil {
-			glog.Fatalf("Get local pods failed: %v", err)
+			return fmt.Errorf("get local pods failed: %v", err)
 		}
 		for _, p := range pods {
-			err = node.UpdatePod(p)
-			if err != nil {
+			if err := node.UpdatePod(p); err != nil {
 				glog.Warningf("Could not update pod %q: %s", p.Name, err)
+				node.recordStatusError(fmt.Sprintf("update pod %q: %s", p.Name, err))
 			}
 		}
 	}
 
+	if node.dryRun {
+		if dryRunBackend, ok := node.ovs.(*ovs.DryRunFlowBackend); ok {
+			glog.Infof("Dry run: intended OVS changes, by namespace/feature:\n%s", formatDryRunMutations(dryRunBackend.Mutations))
+		}
+	}
+
 	node.markPodNetworkReady()
+	return nil
+}
+
+// Stop tells every goroutine launched by Start to exit, by canceling the
+// context Start derived from the one it was given. It does not block for
+// them to actually finish; there's no coordinated drain today, since nothing
+// currently needs one (the process exiting is what unwinds the CNI socket
+// listener and OVS itself is left as-is on the host).
+func (node *KsdnNode) Stop() {
+	if node.cancel != nil {
+		node.cancel()
+	}
 }
 
 // FIXME: this should eventually go into kubelet via a CNI UPDATE/CHANGE action
 // See https://github.com/containernetworking/cni/issues/89
 func (node *KsdnNode) UpdatePod(pod kapi.Pod) error {
+	// netns is read from docker if needed, since we don't get it from kubelet
+	_, err := node.runPodRequest(cniserver.CNI_UPDATE, pod.Namespace, pod.Name, getPodContainerID(&pod), "")
+	return err
+}
+
+// runPodRequest builds and dispatches a pod manager CNI request. It's the
+// single place that turns a (command, pod, container, netns) tuple into a
+// podManager call, so both UpdatePod and the admin API's pod setup/teardown
+// handlers go through the same implementation.
+func (node *KsdnNode) runPodRequest(command cniserver.CNICommand, namespace, name, containerID, netns string) ([]byte, error) {
 	req := &cniserver.PodRequest{
-		Command:      cniserver.CNI_UPDATE,
-		PodNamespace: pod.Namespace,
-		PodName:      pod.Name,
-		ContainerId:  getPodContainerID(&pod),
-		// netns is read from docker if needed, since we don't get it from kubelet
-		Result: make(chan *cniserver.PodResult),
+		Command:      command,
+		PodNamespace: namespace,
+		PodName:      name,
+		ContainerId:  containerID,
+		Netns:        netns,
+		Result:       make(chan *cniserver.PodResult),
 	}
+	return node.podManager.handleCNIRequest(req)
+}
 
-	// Send request and wait for the result
-	_, err := node.podManager.handleCNIRequest(req)
-	return err
+// adminPodSetup implements the admin API's pod setup call.
+func (node *KsdnNode) adminPodSetup(namespace, name, containerID, netns string) ([]byte, error) {
+	return node.runPodRequest(cniserver.CNI_ADD, namespace, name, containerID, netns)
 }
 
-func (node *KsdnNode) GetLocalPods(namespace string) ([]kapi.Pod, []kapi.Pod, error) {
-	fieldSelector := fields.Set{"spec.nodeName": node.hostName}.AsSelector()
-	opts := kapi.ListOptions{
-		LabelSelector: labels.Everything(),
-		FieldSelector: fieldSelector,
+// adminPodTeardown implements the admin API's pod teardown call.
+func (node *KsdnNode) adminPodTeardown(namespace, name, containerID, netns string) ([]byte, error) {
+	return node.runPodRequest(cniserver.CNI_DEL, namespace, name, containerID, netns)
+}
+
+// adminPodStatus implements the admin API's pod status call.
+func (node *KsdnNode) adminPodStatus(namespace, name string) (*adminapi.PodStatus, error) {
+	pods, err := node.pods.Pods(namespace)
+	if err != nil {
+		return nil, err
 	}
-	podList, err := node.kClient.Pods(namespace).List(opts)
+	for _, pod := range pods {
+		if pod.Name != name {
+			continue
+		}
+		vnid, _ := node.vnids.GetVNID(namespace)
+		return &adminapi.PodStatus{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Phase:     string(pod.Status.Phase),
+			PodIP:     pod.Status.PodIP,
+			VNID:      vnid,
+		}, nil
+	}
+	return nil, fmt.Errorf("pod %s/%s not found", namespace, name)
+}
+
+// Reconcile re-runs SDN setup, the same call Start makes at the end of
+// startup population, and reports whether it changed the node's network
+// configuration. It's exposed as its own method so the admin API's
+// reconcile call and Start share this implementation.
+func (node *KsdnNode) Reconcile() (bool, error) {
+	networkChanged, err := node.SetupSDN()
+	if err != nil {
+		return false, err
+	}
+	node.recordReconcile()
+	return networkChanged, nil
+}
+
+// installServicesForVNIDTransition additively installs namespace's service
+// rules under netID, through the service controller, so its watch-driven
+// syncService and updatePodNetwork's make-before-break transition never
+// disagree about what's currently installed; see
+// serviceController.installServicesForTransition. It's a no-op if this node
+// isn't programming its own service rules (see SetServiceRulesMode).
+func (node *KsdnNode) installServicesForVNIDTransition(namespace string, netID uint32) error {
+	node.servicesLock.Lock()
+	services := node.services
+	node.servicesLock.Unlock()
+
+	if services == nil {
+		return nil
+	}
+	return services.installServicesForTransition(namespace, netID)
+}
+
+// finishServicesForVNIDTransition removes namespace's service rules for
+// oldNetID, once installServicesForVNIDTransition and the pod re-tag that
+// follows it have both completed; see
+// serviceController.finishServicesTransition.
+func (node *KsdnNode) finishServicesForVNIDTransition(namespace string, oldNetID uint32) error {
+	node.servicesLock.Lock()
+	services := node.services
+	node.servicesLock.Unlock()
+
+	if services == nil {
+		return nil
+	}
+	return services.finishServicesTransition(namespace, oldNetID)
+}
+
+// SetServiceRulesMode re-resolves mode (see WithServiceRulesMode) and, if it
+// changes whether this node programs its own service OVS rules, starts or
+// stops the service controller accordingly: enabling starts a fresh
+// controller and removes the table 4 bypass, disabling deletes every
+// service rule the controller had installed and adds the bypass so
+// in-flight service traffic isn't dropped. It returns the resolved enabled
+// state. Safe to call at any time after Start returns; see the admin API's
+// service-rules call.
+func (node *KsdnNode) SetServiceRulesMode(mode string) (bool, error) {
+	enabled, err := resolveServiceRulesMode(mode)
+	if err != nil {
+		return false, err
+	}
+
+	node.servicesLock.Lock()
+	defer node.servicesLock.Unlock()
+
+	if enabled == node.servicesEnabled {
+		node.serviceRulesMode = mode
+		return enabled, nil
+	}
+
+	if enabled {
+		services := newServiceController(node)
+		if !services.WaitForSync(node.ctx.Done()) {
+			return node.servicesEnabled, fmt.Errorf("service cache failed to sync")
+		}
+		services.StartWorkers()
+		if err := node.DeleteServiceRulesBypass(); err != nil {
+			return node.servicesEnabled, err
+		}
+		node.services = services
+	} else {
+		if node.services != nil {
+			if err := node.services.Stop(); err != nil {
+				return node.servicesEnabled, err
+			}
+			node.services = nil
+		}
+		if err := node.AddServiceRulesBypass(); err != nil {
+			return node.servicesEnabled, err
+		}
+	}
+
+	node.serviceRulesMode = mode
+	node.servicesEnabled = enabled
+	glog.Infof("service-rules: switched to %q, service rules now %v", mode, enabled)
+	return enabled, nil
+}
+
+// FlowTableCounts returns the current per-table flow counts, the same data
+// syncFlowStats exports as metrics, for the admin API's flow-state query.
+func (node *KsdnNode) FlowTableCounts() (map[int]uint64, error) {
+	counts := make(map[int]uint64, len(flowTables))
+	for _, table := range flowTables {
+		count, err := node.ovs.DumpTableAggregate(table)
+		if err != nil {
+			return nil, err
+		}
+		counts[table] = count
+	}
+	return counts, nil
+}
+
+// GetLocalPods returns the node's local pods in namespace, split into
+// running and non-running pods. It's a thin wrapper over the node's local
+// pod cache, kept as its own method for compatibility with existing callers.
+func (node *KsdnNode) GetLocalPods(namespace string) ([]kapi.Pod, []kapi.Pod, error) {
+	pods, err := node.pods.Pods(namespace)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Filter running pods
-	runPods := make([]kapi.Pod, 0, len(podList.Items))
-	otherPods := make([]kapi.Pod, 0, len(podList.Items))
-	for _, pod := range podList.Items {
+	runPods := make([]kapi.Pod, 0, len(pods))
+	otherPods := make([]kapi.Pod, 0, len(pods))
+	for _, pod := range pods {
 		if pod.Status.Phase == kapi.PodRunning {
 			runPods = append(runPods, pod)
 		} else {
@@ -194,8 +1103,16 @@ func (node *KsdnNode) markPodNetworkReady() {
 func (node *KsdnNode) IsPodNetworkReady() error {
 	select {
 	case <-node.podNetworkReady:
-		return nil
 	default:
 		return fmt.Errorf("SDN pod network is not ready")
 	}
+
+	if _, age := node.eClient.WatchLagStatus(); age > maxAcceptableEtcdWatchLagAge {
+		return fmt.Errorf("SDN etcd watches are stale (last event %v ago)", age)
+	}
+
+	if cb, ok := node.ovs.(ovs.CircuitBreakerAware); ok && !cb.DatapathAvailable() {
+		return fmt.Errorf("OVS datapath is unavailable (circuit breaker open)")
+	}
+	return nil
 }
@@ -2,6 +2,8 @@ package ksdn
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,6 +15,35 @@ import (
 	utilwait "k8s.io/kubernetes/pkg/util/wait"
 )
 
+// mssClampAuto is the --tcp-mss-clamp value that derives the clamp from the
+// node's pod MTU instead of an explicit value.
+const mssClampAuto = "auto"
+
+// ipv4TCPHeaderOverhead is the combined IPv4 and TCP header size a SYN's own
+// path MTU doesn't leave room for, subtracted from the pod MTU to get a safe
+// MSS clamp value.
+const ipv4TCPHeaderOverhead = 40
+
+// resolveMSSClamp turns the --tcp-mss-clamp setting into the MSS value to
+// clamp egress TCP SYNs to, or 0 to disable clamping.
+func resolveMSSClamp(setting string, mtu uint32) (uint32, error) {
+	switch {
+	case setting == "":
+		return 0, nil
+	case setting == mssClampAuto:
+		if mtu <= ipv4TCPHeaderOverhead {
+			return 0, fmt.Errorf("pod MTU %d is too small to derive a TCP MSS clamp from", mtu)
+		}
+		return mtu - ipv4TCPHeaderOverhead, nil
+	default:
+		value, err := strconv.ParseUint(setting, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid --tcp-mss-clamp value %q: must be empty, %q, or an explicit MSS: %v", setting, mssClampAuto, err)
+		}
+		return uint32(value), nil
+	}
+}
+
 type FirewallRule struct {
 	table string
 	chain string
@@ -24,14 +55,80 @@ type NodeIPTables struct {
 	clusterNetworkCIDR string
 	syncPeriod         time.Duration
 
+	// mssClamp is the TCP MSS value egress SYNs toward non-cluster
+	// destinations are clamped to, or 0 to install no clamping rule; see
+	// resolveMSSClamp.
+	mssClamp uint32
+
+	// directCIDRs are external CIDRs exempted from the POSTROUTING
+	// MASQUERADE rule below, so a pod reaching one of them keeps its own
+	// IP instead of being SNATed to the node's; kept in sync with
+	// ClusterNetwork.DirectCIDRs by SetDirectCIDRs (see direct_cidrs.go).
+	directCIDRs   []*net.IPNet
+	directCIDRsMu sync.Mutex
+
+	// noMasqueradeCIDRs are external CIDRs exempted from the POSTROUTING
+	// MASQUERADE rule below, same as directCIDRs, but without any table 5
+	// routing change; kept in sync with ClusterNetwork.NoMasqueradeCIDRs by
+	// SetNoMasqueradeCIDRs (see no_masquerade_cidrs.go).
+	noMasqueradeCIDRs   []*net.IPNet
+	noMasqueradeCIDRsMu sync.Mutex
+
 	mu sync.Mutex // Protects concurrent access to syncIPTableRules()
 }
 
-func newNodeIPTables(clusterNetworkCIDR string, syncPeriod time.Duration) *NodeIPTables {
+// SetDirectCIDRs updates the external CIDRs exempted from source NAT. The
+// exemption rules of CIDRs no longer listed are deleted here; rules for new
+// ones are added on the next syncIPTableRules pass.
+func (n *NodeIPTables) SetDirectCIDRs(cidrs []*net.IPNet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.directCIDRsMu.Lock()
+	defer n.directCIDRsMu.Unlock()
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr.String()] = true
+	}
+	for _, old := range n.directCIDRs {
+		if wanted[old.String()] {
+			continue
+		}
+		if err := n.ipt.DeleteRule(iptables.Table("nat"), iptables.Chain("POSTROUTING"), "-s", n.clusterNetworkCIDR, "-d", old.String(), "-m", "comment", "--comment", "k8s-ovs direct CIDR, no source NAT", "-j", "ACCEPT"); err != nil {
+			glog.Errorf("Failed to remove direct CIDR NAT exemption for %s: %v", old, err)
+		}
+	}
+	n.directCIDRs = cidrs
+}
+
+// SetNoMasqueradeCIDRs updates the external CIDRs exempted from source NAT.
+// The exemption rules of CIDRs no longer listed are deleted here; rules for
+// new ones are added on the next syncIPTableRules pass.
+func (n *NodeIPTables) SetNoMasqueradeCIDRs(cidrs []*net.IPNet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.noMasqueradeCIDRsMu.Lock()
+	defer n.noMasqueradeCIDRsMu.Unlock()
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr.String()] = true
+	}
+	for _, old := range n.noMasqueradeCIDRs {
+		if wanted[old.String()] {
+			continue
+		}
+		if err := n.ipt.DeleteRule(iptables.Table("nat"), iptables.Chain("POSTROUTING"), "-s", n.clusterNetworkCIDR, "-d", old.String(), "-m", "comment", "--comment", "k8s-ovs no-masquerade CIDR, no source NAT", "-j", "RETURN"); err != nil {
+			glog.Errorf("Failed to remove no-masquerade NAT exemption for %s: %v", old, err)
+		}
+	}
+	n.noMasqueradeCIDRs = cidrs
+}
+
+func newNodeIPTables(clusterNetworkCIDR string, syncPeriod time.Duration, mssClamp uint32, execer kexec.Interface) *NodeIPTables {
 	return &NodeIPTables{
-		ipt:                iptables.New(kexec.New(), utildbus.New(), iptables.ProtocolIpv4),
+		ipt:                iptables.New(execer, utildbus.New(), iptables.ProtocolIpv4),
 		clusterNetworkCIDR: clusterNetworkCIDR,
 		syncPeriod:         syncPeriod,
+		mssClamp:           mssClamp,
 	}
 }
 
@@ -88,14 +185,63 @@ func (n *NodeIPTables) syncIPTableRules() error {
 	return nil
 }
 
+// Dump returns the full "iptables-save" output, for use by crash diagnostics.
+func (n *NodeIPTables) Dump() (string, error) {
+	out, err := n.ipt.SaveAll()
+	return string(out), err
+}
+
 // Get k8s-ovs iptables rules
 func (n *NodeIPTables) getStaticNodeIPTablesRules() []FirewallRule {
-	return []FirewallRule{
+	rules := []FirewallRule{
 		{"nat", "POSTROUTING", []string{"-s", n.clusterNetworkCIDR, "-j", "MASQUERADE"}},
-		{"filter", "INPUT", []string{"-p", "udp", "-m", "multiport", "--dports", VXLAN_PORT, "-m", "comment", "--comment", "001 vxlan incoming", "-j", "ACCEPT"}},
-		{"filter", "INPUT", []string{"-i", TUN, "-m", "comment", "--comment", "traffic from SDN", "-j", "ACCEPT"}},
-		{"filter", "INPUT", []string{"-i", "docker0", "-m", "comment", "--comment", "traffic from docker", "-j", "ACCEPT"}},
-		{"filter", "FORWARD", []string{"-d", n.clusterNetworkCIDR, "-j", "ACCEPT"}},
-		{"filter", "FORWARD", []string{"-s", n.clusterNetworkCIDR, "-j", "ACCEPT"}},
 	}
+
+	// syncIPTableRules inserts each rule at the top of its chain with
+	// EnsureRule(Prepend, ...), which leaves a rule already present where it
+	// is, so a rule inserted later ends up ahead of one inserted earlier,
+	// whether later in this slice or on a later sync. These NAT
+	// exemptions are appended right after MASQUERADE so they land above it
+	// in the chain and get evaluated first.
+	n.noMasqueradeCIDRsMu.Lock()
+	for _, cidr := range n.noMasqueradeCIDRs {
+		rules = append(rules, FirewallRule{"nat", "POSTROUTING", []string{
+			"-s", n.clusterNetworkCIDR,
+			"-d", cidr.String(),
+			"-m", "comment", "--comment", "k8s-ovs no-masquerade CIDR, no source NAT",
+			"-j", "RETURN",
+		}})
+	}
+	n.noMasqueradeCIDRsMu.Unlock()
+
+	n.directCIDRsMu.Lock()
+	for _, cidr := range n.directCIDRs {
+		rules = append(rules, FirewallRule{"nat", "POSTROUTING", []string{
+			"-s", n.clusterNetworkCIDR,
+			"-d", cidr.String(),
+			"-m", "comment", "--comment", "k8s-ovs direct CIDR, no source NAT",
+			"-j", "ACCEPT",
+		}})
+	}
+	n.directCIDRsMu.Unlock()
+
+	rules = append(rules,
+		FirewallRule{"filter", "INPUT", []string{"-p", "udp", "-m", "multiport", "--dports", VXLAN_PORT, "-m", "comment", "--comment", "001 vxlan incoming", "-j", "ACCEPT"}},
+		FirewallRule{"filter", "INPUT", []string{"-i", TUN, "-m", "comment", "--comment", "traffic from SDN", "-j", "ACCEPT"}},
+		FirewallRule{"filter", "INPUT", []string{"-i", "docker0", "-m", "comment", "--comment", "traffic from docker", "-j", "ACCEPT"}},
+		FirewallRule{"filter", "FORWARD", []string{"-d", n.clusterNetworkCIDR, "-j", "ACCEPT"}},
+		FirewallRule{"filter", "FORWARD", []string{"-s", n.clusterNetworkCIDR, "-j", "ACCEPT"}},
+	)
+
+	if n.mssClamp > 0 {
+		rules = append(rules, FirewallRule{"mangle", "FORWARD", []string{
+			"-s", n.clusterNetworkCIDR,
+			"!", "-d", n.clusterNetworkCIDR,
+			"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN",
+			"-m", "comment", "--comment", "k8s-ovs TCP MSS clamp for PMTUD blackholes",
+			"-j", "TCPMSS", "--set-mss", strconv.FormatUint(uint64(n.mssClamp), 10),
+		}})
+	}
+
+	return rules
 }
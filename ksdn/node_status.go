@@ -0,0 +1,219 @@
+package ksdn
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/ovs"
+)
+
+const (
+	// nodeStatusAnnotation holds a compact JSON-encoded NodeStatus, letting an
+	// operator or the master read a node's SDN health directly off its Node
+	// object without ssh-ing in.
+	nodeStatusAnnotation = "k8s-ovs.io/sdn-status"
+
+	nodeStatusSyncPeriod = 1 * time.Minute
+
+	// maxRecentErrors bounds how many error summaries we carry in the status
+	// record, keeping the annotation small.
+	maxRecentErrors = 5
+)
+
+// NodeStatus is the compact per-node SDN health record written to the node's
+// Node object annotation. A status is considered stale once LastUpdated is
+// older than a few sync periods; the annotation itself does not encode
+// staleness so that readers can apply their own threshold.
+type NodeStatus struct {
+	PluginVersion    string    `json:"pluginVersion"`
+	FlowTableVersion string    `json:"flowTableVersion"`
+	LastReconcile    time.Time `json:"lastReconcile"`
+	LastUpdated      time.Time `json:"lastUpdated"`
+	ManagedPods      int       `json:"managedPods"`
+	RecentErrors     []string  `json:"recentErrors,omitempty"`
+
+	// DataplaneVersion is the flow table version this node is currently
+	// generating flows as -- either the cluster's negotiated compatibility
+	// floor or its rollout target, see resolveFlowVersion in compat.go. The
+	// master watches this across every node to know when it's safe to flip
+	// DataplaneCompat.AllNodesUpgraded.
+	DataplaneVersion int `json:"dataplaneVersion"`
+
+	// ChecksumWorkaroundApplied reports whether this node disabled tx
+	// checksum offload on its underlay interface to work around a known
+	// VXLAN checksum offload defect; see
+	// resolveVXLANChecksumWorkaround in vxlan_checksum_workaround.go.
+	ChecksumWorkaroundApplied bool `json:"checksumWorkaroundApplied"`
+
+	// EtcdEndpoints reports the health of each of this node's backing etcd
+	// endpoints and which one it's currently using, from eClient.EndpointStatus.
+	EtcdEndpoints []etcdmanager.EndpointStatus `json:"etcdEndpoints,omitempty"`
+
+	// ConnectivityProbes reports the last overlay connectivity probe result
+	// to each sampled peer node, from connectivityProber.snapshot. Empty if
+	// WithConnectivityProbe wasn't enabled, or no peer has been sampled yet.
+	ConnectivityProbes []PeerConnectivity `json:"connectivityProbes,omitempty"`
+
+	// Preflight reports the outcome of the startup preflight checks (see
+	// preflight.go): required kernel modules, sysctls and OVS version. A
+	// node that's actually running always has Preflight.OK true -- Start
+	// fails outright otherwise -- so this is mainly useful for seeing which
+	// checks needed a fix applied.
+	Preflight *PreflightReport `json:"preflight,omitempty"`
+
+	// FlowExport reports the bridge's currently-applied sFlow/NetFlow export
+	// configuration, so an operator can audit which nodes are exporting
+	// without logging into each one; see flow_export.go.
+	FlowExport *FlowExportStatus `json:"flowExport,omitempty"`
+
+	// MaintenanceFrozen reports whether this node currently considers the
+	// cluster's dataplane frozen for maintenance; see maintenance_freeze.go.
+	MaintenanceFrozen bool `json:"maintenanceFrozen,omitempty"`
+}
+
+// FlowExportStatus is the node status record's view of the bridge's sFlow/
+// NetFlow export configuration.
+type FlowExportStatus struct {
+	SFlowEnabled   bool     `json:"sFlowEnabled"`
+	SFlowTargets   []string `json:"sFlowTargets,omitempty"`
+	NetFlowEnabled bool     `json:"netFlowEnabled"`
+	NetFlowTargets []string `json:"netFlowTargets,omitempty"`
+
+	// Error is the last SetFlowExport failure, if any -- the bridge may
+	// still be exporting a stale configuration from before the failure.
+	Error string `json:"error,omitempty"`
+}
+
+// statusRecorder accumulates the pieces of a NodeStatus as the node runs, and
+// periodically flushes a compact record to the node's Node annotation.
+type statusRecorder struct {
+	mu            sync.Mutex
+	lastReconcile time.Time
+	recentErrors  []string
+	flowExport    *FlowExportStatus
+}
+
+// recordReconcile marks that a full SDN reconcile (SetupSDN) has completed
+// successfully.
+func (node *KsdnNode) recordReconcile() {
+	node.status.mu.Lock()
+	defer node.status.mu.Unlock()
+	node.status.lastReconcile = time.Now()
+}
+
+// recordStatusError appends a short error summary to the status record. Only
+// the last maxRecentErrors are kept.
+func (node *KsdnNode) recordStatusError(summary string) {
+	node.status.mu.Lock()
+	defer node.status.mu.Unlock()
+	node.status.recentErrors = append(node.status.recentErrors, summary)
+	if len(node.status.recentErrors) > maxRecentErrors {
+		node.status.recentErrors = node.status.recentErrors[len(node.status.recentErrors)-maxRecentErrors:]
+	}
+}
+
+// recordFlowExportStatus records the outcome of the most recent
+// syncFlowExport call for the next status write. err is the SetFlowExport
+// error, if any; sflow/netflow are what was attempted regardless of whether
+// it succeeded.
+func (node *KsdnNode) recordFlowExportStatus(sflow *ovs.SFlowConfig, netflow *ovs.NetFlowConfig, err error) {
+	status := &FlowExportStatus{}
+	if sflow != nil {
+		status.SFlowEnabled = true
+		status.SFlowTargets = sflow.Targets
+	}
+	if netflow != nil {
+		status.NetFlowEnabled = true
+		status.NetFlowTargets = netflow.Targets
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	node.status.mu.Lock()
+	defer node.status.mu.Unlock()
+	node.status.flowExport = status
+}
+
+// startStatusSync starts a goroutine that periodically writes a compact SDN
+// status record to the node's Node annotation. Writes are rate-limited to
+// nodeStatusSyncPeriod so a flapping node cannot hammer the API server.
+func (node *KsdnNode) startStatusSync() {
+	go utilwait.Until(node.syncNodeStatus, nodeStatusSyncPeriod, node.ctx.Done())
+}
+
+// parseNodeStatus decodes a Node's SDN status annotation, if present and
+// well-formed. Used by the master to read what every node last reported,
+// e.g. for dataplane compatibility convergence (see compat.go).
+func parseNodeStatus(n *kapi.Node) (*NodeStatus, bool) {
+	raw, ok := n.Annotations[nodeStatusAnnotation]
+	if !ok {
+		return nil, false
+	}
+	var status NodeStatus
+	if err := json.Unmarshal([]byte(raw), &status); err != nil {
+		glog.Warningf("Ignoring unparseable SDN status annotation on node %q: %v", n.Name, err)
+		return nil, false
+	}
+	return &status, true
+}
+
+func (node *KsdnNode) syncNodeStatus() {
+	pluginVersion := getPluginVersion(node.multitenant, node.flowVersion)
+
+	pods, _, err := node.GetLocalPods(kapi.NamespaceAll)
+	if err != nil {
+		glog.Errorf("Failed to list local pods for SDN status: %v", err)
+		return
+	}
+
+	var connectivityProbes []PeerConnectivity
+	if node.connectivityProber != nil {
+		connectivityProbes = node.connectivityProber.snapshot()
+	}
+
+	node.status.mu.Lock()
+	status := NodeStatus{
+		PluginVersion:             pluginVersion[1],
+		FlowTableVersion:          pluginVersion[0],
+		LastReconcile:             node.status.lastReconcile,
+		LastUpdated:               time.Now(),
+		ManagedPods:               len(pods),
+		RecentErrors:              append([]string(nil), node.status.recentErrors...),
+		DataplaneVersion:          node.flowVersion,
+		ChecksumWorkaroundApplied: node.vxlanChecksumWorkaroundApplied,
+		EtcdEndpoints:             node.eClient.EndpointStatus(),
+		ConnectivityProbes:        connectivityProbes,
+		Preflight:                 node.preflightReport,
+		FlowExport:                node.status.flowExport,
+		MaintenanceFrozen:         node.maintenanceFreeze.Frozen(),
+	}
+	node.status.mu.Unlock()
+
+	raw, err := json.Marshal(&status)
+	if err != nil {
+		glog.Errorf("Failed to marshal SDN status: %v", err)
+		return
+	}
+
+	kn, err := node.kClient.Nodes().Get(node.hostName)
+	if err != nil {
+		glog.Errorf("Failed to get Node %q to write SDN status: %v", node.hostName, err)
+		return
+	}
+	if kn.Annotations == nil {
+		kn.Annotations = make(map[string]string)
+	}
+	kn.Annotations[nodeStatusAnnotation] = string(raw)
+
+	if _, err := node.kClient.Nodes().Update(kn); err != nil {
+		glog.Errorf("Failed to update Node %q with SDN status: %v", node.hostName, err)
+	}
+}
@@ -4,14 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"k8s-ovs/cniserver"
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/ovs"
 	netutils "k8s-ovs/pkg/utils"
 
 	"github.com/golang/glog"
 
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
-	"k8s.io/kubernetes/pkg/kubelet/dockertools"
+	kexec "k8s.io/kubernetes/pkg/util/exec"
+	"k8s.io/kubernetes/pkg/util/sets"
+
+	"k8s.io/kubernetes/pkg/types"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 )
@@ -30,7 +37,17 @@ type podManager struct {
 	requests chan (*cniserver.PodRequest)
 	// Tracks pod :: IP address for hostport handling
 
-	dClient dockertools.DockerInterface
+	// setupStateLock guards setupState.
+	setupStateLock sync.Mutex
+	// setupState records, per pod key (see getPodKey), the setup call this
+	// node most recently completed successfully and hasn't yet torn down.
+	// pod_teardown_reconcile.go uses it to find pods a real CNI_DEL never
+	// arrived for.
+	setupState map[string]*podSetupState
+
+	// runtime resolves a container's network namespace path; see
+	// containerruntime.go.
+	runtime containerRuntime
 
 	// Live pod setup/teardown stuff not used in testing code
 	multitenant bool
@@ -38,16 +55,66 @@ type podManager struct {
 	vnids       *nodeVNIDMap
 	ipamConfig  []byte
 	mtu         uint32
+
+	// ovs and alsoAcceptVNIDsNamespaces back the k8s-ovs/also-accept-vnids
+	// pod annotation; see also_accept_vnids.go. ovs is nil in tests, which
+	// don't exercise that annotation.
+	ovs                       ovs.FlowBackend
+	alsoAcceptVNIDsNamespaces sets.String
+
+	// egressRouterAllowedCIDRs and egressRouterInterface back the
+	// k8s-ovs/egress-router-source-ip pod annotation; see egress_router.go.
+	// egressRouterInterface is empty by default, disabling the feature even
+	// for a pod that requests it.
+	egressRouterAllowedCIDRs []*net.IPNet
+	egressRouterInterface    string
+
+	// execer runs the k8s-sdn-ovs veth setup script; see pod_linux.go.
+	execer kexec.Interface
+
+	// vnidDrain backs updatePodNetwork's optional grace-period transition
+	// mode; see vnid_transition_drain.go. nil disables it, in tests and
+	// whenever WithVNIDTransitionGracePeriod is left at its zero default.
+	vnidDrain *vnidDrainQueue
+
+	// arpCheckEnabled and arpCheckTimeout back the pre-success duplicate
+	// address check in setup; see pod_arp_check.go.
+	arpCheckEnabled bool
+	arpCheckTimeout time.Duration
+
+	// maintenanceFreeze backs setup's freeze check: a genuinely new pod is
+	// refused while frozen unless allowNewPodsWhileFrozen is set. nil in
+	// tests, which don't exercise a freeze.
+	maintenanceFreeze       *maintenanceFreezeState
+	allowNewPodsWhileFrozen bool
+
+	// eClient and additionalNetworkState back getPodConfig's namespace ->
+	// additional-network lookup; see multinetwork.go. additionalNetworkState
+	// is nil when no AdditionalNetworks are configured, the common case.
+	eClient                etcdmanager.EtcdManager
+	additionalNetworkState map[string]*additionalNetworkState
 }
 
 // Creates a new live podManager; used by node code
-func newPodManager(multitenant bool, localSubnetCIDR string, netInfo *NetworkInfo, kClient *kclient.Client, dClient dockertools.DockerInterface, vnids *nodeVNIDMap, mtu uint32) (*podManager, error) {
+func newPodManager(multitenant bool, localSubnetCIDR string, netInfo *NetworkInfo, kClient *kclient.Client, runtime containerRuntime, vnids *nodeVNIDMap, mtu uint32, flowBackend ovs.FlowBackend, alsoAcceptVNIDsNamespaces sets.String, egressRouterAllowedCIDRs []*net.IPNet, egressRouterInterface string, execer kexec.Interface, vnidDrain *vnidDrainQueue, arpCheckEnabled bool, arpCheckTimeout time.Duration, maintenanceFreeze *maintenanceFreezeState, allowNewPodsWhileFrozen bool, eClient etcdmanager.EtcdManager, additionalNetworkState map[string]*additionalNetworkState) (*podManager, error) {
 	pm := newDefaultPodManager()
 	pm.multitenant = multitenant
 	pm.kClient = kClient
-	pm.dClient = dClient
+	pm.runtime = runtime
 	pm.vnids = vnids
 	pm.mtu = mtu
+	pm.ovs = flowBackend
+	pm.alsoAcceptVNIDsNamespaces = alsoAcceptVNIDsNamespaces
+	pm.egressRouterAllowedCIDRs = egressRouterAllowedCIDRs
+	pm.egressRouterInterface = egressRouterInterface
+	pm.execer = execer
+	pm.vnidDrain = vnidDrain
+	pm.arpCheckEnabled = arpCheckEnabled
+	pm.arpCheckTimeout = arpCheckTimeout
+	pm.maintenanceFreeze = maintenanceFreeze
+	pm.allowNewPodsWhileFrozen = allowNewPodsWhileFrozen
+	pm.eClient = eClient
+	pm.additionalNetworkState = additionalNetworkState
 	pm.podHandler = pm
 
 	var err error
@@ -62,8 +129,96 @@ func newPodManager(multitenant bool, localSubnetCIDR string, netInfo *NetworkInf
 // Creates a new basic podManager; used by testcases
 func newDefaultPodManager() *podManager {
 	return &podManager{
-		requests: make(chan *cniserver.PodRequest, 20),
+		requests:   make(chan *cniserver.PodRequest, 20),
+		execer:     kexec.New(),
+		setupState: make(map[string]*podSetupState),
+	}
+}
+
+// podSetupState is what pod_teardown_reconcile.go needs to run the normal
+// teardown path for a pod whose real CNI_DEL never arrived: enough to build
+// the same PodRequest kubelet's own teardown call would have.
+type podSetupState struct {
+	uid         types.UID
+	containerID string
+	netns       string
+
+	// missingSince is when the reconciler first noticed this pod was gone
+	// or terminal; the zero value means it still looks live. Reset to zero
+	// if the pod reappears before the grace period elapses, so a momentary
+	// informer hiccup doesn't get treated the same as a real leftover.
+	missingSince time.Time
+}
+
+// trackPodSetup records that req's pod now has live setup state, superseding
+// any state already recorded for the same pod key -- including a different
+// pod (by UID) that reused the same namespace/name and never had its own
+// teardown recorded, which pod_teardown_reconcile.go treats as normal
+// (setup implicitly means whatever came before is gone).
+func (m *podManager) trackPodSetup(req *cniserver.PodRequest, uid types.UID) {
+	m.setupStateLock.Lock()
+	defer m.setupStateLock.Unlock()
+	m.setupState[getPodKey(req)] = &podSetupState{
+		uid:         uid,
+		containerID: req.ContainerId,
+		netns:       req.Netns,
+	}
+}
+
+// forgetPodSetup clears req's pod's setup state, if any. It's a no-op if the
+// recorded state belongs to a different container, so a stale teardown call
+// for a pod that has since been re-added can't clobber the new state.
+func (m *podManager) forgetPodSetup(req *cniserver.PodRequest) {
+	m.setupStateLock.Lock()
+	defer m.setupStateLock.Unlock()
+	key := getPodKey(req)
+	if state, ok := m.setupState[key]; ok && state.containerID == req.ContainerId {
+		delete(m.setupState, key)
+	}
+}
+
+// snapshotPodSetupState returns a shallow copy of the current setup state,
+// keyed by pod key, for pod_teardown_reconcile.go to scan without holding
+// setupStateLock while it also has to touch the pod cache.
+func (m *podManager) snapshotPodSetupState() map[string]*podSetupState {
+	m.setupStateLock.Lock()
+	defer m.setupStateLock.Unlock()
+	snapshot := make(map[string]*podSetupState, len(m.setupState))
+	for key, state := range m.setupState {
+		copied := *state
+		snapshot[key] = &copied
+	}
+	return snapshot
+}
+
+// markPodSetupMissing records that the pod at key looked gone or terminal as
+// of now, unless it's already marked missing from an earlier check, and
+// returns the (possibly earlier) time it was first noticed missing. It's a
+// no-op if state has since been superseded or cleared.
+func (m *podManager) markPodSetupMissing(key string, expected *podSetupState, now time.Time) time.Time {
+	m.setupStateLock.Lock()
+	defer m.setupStateLock.Unlock()
+	state, ok := m.setupState[key]
+	if !ok || state.uid != expected.uid || state.containerID != expected.containerID {
+		return now
+	}
+	if state.missingSince.IsZero() {
+		state.missingSince = now
+	}
+	return state.missingSince
+}
+
+// clearPodSetupMissing un-marks key as missing, since the pod was seen live
+// again before the grace period elapsed. It's a no-op if state has since
+// been superseded or cleared.
+func (m *podManager) clearPodSetupMissing(key string, expected *podSetupState) {
+	m.setupStateLock.Lock()
+	defer m.setupStateLock.Unlock()
+	state, ok := m.setupState[key]
+	if !ok || state.uid != expected.uid || state.containerID != expected.containerID {
+		return
 	}
+	state.missingSince = time.Time{}
 }
 
 // Generates a CNI IPAM config from a given node cluster and local subnet that
@@ -0,0 +1,134 @@
+package ksdn
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/ns"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	"k8s-ovs/cniserver"
+)
+
+const (
+	// arpingBinary is the iputils tool setup shells out to from inside the
+	// container netns, both to probe for a squatting device (-D) and to
+	// announce the address once it's confirmed free (-U).
+	arpingBinary = "arping"
+
+	// defaultDuplicateAddressCheckTimeout bounds how long the duplicate
+	// address check waits for a conflicting reply, absent
+	// WithDuplicateAddressDetection. Kept well under a second so a
+	// squatting device can only ever add a small, bounded delay to pod
+	// setup.
+	defaultDuplicateAddressCheckTimeout = 200 * time.Millisecond
+
+	// maxDuplicateAddressAttempts caps how many candidate addresses setup
+	// will try before giving up, so a subnet that's mostly squatted-on
+	// fails setup instead of looping the allocator forever.
+	maxDuplicateAddressAttempts = 3
+)
+
+// checkDuplicateAddress ARP-probes ip for a conflicting reply from the pod's
+// interface inside the container netns, returning an error if one arrives
+// within the configured timeout (someone else is already using ip) or the
+// probe itself couldn't be run.
+func (m *podManager) checkDuplicateAddress(netnsPath, ip string) error {
+	timeout := m.arpCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultDuplicateAddressCheckTimeout
+	}
+
+	return ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		out, err := m.execer.Command(arpingBinary, "-D", "-q", "-c", "1", "-w", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64), "-I", podInterfaceName, ip).CombinedOutput()
+		if isScriptError(err) {
+			return fmt.Errorf("address %s appears to already be in use on the pod network: %s", ip, getScriptError(out))
+		}
+		return err
+	})
+}
+
+// sendGratuitousARP announces ip from the pod's interface so upstream ARP
+// caches update quickly after IP reuse. Best-effort: a failure here doesn't
+// fail pod setup, since a stale cache entry will eventually just expire on
+// its own.
+func (m *podManager) sendGratuitousARP(netnsPath, ip string) {
+	err := ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		out, err := m.execer.Command(arpingBinary, "-U", "-q", "-c", "1", "-I", podInterfaceName, ip).CombinedOutput()
+		if isScriptError(err) {
+			return fmt.Errorf("%s", getScriptError(out))
+		}
+		return err
+	})
+	if err != nil {
+		glog.Warningf("Failed to send gratuitous ARP for %s: %v", ip, err)
+	}
+}
+
+// reconfigureContainerAddress replaces the pod interface's address with the
+// one in ipamResult, used by ensureUniqueAddress to move to a freshly
+// allocated candidate after a conflict.
+func reconfigureContainerAddress(netnsPath string, ipamResult *cnitypes.Result) error {
+	return ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		iface, err := netlink.LinkByName(podInterfaceName)
+		if err != nil {
+			return fmt.Errorf("failed to fetch container veth: %v", err)
+		}
+		addrs, err := netlink.AddrList(iface, syscall.AF_INET)
+		if err != nil {
+			return fmt.Errorf("failed to list container addresses: %v", err)
+		}
+		for i := range addrs {
+			if err := netlink.AddrDel(iface, &addrs[i]); err != nil {
+				return fmt.Errorf("failed to remove previous container address: %v", err)
+			}
+		}
+
+		ipamResult.IP4.Gateway = nil
+		if err := ipam.ConfigureIface(podInterfaceName, ipamResult); err != nil {
+			return fmt.Errorf("failed to reconfigure container IPAM: %v", err)
+		}
+		return nil
+	})
+}
+
+// ensureUniqueAddress runs the duplicate address check against ipamResult's
+// allocated address, releasing it and retrying with a freshly allocated one
+// up to maxDuplicateAddressAttempts times if a conflicting reply arrives. On
+// success it sends a gratuitous ARP for the address it settles on. A no-op
+// returning ipamResult unchanged if m.arpCheckEnabled is false.
+func (m *podManager) ensureUniqueAddress(req *cniserver.PodRequest, ipamResult *cnitypes.Result) (*cnitypes.Result, error) {
+	if !m.arpCheckEnabled {
+		return ipamResult, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		podIP := ipamResult.IP4.IP.IP.String()
+		err := m.checkDuplicateAddress(req.Netns, podIP)
+		if err == nil {
+			m.sendGratuitousARP(req.Netns, podIP)
+			return ipamResult, nil
+		}
+		if attempt >= maxDuplicateAddressAttempts {
+			return nil, fmt.Errorf("duplicate address check failed after %d attempts: %v", attempt, err)
+		}
+		glog.Warningf("Duplicate address check failed for %s, retrying with a new address: %v", podIP, err)
+
+		if delErr := m.ipamDel(req.ContainerId); delErr != nil {
+			glog.Warningf("Failed to release conflicting IPAM allocation %s: %v", podIP, delErr)
+		}
+		ipamResult, err = m.ipamAdd(req.Netns, req.ContainerId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate a replacement address after a duplicate address conflict: %v", err)
+		}
+		if err := reconfigureContainerAddress(req.Netns, ipamResult); err != nil {
+			return nil, err
+		}
+	}
+}
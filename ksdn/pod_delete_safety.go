@@ -0,0 +1,101 @@
+package ksdn
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/intstr"
+	"k8s.io/kubernetes/pkg/util/sets"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// massPodDeleteAckAnnotation lets an operator force through a mass pod
+// deletion podDeleteGuard would otherwise hold back for exceeding its
+// threshold, without waiting for the next reconcile to re-verify it. It's
+// read off the Namespace object, since the question is whether deleting
+// (most of) that namespace's pods is really intended.
+const massPodDeleteAckAnnotation = "k8s-ovs.com/allow-mass-pod-delete"
+
+// podDeleteGuard is updatePodNetwork's safety valve against deleting most or
+// all of a namespace's pods in one pass: a bug elsewhere (GetLocalPods
+// misclassifying pods after an API quirk, a stale watch) could otherwise
+// turn a single VNID event into a namespace-wide outage. The first time a
+// namespace crosses the threshold, the guard holds the deletion back and
+// remembers which pods it was about to delete. If a later call reports the
+// exact same set again, that's taken as re-verification that this isn't a
+// one-off glitch, and the deletion is allowed through.
+type podDeleteGuard struct {
+	lock sync.Mutex
+	// pending maps namespace to the pod names held back on the last
+	// tripped attempt.
+	pending map[string]sets.String
+}
+
+func newPodDeleteGuard() *podDeleteGuard {
+	return &podDeleteGuard{pending: make(map[string]sets.String)}
+}
+
+// allow decides whether otherPods (out of totalPods local pods currently in
+// namespace) may be deleted. threshold is nil to disable the guard entirely
+// (the break-glass case, for migrations that legitimately touch every pod).
+// acked is called, at most once, only once the threshold is known to be
+// exceeded, to check whether namespace carries massPodDeleteAckAnnotation --
+// it's a func rather than a bool so the common under-threshold path never
+// pays for the Namespace API call.
+func (g *podDeleteGuard) allow(namespace string, otherPods []kapi.Pod, totalPods int, threshold *intstr.IntOrString, acked func() bool) bool {
+	names := sets.NewString()
+	for _, pod := range otherPods {
+		names.Insert(pod.Name)
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if len(names) == 0 || threshold == nil {
+		delete(g.pending, namespace)
+		return true
+	}
+
+	limit, err := intstr.GetValueFromIntOrPercent(threshold, totalPods, true)
+	if err != nil {
+		glog.Errorf("Invalid pod delete safety threshold %v: %v; allowing deletion in namespace %q", threshold, err, namespace)
+		delete(g.pending, namespace)
+		return true
+	}
+	if len(names) <= limit {
+		delete(g.pending, namespace)
+		return true
+	}
+
+	if acked() {
+		glog.Warningf("Mass deletion of %d/%d pods in namespace %q exceeds safety threshold %v; proceeding, acknowledged via %s annotation", len(names), totalPods, namespace, threshold, massPodDeleteAckAnnotation)
+		delete(g.pending, namespace)
+		return true
+	}
+
+	if prev, held := g.pending[namespace]; held && prev.Len() == names.Len() && prev.HasAll(names.List()...) {
+		glog.Warningf("Mass deletion of %d/%d pods in namespace %q exceeds safety threshold %v; proceeding, re-verified unchanged on reconcile", len(names), totalPods, namespace, threshold)
+		delete(g.pending, namespace)
+		return true
+	}
+
+	metrics.MassPodDeleteHeld.Inc()
+	glog.Errorf("Holding back deletion of %d/%d pods in namespace %q: exceeds safety threshold %v; set %s=true on the namespace to override, or wait for the next reconcile to re-verify", len(names), totalPods, namespace, threshold, massPodDeleteAckAnnotation)
+	g.pending[namespace] = names
+	return false
+}
+
+// massPodDeleteAcked reports whether namespace carries
+// massPodDeleteAckAnnotation, letting an operator force through a mass pod
+// deletion the safety threshold would otherwise hold back.
+func (node *KsdnNode) massPodDeleteAcked(namespace string) bool {
+	ns, err := node.kClient.Namespaces().Get(namespace)
+	if err != nil {
+		glog.Warningf("Could not get namespace %q to check %s annotation: %v", namespace, massPodDeleteAckAnnotation, err)
+		return false
+	}
+	return ns.Annotations[massPodDeleteAckAnnotation] == "true"
+}
@@ -0,0 +1,154 @@
+package ksdn
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/apis/policy"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// defaultPodEvictionGracePeriodSeconds is how long a pod gets to shut down
+// cleanly when updatePodNetwork evicts it, absent WithPodEvictionGracePeriod.
+const defaultPodEvictionGracePeriodSeconds = int64(30)
+
+// defaultPodEvictionMaxAttempts is how many times updatePodNetwork retries a
+// pod's eviction after a PodDisruptionBudget rejection before giving up on
+// it, absent WithPodEvictionMaxAttempts.
+const defaultPodEvictionMaxAttempts = 10
+
+// podEvictionHeldEventReason is the Event reason recorded against a pod
+// updatePodNetwork gave up evicting after repeated PodDisruptionBudget
+// rejections.
+const podEvictionHeldEventReason = "PodEvictionHeld"
+
+// evictPod requests pod's eviction through the pods/eviction subresource
+// (see PodDisruptionBudget) instead of deleting it directly, so the
+// apiserver can reject the request when it would violate a
+// PodDisruptionBudget. This vendor tree has no generated client for the
+// subresource, so the request is built the same bespoke way
+// PodExpansion.Bind builds the equally ungenerated bindings subresource.
+func evictPod(kClient *kclient.Client, pod kapi.Pod, gracePeriodSeconds int64) error {
+	eviction := &policy.Eviction{
+		ObjectMeta: kapi.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: &kapi.DeleteOptions{GracePeriodSeconds: &gracePeriodSeconds},
+	}
+	return kClient.Post().
+		Namespace(pod.Namespace).
+		Resource("pods").
+		Name(pod.Name).
+		SubResource("eviction").
+		Body(eviction).
+		Do().
+		Error()
+}
+
+// isPDBRejection reports whether err is the apiserver's response to an
+// eviction request that would violate a PodDisruptionBudget, as opposed to
+// some other failure (a real API error, a pod that's already gone).
+func isPDBRejection(err error) bool {
+	status, ok := err.(kerrors.APIStatus)
+	return ok && status.Status().Code == kerrors.StatusTooManyRequests
+}
+
+// evictOtherPods evicts namespace's otherPods (the pods GetLocalPods found
+// without a running container) through the eviction subresource instead of
+// a hard Delete, so a PodDisruptionBudget can hold one back rather than a
+// mass VNID-transition delete taking down a quorum-based workload's last
+// remaining replicas; see updatePodNetwork.
+func (node *KsdnNode) evictOtherPods(namespace string, otherPods []kapi.Pod) {
+	for _, pod := range otherPods {
+		node.evictPodWithRetry(pod)
+	}
+}
+
+// evictPodWithRetry retries pod's eviction with backoff while it's being
+// rejected by a PodDisruptionBudget, up to podEvictionMaxAttempts, then
+// leaves the pod alone and reports the situation via Event and metric --
+// rather than escalating to a hard delete, which is exactly the disruption a
+// PodDisruptionBudget exists to prevent. Any other eviction error (the pod
+// is already gone, an unrelated API failure) is logged and abandoned
+// immediately, without consuming a retry budget meant for PDB contention.
+func (node *KsdnNode) evictPodWithRetry(pod kapi.Pod) {
+	maxAttempts := node.podEvictionMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultPodEvictionMaxAttempts
+	}
+	gracePeriodSeconds := node.podEvictionGracePeriodSeconds
+	if gracePeriodSeconds <= 0 {
+		gracePeriodSeconds = defaultPodEvictionGracePeriodSeconds
+	}
+	backoff := utilwait.Backoff{
+		Duration: 1 * time.Second,
+		Factor:   2,
+		Steps:    maxAttempts,
+	}
+
+	var lastErr error
+	attempts := 0
+	err := utilwait.ExponentialBackoff(backoff, func() (bool, error) {
+		attempts++
+		evictErr := evictPod(node.kClient, pod, gracePeriodSeconds)
+		switch {
+		case evictErr == nil || kerrors.IsNotFound(evictErr):
+			return true, nil
+		case isPDBRejection(evictErr):
+			lastErr = evictErr
+			return false, nil
+		default:
+			return false, evictErr
+		}
+	})
+
+	switch {
+	case err == nil:
+		return
+	case err == utilwait.ErrWaitTimeout:
+		glog.Warningf("Gave up evicting pod %q in namespace %q after %d attempts, still rejected by a PodDisruptionBudget: %v", pod.Name, pod.Namespace, attempts, lastErr)
+		metrics.PodEvictionHeld.Inc()
+		node.recordPodEvictionHeldEvent(pod, lastErr, attempts)
+	default:
+		glog.Errorf("Could not evict pod %q in namespace %q: %v", pod.Name, pod.Namespace, err)
+	}
+}
+
+// recordPodEvictionHeldEvent records a Warning Event against pod so an
+// operator sees it's been left running past its namespace's VNID
+// transition, rather than silently piling up alongside a stale netid. Best
+// effort: logged on failure, never fails the caller.
+func (node *KsdnNode) recordPodEvictionHeldEvent(pod kapi.Pod, cause error, attempts int) {
+	now := unversioned.NewTime(time.Now())
+	event := &kapi.Event{
+		ObjectMeta: kapi.ObjectMeta{
+			GenerateName: "k8s-ovs-pod-eviction-held.",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: kapi.ObjectReference{
+			Kind:      "Pod",
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			UID:       pod.UID,
+		},
+		Reason:         podEvictionHeldEventReason,
+		Message:        fmt.Sprintf("Held back eviction after %d attempts, still rejected by a PodDisruptionBudget: %v", attempts, cause),
+		Source:         kapi.EventSource{Component: "k8s-ovs"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           kapi.EventTypeWarning,
+	}
+	if _, err := node.kClient.Events(pod.Namespace).Create(event); err != nil {
+		glog.Warningf("Could not record pod eviction held event for pod %q in namespace %q: %v", pod.Name, pod.Namespace, err)
+	}
+}
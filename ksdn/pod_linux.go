@@ -2,18 +2,17 @@ package ksdn
 
 import (
 	"fmt"
-	"os/exec"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 
 	kapi "k8s.io/kubernetes/pkg/api"
-	kcontainer "k8s.io/kubernetes/pkg/kubelet/container"
-	"k8s.io/kubernetes/pkg/kubelet/dockertools"
 	knetwork "k8s.io/kubernetes/pkg/kubelet/network"
 	kbandwidth "k8s.io/kubernetes/pkg/util/bandwidth"
+	kexec "k8s.io/kubernetes/pkg/util/exec"
 
 	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/ip"
@@ -23,6 +22,7 @@ import (
 
 	"github.com/vishvananda/netlink"
 	"k8s-ovs/cniserver"
+	"k8s-ovs/pkg/metrics"
 )
 
 const (
@@ -62,7 +62,11 @@ func (m *podManager) getPodConfig(req *cniserver.PodRequest) (*PodConfig, *kapi.
 
 	config := &PodConfig{}
 	if m.multitenant {
-		config.vnid, err = m.vnids.GetVNID(req.PodNamespace)
+		vnids, err := m.vnidsForNamespace(req.PodNamespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.vnid, err = vnids.GetVNID(req.PodNamespace)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -166,7 +170,7 @@ func (m *podManager) ipamDel(id string) error {
 }
 
 func isScriptError(err error) bool {
-	_, ok := err.(*exec.ExitError)
+	_, ok := err.(kexec.ExitError)
 	return ok
 }
 
@@ -187,7 +191,16 @@ func vnidToString(vnid uint32) string {
 
 // Set up all networking (host/container veth, OVS flows, IPAM, loopback, etc)
 func (m *podManager) setup(req *cniserver.PodRequest) (*cnitypes.Result, error) {
-	podConfig, _, err := m.getPodConfig(req)
+	if m.maintenanceFreeze != nil && m.maintenanceFreeze.Frozen() && !m.allowNewPodsWhileFrozen {
+		return nil, fmt.Errorf("cluster dataplane is frozen for maintenance; refusing to set up pod %s/%s (kubelet will retry)", req.PodNamespace, req.PodName)
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.PodSetupLatency.Observe(time.Since(start).Seconds())
+	}()
+
+	podConfig, pod, err := m.getPodConfig(req)
 	if err != nil {
 		return nil, err
 	}
@@ -238,9 +251,15 @@ func (m *podManager) setup(req *cniserver.PodRequest) (*cnitypes.Result, error)
 		return nil, err
 	}
 
+	ipamResult, err = m.ensureUniqueAddress(req, ipamResult)
+	if err != nil {
+		return nil, err
+	}
+	podIP = ipamResult.IP4.IP.IP
+
 	contVethMac := contVeth.Attrs().HardwareAddr.String()
 	vnidStr := vnidToString(podConfig.vnid)
-	out, err := exec.Command(sdnScript, setUpCmd, hostVeth.Attrs().Name, contVethMac, podIP.String(), vnidStr, podConfig.ingressBandwidth, podConfig.egressBandwidth).CombinedOutput()
+	out, err := m.execer.Command(sdnScript, setUpCmd, hostVeth.Attrs().Name, contVethMac, podIP.String(), vnidStr, podConfig.ingressBandwidth, podConfig.egressBandwidth).CombinedOutput()
 	glog.V(5).Infof("SetUpPod network plugin output: %s, %v", string(out), err)
 
 	if isScriptError(err) {
@@ -249,17 +268,22 @@ func (m *podManager) setup(req *cniserver.PodRequest) (*cnitypes.Result, error)
 		return nil, err
 	}
 
+	m.installAlsoAcceptVNIDFlows(pod, hostVeth.Attrs().Name, podIP.String())
+	m.installVNIDDrainFlow(pod, hostVeth.Attrs().Name, podIP.String())
+	m.setUpEgressRouter(pod, req.Netns)
+
 	success = true
+	metrics.ActivePodPorts.Inc()
+	m.trackPodSetup(req, pod.UID)
 	return ipamResult, nil
 }
 
 func (m *podManager) getContainerNetnsPath(id string) (string, error) {
-	inspectResult, err := m.dClient.InspectContainer(kcontainer.DockerID(id).ContainerID().ID)
+	netnsPath, err := m.runtime.GetNetNS(id)
 	if err != nil {
-		glog.Errorf("Error inspecting container: '%v'", err)
+		glog.Errorf("Error resolving container netns: '%v'", err)
 		return "", err
 	}
-	netnsPath := fmt.Sprintf(dockertools.DockerNetnsFmt, inspectResult.State.Pid)
 	return netnsPath, nil
 }
 
@@ -277,7 +301,7 @@ func (m *podManager) update(req *cniserver.PodRequest) error {
 		glog.V(5).Infof("get netns:%v for container:%v", netns, req.ContainerId)
 	}
 
-	podConfig, _, err := m.getPodConfig(req)
+	podConfig, pod, err := m.getPodConfig(req)
 	if err != nil {
 		return err
 	}
@@ -288,7 +312,7 @@ func (m *podManager) update(req *cniserver.PodRequest) error {
 	}
 
 	vnidStr := vnidToString(podConfig.vnid)
-	out, err := exec.Command(sdnScript, updateCmd, hostVethName, contVethMac, podIP, vnidStr, podConfig.ingressBandwidth, podConfig.egressBandwidth).CombinedOutput()
+	out, err := m.execer.Command(sdnScript, updateCmd, hostVethName, contVethMac, podIP, vnidStr, podConfig.ingressBandwidth, podConfig.egressBandwidth).CombinedOutput()
 	glog.V(5).Infof("UpdatePod network plugin output: %s, %v", string(out), err)
 
 	if isScriptError(err) {
@@ -297,6 +321,9 @@ func (m *podManager) update(req *cniserver.PodRequest) error {
 		return err
 	}
 
+	m.installAlsoAcceptVNIDFlows(pod, hostVethName, podIP)
+	m.installVNIDDrainFlow(pod, hostVethName, podIP)
+
 	return nil
 }
 
@@ -317,7 +344,7 @@ func (m *podManager) teardown(req *cniserver.PodRequest) error {
 		}
 
 		// The script's teardown functionality doesn't need the VNID
-		out, err := exec.Command(sdnScript, tearDownCmd, hostVethName, contVethMac, podIP, "-1").CombinedOutput()
+		out, err := m.execer.Command(sdnScript, tearDownCmd, hostVethName, contVethMac, podIP, "-1").CombinedOutput()
 		glog.V(5).Infof("TearDownPod network plugin output: %s, %v", string(out), err)
 
 		if isScriptError(err) {
@@ -331,5 +358,9 @@ func (m *podManager) teardown(req *cniserver.PodRequest) error {
 		return err
 	}
 
+	if netnsValid {
+		metrics.ActivePodPorts.Dec()
+	}
+	m.forgetPodSetup(req)
 	return nil
 }
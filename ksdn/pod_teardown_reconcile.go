@@ -0,0 +1,85 @@
+package ksdn
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+
+	"k8s-ovs/cniserver"
+)
+
+// podTeardownReconcileSyncPeriod is how often the reconciler scans for pods
+// this node still holds setup state for but that went terminal or vanished
+// without a real CNI_DEL ever arriving -- e.g. kubelet or the CNI socket
+// dropped the call during a node restart.
+const podTeardownReconcileSyncPeriod = 1 * time.Minute
+
+// podTeardownGracePeriod is how long a pod must have looked gone or
+// terminal, continuously, before the reconciler tears it down. This gives a
+// pod that's simply being recreated (or an informer that's momentarily
+// behind) time to resolve on its own before we act on stale state.
+const podTeardownGracePeriod = 2 * time.Minute
+
+// startPodTeardownReconcile starts a goroutine that periodically reconciles
+// podManager's setup state against node.pods. It does nothing until the pod
+// cache has completed its initial sync, so a node that's just starting up
+// never mistakes "haven't listed yet" for "pod is gone".
+func (node *KsdnNode) startPodTeardownReconcile() {
+	go utilwait.Until(node.reconcilePodTeardowns, podTeardownReconcileSyncPeriod, node.ctx.Done())
+}
+
+func (node *KsdnNode) reconcilePodTeardowns() {
+	if !node.pods.HasSynced() {
+		return
+	}
+
+	live, err := node.pods.Pods(kapi.NamespaceAll)
+	if err != nil {
+		glog.Errorf("Failed to list local pods for teardown reconciliation: %v", err)
+		return
+	}
+	liveByKey := make(map[string]*kapi.Pod, len(live))
+	for i := range live {
+		pod := &live[i]
+		liveByKey[pod.Namespace+"/"+pod.Name] = pod
+	}
+
+	now := time.Now()
+	for key, state := range node.podManager.snapshotPodSetupState() {
+		namespace, name, err := kcache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			glog.Errorf("Failed to parse pod key %q during teardown reconciliation: %v", key, err)
+			continue
+		}
+		if node.unmanaged.Contains(namespace) {
+			continue
+		}
+
+		pod, stillHere := liveByKey[key]
+		leftover := !stillHere || pod.UID != state.uid || podPhaseTerminal(pod.Status.Phase)
+		if !leftover {
+			node.podManager.clearPodSetupMissing(key, state)
+			continue
+		}
+
+		missingSince := node.podManager.markPodSetupMissing(key, state, now)
+		if now.Sub(missingSince) < podTeardownGracePeriod {
+			continue
+		}
+
+		glog.Warningf("Pod %s/%s (uid %s) has been gone or terminal for over %s with no teardown call ever received; reconciling leftover SDN state", namespace, name, state.uid, podTeardownGracePeriod)
+		if _, err := node.runPodRequest(cniserver.CNI_DEL, namespace, name, state.containerID, state.netns); err != nil {
+			glog.Errorf("Failed to reconcile leftover SDN state for pod %s/%s: %v", namespace, name, err)
+		}
+	}
+}
+
+// podPhaseTerminal reports whether phase means the pod's containers have all
+// exited for good and won't be restarted by kubelet under that pod UID.
+func podPhaseTerminal(phase kapi.PodPhase) bool {
+	return phase == kapi.PodSucceeded || phase == kapi.PodFailed
+}
@@ -0,0 +1,139 @@
+package ksdn
+
+import (
+	"sync"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+)
+
+// podCacheResyncPeriod is how often the local pod informer re-lists, so a
+// dropped or missed watch event is eventually corrected.
+const podCacheResyncPeriod = 30 * time.Minute
+
+// podCache is a node-local, namespace-indexed cache of pods scheduled to
+// this node, kept in sync by a watch instead of being re-listed from the
+// API server on every caller. It backs GetLocalPods and lets features like
+// orphan cleanup and teardown reconciliation inspect local pods without
+// making their own API calls.
+type podCache struct {
+	indexer    kcache.Indexer
+	controller *framework.Controller
+
+	mu        sync.Mutex
+	listeners []func(namespace string)
+}
+
+func newPodCache(kClient *kclient.Client, hostname string) *podCache {
+	pc := &podCache{}
+
+	fieldSelector := fields.Set{"spec.nodeName": hostname}.AsSelector()
+	lw := kcache.NewListWatchFromClient(kClient, "pods", kapi.NamespaceAll, fieldSelector)
+	indexer, controller := framework.NewIndexerInformer(
+		lw,
+		&kapi.Pod{},
+		podCacheResyncPeriod,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { pc.notify(podCacheNamespace(obj)) },
+			DeleteFunc: func(obj interface{}) { pc.notify(podCacheNamespace(obj)) },
+		},
+		kcache.Indexers{kcache.NamespaceIndex: kcache.MetaNamespaceIndexFunc},
+	)
+	pc.indexer = indexer
+	pc.controller = controller
+	return pc
+}
+
+// newStaticPodCache returns a podCache pre-loaded with pods and backed by no
+// informer, for tests that need GetLocalPods to see a fixed set without
+// running a real watch against an API server; see WithLocalPods.
+func newStaticPodCache(pods []kapi.Pod) *podCache {
+	indexer := kcache.NewIndexer(kcache.MetaNamespaceKeyFunc, kcache.Indexers{kcache.NamespaceIndex: kcache.MetaNamespaceIndexFunc})
+	for i := range pods {
+		indexer.Add(&pods[i])
+	}
+	return &podCache{indexer: indexer}
+}
+
+// OnNamespaceChanged registers fn to be called with a namespace's name
+// whenever a local pod is added to or removed from it. It does not
+// distinguish an add from a remove; callers should re-check current state
+// (e.g. via Pods) rather than trying to infer it from the callback.
+func (pc *podCache) OnNamespaceChanged(fn func(namespace string)) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.listeners = append(pc.listeners, fn)
+}
+
+func (pc *podCache) notify(namespace string) {
+	if namespace == "" {
+		return
+	}
+	pc.mu.Lock()
+	listeners := make([]func(string), len(pc.listeners))
+	copy(listeners, pc.listeners)
+	pc.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(namespace)
+	}
+}
+
+// podCacheNamespace extracts the namespace of an informer AddFunc/DeleteFunc
+// object, handling the DeletedFinalStateUnknown wrapper delivered for
+// deletes the informer missed the direct notification for.
+func podCacheNamespace(obj interface{}) string {
+	key, err := DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return ""
+	}
+	namespace, _, err := kcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return ""
+	}
+	return namespace
+}
+
+// Run starts the cache's informer. It does not block.
+func (pc *podCache) Run(stopCh <-chan struct{}) {
+	go pc.controller.Run(stopCh)
+}
+
+// WaitForSync blocks until the cache has completed its initial list.
+func (pc *podCache) WaitForSync(stopCh <-chan struct{}) bool {
+	return framework.WaitForCacheSync(stopCh, pc.controller.HasSynced)
+}
+
+// HasSynced reports whether the cache has completed its initial list,
+// without blocking. Used by periodic reconcilers that would rather skip a
+// pass than wait, since they'll be back again next period.
+func (pc *podCache) HasSynced() bool {
+	return pc.controller.HasSynced()
+}
+
+// Pods returns the cached pods in namespace, or across all namespaces if
+// namespace is kapi.NamespaceAll.
+func (pc *podCache) Pods(namespace string) ([]kapi.Pod, error) {
+	if namespace == kapi.NamespaceAll {
+		objs := pc.indexer.List()
+		pods := make([]kapi.Pod, 0, len(objs))
+		for _, obj := range objs {
+			pods = append(pods, *obj.(*kapi.Pod))
+		}
+		return pods, nil
+	}
+
+	objs, err := pc.indexer.ByIndex(kcache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]kapi.Pod, 0, len(objs))
+	for _, obj := range objs {
+		pods = append(pods, *obj.(*kapi.Pod))
+	}
+	return pods, nil
+}
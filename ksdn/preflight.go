@@ -0,0 +1,258 @@
+package ksdn
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	kexec "k8s.io/kubernetes/pkg/util/exec"
+	"k8s.io/kubernetes/pkg/util/sysctl"
+
+	"k8s-ovs/pkg/ovs"
+)
+
+// minOVSVersion is the oldest ovs-vsctl version k8s-ovs's flow syntax and
+// table layout are known to work against. There's no way to fix an old OVS
+// package short of upgrading it by hand, so preflightOVSVersion only ever
+// reports this one, never fixes it.
+const minOVSVersion = "2.5.0"
+
+// requiredKernelModules are the modules k8s-ovs depends on that aren't
+// necessarily loaded by default: the openvswitch datapath itself, and vxlan
+// for the tunnel overlay. preflightKernelModules loads whichever of these
+// aren't already present.
+var requiredKernelModules = []string{"openvswitch", "vxlan"}
+
+// preflightRPFilterInterfaces are the interfaces preflightRPFilter loosens
+// rp_filter on -- deliberately just these two rather than
+// net/ipv4/conf/all or /default, so fixing a strict rp_filter here can never
+// change how the node treats traffic on an interface unrelated to the SDN
+// overlay.
+var preflightRPFilterInterfaces = []string{TUN, VXLAN}
+
+// PreflightCheck is one prerequisite runPreflight verified -- and tried to
+// fix, if Fixed is true -- before allowing node startup to proceed.
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Fixed  bool   `json:"fixed,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// PreflightReport is the outcome of every check runPreflight ran, included
+// in the node's SDN status record (see node_status.go) so a failed
+// prerequisite -- or a fix runPreflight applied -- is visible without a
+// shell on the node.
+type PreflightReport struct {
+	Checks []PreflightCheck `json:"checks"`
+	OK     bool             `json:"ok"`
+}
+
+// RunPreflightCheck runs every startup preflight check with a plain local
+// executor, printing a human-readable report to stdout, for --preflight-only
+// (see main.go). It talks to neither Kubernetes nor etcd, so it can run
+// standalone in a node-validation pipeline before the daemon itself is ever
+// started. Returns nil if every check passed (after applying whichever
+// fixes were safe to apply automatically), or the same consolidated error
+// runPreflight would return otherwise.
+func RunPreflightCheck() error {
+	report, err := runPreflight(kexec.New())
+	for _, c := range report.Checks {
+		status := "OK"
+		if !c.OK {
+			status = "FAIL"
+		} else if c.Fixed {
+			status = "FIXED"
+		}
+		if c.Detail != "" {
+			fmt.Printf("[%s] %s: %s\n", status, c.Name, c.Detail)
+		} else {
+			fmt.Printf("[%s] %s\n", status, c.Name)
+		}
+	}
+	return err
+}
+
+// runPreflight checks each of node startup's environmental prerequisites --
+// the openvswitch/vxlan kernel modules, IPv4 forwarding, rp_filter on the
+// SDN interfaces, and the local OVS version -- fixing whichever of those are
+// safe to fix automatically. It returns a report of every check either way;
+// err is only non-nil, carrying a consolidated human-readable summary, if a
+// check failed and couldn't be fixed.
+func runPreflight(execer kexec.Interface) (*PreflightReport, error) {
+	checks := []PreflightCheck{
+		preflightKernelModules(execer),
+		preflightIPForward(),
+		preflightRPFilter(),
+		preflightOVSVersion(execer),
+	}
+
+	report := &PreflightReport{Checks: checks, OK: true}
+	var failed []string
+	for _, c := range checks {
+		if !c.OK {
+			report.OK = false
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Detail))
+		}
+	}
+	if len(failed) > 0 {
+		return report, fmt.Errorf("preflight checks failed:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return report, nil
+}
+
+// preflightKernelModules loads whichever of requiredKernelModules aren't
+// already present, via modprobe.
+func preflightKernelModules(execer kexec.Interface) PreflightCheck {
+	const name = "kernel modules"
+
+	var loaded, failed []string
+	for _, mod := range requiredKernelModules {
+		if _, err := os.Stat(filepath.Join("/sys/module", mod)); err == nil {
+			continue
+		}
+		out, err := execer.Command("modprobe", mod).CombinedOutput()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s (modprobe failed: %v: %s)", mod, err, strings.TrimSpace(string(out))))
+			continue
+		}
+		loaded = append(loaded, mod)
+	}
+
+	if len(failed) > 0 {
+		return PreflightCheck{Name: name, Detail: fmt.Sprintf("missing and could not be loaded: %s", strings.Join(failed, ", "))}
+	}
+	if len(loaded) > 0 {
+		glog.Infof("Preflight: loaded missing kernel module(s) %s", strings.Join(loaded, ", "))
+		return PreflightCheck{Name: name, OK: true, Fixed: true, Detail: fmt.Sprintf("loaded: %s", strings.Join(loaded, ", "))}
+	}
+	return PreflightCheck{Name: name, OK: true}
+}
+
+// preflightIPForward enables net.ipv4.ip_forward if it isn't already, the
+// same sysctl SetupSDN itself relies on once the bridge is up.
+func preflightIPForward() PreflightCheck {
+	const name = "IPv4 forwarding"
+
+	sc := sysctl.New()
+	val, err := sc.GetSysctl("net/ipv4/ip_forward")
+	if err != nil {
+		return PreflightCheck{Name: name, Detail: fmt.Sprintf("could not read net.ipv4.ip_forward: %v", err)}
+	}
+	if val != 0 {
+		return PreflightCheck{Name: name, OK: true}
+	}
+
+	if err := sc.SetSysctl("net/ipv4/ip_forward", 1); err != nil {
+		return PreflightCheck{Name: name, Detail: fmt.Sprintf("net.ipv4.ip_forward=0 and could not be enabled: %v", err)}
+	}
+	glog.Infof("Preflight: enabled net.ipv4.ip_forward")
+	return PreflightCheck{Name: name, OK: true, Fixed: true, Detail: "enabled net.ipv4.ip_forward"}
+}
+
+// preflightRPFilter loosens rp_filter on preflightRPFilterInterfaces from
+// strict (1) to loose (2) mode wherever it's currently strict: strict mode
+// drops a packet whose return route doesn't go back out the interface it
+// arrived on, which the overlay's asymmetric tunnel/gateway routing
+// routinely triggers for legitimate traffic. An interface that doesn't
+// exist yet (the tunnel bridge hasn't been created) is skipped rather than
+// failed; SetupSDN creates it before any pod traffic can flow.
+func preflightRPFilter() PreflightCheck {
+	const name = "rp_filter"
+
+	sc := sysctl.New()
+	var fixed, failed []string
+	for _, iface := range preflightRPFilterInterfaces {
+		key := fmt.Sprintf("net/ipv4/conf/%s/rp_filter", iface)
+		val, err := sc.GetSysctl(key)
+		if err != nil {
+			// Interface not present yet; SetupSDN will create it and this
+			// check will apply cleanly on the next preflight run.
+			continue
+		}
+		if val != 1 {
+			continue
+		}
+		if err := sc.SetSysctl(key, 2); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", iface, err))
+			continue
+		}
+		fixed = append(fixed, iface)
+	}
+
+	if len(failed) > 0 {
+		return PreflightCheck{Name: name, Detail: fmt.Sprintf("strict rp_filter could not be loosened on: %s", strings.Join(failed, ", "))}
+	}
+	if len(fixed) > 0 {
+		glog.Infof("Preflight: loosened strict rp_filter on %s", strings.Join(fixed, ", "))
+		return PreflightCheck{Name: name, OK: true, Fixed: true, Detail: fmt.Sprintf("loosened on: %s", strings.Join(fixed, ", "))}
+	}
+	return PreflightCheck{Name: name, OK: true}
+}
+
+// preflightOVSVersion reports whether the local ovs-vsctl is at least
+// minOVSVersion. There's nothing safe to fix here automatically, so a
+// version that's too old (or unparseable, or missing entirely) just fails
+// the check.
+func preflightOVSVersion(execer kexec.Interface) PreflightCheck {
+	const name = "OVS version"
+
+	out, err := execer.Command(ovs.OVS_VSCTL, "--version").CombinedOutput()
+	if err != nil {
+		return PreflightCheck{Name: name, Detail: fmt.Sprintf("could not run %s --version: %v", ovs.OVS_VSCTL, err)}
+	}
+
+	version, err := parseOVSVersion(string(out))
+	if err != nil {
+		return PreflightCheck{Name: name, Detail: fmt.Sprintf("could not parse %s --version output: %v", ovs.OVS_VSCTL, err)}
+	}
+	if compareDottedVersions(version, minOVSVersion) < 0 {
+		return PreflightCheck{Name: name, Detail: fmt.Sprintf("OVS %s is older than the minimum supported version %s", version, minOVSVersion)}
+	}
+	return PreflightCheck{Name: name, OK: true, Detail: fmt.Sprintf("OVS %s", version)}
+}
+
+// parseOVSVersion pulls the dotted version number out of ovs-vsctl
+// --version's first line, e.g. "ovs-vsctl (Open vSwitch) 2.9.2" -> "2.9.2".
+func parseOVSVersion(output string) (string, error) {
+	firstLine := strings.SplitN(strings.TrimSpace(output), "\n", 2)[0]
+	fields := strings.Fields(firstLine)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty version output")
+	}
+	last := fields[len(fields)-1]
+	if !strings.Contains(last, ".") {
+		return "", fmt.Errorf("unrecognized version output: %q", firstLine)
+	}
+	return last, nil
+}
+
+// compareDottedVersions compares two dotted-integer version strings
+// (e.g. "2.10.0" vs "2.5.0"), returning -1, 0 or 1 the way strings.Compare
+// does. A component that isn't a valid integer compares as 0 against the
+// other side's component, rather than failing the whole comparison over one
+// odd release string (e.g. a distro suffix).
+func compareDottedVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// serviceCIDRSyncPeriod is how often a running node re-reads the cluster's
+// configured service network and checks it against checkServiceCIDR (see
+// controller.go), so a change to ClusterNetwork.ServiceNetwork is caught --
+// and, where safe, applied -- without waiting for the node to restart.
+const serviceCIDRSyncPeriod = 30 * time.Second
+
+// startServiceCIDRSync starts a goroutine that periodically re-validates
+// the configured service network against what the node's flows are
+// currently classifying.
+func (node *KsdnNode) startServiceCIDRSync() {
+	go utilwait.Until(node.syncServiceCIDR, serviceCIDRSyncPeriod, node.ctx.Done())
+}
+
+func (node *KsdnNode) syncServiceCIDR() {
+	networkConfig, err := node.eClient.GetNetworkConfig(node.ctx, node.network)
+	if err != nil {
+		glog.Errorf("Failed to get network config for service network sync: %v", err)
+		return
+	}
+
+	_, configuredNet, err := net.ParseCIDR(networkConfig.ServiceNetwork)
+	if err != nil {
+		glog.Errorf("Failed to parse configured service network %q: %v", networkConfig.ServiceNetwork, err)
+		return
+	}
+	if configuredNet.String() == node.networkInfo.ServiceNetwork.String() {
+		return
+	}
+
+	// SetupSDN reads plugin.networkInfo.ServiceNetwork fresh on every call
+	// and runs it through checkServiceCIDR, so flipping this field ahead of
+	// the call is what makes the reprogram-or-refuse decision apply to the
+	// new value. Put it back on refusal so validateNodeIP and everything
+	// else built on networkInfo keeps using the last known-good range.
+	previous := node.networkInfo.ServiceNetwork
+	node.networkInfo.ServiceNetwork = configuredNet
+	if _, err := node.SetupSDN(); err != nil {
+		node.networkInfo.ServiceNetwork = previous
+		glog.Errorf("Not adopting service network change from %s to %s: %v", previous, configuredNet, err)
+		node.recordStatusError(fmt.Sprintf("service network change to %s rejected: %v", configuredNet, err))
+		return
+	}
+	node.recordReconcile()
+	glog.Infof("Adopted service network change from %s to %s", previous, configuredNet)
+}
@@ -0,0 +1,58 @@
+package ksdn
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Recognized values for WithServiceRulesMode / --service-rules.
+const (
+	ServiceRulesEnabled  = "enabled"
+	ServiceRulesDisabled = "disabled"
+	ServiceRulesAuto     = "auto"
+)
+
+// kubeProxyHealthzURL is kube-proxy's default healthz endpoint, probed by
+// ServiceRulesAuto to detect a coexisting kube-proxy at startup.
+const kubeProxyHealthzURL = "http://127.0.0.1:10256/healthz"
+
+// kubeProxyProbeTimeout bounds the auto-detection probe so a firewalled or
+// hung port can't stall node startup.
+const kubeProxyProbeTimeout = 2 * time.Second
+
+// resolveServiceRulesMode turns mode into whether this node should program
+// its own service OVS rules, probing for a running kube-proxy when mode is
+// ServiceRulesAuto and logging the decision either way.
+func resolveServiceRulesMode(mode string) (bool, error) {
+	switch mode {
+	case ServiceRulesEnabled:
+		return true, nil
+	case ServiceRulesDisabled:
+		return false, nil
+	case ServiceRulesAuto:
+		if kubeProxyRunning() {
+			glog.Infof("service-rules=auto: detected a running kube-proxy, disabling k8s-ovs service rules")
+			return false, nil
+		}
+		glog.Infof("service-rules=auto: no running kube-proxy detected, enabling k8s-ovs service rules")
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown --service-rules value %q, must be %q, %q or %q", mode, ServiceRulesEnabled, ServiceRulesDisabled, ServiceRulesAuto)
+	}
+}
+
+// kubeProxyRunning reports whether kube-proxy's healthz endpoint answers on
+// this host, the port kube-proxy has exposed there by default since it
+// gained a healthz server.
+func kubeProxyRunning() bool {
+	client := http.Client{Timeout: kubeProxyProbeTimeout}
+	resp, err := client.Get(kubeProxyHealthzURL)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,433 @@
+package ksdn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/util/workqueue"
+)
+
+// serviceWorkers is the number of goroutines processing the service work
+// queue concurrently.
+const serviceWorkers = 2
+
+// serviceResyncPeriod is how often the service informer re-lists, so a
+// dropped or missed watch event is eventually corrected.
+const serviceResyncPeriod = 30 * time.Minute
+
+// serviceDebounceWindow is how long to hold a dirtied service key before
+// releasing it to the work queue, so a burst of changes to services in the
+// same namespace (e.g. a helm upgrade) is released as a single batch rather
+// than trickling in one at a time. A service's first observed event is
+// always released immediately so initial programming stays fast; a window
+// of 0 still works, it just releases keys on the next tick instead of
+// synchronously.
+var serviceDebounceWindow = 200 * time.Millisecond
+
+// serviceController watches Kubernetes Services through a shared informer
+// and applies the resulting OVS service rules through a rate-limited work
+// queue, so a failing sync is retried instead of silently dropped, and the
+// informer's periodic resync catches anything a retry alone would miss.
+//
+// If lazy is set, a namespace's service rules are only installed once the
+// namespace has at least one local pod (per node.pods), and are torn down
+// again once its last local pod leaves; the informer's store is retained
+// regardless, so installing on first-pod-arrival doesn't need a fresh API
+// list. NodePort/LoadBalancer services are exempt from this, since their
+// traffic can be delivered to this node by kube-proxy's DNAT regardless of
+// where the service's own pods happen to be running.
+type serviceController struct {
+	node       *KsdnNode
+	store      kcache.Store
+	controller *framework.Controller
+	queue      workqueue.RateLimitingInterface
+	debouncer  *serviceDebouncer
+	lazy       bool
+
+	// stopCh is this controller's own lifetime, separate from node.ctx, so
+	// KsdnNode.SetServiceRulesMode can stop one instance and later start a
+	// fresh one without tearing down the whole node; see Stop.
+	stopCh chan struct{}
+
+	lock    sync.Mutex
+	applied map[string]appliedService // by UID, rules currently installed
+}
+
+// appliedService is what syncService recorded installing for a service, so a
+// later sync can tell a VNID change apart from a no-op: the Service object
+// the informer delivers doesn't reflect its namespace's VNID, only netid
+// does.
+type appliedService struct {
+	svc   *kapi.Service
+	netid uint32
+}
+
+// newServiceController builds a service controller and starts its informer,
+// but does not start the workers that apply OVS rules. This lets the
+// informer's initial List of every Service in the cluster (its "cache
+// warm-up") run concurrently with the rest of node startup population; call
+// WaitForSync to wait for it, and StartWorkers once it's safe to start
+// mutating flows.
+func newServiceController(node *KsdnNode) *serviceController {
+	sc := &serviceController{
+		node:    node,
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "services"),
+		applied: make(map[string]appliedService),
+		lazy:    node.lazyServiceRules,
+		stopCh:  make(chan struct{}),
+	}
+	sc.debouncer = newServiceDebouncer(serviceDebounceWindow, sc.queue.Add)
+
+	lw := kcache.NewListWatchFromClient(node.kClient, "services", kapi.NamespaceAll, fields.Everything())
+	store, controller := framework.NewInformer(lw, &kapi.Service{}, serviceResyncPeriod, framework.ResourceEventHandlerFuncs{
+		AddFunc:    sc.enqueue,
+		UpdateFunc: func(old, cur interface{}) { sc.enqueue(cur) },
+		DeleteFunc: sc.enqueue,
+	})
+	sc.store = store
+	sc.controller = controller
+
+	if sc.lazy {
+		node.pods.OnNamespaceChanged(sc.resyncNamespace)
+	}
+
+	go controller.Run(sc.stopCh)
+	return sc
+}
+
+// WaitForSync blocks until the controller's initial List of every Service
+// has completed.
+func (sc *serviceController) WaitForSync(stopCh <-chan struct{}) bool {
+	return framework.WaitForCacheSync(stopCh, sc.controller.HasSynced)
+}
+
+// StartWorkers starts the goroutines that apply OVS service rules from the
+// work queue. It must not be called until node startup has reached its
+// flow-mutation barrier, since a worker can install or delete flows as soon
+// as it picks up its first key.
+func (sc *serviceController) StartWorkers() {
+	for i := 0; i < serviceWorkers; i++ {
+		go utilwait.Until(sc.runWorker, time.Second, sc.stopCh)
+	}
+}
+
+// Stop halts the controller's informer and workers and deletes every OVS
+// service rule it had installed, so switching service rules off at runtime
+// (see KsdnNode.SetServiceRulesMode) leaves no stale flows behind. It must
+// not be called more than once.
+func (sc *serviceController) Stop() error {
+	close(sc.stopCh)
+	sc.queue.ShutDown()
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	var lastErr error
+	for uid, entry := range sc.applied {
+		if err := sc.node.DeleteServiceRules(entry.svc); err != nil {
+			lastErr = err
+			glog.Errorf("Error deleting service rules for %s while disabling service rules: %v", serviceKey(entry.svc), err)
+		}
+		delete(sc.applied, uid)
+	}
+	return lastErr
+}
+
+// installServicesForTransition additively installs namespace's service
+// rules tagged with netID, without removing whatever's already installed
+// under a different netID; see finishServicesTransition, which tears the
+// old rules down once pods have been re-tagged. This is updatePodNetwork's
+// make-before-break path: a namespace's pods must never be re-tagged to
+// netID before its services accept traffic tagged with it. An ordinary
+// service update goes through syncService instead, which doesn't need this
+// two-phase dance since only one service changes at a time, not a whole
+// namespace's netid.
+func (sc *serviceController) installServicesForTransition(namespace string, netID uint32) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	var lastErr error
+	for _, obj := range sc.store.List() {
+		svc := obj.(*kapi.Service)
+		if svc.Namespace != namespace || !kapi.IsServiceIPSet(svc) || !sc.shouldInstall(svc) {
+			continue
+		}
+		if err := sc.node.AddServiceRules(svc, netID); err != nil {
+			lastErr = err
+			glog.Errorf("Error installing transitional service rules for %s: %v", serviceKey(svc), err)
+			continue
+		}
+		sc.applied[string(svc.UID)] = appliedService{svc: svc, netid: netID}
+	}
+	return lastErr
+}
+
+// finishServicesTransition removes namespace's service rules tagged with
+// oldNetID, once installServicesForTransition has made the netID-tagged
+// rules live and pods have been re-tagged to netID; see updatePodNetwork.
+func (sc *serviceController) finishServicesTransition(namespace string, oldNetID uint32) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	var lastErr error
+	for _, obj := range sc.store.List() {
+		svc := obj.(*kapi.Service)
+		if svc.Namespace != namespace || !kapi.IsServiceIPSet(svc) {
+			continue
+		}
+		if err := sc.node.DeleteServiceRulesForNetID(svc, oldNetID); err != nil {
+			lastErr = err
+			glog.Errorf("Error removing old-VNID service rules for %s: %v", serviceKey(svc), err)
+		}
+	}
+	return lastErr
+}
+
+// resyncNamespace re-enqueues every cached service in namespace so syncService
+// can re-evaluate whether it now belongs installed or not, after a local pod
+// was added to or removed from the namespace.
+func (sc *serviceController) resyncNamespace(namespace string) {
+	for _, obj := range sc.store.List() {
+		svc := obj.(*kapi.Service)
+		if svc.Namespace == namespace {
+			sc.enqueue(svc)
+		}
+	}
+}
+
+func (sc *serviceController) enqueue(obj interface{}) {
+	key, err := DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Could not compute key for service object: %v", err)
+		return
+	}
+	sc.debouncer.add(key)
+}
+
+// serviceDebouncer batches dirtied service keys per namespace, releasing
+// them to the work queue together once no new key in that namespace has
+// arrived for the debounce window. A key's first arrival is always released
+// immediately, bypassing the window.
+type serviceDebouncer struct {
+	window  time.Duration
+	release func(key interface{})
+
+	lock    sync.Mutex
+	seen    map[string]bool
+	pending map[string]map[string]bool // namespace -> dirtied keys
+	timers  map[string]*time.Timer     // namespace -> pending flush timer
+}
+
+func newServiceDebouncer(window time.Duration, release func(key interface{})) *serviceDebouncer {
+	return &serviceDebouncer{
+		window:  window,
+		release: release,
+		seen:    make(map[string]bool),
+		pending: make(map[string]map[string]bool),
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+func (d *serviceDebouncer) add(key string) {
+	namespace, _, err := kcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		namespace = ""
+	}
+
+	d.lock.Lock()
+	if !d.seen[key] {
+		d.seen[key] = true
+		d.lock.Unlock()
+		d.release(key)
+		return
+	}
+
+	if d.pending[namespace] == nil {
+		d.pending[namespace] = make(map[string]bool)
+	}
+	d.pending[namespace][key] = true
+
+	if _, running := d.timers[namespace]; !running {
+		d.timers[namespace] = time.AfterFunc(d.window, func() { d.flush(namespace) })
+	}
+	d.lock.Unlock()
+}
+
+func (d *serviceDebouncer) flush(namespace string) {
+	d.lock.Lock()
+	keys := d.pending[namespace]
+	delete(d.pending, namespace)
+	delete(d.timers, namespace)
+	d.lock.Unlock()
+
+	for key := range keys {
+		d.release(key)
+	}
+}
+
+func (sc *serviceController) runWorker() {
+	for sc.processNextWorkItem() {
+	}
+}
+
+func (sc *serviceController) processNextWorkItem() bool {
+	key, quit := sc.queue.Get()
+	if quit {
+		return false
+	}
+	defer sc.queue.Done(key)
+
+	if err := sc.syncService(key.(string)); err != nil {
+		glog.Errorf("Error syncing service %q, will retry: %v", key, err)
+		sc.queue.AddRateLimited(key)
+		return true
+	}
+	sc.queue.Forget(key)
+	return true
+}
+
+// syncService applies the OVS service rules for the service named by key,
+// reading the current object (if any) from the informer's cache rather than
+// from a passed-in delta. It is idempotent, so it's safe to call repeatedly
+// for the same key on retry or resync.
+func (sc *serviceController) syncService(key string) error {
+	obj, exists, err := sc.store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if !exists {
+		// The service is gone; find the rules we previously applied for it
+		// by namespace/name, since a deleted object no longer has a UID we
+		// can look up in the informer's cache.
+		for uid, entry := range sc.applied {
+			if key != serviceKey(entry.svc) {
+				continue
+			}
+			delete(sc.applied, uid)
+			return sc.node.DeleteServiceRules(entry.svc)
+		}
+		return nil
+	}
+
+	serv := obj.(*kapi.Service)
+	oldEntry, existed := sc.applied[string(serv.UID)]
+
+	// A service that used to have a ClusterIP and lost it (gone headless) is
+	// handled here rather than being ignored outright below, so the rules it
+	// had installed for its old VIP get torn down instead of leaking; a
+	// service that's headless and stays headless never reaches sc.applied in
+	// the first place, so existed is false and this is a no-op for it.
+	if !kapi.IsServiceIPSet(serv) {
+		if !existed {
+			return nil
+		}
+		delete(sc.applied, string(serv.UID))
+		return sc.node.DeleteServiceRules(oldEntry.svc)
+	}
+
+	install := sc.shouldInstall(serv)
+
+	var netid uint32
+	var generation uint64
+	if install {
+		var err error
+		netid, generation, err = sc.node.vnids.WaitAndGetVNIDAndGeneration(serv.Namespace)
+		if err != nil {
+			return fmt.Errorf("skipped adding service rules for %s: %v", key, err)
+		}
+	}
+
+	if existed {
+		// isServiceChanged only looks at the Service object; a VNID change
+		// isn't visible there, so it's compared against the netid this
+		// entry was actually installed with, which updatePodNetwork keeps
+		// current the same way an ordinary service update would.
+		if install && !isServiceChanged(oldEntry.svc, serv) && oldEntry.netid == netid {
+			return nil
+		}
+		if err := sc.node.DeleteServiceRules(oldEntry.svc); err != nil {
+			glog.Error(err)
+		}
+		delete(sc.applied, string(serv.UID))
+	}
+
+	if !install {
+		return nil
+	}
+
+	if err := sc.node.AddServiceRules(serv, netid); err != nil {
+		return err
+	}
+
+	// The namespace's VNID could have changed, or been unset entirely,
+	// between WaitAndGetVNIDAndGeneration above and this rules install; if
+	// so, netid is already stale and undoing the install is safer than
+	// leaving rules tagged with a netid nothing accepts anymore. A namespace
+	// deletion racing this closely also unsets the VNID, so this doubles as
+	// the cleanup DeleteServiceRules that no other path would otherwise run.
+	if !sc.node.vnids.ValidateGeneration(serv.Namespace, generation) {
+		if err := sc.node.DeleteServiceRules(serv); err != nil {
+			glog.Error(err)
+		}
+		return fmt.Errorf("netid for namespace %q changed while installing service rules for %s, rolled back", serv.Namespace, key)
+	}
+
+	sc.applied[string(serv.UID)] = appliedService{svc: serv, netid: netid}
+	return nil
+}
+
+// shouldInstall reports whether svc's rules belong installed on this node
+// right now. Outside of lazy mode, everything is always installed, matching
+// the pre-lazy behavior.
+func (sc *serviceController) shouldInstall(svc *kapi.Service) bool {
+	if !sc.lazy {
+		return true
+	}
+
+	// kube-proxy DNATs NodePort/LoadBalancer traffic to this service on
+	// every node, not just ones running its pods, so those rules can't be
+	// gated on having a local pod.
+	if svc.Spec.Type == kapi.ServiceTypeNodePort || svc.Spec.Type == kapi.ServiceTypeLoadBalancer {
+		return true
+	}
+
+	pods, err := sc.node.pods.Pods(svc.Namespace)
+	if err != nil {
+		glog.Errorf("Could not check local pods for namespace %s, installing service rules eagerly: %v", svc.Namespace, err)
+		return true
+	}
+	return len(pods) > 0
+}
+
+func serviceKey(svc *kapi.Service) string {
+	key, _ := DeletionHandlingMetaNamespaceKeyFunc(svc)
+	return key
+}
+
+func isServiceChanged(oldsvc, newsvc *kapi.Service) bool {
+	if oldsvc.Annotations[accessibleFromAnnotation] != newsvc.Annotations[accessibleFromAnnotation] {
+		return true
+	}
+	if len(oldsvc.Spec.Ports) == len(newsvc.Spec.Ports) {
+		for i := range oldsvc.Spec.Ports {
+			if oldsvc.Spec.Ports[i].Protocol != newsvc.Spec.Ports[i].Protocol ||
+				oldsvc.Spec.Ports[i].Port != newsvc.Spec.Ports[i].Port {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -108,6 +108,12 @@ func isValidNodeIP(node *kapi.Node, nodeIP string) bool {
 }
 
 func getNodeIP(node *kapi.Node) (string, error) {
+	// A node with a pinned --vxlan-source overrides whatever address
+	// Kubelet reports, so the master targets the same interface the node
+	// actually tunnels through; see tunnel_source.go.
+	if ip, ok := tunnelSourceOverride(node); ok {
+		return ip, nil
+	}
 	if len(node.Status.Addresses) > 0 && node.Status.Addresses[0].Address != "" {
 		return node.Status.Addresses[0].Address, nil
 	} else {
@@ -130,7 +136,8 @@ func (master *KsdnMaster) watchNodes() {
 		switch delta.Type {
 		case cache.Sync, cache.Added, cache.Updated:
 
-			if oldNodeIP, ok := nodeAddressMap[uid]; ok && ((nodeIP == oldNodeIP) || isValidNodeIP(node, oldNodeIP)) {
+			oldNodeIP, hadIP := nodeAddressMap[uid]
+			if hadIP && ((nodeIP == oldNodeIP) || isValidNodeIP(node, oldNodeIP)) {
 				break
 			}
 			// Node status is frequently updated by kubelet, so log only if the above condition is not met
@@ -141,6 +148,18 @@ func (master *KsdnMaster) watchNodes() {
 				return fmt.Errorf("error creating subnet for node %s, ip %s: %v", name, nodeIP, err)
 			}
 			nodeAddressMap[uid] = nodeIP
+
+			// The node's IP changed out from under its previous HostSubnet
+			// record (and it's no longer even a stale/secondary address on
+			// the Node object), so that record's tunnel endpoint is now
+			// unclaimed: revoke it promptly rather than leaving its VXLAN
+			// ingress allowlist entry (see AddHostSubnetRules) usable by
+			// whoever ends up with the old IP next.
+			if hadIP && oldNodeIP != nodeIP {
+				if err := master.deleteNode(oldNodeIP); err != nil {
+					glog.Errorf("Error revoking stale subnet for node %s at old IP %s: %v", name, oldNodeIP, err)
+				}
+			}
 		case cache.Deleted:
 			glog.Infof("Watch %s event for Node %q", delta.Type, name)
 			delete(nodeAddressMap, uid)
@@ -239,7 +258,7 @@ func (node *KsdnNode) nodeHandleSubnetEvent(batch []Event) {
 }
 
 func (node *KsdnNode) SubnetStartNode() error {
-	go utilwait.Forever(node.watchSubnets, 0)
+	go utilwait.Until(node.watchSubnets, 0, node.ctx.Done())
 	return nil
 }
 
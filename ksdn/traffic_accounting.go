@@ -0,0 +1,164 @@
+package ksdn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s-ovs/pkg/metrics"
+	"k8s-ovs/pkg/ovs"
+
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+const (
+	// defaultTrafficAccountingInterval is how often the traffic accountant
+	// re-reads table 4's per-tenant service flows, absent
+	// WithTrafficAccountingInterval.
+	defaultTrafficAccountingInterval = 30 * time.Second
+
+	// defaultTrafficAccountingNamespaceLimit caps how many distinct VNIDs
+	// the accountant will export a namespace-labelled series for, absent
+	// WithTrafficAccountingNamespaceLimit, so a cluster with many tenants
+	// doesn't turn TrafficAccountedBytes/TrafficAccountedPackets into an
+	// unbounded label set.
+	defaultTrafficAccountingNamespaceLimit = 500
+)
+
+// flowIdentity is the part of a table 4 flow that stays stable across
+// dump-flows reads of the same installed flow, but changes if the flow is
+// reinstalled with a different cookie or match (e.g. a service's port
+// changing, or a namespace cycling through a VNID transition). A flow
+// reinstalled unchanged keeps its identity; sync catches that counter reset
+// by the counters moving backward, so the accountant doesn't read a fresh
+// flow's small counter as a many-gigabyte drop in traffic.
+type flowIdentity struct {
+	cookie uint64
+	table  int
+	match  string
+}
+
+// trafficAccountant periodically reads table 4's per-tenant service flows
+// (tagged with vnidFlowCookie; see AddServiceRules) and exports their
+// cumulative byte/packet counts as Prometheus counters labelled by
+// namespace, for chargeback. OVS's own counters are cumulative for the life
+// of a flow and reset to zero if the flow is deleted and reinstalled, so the
+// accountant tracks each flow's last-seen counters and only ever adds
+// forward deltas onto the exported total.
+type trafficAccountant struct {
+	node *KsdnNode
+
+	interval       time.Duration
+	namespaceLimit int
+
+	lock       sync.Mutex
+	lastSeen   map[flowIdentity]ovs.Flow
+	namespaces map[uint32]bool // VNIDs already counted against the label limit
+}
+
+func newTrafficAccountant(node *KsdnNode) *trafficAccountant {
+	interval := node.trafficAccountingInterval
+	if interval == 0 {
+		interval = defaultTrafficAccountingInterval
+	}
+	limit := node.trafficAccountingNamespaceLimit
+	if limit == 0 {
+		limit = defaultTrafficAccountingNamespaceLimit
+	}
+	return &trafficAccountant{
+		node:           node,
+		interval:       interval,
+		namespaceLimit: limit,
+		lastSeen:       make(map[flowIdentity]ovs.Flow),
+		namespaces:     make(map[uint32]bool),
+	}
+}
+
+// run starts the accountant's periodic sync. It returns immediately; the
+// goroutine stops when stopCh is closed.
+func (a *trafficAccountant) run(stopCh <-chan struct{}) {
+	go utilwait.Until(a.sync, a.interval, stopCh)
+}
+
+// sync streams the flow table once, aggregates the forward byte/packet
+// deltas of every vnidFlowCookie-tagged flow by VNID, and exports the
+// result. It's a method on trafficAccountant, not KsdnNode, since lastSeen
+// and namespaces are its own state, not the node's.
+func (a *trafficAccountant) sync() {
+	type totals struct {
+		bytes, packets uint64
+	}
+	deltas := make(map[uint32]totals)
+
+	a.lock.Lock()
+	seen := make(map[flowIdentity]bool)
+	err := a.node.ovs.StreamFlows(func(flow ovs.Flow) bool {
+		if !isVNIDCookie(flow.Cookie) {
+			return true
+		}
+		id := flowIdentity{cookie: flow.Cookie, table: flow.Table, match: flow.Match}
+		seen[id] = true
+
+		t := deltas[vnidFromCookie(flow.Cookie)]
+		if prev, ok := a.lastSeen[id]; ok && flow.NPackets >= prev.NPackets && flow.NBytes >= prev.NBytes {
+			t.bytes += flow.NBytes - prev.NBytes
+			t.packets += flow.NPackets - prev.NPackets
+		}
+		// A missing or backward-moving previous reading means the flow was
+		// just installed (first time seen) or reinstalled since the last
+		// sync (counters reset to 0); either way there's no prior baseline
+		// to take a delta against, so this reading becomes the new baseline
+		// with nothing added to the total.
+		deltas[vnidFromCookie(flow.Cookie)] = t
+		a.lastSeen[id] = flow
+		return true
+	})
+	// Flows that disappeared since the last sync (deleted, or reinstalled
+	// and picked up above under a new identity) shouldn't keep pinning a
+	// stale baseline forever.
+	for id := range a.lastSeen {
+		if !seen[id] {
+			delete(a.lastSeen, id)
+		}
+	}
+	a.lock.Unlock()
+
+	if err != nil {
+		glog.Errorf("Failed to collect traffic accounting flow stats: %v", err)
+		return
+	}
+
+	for netID, t := range deltas {
+		namespaces := a.node.vnids.GetNamespaces(netID)
+		if len(namespaces) == 0 {
+			// Traffic surviving from a namespace that's since been deleted
+			// or moved off this VNID; nothing to attribute it to.
+			continue
+		}
+		if !a.admit(netID) {
+			metrics.TrafficAccountingNamespacesDropped.Inc()
+			continue
+		}
+		for _, namespace := range namespaces {
+			metrics.TrafficAccountedBytes.WithLabelValues(namespace).Add(float64(t.bytes))
+			metrics.TrafficAccountedPackets.WithLabelValues(namespace).Add(float64(t.packets))
+		}
+	}
+}
+
+// admit reports whether netID is already counted against the accountant's
+// namespace label limit, admitting it if there's still room.
+func (a *trafficAccountant) admit(netID uint32) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.namespaces[netID] {
+		return true
+	}
+	if len(a.namespaces) >= a.namespaceLimit {
+		return false
+	}
+	a.namespaces[netID] = true
+	return true
+}
@@ -0,0 +1,110 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+// vxlanSourceAnnotation records the address --vxlan-source resolved to on
+// this node's Node object, so the master's node-IP-change handling (see
+// getNodeIP in subnets.go) targets the pinned interface instead of
+// whatever address Kubelet happens to report, and other nodes' peer flows
+// (see AddHostSubnetRules) end up addressed correctly.
+const vxlanSourceAnnotation = "k8s-ovs.io/vxlan-source-ip"
+
+// resolveTunnelSourceIP turns a --vxlan-source spec into the concrete
+// address the VXLAN tunnel should bind to. spec is tried first as a
+// network interface name, then as a CIDR to match one of this host's
+// addresses against; it errors out if neither resolves to an address that
+// actually exists on this host, so a misconfigured node fails loudly at
+// startup instead of silently falling back to the default interface.
+func resolveTunnelSourceIP(spec string) (net.IP, error) {
+	if iface, err := net.InterfaceByName(spec); err == nil {
+		ip, err := firstIPv4(iface)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %v", spec, err)
+		}
+		return ip, nil
+	}
+
+	_, cidr, err := net.ParseCIDR(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a local interface name nor a valid CIDR", spec)
+	}
+	ip, err := findIPv4InCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("CIDR %s: %v", cidr, err)
+	}
+	return ip, nil
+}
+
+func firstIPv4(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("list addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 address assigned")
+}
+
+func findIPv4InCIDR(cidr *net.IPNet) (net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("list interfaces: %v", err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip4 := ipnet.IP.To4(); ip4 != nil && cidr.Contains(ip4) {
+				return ip4, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no local interface has an address in this range")
+}
+
+// publishTunnelSourceIP records ip on this node's Node object, so the
+// master picks it up as this node's address the same way it would notice
+// any other node IP change; see getNodeIP in subnets.go.
+func (node *KsdnNode) publishTunnelSourceIP(ip string) error {
+	kn, err := node.kClient.Nodes().Get(node.hostName)
+	if err != nil {
+		return fmt.Errorf("get Node %q: %v", node.hostName, err)
+	}
+	if kn.Annotations == nil {
+		kn.Annotations = make(map[string]string)
+	}
+	if kn.Annotations[vxlanSourceAnnotation] == ip {
+		return nil
+	}
+	kn.Annotations[vxlanSourceAnnotation] = ip
+
+	if _, err := node.kClient.Nodes().Update(kn); err != nil {
+		return fmt.Errorf("update Node %q: %v", node.hostName, err)
+	}
+	return nil
+}
+
+// tunnelSourceOverride returns n's pinned tunnel source IP, if
+// publishTunnelSourceIP has recorded one, and whether it found one.
+func tunnelSourceOverride(n *kapi.Node) (string, bool) {
+	ip, ok := n.Annotations[vxlanSourceAnnotation]
+	return ip, ok
+}
@@ -0,0 +1,91 @@
+package ksdn
+
+import (
+	"sync"
+
+	"k8s.io/kubernetes/pkg/util/sets"
+)
+
+// unmanagedNamespaceAnnotation opts a namespace out of SDN management: no
+// service-rule programming, no VNID-driven pod updates, and no
+// pod-cache-driven reconciliation for pods in it. Meant for namespaces whose
+// pods always run with hostNetwork or are wired up by a different CNI
+// entirely (e.g. on dedicated nodes), where k8s-ovs's usual bookkeeping is
+// pure overhead. See unmanagedNamespaces.
+const unmanagedNamespaceAnnotation = "k8s-ovs/unmanaged"
+
+// namespaceUnmanaged reports whether a Namespace's (or NetNamespace's
+// mirrored) annotations carry unmanagedNamespaceAnnotation.
+func namespaceUnmanaged(annotations map[string]string) bool {
+	return annotations[unmanagedNamespaceAnnotation] == "true"
+}
+
+// NamespaceUnmanaged is the exported form of namespaceUnmanaged, for callers
+// outside this package that need to recognize the annotation on their own,
+// e.g. the "k8s-ovs diagnose" tool marking unmanaged namespaces in its
+// report.
+func NamespaceUnmanaged(annotations map[string]string) bool {
+	return namespaceUnmanaged(annotations)
+}
+
+// unmanagedNamespaces tracks which namespaces are currently excluded from
+// SDN management: a static list fixed at startup (--unmanaged-namespaces),
+// plus namespaces currently carrying unmanagedNamespaceAnnotation, which can
+// come and go at runtime as the annotation is added or removed. Safe for
+// concurrent use.
+type unmanagedNamespaces struct {
+	static sets.String
+
+	lock      sync.RWMutex
+	annotated sets.String
+}
+
+func newUnmanagedNamespaces(static []string) *unmanagedNamespaces {
+	return &unmanagedNamespaces{
+		static:    sets.NewString(static...),
+		annotated: sets.NewString(),
+	}
+}
+
+// Contains reports whether namespace is currently unmanaged, whether by the
+// static list or the live annotation.
+func (u *unmanagedNamespaces) Contains(namespace string) bool {
+	if u.static.Has(namespace) {
+		return true
+	}
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.annotated.Has(namespace)
+}
+
+// SetAnnotated records the current unmanaged-annotation state seen for
+// namespace, and reports whether that's a change from what was last
+// recorded. A namespace on the static list is tracked the same way (so a
+// later removal from the static list, on a restart, doesn't need the
+// annotation replayed to be picked up), but its removal is never reported as
+// a transition, since Contains never stops returning true for it anyway.
+func (u *unmanagedNamespaces) SetAnnotated(namespace string, unmanaged bool) (transitioned bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	was := u.annotated.Has(namespace)
+	if unmanaged {
+		u.annotated.Insert(namespace)
+	} else {
+		u.annotated.Delete(namespace)
+	}
+
+	if u.static.Has(namespace) {
+		return false
+	}
+	return was != unmanaged
+}
+
+// Forget drops namespace's tracked annotation state, e.g. once its
+// NetNamespace record has been removed and there's nothing left to track a
+// transition against.
+func (u *unmanagedNamespaces) Forget(namespace string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.annotated.Delete(namespace)
+}
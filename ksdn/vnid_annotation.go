@@ -0,0 +1,87 @@
+package ksdn
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// netIDAnnotation is a read-only informational annotation the master keeps
+// in sync with a namespace's currently allocated VNID, so an operator can
+// answer "what VNID does this namespace have" from `kubectl get namespace`
+// alone instead of needing etcd access. It's output only: nothing in this
+// package ever reads it back as a source of truth, and it must not be
+// confused with a namespace's own (input) fixed-VNID request annotation --
+// doing so would create a feedback loop between what the master assigns and
+// what it thinks it was asked for.
+const netIDAnnotation = "k8s-ovs/netid"
+
+// netIDAnnotationRetryBackoff bounds how hard syncNetIDAnnotationAsync
+// retries a failed Namespace patch before giving up and logging. Giving up
+// just leaves the annotation stale until the namespace's next VNID change
+// gives it another chance, rather than blocking VNID allocation on API
+// server availability.
+var netIDAnnotationRetryBackoff = utilwait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Steps:    5,
+}
+
+// syncNetIDAnnotationAsync patches nsName's Namespace object with netid (or
+// removes netIDAnnotation if present is false), retrying with backoff in
+// the background so a slow or momentarily unavailable API server never
+// blocks the VNID allocation this annotation is only reporting on.
+func syncNetIDAnnotationAsync(kClient *kclient.Client, nsName string, netid uint32, present bool) {
+	go func() {
+		err := utilwait.ExponentialBackoff(netIDAnnotationRetryBackoff, func() (bool, error) {
+			err := syncNetIDAnnotation(kClient, nsName, netid, present)
+			if err != nil {
+				glog.Warningf("Retrying failed netid annotation update for namespace %q: %v", nsName, err)
+			}
+			return err == nil, nil
+		})
+		if err != nil {
+			glog.Errorf("Giving up updating netid annotation for namespace %q: %v", nsName, err)
+		}
+	}()
+}
+
+// syncNetIDAnnotation makes a single attempt at patching nsName's Namespace
+// object's netIDAnnotation to netid, or removing it if present is false
+// (e.g. the namespace's NetNamespace was just revoked). A namespace that no
+// longer exists has nothing to clean up, so that's treated as success
+// rather than an error worth retrying.
+func syncNetIDAnnotation(kClient *kclient.Client, nsName string, netid uint32, present bool) error {
+	ns, err := kClient.Namespaces().Get(nsName)
+	if kerrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get Namespace %q: %v", nsName, err)
+	}
+
+	if !present {
+		if _, ok := ns.Annotations[netIDAnnotation]; !ok {
+			return nil
+		}
+		delete(ns.Annotations, netIDAnnotation)
+	} else {
+		want := fmt.Sprintf("%d", netid)
+		if ns.Annotations[netIDAnnotation] == want {
+			return nil
+		}
+		if ns.Annotations == nil {
+			ns.Annotations = make(map[string]string)
+		}
+		ns.Annotations[netIDAnnotation] = want
+	}
+
+	if _, err := kClient.Namespaces().Update(ns); err != nil {
+		return fmt.Errorf("update Namespace %q: %v", nsName, err)
+	}
+	return nil
+}
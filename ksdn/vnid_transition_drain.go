@@ -0,0 +1,235 @@
+package ksdn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/ovs"
+)
+
+// vnidDrainFlowPriority matches installAlsoAcceptVNIDFlows's Table 7 accept
+// flows, since the two mechanisms install the same kind of flow for the same
+// reason -- an extra VNID a pod's traffic should be delivered under -- and
+// should sort against each other identically.
+const vnidDrainFlowPriority = 100
+
+// pendingVNIDDrain is a namespace's in-flight grace-period cleanup: its
+// old-VNID accept flows are still live and come down when timer fires,
+// unless a newer transition supersedes it first.
+type pendingVNIDDrain struct {
+	oldNetID, netID uint32
+	timer           *time.Timer
+}
+
+// vnidDrainQueue implements updatePodNetwork's optional grace-period
+// transition mode: instead of removing a namespace's old-VNID service and
+// pod accept flows as soon as its pods are re-tagged, it keeps them installed
+// alongside the new VNID's for node.vnidTransitionGracePeriod, so connections
+// established under the old VNID keep draining instead of being cut off the
+// instant the namespace re-tags. Disabled (node.vnidTransitionGracePeriod ==
+// 0), updatePodNetwork never calls begin and keeps its original
+// immediate-cleanup behavior.
+//
+// Each pending drain is persisted to etcd, keyed by this node's own host and
+// the namespace, so a daemon restart mid-window resumes it instead of
+// leaving the old-VNID flows installed forever; see resume. The OVS flows
+// themselves live in the bridge, not the daemon, so they survive a daemon
+// restart on their own -- resume only needs to re-arm the cleanup timer, not
+// reinstall anything.
+type vnidDrainQueue struct {
+	node *KsdnNode
+
+	lock    sync.Mutex
+	pending map[string]*pendingVNIDDrain // namespace -> drain
+}
+
+func newVNIDDrainQueue(node *KsdnNode) *vnidDrainQueue {
+	return &vnidDrainQueue{
+		node:    node,
+		pending: make(map[string]*pendingVNIDDrain),
+	}
+}
+
+// begin opens namespace's grace window for the oldNetID -> netID transition,
+// superseding any window already pending for namespace. It must be called
+// before updatePodNetwork re-tags namespace's pods, so podManager's
+// installVNIDDrainFlow (invoked as part of that re-tag) sees the window
+// already open and installs oldNetID's accept flow alongside each pod's
+// ordinary one.
+func (q *vnidDrainQueue) begin(namespace string, oldNetID, netID uint32) {
+	q.supersede(namespace)
+
+	expiresAt := time.Now().Add(q.node.vnidTransitionGracePeriod)
+	state := &etcdmanager.VNIDTransitionState{Namespace: namespace, OldNetID: oldNetID, NetID: netID, ExpiresAt: expiresAt}
+	if err := q.node.eClient.SetVNIDTransitionState(q.node.ctx, q.node.networkInfo.name, q.node.localIP, namespace, state); err != nil {
+		glog.Errorf("Could not persist grace-period transition state for namespace %q: %v", namespace, err)
+	}
+
+	q.schedule(namespace, oldNetID, netID, q.node.vnidTransitionGracePeriod)
+}
+
+// schedule arms the in-memory timer that runs cleanup once d has elapsed, or
+// runs it right away if d has already passed (the restart-resume case).
+func (q *vnidDrainQueue) schedule(namespace string, oldNetID, netID uint32, d time.Duration) {
+	drain := &pendingVNIDDrain{oldNetID: oldNetID, netID: netID}
+	if d <= 0 {
+		q.lock.Lock()
+		q.pending[namespace] = drain
+		q.lock.Unlock()
+		q.cleanup(namespace, oldNetID)
+		return
+	}
+
+	drain.timer = time.AfterFunc(d, func() { q.cleanup(namespace, oldNetID) })
+	q.lock.Lock()
+	q.pending[namespace] = drain
+	q.lock.Unlock()
+}
+
+// supersede cancels namespace's pending drain, if any, and immediately runs
+// its cleanup -- its old-VNID flows are stale the moment a newer transition
+// begins, whether or not its own grace period had elapsed yet.
+func (q *vnidDrainQueue) supersede(namespace string) {
+	q.lock.Lock()
+	drain, ok := q.pending[namespace]
+	q.lock.Unlock()
+	if !ok {
+		return
+	}
+	if drain.timer != nil {
+		drain.timer.Stop()
+	}
+	q.cleanup(namespace, drain.oldNetID)
+}
+
+// cleanup removes namespace's oldNetID accept flows and service rules,
+// deletes the persisted transition state, and forgets the pending drain.
+// Called once per drain, either by its timer, by a superseding begin, or by
+// resume finding an already-expired window.
+func (q *vnidDrainQueue) cleanup(namespace string, oldNetID uint32) {
+	q.lock.Lock()
+	delete(q.pending, namespace)
+	q.lock.Unlock()
+
+	if err := q.node.removeVNIDDrainPodFlows(namespace, oldNetID); err != nil {
+		glog.Errorf("Could not remove grace-period accept flows for namespace %q (netid %d): %v", namespace, oldNetID, err)
+	}
+	if err := q.node.finishServicesForVNIDTransition(namespace, oldNetID); err != nil {
+		glog.Errorf("Could not remove old-netid services for namespace %q after grace period: %v", namespace, err)
+	}
+	if err := q.node.eClient.DeleteVNIDTransitionState(q.node.ctx, q.node.networkInfo.name, q.node.localIP, namespace); err != nil {
+		glog.Errorf("Could not clear grace-period transition state for namespace %q: %v", namespace, err)
+	}
+}
+
+// oldNetIDFor returns namespace's currently draining old VNID, if any, for
+// podManager to also accept when it (re)installs a pod's flows; see
+// installVNIDDrainFlow.
+func (q *vnidDrainQueue) oldNetIDFor(namespace string) (uint32, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	drain, ok := q.pending[namespace]
+	if !ok {
+		return 0, false
+	}
+	return drain.oldNetID, true
+}
+
+// resume re-arms every grace-period cleanup this host had persisted before a
+// restart, so it still completes on schedule. It never reinstalls flows:
+// those live in the OVS bridge, not this process, so whatever
+// installVNIDDrainFlow already added is still there. A window whose NetID no
+// longer matches the namespace's current VNID was superseded by a later
+// transition this node crashed before finishing the cleanup of; it's cleaned
+// up immediately instead, the same as supersede would.
+func (q *vnidDrainQueue) resume() {
+	states, err := q.node.eClient.ListVNIDTransitionStates(q.node.ctx, q.node.networkInfo.name, q.node.localIP)
+	if err != nil {
+		glog.Errorf("Could not list pending grace-period transitions, none will be resumed: %v", err)
+		return
+	}
+
+	for _, state := range states {
+		if currentNetID, err := q.node.vnids.GetVNID(state.Namespace); err == nil && currentNetID != state.NetID {
+			glog.Infof("Discarding stale grace-period transition for namespace %q: recorded target netid %d, current netid %d", state.Namespace, state.NetID, currentNetID)
+			q.cleanup(state.Namespace, state.OldNetID)
+			continue
+		}
+
+		remaining := time.Until(state.ExpiresAt)
+		glog.Infof("Resuming grace-period transition for namespace %q (netid %d -> %d), %s remaining", state.Namespace, state.OldNetID, state.NetID, remaining)
+		q.schedule(state.Namespace, state.OldNetID, state.NetID, remaining)
+	}
+}
+
+// removeVNIDDrainPodFlows removes the Table 7 accept flows
+// installVNIDDrainFlow added for oldNetID, for whichever of namespace's pods
+// are still local when the grace period ends. Matching by table and match
+// string alone (no ofport, no priority-bearing action) is enough to delete a
+// flow, the same as DeleteHostSubnetRules and friends do elsewhere.
+func (node *KsdnNode) removeVNIDDrainPodFlows(namespace string, oldNetID uint32) error {
+	if node.ovs == nil {
+		return nil
+	}
+
+	runPods, _, err := node.GetLocalPods(namespace)
+	if err != nil {
+		return fmt.Errorf("could not get list of local pods in namespace %q: %v", namespace, err)
+	}
+
+	var mods []ovs.FlowMod
+	for _, pod := range runPods {
+		mods = append(mods, ovs.FlowMod{
+			Table:     7,
+			Priority:  vnidDrainFlowPriority,
+			Namespace: namespace,
+			Match:     fmt.Sprintf("reg0=%d, ip, nw_dst=%s", oldNetID, pod.Status.PodIP),
+		})
+	}
+	if len(mods) == 0 {
+		return nil
+	}
+	return node.ovs.DelFlows(mods...)
+}
+
+// installVNIDDrainFlow adds pod's Table 7 accept flow for its namespace's
+// currently draining old VNID, if any, once its base OVS port and flows are
+// up. Mirrors installAlsoAcceptVNIDFlows's shape, but keyed off an
+// in-progress VNID transition (see vnidDrainQueue) rather than a pod's own
+// annotation. Called from the same setup/update call sites, right alongside
+// it. Failures are logged and swallowed, the same as
+// installAlsoAcceptVNIDFlows: a grace-period accept flow is a best-effort
+// extra, not something worth failing pod setup/update over.
+func (m *podManager) installVNIDDrainFlow(pod *kapi.Pod, hostVethName, podIP string) {
+	if m.ovs == nil || m.vnidDrain == nil {
+		return
+	}
+
+	oldNetID, ok := m.vnidDrain.oldNetIDFor(pod.Namespace)
+	if !ok {
+		return
+	}
+
+	ofport, err := m.ovs.GetOfPort(hostVethName)
+	if err != nil {
+		glog.Warningf("Could not resolve OVS port %s for pod %s/%s, skipping grace-period accept flow: %v", hostVethName, pod.Namespace, pod.Name, err)
+		return
+	}
+
+	mod := ovs.FlowMod{
+		Table:     7,
+		Priority:  vnidDrainFlowPriority,
+		Namespace: pod.Namespace,
+		Match:     fmt.Sprintf("reg0=%d, ip, nw_dst=%s", oldNetID, podIP),
+		Actions:   fmt.Sprintf("output:%d", ofport),
+	}
+	if err := m.ovs.AddFlows(mod); err != nil {
+		glog.Warningf("Could not add grace-period accept flow for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+}
@@ -0,0 +1,67 @@
+package ksdn
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/kubernetes/pkg/apis/authentication"
+
+	"k8s-ovs/vnidapi"
+)
+
+// StartVNIDAPI starts the master's VNID provisioning API (see package
+// vnidapi) listening on bindAddress. It's a no-op if bindAddress is empty.
+func (master *KsdnMaster) StartVNIDAPI(bindAddress string) error {
+	if bindAddress == "" {
+		return nil
+	}
+	if master.vnids == nil {
+		return fmt.Errorf("VNID API requires a multitenant network plugin")
+	}
+
+	server := vnidapi.NewServer(bindAddress, vnidapi.Handlers{
+		Authenticate:       master.authenticateVNIDAPIToken,
+		QueryVNID:          master.vnidAPIQueryVNID,
+		ReserveVNID:        master.vnidAPIReserveVNID,
+		ReleaseReservation: master.vnidAPIReleaseReservation,
+	})
+	return server.Start()
+}
+
+// authenticateVNIDAPIToken validates token via the API server's TokenReview
+// API, so the API server that checks the daemon's own credentials (see
+// package kubeclient) also checks callers' tokens.
+func (master *KsdnMaster) authenticateVNIDAPIToken(token string) (bool, error) {
+	review, err := master.kClient.Authentication().TokenReviews().Create(&authentication.TokenReview{
+		Spec: authentication.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Authenticated, nil
+}
+
+func (master *KsdnMaster) vnidAPIQueryVNID(namespace string) (vnidapi.VNIDInfo, bool, error) {
+	netid, reserved, found, err := master.vnids.QueryVNID(master.ctx, master.networkInfo.name, master.eClient, namespace)
+	if err != nil || !found {
+		return vnidapi.VNIDInfo{}, false, err
+	}
+	return vnidapi.VNIDInfo{Namespace: namespace, NetID: netid, Reserved: reserved}, true, nil
+}
+
+func (master *KsdnMaster) vnidAPIReserveVNID(namespace string, netID uint32, ttl time.Duration) (*vnidapi.Reservation, error) {
+	reservation, err := master.vnids.ReserveVNID(master.ctx, master.networkInfo.name, master.eClient, namespace, netID, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &vnidapi.Reservation{
+		Namespace: reservation.Namespace,
+		NetID:     reservation.NetID,
+		Auto:      reservation.Auto,
+		ExpiresAt: reservation.ExpiresAt,
+	}, nil
+}
+
+func (master *KsdnMaster) vnidAPIReleaseReservation(namespace string) error {
+	return master.vnids.ReleaseVNIDReservation(master.ctx, master.networkInfo.name, master.eClient, namespace)
+}
@@ -2,13 +2,16 @@ package ksdn
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	kapi "k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/client/cache"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/util/sets"
 	utilwait "k8s.io/kubernetes/pkg/util/wait"
 
@@ -27,17 +30,25 @@ type masterVNIDMap struct {
 	adminNamespaces sets.String
 }
 
-func newMasterVNIDMap() *masterVNIDMap {
+func newMasterVNIDMap(reservedVNIDsSpec string) (*masterVNIDMap, error) {
 	netIDRange, err := pnetid.NewNetIDRange(vnid.MinVNID, vnid.MaxVNID)
 	if err != nil {
 		panic(err)
 	}
 
+	reserved, err := vnid.ParseReservedRanges(reservedVNIDsSpec)
+	if err != nil {
+		return nil, fmt.Errorf("parse reserved VNID ranges failed: %v", err)
+	}
+
+	netIDManager := pnetid.NewInMemory(netIDRange)
+	netIDManager.SetReservedRanges(reserved)
+
 	return &masterVNIDMap{
-		netIDManager:    pnetid.NewInMemory(netIDRange),
+		netIDManager:    netIDManager,
 		adminNamespaces: sets.NewString(utils.SdnNamespace),
 		ids:             make(map[string]uint32),
-	}
+	}, nil
 }
 
 func (vmap *masterVNIDMap) getVNID(name string) (uint32, bool) {
@@ -95,10 +106,59 @@ func (vmap *masterVNIDMap) populateVNIDs(ctx context.Context, network string, eC
 			return fmt.Errorf("unable to allocate netid %d: %v", netns.NetID, err)
 		}
 	}
+
+	vmap.reportQuarantinedNetNamespaces(ctx, network, eClient)
+
+	return vmap.populateReservations(ctx, network, eClient)
+}
+
+// reportQuarantinedNetNamespaces logs any NetNamespace records the etcd
+// backend has withheld from delivery for failing NetNamespace.Validate, so a
+// bad write shows up in master startup logs instead of only being visible by
+// querying etcd/vnidctl directly. It doesn't affect allocation: a quarantined
+// record was never allocated a slot in vmap.netIDManager in the first place.
+func (vmap *masterVNIDMap) reportQuarantinedNetNamespaces(ctx context.Context, network string, eClient EtcdManager) {
+	quarantined, err := eClient.ListQuarantinedNetNamespaces(ctx, network)
+	if err != nil {
+		glog.Warningf("Unable to list quarantined NetNamespaces: %v", err)
+		return
+	}
+	for _, q := range quarantined {
+		glog.Warningf("NetNamespace %q is quarantined (%s), as of %s; see vnidctl list-quarantine", q.NetName, q.Reason, q.QuarantinedAt)
+	}
+}
+
+// populateReservations re-seeds the allocator with any pending VNID
+// reservations from a previous master run, so they can't be handed out to
+// something else before their namespace shows up. Expired reservations are
+// skipped here and swept up separately (see sweepExpiredVNIDReservations).
+func (vmap *masterVNIDMap) populateReservations(ctx context.Context, network string, eClient EtcdManager) error {
+	reservations, err := eClient.ListVNIDReservations(ctx, network)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, reservation := range reservations {
+		if now.After(reservation.ExpiresAt) {
+			continue
+		}
+		switch err := vmap.netIDManager.Allocate(reservation.NetID); err {
+		case nil: // Expected normal case
+		case pnetid.ErrAllocated: // The namespace was created between the reservation and now
+		default:
+			glog.Warningf("Unable to honor pending VNID reservation of netid %d for namespace %q: %v", reservation.NetID, reservation.Namespace, err)
+		}
+	}
 	return nil
 }
 
-func (vmap *masterVNIDMap) allocateNetID(nsName string) (uint32, bool, error) {
+// allocateNetID returns the NetID for nsName, allocating one if this is the
+// first time nsName has been seen. If reservedID is non-nil, it's honored
+// instead of the normal admin/auto-allocate logic; the caller is responsible
+// for having already reserved it with vmap.netIDManager (see assignVNID),
+// since a reservation may have been made in an earlier master run.
+func (vmap *masterVNIDMap) allocateNetID(nsName string, reservedID *uint32) (uint32, bool, error) {
 	// Nothing to do if the netid is in the vnid map
 	exists := false
 	if netid, found := vmap.getVNID(nsName); found {
@@ -109,9 +169,12 @@ func (vmap *masterVNIDMap) allocateNetID(nsName string) (uint32, bool, error) {
 
 	// NetNamespace not found, so allocate new NetID
 	var netid uint32
-	if vmap.isAdminNamespace(nsName) {
+	switch {
+	case reservedID != nil:
+		netid = *reservedID
+	case vmap.isAdminNamespace(nsName):
 		netid = vnid.GlobalVNID
-	} else {
+	default:
 		var err error
 		netid, err = vmap.netIDManager.AllocateNext()
 		if err != nil {
@@ -199,12 +262,68 @@ func (vmap *masterVNIDMap) updateNetID(nsName string, action, args string) (uint
 	return netid, nil
 }
 
+// vnidAuditActor identifies this component in VNID audit entries.
+const vnidAuditActor = "k8s-ovs-master"
+
+// auditVNIDChange appends a VNID audit entry. Failures are logged but not
+// returned: a failed audit write must never block the VNID change itself.
+func auditVNIDChange(ctx context.Context, network string, eClient EtcdManager, nsName string, oldNetID, newNetID uint32, reason string) {
+	entry := &VNIDAuditEntry{
+		Namespace: nsName,
+		OldNetID:  oldNetID,
+		NewNetID:  newNetID,
+		Reason:    reason,
+		Actor:     vnidAuditActor,
+		Timestamp: time.Now(),
+	}
+	if err := eClient.AppendVNIDAudit(ctx, network, entry); err != nil {
+		glog.Warningf("Failed to record VNID audit entry for namespace %q: %v", nsName, err)
+	}
+}
+
 // assignVNID, revokeVNID and updateVNID methods updates in-memory structs and persists etcd objects
-func (vmap *masterVNIDMap) assignVNID(ctx context.Context, network string, eClient EtcdManager, nsName string) error {
+//
+// skipAllocation is set when the caller has decided this namespace is
+// unmanaged and the master is configured not to allocate VNIDs for those: if
+// it already has a NetNamespace (e.g. from before it was marked unmanaged),
+// assignVNID revokes it instead, so the skip-list transition cleans up its
+// state the same way an actual namespace deletion would; if it doesn't,
+// assignVNID does nothing.
+func (vmap *masterVNIDMap) assignVNID(ctx context.Context, network string, eClient EtcdManager, kClient *kclient.Client, nsName string, annotations, labels map[string]string, skipAllocation bool) error {
 	vmap.lock.Lock()
 	defer vmap.lock.Unlock()
 
-	netid, exists, err := vmap.allocateNetID(nsName)
+	if skipAllocation {
+		oldNetID, exists := vmap.getVNID(nsName)
+		if !exists {
+			return nil
+		}
+		glog.Infof("Revoking NetNamespace for now-unmanaged namespace %q", nsName)
+		if err := eClient.RevokeNetNamespace(ctx, network, nsName); err != nil {
+			return err
+		}
+		if err := vmap.releaseNetID(nsName); err != nil {
+			return err
+		}
+		auditVNIDChange(ctx, network, eClient, nsName, oldNetID, 0, "unmanaged")
+		syncNetIDAnnotationAsync(kClient, nsName, 0, false)
+		return nil
+	}
+
+	// Honor a pending reservation for this namespace, if there is one and
+	// it hasn't expired, instead of auto-allocating a fresh netid.
+	reason := "auto-allocate"
+	var reservedID *uint32
+	reservation, err := eClient.GetVNIDReservation(ctx, network, nsName)
+	if err != nil {
+		glog.Warningf("Failed to look up VNID reservation for namespace %q: %v", nsName, err)
+	} else if reservation != nil && time.Now().Before(reservation.ExpiresAt) {
+		id := reservation.NetID
+		reservedID = &id
+		reason = "reservation"
+	}
+
+	netid, exists, err := vmap.allocateNetID(nsName, reservedID)
 	if err != nil {
 		return err
 	}
@@ -213,24 +332,48 @@ func (vmap *masterVNIDMap) assignVNID(ctx context.Context, network string, eClie
 		glog.Infof("Create NetNamespace for netid:%d, nsName: %q", netid, nsName)
 		// Create NetNamespace Object and update vnid map
 		netns := &NetNamespace{
-			NetName: nsName,
-			NetID:   netid,
+			NetName:     nsName,
+			NetID:       netid,
+			Annotations: annotations,
+			Labels:      labels,
 		}
 		err := eClient.AcquireNetNamespace(ctx, network, netns)
 		if err != nil {
 			vmap.releaseNetID(nsName)
 			return err
 		}
+		auditVNIDChange(ctx, network, eClient, nsName, 0, netid, reason)
+		if reservedID != nil {
+			if err := eClient.ReleaseVNIDReservation(ctx, network, nsName); err != nil {
+				glog.Warningf("Failed to release consumed VNID reservation for namespace %q: %v", nsName, err)
+			}
+		}
 	} else {
 		glog.Infof("Create NetNamespace for netid:%d, nsName: %q", netid, nsName)
+
+		existing, err := eClient.GetNetNamespace(ctx, network, nsName)
+		if err != nil {
+			glog.Warningf("Failed to look up existing NetNamespace for namespace %q to check for metadata changes: %v", nsName, err)
+		} else if !reflect.DeepEqual(existing.Annotations, annotations) || !reflect.DeepEqual(existing.Labels, labels) {
+			updated := *existing
+			updated.Annotations = annotations
+			updated.Labels = labels
+			if err := eClient.RenewNetNamespace(ctx, network, &updated); err != nil {
+				glog.Warningf("Failed to persist updated metadata on NetNamespace for namespace %q: %v", nsName, err)
+			}
+		}
 	}
+	syncNetIDAnnotationAsync(kClient, nsName, netid, true)
 	return nil
 }
 
-func (vmap *masterVNIDMap) updateVNID(ctx context.Context, network string, eClient EtcdManager, netns *NetNamespace) error {
+func (vmap *masterVNIDMap) updateVNID(ctx context.Context, network string, eClient EtcdManager, kClient *kclient.Client, netns *NetNamespace) error {
 	vmap.lock.Lock()
 	defer vmap.lock.Unlock()
 
+	oldNetID, _ := vmap.getVNID(netns.NetName)
+	action := netns.Action
+
 	netid, err := vmap.updateNetID(netns.NetName, netns.Action, netns.Namespace)
 	if err != nil {
 		return err
@@ -242,13 +385,17 @@ func (vmap *masterVNIDMap) updateVNID(ctx context.Context, network string, eClie
 	if err := eClient.RenewNetNamespace(ctx, network, netns); err != nil {
 		return err
 	}
+	auditVNIDChange(ctx, network, eClient, netns.NetName, oldNetID, netid, action)
+	syncNetIDAnnotationAsync(kClient, netns.NetName, netid, true)
 	return nil
 }
 
-func (vmap *masterVNIDMap) revokeVNID(ctx context.Context, network string, eClient EtcdManager, nsName string) error {
+func (vmap *masterVNIDMap) revokeVNID(ctx context.Context, network string, eClient EtcdManager, kClient *kclient.Client, nsName string) error {
 	vmap.lock.Lock()
 	defer vmap.lock.Unlock()
 
+	oldNetID, _ := vmap.getVNID(nsName)
+
 	// Delete NetNamespace object
 
 	if err := eClient.RevokeNetNamespace(ctx, network, nsName); err != nil {
@@ -258,9 +405,97 @@ func (vmap *masterVNIDMap) revokeVNID(ctx context.Context, network string, eClie
 	if err := vmap.releaseNetID(nsName); err != nil {
 		return err
 	}
+	auditVNIDChange(ctx, network, eClient, nsName, oldNetID, 0, "gc")
+	syncNetIDAnnotationAsync(kClient, nsName, 0, false)
 	return nil
 }
 
+// ReserveVNID reserves netID for nsName, which must not already have a
+// live NetNamespace or a pending reservation. If netID is 0, one is
+// allocated automatically. The reservation is honored by assignVNID once a
+// namespace named nsName is actually created, and expires on its own after
+// ttl if that never happens.
+func (vmap *masterVNIDMap) ReserveVNID(ctx context.Context, network string, eClient EtcdManager, nsName string, netID uint32, ttl time.Duration) (*VNIDReservation, error) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+
+	if _, found := vmap.getVNID(nsName); found {
+		return nil, fmt.Errorf("namespace %q already has an assigned VNID", nsName)
+	}
+	if existing, err := eClient.GetVNIDReservation(ctx, network, nsName); err != nil {
+		return nil, err
+	} else if existing != nil && time.Now().Before(existing.ExpiresAt) {
+		return nil, fmt.Errorf("namespace %q already has a pending VNID reservation", nsName)
+	}
+
+	auto := netID == 0
+	if auto {
+		id, err := vmap.netIDManager.AllocateNext()
+		if err != nil {
+			return nil, err
+		}
+		netID = id
+	} else if err := vmap.netIDManager.Allocate(netID); err != nil {
+		return nil, fmt.Errorf("reserve netid %d: %v", netID, err)
+	}
+
+	reservation := &VNIDReservation{
+		Namespace: nsName,
+		NetID:     netID,
+		Auto:      auto,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := eClient.ReserveVNID(ctx, network, reservation); err != nil {
+		vmap.netIDManager.Release(netID)
+		return nil, err
+	}
+	glog.Infof("Reserved netid %d for pending namespace %q", netID, nsName)
+	return reservation, nil
+}
+
+// ReleaseVNIDReservation releases a pending reservation for nsName, freeing
+// its VNID back to the allocator. It is not an error to release a
+// reservation that doesn't exist or has already expired.
+func (vmap *masterVNIDMap) ReleaseVNIDReservation(ctx context.Context, network string, eClient EtcdManager, nsName string) error {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+
+	reservation, err := eClient.GetVNIDReservation(ctx, network, nsName)
+	if err != nil {
+		return err
+	}
+	if reservation == nil {
+		return nil
+	}
+	if err := eClient.ReleaseVNIDReservation(ctx, network, nsName); err != nil {
+		return err
+	}
+	vmap.netIDManager.Release(reservation.NetID)
+	glog.Infof("Released VNID reservation of netid %d for namespace %q", reservation.NetID, nsName)
+	return nil
+}
+
+// QueryVNID returns the live VNID for nsName if the namespace already
+// exists, otherwise its pending reservation, if any. found is false if
+// neither exists.
+func (vmap *masterVNIDMap) QueryVNID(ctx context.Context, network string, eClient EtcdManager, nsName string) (netid uint32, reserved bool, found bool, err error) {
+	vmap.lock.Lock()
+	if id, ok := vmap.getVNID(nsName); ok {
+		vmap.lock.Unlock()
+		return id, false, true, nil
+	}
+	vmap.lock.Unlock()
+
+	reservation, err := eClient.GetVNIDReservation(ctx, network, nsName)
+	if err != nil {
+		return 0, false, false, err
+	}
+	if reservation == nil || time.Now().After(reservation.ExpiresAt) {
+		return 0, false, false, nil
+	}
+	return reservation.NetID, true, true, nil
+}
+
 //--------------------- Master methods ----------------------
 
 func (master *KsdnMaster) VnidStartMaster() error {
@@ -271,9 +506,34 @@ func (master *KsdnMaster) VnidStartMaster() error {
 
 	go utilwait.Forever(master.watchNamespaces, 0)
 	go utilwait.Forever(master.watchNetNamespaces, 0)
+	go utilwait.Forever(master.sweepExpiredVNIDReservations, reservationSweepInterval)
 	return nil
 }
 
+// reservationSweepInterval is how often the master looks for expired VNID
+// reservations to release.
+const reservationSweepInterval = time.Minute
+
+func (master *KsdnMaster) sweepExpiredVNIDReservations() {
+	reservations, err := master.eClient.ListVNIDReservations(master.ctx, master.networkInfo.name)
+	if err != nil {
+		glog.Warningf("Failed to list VNID reservations: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, reservation := range reservations {
+		if !now.After(reservation.ExpiresAt) {
+			continue
+		}
+		if err := master.vnids.ReleaseVNIDReservation(master.ctx, master.networkInfo.name, master.eClient, reservation.Namespace); err != nil {
+			glog.Warningf("Failed to release expired VNID reservation for namespace %q: %v", reservation.Namespace, err)
+		} else {
+			glog.Infof("Released expired VNID reservation of netid %d for namespace %q", reservation.NetID, reservation.Namespace)
+		}
+	}
+}
+
 func (master *KsdnMaster) watchNamespaces() {
 	RunEventQueue(master.kClient, Namespaces, func(delta cache.Delta) error {
 		ns := delta.Object.(*kapi.Namespace)
@@ -282,11 +542,12 @@ func (master *KsdnMaster) watchNamespaces() {
 		glog.V(5).Infof("Watch %s event for Namespace %q", delta.Type, name)
 		switch delta.Type {
 		case cache.Sync, cache.Added, cache.Updated:
-			if err := master.vnids.assignVNID(master.ctx, master.networkInfo.name, master.eClient, name); err != nil {
+			skipAllocation := master.skipVNIDForUnmanaged && (master.unmanaged.Contains(name) || namespaceUnmanaged(ns.Annotations))
+			if err := master.vnids.assignVNID(master.ctx, master.networkInfo.name, master.eClient, master.kClient, name, ns.Annotations, ns.Labels, skipAllocation); err != nil {
 				return fmt.Errorf("Error assigning netid: %v", err)
 			}
 		case cache.Deleted:
-			if err := master.vnids.revokeVNID(master.ctx, master.networkInfo.name, master.eClient, name); err != nil {
+			if err := master.vnids.revokeVNID(master.ctx, master.networkInfo.name, master.eClient, master.kClient, name); err != nil {
 				return fmt.Errorf("Error revoking netid: %v", err)
 			}
 		}
@@ -303,7 +564,7 @@ func (master *KsdnMaster) masterHandleNetnsEvent(batch []Event) {
 				glog.V(5).Infof("Null action for netnamespace update")
 				continue
 			}
-			err := master.vnids.updateVNID(master.ctx, master.networkInfo.name, master.eClient, &netns)
+			err := master.vnids.updateVNID(master.ctx, master.networkInfo.name, master.eClient, master.kClient, &netns)
 			if err != nil {
 				glog.Errorf("Error updating netid: %v", err)
 			}
@@ -8,29 +8,68 @@ import (
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 
-	kapi "k8s.io/kubernetes/pkg/api"
-	"k8s.io/kubernetes/pkg/client/cache"
 	"k8s.io/kubernetes/pkg/util/sets"
 	utilwait "k8s.io/kubernetes/pkg/util/wait"
 
 	. "k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/metrics"
 	"k8s-ovs/pkg/vnid"
 )
 
+// vnidTombstoneTTL is how long unsetVNID keeps a removed namespace's
+// generation counter around, so a ValidateGeneration call that races the
+// removal still has something to compare against instead of just failing to
+// find the namespace at all; see nodeVNIDMap.tombstones. Chosen generously
+// relative to how long a rules-installation caller takes to validate after
+// its lookup, since that's normally a handful of flow-mod round trips.
+const vnidTombstoneTTL = 30 * time.Second
+
 type nodeVNIDMap struct {
-	// Synchronizes add or remove ids/namespaces
-	lock       sync.Mutex
+	// Synchronizes add or remove ids/namespaces. A pod setup storm on node
+	// boot can have hundreds of goroutines calling WaitAndGetVNID
+	// concurrently, so reads take lock.RLock and only the rarer
+	// setVNID/unsetVNID writers take the exclusive lock.Lock.
+	lock       sync.RWMutex
 	ids        map[string]uint32
 	namespaces map[uint32]sets.String
+
+	// generation counts the number of times each namespace's mapping has
+	// been set or unset, so a caller that read a VNID via
+	// GetVNIDAndGeneration/WaitAndGetVNIDAndGeneration can tell afterwards,
+	// via ValidateGeneration, whether the mapping it read is still current.
+	// An entry here outlives the namespace's entry in ids for
+	// vnidTombstoneTTL after a removal; see tombstones.
+	generation map[string]uint64
+
+	// tombstones records when a namespace's entry was removed from ids, so
+	// its generation entry can be swept once nothing installing rules based
+	// on a pre-removal lookup should plausibly still be running. Swept
+	// lazily from setVNID/unsetVNID.
+	tombstones map[string]time.Time
+
+	// reserved is the cluster's configured set of reserved VNID ranges (see
+	// ClusterNetwork.ReservedVNIDs); setVNID warns when it sees one of these
+	// that it didn't already know about.
+	reserved vnid.ReservedRanges
+
+	changeListeners []func(namespace string, oldID, newID uint32)
 }
 
 func newNodeVNIDMap() *nodeVNIDMap {
 	return &nodeVNIDMap{
 		ids:        make(map[string]uint32),
 		namespaces: make(map[uint32]sets.String),
+		generation: make(map[string]uint64),
+		tombstones: make(map[string]time.Time),
 	}
 }
 
+// SetReservedRanges sets the VNID ranges setVNID warns about; see
+// nodeVNIDMap.reserved. Not safe to call concurrently with setVNID.
+func (vmap *nodeVNIDMap) SetReservedRanges(reserved vnid.ReservedRanges) {
+	vmap.reserved = reserved
+}
+
 func (vmap *nodeVNIDMap) addNamespaceToSet(name string, vnid uint32) {
 	set, found := vmap.namespaces[vnid]
 	if !found {
@@ -50,8 +89,8 @@ func (vmap *nodeVNIDMap) removeNamespaceFromSet(name string, vnid uint32) {
 }
 
 func (vmap *nodeVNIDMap) GetNamespaces(id uint32) []string {
-	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
+	vmap.lock.RLock()
+	defer vmap.lock.RUnlock()
 
 	if set, ok := vmap.namespaces[id]; ok {
 		return set.List()
@@ -61,8 +100,8 @@ func (vmap *nodeVNIDMap) GetNamespaces(id uint32) []string {
 }
 
 func (vmap *nodeVNIDMap) GetVNID(name string) (uint32, error) {
-	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
+	vmap.lock.RLock()
+	defer vmap.lock.RUnlock()
 
 	if id, ok := vmap.ids[name]; ok {
 		return id, nil
@@ -70,6 +109,38 @@ func (vmap *nodeVNIDMap) GetVNID(name string) (uint32, error) {
 	return 0, fmt.Errorf("Failed to find netid for namespace: %s in vnid map", name)
 }
 
+// GetVNIDAndGeneration is GetVNID plus the namespace's current generation
+// counter, for a caller that's about to install something long-lived (e.g.
+// service rules) based on the result and needs to detect afterwards, via
+// ValidateGeneration, whether it raced a concurrent setVNID/unsetVNID.
+func (vmap *nodeVNIDMap) GetVNIDAndGeneration(name string) (uint32, uint64, error) {
+	vmap.lock.RLock()
+	defer vmap.lock.RUnlock()
+
+	if id, ok := vmap.ids[name]; ok {
+		return id, vmap.generation[name], nil
+	}
+	return 0, 0, fmt.Errorf("Failed to find netid for namespace: %s in vnid map", name)
+}
+
+// ValidateGeneration reports whether namespace's generation is still exactly
+// what a prior GetVNIDAndGeneration/WaitAndGetVNIDAndGeneration call
+// observed. A caller that installed something long-lived based on that
+// lookup should call this immediately afterwards and undo the install if it
+// returns false: a mismatch means the namespace's VNID changed, or was
+// unset, while the install was in flight, so what got installed may already
+// be tagged with a netid nothing accepts anymore. False also covers a
+// namespace whose tombstone has since expired, which is the conservative
+// answer: better to undo an install that was actually still fine than to
+// leave one in place that wasn't.
+func (vmap *nodeVNIDMap) ValidateGeneration(name string, generation uint64) bool {
+	vmap.lock.RLock()
+	defer vmap.lock.RUnlock()
+
+	current, ok := vmap.generation[name]
+	return ok && current == generation
+}
+
 // Nodes asynchronously watch for both NetNamespaces and services
 // NetNamespaces populates vnid map and services/pod-setup depend on vnid map
 // If for some reason, vnid map propagation from master to node is slow
@@ -95,33 +166,123 @@ func (vmap *nodeVNIDMap) WaitAndGetVNID(name string) (uint32, error) {
 	}
 }
 
+// WaitAndGetVNIDAndGeneration is WaitAndGetVNID plus the namespace's current
+// generation counter; see GetVNIDAndGeneration.
+func (vmap *nodeVNIDMap) WaitAndGetVNIDAndGeneration(name string) (uint32, uint64, error) {
+	var id uint32
+	var generation uint64
+	backoff := utilwait.Backoff{
+		Duration: 100 * time.Millisecond,
+		Factor:   1.5,
+		Steps:    5,
+	}
+	err := utilwait.ExponentialBackoff(backoff, func() (bool, error) {
+		var err error
+		id, generation, err = vmap.GetVNIDAndGeneration(name)
+		return err == nil, nil
+	})
+	if err == nil {
+		return id, generation, nil
+	}
+	return 0, 0, fmt.Errorf("Failed to find netid for namespace: %s in vnid map", name)
+}
+
 func (vmap *nodeVNIDMap) setVNID(name string, id uint32) {
 	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
-
 	if oldId, found := vmap.ids[name]; found {
 		vmap.removeNamespaceFromSet(name, oldId)
 	}
 	vmap.ids[name] = id
 	vmap.addNamespaceToSet(name, id)
-
+	vmap.generation[name]++
+	delete(vmap.tombstones, name)
+	vmap.sweepTombstones()
+
+	// The node only ever learns a VNID by mirroring the master's
+	// NetNamespace object, so unlike the master it has no way to tell
+	// whether this id was auto-allocated or explicitly assigned; treat any
+	// id inside a reserved range as worth a warning.
+	reserved := vmap.reserved.IsReserved(id)
+	vmap.lock.Unlock()
+
+	// Logging (and the metric bump below) don't touch map state, so they run
+	// after the lock is released rather than holding up every other reader
+	// and writer for the duration of a glog call.
+	if reserved {
+		metrics.VNIDReservedUnexpected.Inc()
+		glog.Warningf("Namespace %q was assigned netid %d, which falls within a reserved VNID range", name, id)
+	}
 	glog.Infof("Associate netid %d to namespace %q", id, name)
 }
 
+// Snapshot returns a point-in-time copy of the namespace-to-netid map, for
+// use by diagnostics; the returned map is safe for the caller to read and
+// mutate freely.
+func (vmap *nodeVNIDMap) Snapshot() map[string]uint32 {
+	vmap.lock.RLock()
+	defer vmap.lock.RUnlock()
+
+	snapshot := make(map[string]uint32, len(vmap.ids))
+	for name, id := range vmap.ids {
+		snapshot[name] = id
+	}
+	return snapshot
+}
+
 func (vmap *nodeVNIDMap) unsetVNID(name string) (id uint32, err error) {
 	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
-
 	id, found := vmap.ids[name]
 	if !found {
+		vmap.lock.Unlock()
 		return 0, fmt.Errorf("Failed to find netid for namespace: %s in vnid map", name)
 	}
 	vmap.removeNamespaceFromSet(name, id)
 	delete(vmap.ids, name)
+	vmap.generation[name]++
+	vmap.tombstones[name] = time.Now()
+	vmap.sweepTombstones()
+	vmap.lock.Unlock()
+
 	glog.Infof("Dissociate netid %d from namespace %q", id, name)
 	return id, nil
 }
 
+// sweepTombstones drops generation entries whose tombstone has aged past
+// vnidTombstoneTTL, so a namespace that's gone for good doesn't leak an
+// entry in vmap.generation forever. Must be called with vmap.lock held.
+func (vmap *nodeVNIDMap) sweepTombstones() {
+	now := time.Now()
+	for name, removedAt := range vmap.tombstones {
+		if now.Sub(removedAt) > vnidTombstoneTTL {
+			delete(vmap.tombstones, name)
+			delete(vmap.generation, name)
+		}
+	}
+}
+
+// OnVNIDChanged registers fn to be called, with the namespace whose VNID
+// changed and its old and new IDs, whenever a namespace's VNID changes via
+// the watch-driven path in nodeHandleNetnsEvent. It is not called for the
+// temporary VNID substitutions SimulateVNIDChange makes directly through
+// setVNID/unsetVNID, since those never touch real state and shouldn't
+// trigger real pod refreshes.
+func (vmap *nodeVNIDMap) OnVNIDChanged(fn func(namespace string, oldID, newID uint32)) {
+	vmap.lock.Lock()
+	defer vmap.lock.Unlock()
+	vmap.changeListeners = append(vmap.changeListeners, fn)
+}
+
+func (vmap *nodeVNIDMap) notifyVNIDChanged(namespace string, oldID, newID uint32) {
+	vmap.lock.RLock()
+	var listeners []func(namespace string, oldID, newID uint32)
+	listeners = append(listeners, vmap.changeListeners...)
+	vmap.lock.RUnlock()
+
+	for _, listener := range listeners {
+		listener(namespace, oldID, newID)
+	}
+}
+
 func (vmap *nodeVNIDMap) populateVNIDs(ctx context.Context, network string, eClient EtcdManager) error {
 	netnsList, err := eClient.GetNetNamespaces(ctx, network)
 	if err != nil {
@@ -139,79 +300,184 @@ func (vmap *nodeVNIDMap) populateVNIDs(ctx context.Context, network string, eCli
 
 //------------------ Node Methods --------------------
 
-func (node *KsdnNode) VnidStartNode() error {
+func (node *KsdnNode) VnidStartNode(reservedVNIDsSpec string) error {
+	reserved, err := vnid.ParseReservedRanges(reservedVNIDsSpec)
+	if err != nil {
+		return fmt.Errorf("parse reserved VNID ranges failed: %v", err)
+	}
+	node.vnids.SetReservedRanges(reserved)
+
 	// Populate vnid map synchronously so that existing services can fetch vnid
-	err := node.vnids.populateVNIDs(node.ctx, node.networkInfo.name, node.eClient)
+	err = node.vnids.populateVNIDs(node.ctx, node.networkInfo.name, node.eClient)
 	if err != nil {
 		return err
 	}
 
-	go utilwait.Forever(node.watchNetNamespaces, 0)
-	go utilwait.Forever(node.watchServices, 0)
+	node.vnids.OnVNIDChanged(node.refreshAlsoAcceptVNIDPods)
+
+	if node.vnidDrain != nil {
+		node.vnidDrain.resume()
+	}
+
+	node.podNetworkRetry = newPodNetworkRetryQueue(node)
+	node.podNetworkRetry.run(node.ctx.Done())
+
+	node.vnidConflicts = newVNIDConflictDetector(node)
+
+	go utilwait.Until(node.watchNetNamespaces, 0, node.ctx.Done())
 	return nil
 }
 
-func (node *KsdnNode) updatePodNetwork(namespace string, oldNetID, netID uint32) {
-	// FIXME: this is racy; traffic coming from the pods gets switched to the new
-	// VNID before the service and firewall rules are updated to match. We need
-	// to do the updates as a single transaction (ovs-ofctl --bundle).
+// updatePodNetwork applies namespace's VNID transition to its local pods and
+// services. It aborts as soon as either half fails outright, rather than
+// pressing on with partial data, since a namespace half-migrated to netID is
+// worse than one still fully on oldNetID: the caller feeds a returned error
+// into podNetworkRetry instead.
+func (node *KsdnNode) updatePodNetwork(namespace string, oldNetID, netID uint32) error {
+	// FIXME: pods are still re-tagged one at a time in the loop below, so two
+	// pods in the same namespace can briefly disagree about which VNID
+	// they're on; a single ovs-ofctl --bundle transaction is the real fix.
+	// The make-before-break ordering here only closes the narrower gap
+	// between a pod's own re-tag and its namespace's service/isolation
+	// rules.
 
 	runPods, otherPods, err := node.GetLocalPods(namespace)
 	if err != nil {
-		glog.Errorf("Could not get list of local pods in namespace %q: %v", namespace, err)
+		return fmt.Errorf("could not get list of local pods in namespace %q: %v", namespace, err)
 	}
-	services, err := node.kClient.Services(namespace).List(kapi.ListOptions{})
-	if err != nil {
-		glog.Errorf("Could not get list of services in namespace %q: %v", namespace, err)
-		services = &kapi.ServiceList{}
+
+	// Install the target VNID's service rules before any pod is re-tagged to
+	// it, so a pod's traffic is never briefly tagged with a netid its own
+	// namespace's services don't accept yet; see
+	// installServicesForVNIDTransition.
+	if err := node.installServicesForVNIDTransition(namespace, netID); err != nil {
+		return fmt.Errorf("could not install services for namespace %q under netid %d: %v", namespace, netID, err)
+	}
+
+	// If a grace period is configured, open namespace's drain window before
+	// any pod is re-tagged, so each pod's UpdatePod call below sees it
+	// already open and keeps accepting oldNetID traffic alongside netID's.
+	if node.vnidTransitionGracePeriod > 0 {
+		node.vnidDrain.begin(namespace, oldNetID, netID)
 	}
 
 	// Update OF rules for the existing/old pods in the namespace
 	for _, pod := range runPods {
-		err = node.UpdatePod(pod)
-		if err != nil {
+		if err := node.UpdatePod(pod); err != nil {
 			glog.Errorf("Could not update pod %q in namespace %q: %v", pod.Name, namespace, err)
 		}
 	}
 
-	deleteOptions := kapi.DeleteOptions{}
-	for _, pod := range otherPods {
-		err := node.kClient.Pods(namespace).Delete(pod.Name, &deleteOptions)
-		if err != nil {
-			glog.Errorf("Could not delete pod %q in namespace %q: %v", pod.Name, namespace, err)
-		}
+	acked := func() bool { return node.massPodDeleteAcked(namespace) }
+	if node.podDeleteGuard.allow(namespace, otherPods, len(runPods)+len(otherPods), node.podDeleteSafetyThreshold, acked) {
+		// Evict rather than Delete, so a PodDisruptionBudget can hold one of
+		// these back instead of a mass VNID-transition cleanup taking down a
+		// quorum-based workload's last remaining replicas; see
+		// pod_eviction.go.
+		node.evictOtherPods(namespace, otherPods)
 	}
 
-	// Update OF rules for the old services in the namespace
-	for _, svc := range services.Items {
-		if !kapi.IsServiceIPSet(&svc) {
-			continue
+	// With no grace period configured, it's safe to remove the old tenant's
+	// service rules as soon as every pod has been re-tagged to netID.
+	// Otherwise vnidDrain's timer (armed by begin, above) does it once the
+	// grace period elapses.
+	if node.vnidTransitionGracePeriod == 0 {
+		if err := node.finishServicesForVNIDTransition(namespace, oldNetID); err != nil {
+			return fmt.Errorf("could not remove old-netid services for namespace %q: %v", namespace, err)
 		}
+	}
+	return nil
+}
 
-		if err = node.DeleteServiceRules(&svc); err != nil {
-			glog.Errorf("Error adding OVS flows for service %v, netid %d: %v", svc, netID, err)
-		}
-		if err = node.AddServiceRules(&svc, netID); err != nil {
-			glog.Errorf("Error deleting OVS flows for service %v: %v", svc, err)
-		}
+// transitionPodNetwork applies namespace's VNID transition and, if
+// updatePodNetwork fails outright, hands it to podNetworkRetry instead of
+// leaving the namespace stuck on oldNetID until some unrelated later event
+// happens to redo the work.
+//
+// While a maintenance freeze is active, it doesn't call updatePodNetwork at
+// all -- not even to fail -- since that would still run the pod re-tag loop
+// and evictOtherPods before hitting a frozen flow backend; instead it defers
+// the transition to be replayed once the freeze lifts. See
+// maintenanceFreezeState.
+func (node *KsdnNode) transitionPodNetwork(namespace string, oldNetID, netID uint32) {
+	if node.maintenanceFreeze.Frozen() {
+		node.maintenanceFreeze.add(namespace, oldNetID, netID)
+		node.recordMaintenanceFreezeEvent(namespace, oldNetID, netID)
+		return
+	}
+
+	if err := node.updatePodNetwork(namespace, oldNetID, netID); err != nil {
+		glog.Errorf("Failed to apply VNID transition for namespace %q (%d -> %d): %v", namespace, oldNetID, netID, err)
+		node.podNetworkRetry.add(namespace, oldNetID, netID, err)
 	}
 }
 
 func (node *KsdnNode) nodeHandleNetnsEvent(batch []Event) {
 	for _, evt := range batch {
 		netns := evt.NetNS
+		// Prefer the watch's own OldNetNS over re-deriving it from
+		// node.vnids: the backend saw the actual prior record (or lack of
+		// one), where a GetVNID lookup can only tell us what we last
+		// applied ourselves, which lags a step behind on the very
+		// transition we're trying to detect. Backends that can't supply
+		// OldNetNS (a genuine create, or the CRD backend, which has no way
+		// to look one up) leave it at the zero value, so fall back to the
+		// old lookup-based determination in that case.
+		haveOldNetID, oldNetID := false, uint32(0)
+		if evt.OldNetNS.NetName != "" {
+			haveOldNetID, oldNetID = true, evt.OldNetNS.NetID
+		} else if id, err := node.vnids.GetVNID(netns.NetName); err == nil {
+			haveOldNetID, oldNetID = true, id
+		}
+
 		switch evt.Type {
 		case EventAdded:
-			oldNetID, err := node.vnids.GetVNID(netns.NetName)
-			if (err == nil) && (oldNetID == netns.NetID) {
+			wasUnmanaged := node.unmanaged.Contains(netns.NetName)
+			nowUnmanaged := namespaceUnmanaged(netns.Annotations)
+			node.unmanaged.SetAnnotated(netns.NetName, nowUnmanaged)
+
+			// syncEgressDSCP runs unconditionally, ahead of the early-break
+			// below, since an annotation-only update (no VNID or unmanaged
+			// change) would otherwise never reach it.
+			node.syncEgressDSCP(netns.NetID)
+			if haveOldNetID && oldNetID != netns.NetID {
+				node.syncEgressDSCP(oldNetID)
+			}
+			if haveOldNetID && oldNetID == netns.NetID && wasUnmanaged == nowUnmanaged {
 				break
 			}
-			node.vnids.setVNID(netns.NetName, netns.NetID)
-			node.updatePodNetwork(netns.NetName, oldNetID, netns.NetID)
+			netID := netns.NetID
+			if node.vnidConflicts.check(netns.NetName, netID) {
+				netID = node.vnidConflicts.resolve(node.ctx, node.networkInfo.name, netns.NetName, netID)
+			}
+			node.vnids.setVNID(netns.NetName, netID)
+			switch {
+			case nowUnmanaged && !wasUnmanaged && haveOldNetID:
+				// Namespace just went unmanaged: drop the service rules it
+				// already has installed for oldNetID, but stop there -- no
+				// re-tag to netID, no further reconciliation from here on.
+				if err := node.finishServicesForVNIDTransition(netns.NetName, oldNetID); err != nil {
+					glog.Errorf("Failed to remove services for namespace %q going unmanaged: %v", netns.NetName, err)
+				}
+			case !nowUnmanaged:
+				node.transitionPodNetwork(netns.NetName, oldNetID, netID)
+			}
+			node.vnids.notifyVNIDChanged(netns.NetName, oldNetID, netID)
 		case EventRemoved:
-			// updatePodNetwork needs vnid, so unset vnid after this call
-			node.updatePodNetwork(netns.NetName, netns.NetID, vnid.GlobalVNID)
+			removedNetID := netns.NetID
+			if haveOldNetID {
+				removedNetID = oldNetID
+			}
+			wasUnmanaged := node.unmanaged.Contains(netns.NetName)
+			node.unmanaged.Forget(netns.NetName)
+
+			if !wasUnmanaged {
+				// updatePodNetwork needs vnid, so unset vnid after this call
+				node.transitionPodNetwork(netns.NetName, removedNetID, vnid.GlobalVNID)
+			}
 			node.vnids.unsetVNID(netns.NetName)
+			node.vnids.notifyVNIDChanged(netns.NetName, removedNetID, vnid.GlobalVNID)
+			node.syncEgressDSCP(removedNetID)
 
 		default:
 			glog.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -223,58 +489,3 @@ func (node *KsdnNode) watchNetNamespaces() {
 	receiver := make(chan []Event)
 	RunNetnsWatch(node.ctx, node.eClient, node.networkInfo.name, receiver, node.nodeHandleNetnsEvent)
 }
-
-func isServiceChanged(oldsvc, newsvc *kapi.Service) bool {
-	if len(oldsvc.Spec.Ports) == len(newsvc.Spec.Ports) {
-		for i := range oldsvc.Spec.Ports {
-			if oldsvc.Spec.Ports[i].Protocol != newsvc.Spec.Ports[i].Protocol ||
-				oldsvc.Spec.Ports[i].Port != newsvc.Spec.Ports[i].Port {
-				return true
-			}
-		}
-		return false
-	}
-	return true
-}
-
-func (node *KsdnNode) watchServices() {
-	services := make(map[string]*kapi.Service)
-	RunEventQueue(node.kClient, Services, func(delta cache.Delta) error {
-		serv := delta.Object.(*kapi.Service)
-
-		// Ignore headless services
-		if !kapi.IsServiceIPSet(serv) {
-			return nil
-		}
-
-		glog.V(5).Infof("Watch %s event for Service %q", delta.Type, serv.ObjectMeta.Name)
-		switch delta.Type {
-		case cache.Sync, cache.Added, cache.Updated:
-			oldsvc, exists := services[string(serv.UID)]
-			if exists {
-				if !isServiceChanged(oldsvc, serv) {
-					break
-				}
-				if err := node.DeleteServiceRules(oldsvc); err != nil {
-					glog.Error(err)
-				}
-			}
-
-			netid, err := node.vnids.WaitAndGetVNID(serv.Namespace)
-			if err != nil {
-				return fmt.Errorf("skipped adding service rules for serviceEvent: %v, Error: %v", delta.Type, err)
-			}
-
-			if err = node.AddServiceRules(serv, netid); err != nil {
-				return err
-			}
-			services[string(serv.UID)] = serv
-		case cache.Deleted:
-			delete(services, string(serv.UID))
-			if err := node.DeleteServiceRules(serv); err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-}
@@ -0,0 +1,129 @@
+package ksdn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// vnidOscillationWindow is how recently a namespace's netid must have
+// changed for a new event reverting it back to what it just left to count as
+// suspicious rather than an ordinary one-off change; see
+// vnidConflictDetector.check.
+const vnidOscillationWindow = 30 * time.Second
+
+// vnidConflictReason is the Event reason recorded when a NetNamespace add
+// event is held back for re-verification against etcd.
+const vnidConflictReason = "VNIDConflictDetected"
+
+// vnidHistoryEntry is the last netid a namespace's watch delivered, and the
+// one before that, so vnidConflictDetector.check can recognize an event that
+// simply reverts the namespace back to the ID it just left.
+type vnidHistoryEntry struct {
+	netID  uint32
+	prevID uint32
+	seenAt time.Time
+}
+
+// vnidConflictDetector watches for NetNamespace add events that contradict a
+// namespace's own recent history closely enough that they're more likely
+// corrupt or racing data -- two networks disagreeing about the same name, a
+// stale write landing after a fresh one -- than a legitimate change, and
+// holds them for verification against etcd instead of letting setVNID apply
+// them blind. It does not second-guess EventRemoved, which always drives the
+// namespace to vnid.GlobalVNID and so has nothing to conflict with.
+type vnidConflictDetector struct {
+	node *KsdnNode
+
+	lock    sync.Mutex
+	history map[string]vnidHistoryEntry
+}
+
+func newVNIDConflictDetector(node *KsdnNode) *vnidConflictDetector {
+	return &vnidConflictDetector{
+		node:    node,
+		history: make(map[string]vnidHistoryEntry),
+	}
+}
+
+// check records namespace's new netID into its history and reports whether
+// the transition looks like a suspicious oscillation: reverting to the ID
+// the namespace held two events ago, within vnidOscillationWindow of leaving
+// it. A caller that gets true back should resolve the conflict against etcd
+// before applying netID; a caller that gets false should proceed normally.
+func (d *vnidConflictDetector) check(namespace string, netID uint32) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	prev, ok := d.history[namespace]
+	suspicious := ok &&
+		prev.prevID != prev.netID &&
+		netID == prev.prevID &&
+		time.Since(prev.seenAt) < vnidOscillationWindow
+
+	d.history[namespace] = vnidHistoryEntry{netID: netID, prevID: prev.netID, seenAt: time.Now()}
+	return suspicious
+}
+
+// resolve re-reads namespace's NetNamespace directly from etcd via the
+// single-key API to establish which of eventID or etcd's current record is
+// trustworthy, since a suspicious event might just as easily be genuine
+// (fast, valid churn) as corrupt. It always records the conflict, via metric
+// and Event, for the master's consistency checker to consume, regardless of
+// which value it ends up recommending.
+func (d *vnidConflictDetector) resolve(ctx context.Context, network, namespace string, eventID uint32) uint32 {
+	metrics.VNIDConflictsDetected.Inc()
+
+	resolvedID := eventID
+	message := fmt.Sprintf("namespace %q's watched netid %d reverted a recent change within %s; could not re-read etcd to verify, trusting the watch", namespace, eventID, vnidOscillationWindow)
+
+	truth, err := d.node.eClient.GetNetNamespace(ctx, network, namespace)
+	if err != nil {
+		glog.Errorf("Could not re-read NetNamespace %q from etcd to resolve VNID conflict: %v", namespace, err)
+	} else {
+		resolvedID = truth.NetID
+		message = fmt.Sprintf("namespace %q's watched netid %d reverted a recent change; etcd's current record says %d, using that", namespace, eventID, truth.NetID)
+	}
+
+	glog.Warningf("VNID conflict: %s", message)
+	d.node.recordVNIDConflictEvent(namespace, message)
+	return resolvedID
+}
+
+// recordVNIDConflictEvent records a Warning Event against namespace so an
+// operator, or the master's consistency checker, can see that a node held
+// back a suspicious VNID assignment, even if it resolved cleanly. Best
+// effort, same as recordPodNetworkDegradedEvent: logged on failure, never
+// fails the caller.
+func (node *KsdnNode) recordVNIDConflictEvent(namespace, message string) {
+	now := unversioned.NewTime(time.Now())
+	event := &kapi.Event{
+		ObjectMeta: kapi.ObjectMeta{
+			GenerateName: "k8s-ovs-vnid-conflict.",
+			Namespace:    namespace,
+		},
+		InvolvedObject: kapi.ObjectReference{
+			Kind:      "Namespace",
+			Name:      namespace,
+			Namespace: namespace,
+		},
+		Reason:         vnidConflictReason,
+		Message:        message,
+		Source:         kapi.EventSource{Component: "k8s-ovs"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           kapi.EventTypeWarning,
+	}
+	if _, err := node.kClient.Events(namespace).Create(event); err != nil {
+		glog.Warningf("Could not record VNID conflict event for namespace %q: %v", namespace, err)
+	}
+}
@@ -0,0 +1,144 @@
+package ksdn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/util/workqueue"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// podNetworkRetryWorkers is the number of goroutines retrying failed VNID
+// transitions concurrently.
+const podNetworkRetryWorkers = 1
+
+// podNetworkDegradedEventReason is the Event reason recorded against a
+// namespace whose pods and/or services are stuck on a stale VNID because
+// updatePodNetwork keeps failing on it.
+const podNetworkDegradedEventReason = "VNIDTransitionFailed"
+
+// podNetworkTransition is a namespace's pending VNID change, captured at the
+// point updatePodNetwork first failed on it, so a retry replays the same
+// transition instead of needing to re-derive it from the vnid map, which may
+// have moved on again by the time the retry runs.
+type podNetworkTransition struct {
+	oldNetID, netID uint32
+}
+
+// podNetworkRetryQueue retries a namespace's failed VNID transition with
+// backoff, the same way serviceController retries a failed service sync,
+// instead of leaving updatePodNetwork's one-shot failure to be silently
+// papered over (or not) by whatever VNID change happens to hit that
+// namespace next.
+type podNetworkRetryQueue struct {
+	node  *KsdnNode
+	queue workqueue.RateLimitingInterface
+
+	lock    sync.Mutex
+	pending map[string]podNetworkTransition // namespace -> latest failed transition
+}
+
+func newPodNetworkRetryQueue(node *KsdnNode) *podNetworkRetryQueue {
+	return &podNetworkRetryQueue{
+		node:    node,
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "podnetwork"),
+		pending: make(map[string]podNetworkTransition),
+	}
+}
+
+// add records namespace's transition and queues it for retry, replacing any
+// earlier transition still pending for the same namespace: only the most
+// recent one is still meaningful to converge on. It also increments the
+// failure metric and records a degraded-namespace Event, so an operator
+// sees this even if the retry eventually succeeds on its own.
+func (q *podNetworkRetryQueue) add(namespace string, oldNetID, netID uint32, cause error) {
+	q.lock.Lock()
+	q.pending[namespace] = podNetworkTransition{oldNetID: oldNetID, netID: netID}
+	q.lock.Unlock()
+
+	metrics.PodNetworkTransitionFailures.Inc()
+	q.node.recordPodNetworkDegradedEvent(namespace, oldNetID, netID, cause)
+	q.queue.AddRateLimited(namespace)
+}
+
+// run starts the retry workers. It returns immediately; the workers stop
+// when stopCh is closed.
+func (q *podNetworkRetryQueue) run(stopCh <-chan struct{}) {
+	for i := 0; i < podNetworkRetryWorkers; i++ {
+		go utilwait.Until(q.runWorker, time.Second, stopCh)
+	}
+}
+
+func (q *podNetworkRetryQueue) runWorker() {
+	for q.processNextWorkItem() {
+	}
+}
+
+func (q *podNetworkRetryQueue) processNextWorkItem() bool {
+	key, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	defer q.queue.Done(key)
+
+	namespace := key.(string)
+	q.lock.Lock()
+	transition, ok := q.pending[namespace]
+	q.lock.Unlock()
+	if !ok {
+		// Superseded by a success recorded between Get and here.
+		q.queue.Forget(key)
+		return true
+	}
+
+	if err := q.node.updatePodNetwork(namespace, transition.oldNetID, transition.netID); err != nil {
+		glog.Errorf("Retry of VNID transition for namespace %q failed, will retry: %v", namespace, err)
+		q.queue.AddRateLimited(key)
+		return true
+	}
+
+	q.lock.Lock()
+	delete(q.pending, namespace)
+	q.lock.Unlock()
+	glog.Infof("VNID transition for namespace %q converged after retry", namespace)
+	q.queue.Forget(key)
+	return true
+}
+
+// recordPodNetworkDegradedEvent records a Warning Event against namespace so
+// an operator watching `kubectl get events` notices a namespace stuck on a
+// stale VNID, not just whoever happens to be watching the
+// pod_network_transition_failures_total metric. Failures here are logged
+// but otherwise ignored: this is best-effort diagnostics, not something
+// worth failing the retry over.
+func (node *KsdnNode) recordPodNetworkDegradedEvent(namespace string, oldNetID, netID uint32, cause error) {
+	now := unversioned.NewTime(time.Now())
+	event := &kapi.Event{
+		ObjectMeta: kapi.ObjectMeta{
+			GenerateName: "k8s-ovs-vnid-transition-failed.",
+			Namespace:    namespace,
+		},
+		InvolvedObject: kapi.ObjectReference{
+			Kind:      "Namespace",
+			Name:      namespace,
+			Namespace: namespace,
+		},
+		Reason:         podNetworkDegradedEventReason,
+		Message:        fmt.Sprintf("Failed to apply VNID transition (%d -> %d), retrying: %v", oldNetID, netID, cause),
+		Source:         kapi.EventSource{Component: "k8s-ovs"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           kapi.EventTypeWarning,
+	}
+	if _, err := node.kClient.Events(namespace).Create(event); err != nil {
+		glog.Warningf("Could not record VNID transition failure event for namespace %q: %v", namespace, err)
+	}
+}
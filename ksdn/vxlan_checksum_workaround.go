@@ -0,0 +1,209 @@
+package ksdn
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	kexec "k8s.io/kubernetes/pkg/util/exec"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// Recognized values for WithVXLANChecksumWorkaround / --vxlan-checksum-workaround.
+const (
+	ChecksumWorkaroundEnabled  = "enabled"
+	ChecksumWorkaroundDisabled = "disabled"
+	ChecksumWorkaroundAuto     = "auto"
+)
+
+// knownBadOffloadDrivers lists underlay NIC drivers that have shipped
+// driver/firmware combinations which corrupt or drop VXLAN-encapsulated
+// traffic when tx checksum offload is left on -- the defect is in the
+// driver's outer-UDP checksum computation for encapsulated packets, fixed
+// upstream at different kernel versions per driver, so we key off driver
+// name rather than chasing every backport.
+var knownBadOffloadDrivers = map[string]bool{
+	"ixgbe":  true,
+	"i40e":   true,
+	"bnx2x":  true,
+	"be2net": true,
+}
+
+// vxlanChecksumWorkaroundKernelCeiling is the kernel release (as reported
+// by "uname -r") at or past which a known-bad driver is assumed to carry
+// the upstream fix; below it, the driver is assumed still affected.
+const vxlanChecksumWorkaroundKernelCeiling = "4.14.0"
+
+// resolveVXLANChecksumWorkaround turns mode into whether this node should
+// disable tx checksum offload on iface, probing its driver and the running
+// kernel when mode is ChecksumWorkaroundAuto and logging the decision
+// either way.
+func resolveVXLANChecksumWorkaround(mode string, execer kexec.Interface, iface string) (bool, error) {
+	switch mode {
+	case ChecksumWorkaroundEnabled:
+		return true, nil
+	case ChecksumWorkaroundDisabled:
+		return false, nil
+	case ChecksumWorkaroundAuto:
+		bad, reason := detectBadOffloadCombination(execer, iface)
+		if bad {
+			glog.Infof("vxlan-checksum-workaround=auto: %s", reason)
+		} else {
+			glog.V(4).Infof("vxlan-checksum-workaround=auto: %s", reason)
+		}
+		return bad, nil
+	default:
+		return false, fmt.Errorf("unknown --vxlan-checksum-workaround value %q, must be %q, %q or %q", mode, ChecksumWorkaroundEnabled, ChecksumWorkaroundDisabled, ChecksumWorkaroundAuto)
+	}
+}
+
+// detectBadOffloadCombination reports whether iface's driver and the
+// running kernel match a known-bad VXLAN checksum offload combination, and
+// a short human-readable reason either way.
+func detectBadOffloadCombination(execer kexec.Interface, iface string) (bool, string) {
+	driver, err := interfaceDriver(execer, iface)
+	if err != nil {
+		return false, fmt.Sprintf("could not determine driver for %s: %v", iface, err)
+	}
+	if !knownBadOffloadDrivers[driver] {
+		return false, fmt.Sprintf("driver %s for %s is not known to be affected", driver, iface)
+	}
+
+	release, err := kernelRelease(execer)
+	if err != nil {
+		return false, fmt.Sprintf("could not determine kernel release: %v", err)
+	}
+	if compareKernelReleases(release, vxlanChecksumWorkaroundKernelCeiling) >= 0 {
+		return false, fmt.Sprintf("driver %s for %s is affected on older kernels, but this kernel (%s) is at or past %s", driver, iface, release, vxlanChecksumWorkaroundKernelCeiling)
+	}
+
+	return true, fmt.Sprintf("driver %s for %s on kernel %s is a known-bad VXLAN checksum offload combination, disabling tx checksum offload", driver, iface, release)
+}
+
+// interfaceDriver runs "ethtool -i iface" and returns its "driver:" line.
+func interfaceDriver(execer kexec.Interface, iface string) (string, error) {
+	out, err := execer.Command("ethtool", "-i", iface).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ethtool -i %s: %v: %s", iface, err, out)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimPrefix(line, "driver: "); name != line {
+			return strings.TrimSpace(name), nil
+		}
+	}
+	return "", fmt.Errorf("ethtool -i %s did not report a driver", iface)
+}
+
+// kernelRelease runs "uname -r" and returns its trimmed output.
+func kernelRelease(execer kexec.Interface) (string, error) {
+	out, err := execer.Command("uname", "-r").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("uname -r: %v: %s", err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// compareKernelReleases compares two "uname -r"-style releases (eg
+// "3.10.0-1160.el7.x86_64") by their leading dot-separated numeric
+// components, ignoring everything from the first non-numeric component
+// onward. It returns a negative number if a < b, 0 if equal, positive if
+// a > b.
+func compareKernelReleases(a, b string) int {
+	av, bv := kernelVersionNumbers(a), kernelVersionNumbers(b)
+	for i := 0; i < len(av) && i < len(bv); i++ {
+		if av[i] != bv[i] {
+			return av[i] - bv[i]
+		}
+	}
+	return len(av) - len(bv)
+}
+
+func kernelVersionNumbers(release string) []int {
+	head := strings.SplitN(release, "-", 2)[0]
+	var nums []int
+	for _, part := range strings.Split(head, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+// applyVXLANChecksumWorkaround disables tx checksum offload on iface via
+// ethtool, logging exactly what it changed and why.
+func applyVXLANChecksumWorkaround(execer kexec.Interface, iface string) error {
+	out, err := execer.Command("ethtool", "-K", iface, "tx", "off").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ethtool -K %s tx off: %v: %s", iface, err, out)
+	}
+	glog.Infof("Disabled tx checksum offload on %s to work around a known VXLAN checksum offload defect", iface)
+	return nil
+}
+
+// applyVXLANChecksumWorkaroundIfNeeded resolves node's underlay interface
+// from node.localIP, decides via resolveVXLANChecksumWorkaround whether it
+// needs the tx checksum offload workaround, applies it if so, and records
+// the outcome in node.vxlanChecksumWorkaroundApplied and the
+// vxlan_checksum_workaround_applied metric either way, so a node that
+// can't even determine its underlay interface still reports (as
+// not-applied) rather than leaving the metric unset.
+func (node *KsdnNode) applyVXLANChecksumWorkaroundIfNeeded() error {
+	defer func() {
+		applied := float64(0)
+		if node.vxlanChecksumWorkaroundApplied {
+			applied = 1
+		}
+		metrics.VXLANChecksumWorkaroundApplied.Set(applied)
+	}()
+
+	iface, err := interfaceForIP(net.ParseIP(node.localIP))
+	if err != nil {
+		glog.Warningf("Could not determine underlay interface for VXLAN checksum offload check: %v", err)
+		return nil
+	}
+
+	apply, err := resolveVXLANChecksumWorkaround(node.vxlanChecksumWorkaroundMode, node.execer, iface)
+	if err != nil {
+		return err
+	}
+	if !apply {
+		return nil
+	}
+	if err := applyVXLANChecksumWorkaround(node.execer, iface); err != nil {
+		return err
+	}
+	node.vxlanChecksumWorkaroundApplied = true
+	return nil
+}
+
+// interfaceForIP returns the name of the local interface configured with
+// ip, so the checksum offload workaround targets the same underlay
+// interface the VXLAN tunnel actually uses.
+func interfaceForIP(ip net.IP) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("list interfaces: %v", err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.Equal(ip) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no local interface has address %s", ip)
+}
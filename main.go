@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -14,30 +16,73 @@ import (
 	"github.com/spf13/pflag"
 	"golang.org/x/net/context"
 
-	client "k8s.io/kubernetes/pkg/client/unversioned"
-
 	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
 	"k8s.io/kubernetes/pkg/kubelet/dockertools"
+	"k8s.io/kubernetes/pkg/util/intstr"
 	utilwait "k8s.io/kubernetes/pkg/util/wait"
 
+	"k8s-ovs/ksdn"
 	"k8s-ovs/pkg/election"
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/etcdmanager/crd"
 	"k8s-ovs/pkg/etcdmanager/etcdv2"
+	"k8s-ovs/pkg/kubeclient"
+	"k8s-ovs/pkg/metrics"
 	"k8s-ovs/pkg/utils"
-	"k8s-ovs/ksdn"
 )
 
 type CmdLineOpts struct {
-	etcdEndpoints *string
-	etcdPrefix    *string
-	etcdKeyfile   *string
-	etcdCertfile  *string
-	etcdCAFile    *string
-	etcdUsername  *string
-	etcdPassword  *string
-	network       *string
-	hostname      *string
-	dEndpoint     *string
-	version       *bool
+	etcdEndpoints                   *string
+	etcdPrefix                      *string
+	etcdKeyfile                     *string
+	etcdCertfile                    *string
+	etcdCAFile                      *string
+	etcdUsername                    *string
+	etcdPassword                    *string
+	network                         *string
+	hostname                        *string
+	dEndpoint                       *string
+	criEndpoint                     *string
+	etcdBackend                     *string
+	crdNamespace                    *string
+	version                         *bool
+	metricsBind                     *string
+	vnidAPIBind                     *string
+	crashDumpDir                    *string
+	lazyServices                    *bool
+	dryRun                          *bool
+	alsoAcceptVNIDsNamespaces       *string
+	dnsServiceNamespace             *string
+	dnsServiceName                  *string
+	accessibleFromNamespaces        *string
+	serviceRulesMode                *string
+	tcpMSSClamp                     *string
+	privilegedHelperSocket          *string
+	podDeleteSafetyThreshold        *string
+	vxlanIngressFilter              *bool
+	vxlanSource                     *string
+	hostNetworkAccess               *bool
+	podEvictionGracePeriod          *int64
+	podEvictionMaxAttempts          *int
+	trafficAccountingInterval       *time.Duration
+	trafficAccountingNamespaceLimit *int
+	egressRouterInterface           *string
+	egressRouterAllowedCIDRs        *string
+	vxlanChecksumWorkaround         *string
+	unmanagedNamespaces             *string
+	skipVNIDForUnmanaged            *bool
+	connectivityProbe               *bool
+	connectivityProbeInterval       *time.Duration
+	connectivityProbeSampleSize     *int
+	vnidTransitionGracePeriod       *time.Duration
+	preflightOnly                   *bool
+	kubeQPS                         *float32
+	kubeBurst                       *int
+	kubeUserAgent                   *string
+	trafficMirrorInterface          *string
+	duplicateAddressCheck           *bool
+	duplicateAddressCheckTimeout    *time.Duration
+	maintenanceFreezeAllowNewPods   *bool
 }
 
 var (
@@ -58,10 +103,71 @@ func init() {
 	opts.network = flags.String("network", "", "network name, ex: (--network=test)")
 	opts.hostname = flags.String("hostname", "", "Hostname")
 	opts.dEndpoint = flags.String("docker-endpoints", "unix:///var/run/docker.sock", "endpoints to communicate with docker daemon")
+	opts.criEndpoint = flags.String("cri-endpoint", "", "CRI runtime endpoint to resolve pod network namespaces through, ex: unix:///run/containerd/containerd.sock (auto-detected if unset, falling back to docker-endpoints)")
+	opts.etcdBackend = flags.String("etcd-backend", "etcd", "backend for subnet/NetNamespace records: \"etcd\" (direct etcd connection) or \"crd\" (Kubernetes ThirdPartyResources, accessed through kClient with normal RBAC; see \"migrate-to-crd\")")
+	opts.crdNamespace = flags.String("crd-namespace", utils.SdnNamespace, "Kubernetes namespace to store records in when --etcd-backend=crd")
 	opts.version = flags.Bool("version", false, "print version and exit")
+	opts.preflightOnly = flags.Bool("preflight-only", false, "run node startup's preflight checks (required kernel modules, sysctls, OVS version) and exit, fixing whatever is safe to fix automatically; does not talk to Kubernetes or etcd. For use in node-validation pipelines")
+	opts.metricsBind = flags.String("metrics-bind-address", "", "bind address for the Prometheus /metrics endpoint, e.g. 127.0.0.1:9101 (disabled if empty)")
+	opts.vnidAPIBind = flags.String("vnid-api-bind-address", "", "bind address for the master's authenticated VNID provisioning API (see package vnidapi), e.g. 0.0.0.0:8445 (disabled if empty, and only used when running as master of a multitenant network)")
+	opts.crashDumpDir = flags.String("crashdump-dir", "", "directory to write diagnostics bundles to on fatal errors and panics (disabled if empty)")
+	opts.lazyServices = flags.Bool("lazy-service-rules", false, "only install a namespace's service OVS rules once it has a local pod, instead of on every node (NodePort/LoadBalancer services are always installed)")
+	opts.dryRun = flags.Bool("dry-run", false, "record intended OVS flow changes instead of applying them, and log them grouped by namespace/feature at the end of startup (see the admin API's simulate-VNID-change call for dry-running a single change against a node that's already running for real)")
+	opts.alsoAcceptVNIDsNamespaces = flags.String("also-accept-vnids-namespaces", "", "comma-separated allowlist of namespaces permitted to use the k8s-ovs/also-accept-vnids pod annotation (disabled cluster-wide if empty)")
+	opts.dnsServiceNamespace = flags.String("dns-service-namespace", "kube-system", "namespace of the cluster DNS service every VNID is allowed to resolve through despite tenant isolation")
+	opts.dnsServiceName = flags.String("dns-service-name", "", "name of the cluster DNS service every VNID is allowed to resolve through despite tenant isolation, e.g. \"kube-dns\" (disabled if empty)")
+	opts.accessibleFromNamespaces = flags.String("accessible-from-namespaces", "", "comma-separated allowlist of namespaces permitted to use the k8s-ovs/accessible-from service annotation (disabled cluster-wide if empty)")
+	opts.serviceRulesMode = flags.String("service-rules", ksdn.ServiceRulesEnabled, "whether this node programs its own service OVS rules: \"enabled\", \"disabled\" (for coexisting with a cluster's own kube-proxy), or \"auto\" (probe for a running kube-proxy at startup and pick accordingly)")
+	opts.tcpMSSClamp = flags.String("tcp-mss-clamp", "", "clamp the TCP MSS of SYNs leaving the cluster network toward non-cluster destinations, to avoid PMTUD blackholes on smaller-MTU paths (e.g. behind a VPN): empty disables, \"auto\" derives the clamp from the pod MTU, or set an explicit MSS")
+	opts.privilegedHelperSocket = flags.String("privileged-helper-socket", "", "unix socket of a k8s-ovs-privhelper process to route privileged ovs-vsctl/ovs-ofctl/iptables/ip/k8s-sdn-ovs commands through, instead of running them locally (disabled if empty)")
+	opts.podDeleteSafetyThreshold = flags.String("pod-delete-safety-threshold", "", "cap how many of a namespace's pods updatePodNetwork may delete for a single NetNamespace event before holding back for the k8s-ovs.com/allow-mass-pod-delete namespace annotation or reconcile re-verification: an absolute count, a percentage like \"25%\", or empty to disable")
+	opts.vxlanIngressFilter = flags.Bool("vxlan-ingress-filter", true, "drop encapsulated traffic arriving on the VXLAN port from a tunnel source outside the current HostSubnet list, instead of accepting it unconditionally; disable only as a break-glass measure, e.g. during a migration where peer nodes' HostSubnet records lag their real tunnel endpoints")
+	opts.vxlanSource = flags.String("vxlan-source", "", "pin the VXLAN tunnel's local address and this node's HostSubnet record to a specific interface (e.g. \"eth1\") or CIDR (e.g. \"10.1.0.0/16\") on multi-NIC nodes, instead of letting the route to each peer pick it; empty keeps the historical auto-selected behavior")
+	opts.hostNetworkAccess = flags.Bool("host-network-access", true, "tag traffic from the node's own addresses with a service's VNID so host-network pods and node processes (kubelet, kube-proxy health checks, ...) can reach it even in an isolated namespace; disable for stricter environments where host processes shouldn't get an implicit pass through tenant isolation")
+	opts.podEvictionGracePeriod = flags.Int64("pod-eviction-grace-period", 30, "grace period, in seconds, updatePodNetwork gives a pod to shut down when evicting it as part of a VNID transition")
+	opts.podEvictionMaxAttempts = flags.Int("pod-eviction-max-attempts", 10, "how many times updatePodNetwork retries a pod's eviction after a PodDisruptionBudget rejection, with backoff, before leaving the pod alone and reporting the situation")
+	opts.trafficAccountingInterval = flags.Duration("traffic-accounting-interval", 30*time.Second, "how often the per-tenant traffic accountant re-reads OVS service flow stats for chargeback")
+	opts.trafficAccountingNamespaceLimit = flags.Int("traffic-accounting-namespace-limit", 500, "maximum number of distinct namespaces the traffic accountant will export per-namespace byte/packet metrics for")
+	opts.egressRouterInterface = flags.String("egress-router-interface", "", "uplink interface egress router pods' macvlan device is created off of (disables the k8s-ovs/egress-router-source-ip pod annotation if empty)")
+	opts.egressRouterAllowedCIDRs = flags.String("egress-router-allowed-cidrs", "", "comma-separated list of CIDRs a pod's k8s-ovs/egress-router-source-ip annotation is allowed to request an address from (disabled if empty)")
+	opts.vxlanChecksumWorkaround = flags.String("vxlan-checksum-workaround", ksdn.ChecksumWorkaroundAuto, "whether to disable tx checksum offload on the underlay interface to work around known VXLAN checksum offload defects: \"enabled\", \"disabled\", or \"auto\" to detect known-bad driver/kernel combinations")
+	opts.unmanagedNamespaces = flags.String("unmanaged-namespaces", "", "comma-separated list of namespaces excluded from SDN management (service-rule programming, VNID-driven pod updates, and pod-cache-driven reconciliation); a namespace can also be excluded at runtime via the k8s-ovs/unmanaged annotation regardless of this list")
+	opts.skipVNIDForUnmanaged = flags.Bool("skip-vnid-for-unmanaged", false, "when running as master, don't allocate a VNID for a namespace excluded from SDN management (see --unmanaged-namespaces); revokes one it already holds if the namespace becomes unmanaged at runtime")
+	opts.connectivityProbe = flags.Bool("connectivity-probe", false, "periodically probe a rotating sample of peer nodes' overlay gateways and export per-peer success/latency metrics, to catch silent overlay breakage (MTU mismatch, a firewall eating VXLAN, a stale tunnel flow)")
+	opts.connectivityProbeInterval = flags.Duration("connectivity-probe-interval", 30*time.Second, "how often the connectivity prober samples peer gateways")
+	opts.connectivityProbeSampleSize = flags.Int("connectivity-probe-sample-size", 5, "maximum number of peer gateways the connectivity prober probes per sample")
+	opts.vnidTransitionGracePeriod = flags.Duration("vnid-transition-grace-period", 0, "how long a namespace's old-VNID accept flows and service rules stay installed alongside its new VNID's after a VNID transition, so already-established connections keep draining instead of being cut off immediately; 0 disables the grace period and removes the old rules right away")
+	opts.trafficMirrorInterface = flags.String("traffic-mirror-interface", "", "name of a dedicated internal OVS port SetupSDN creates for the admin API's on-demand per-namespace traffic mirrors (see the /v1/namespaces/{namespace}/mirror routes), so a tenant's traffic can be captured on its own interface instead of the encapsulated mess on the physical NIC; disables the feature if empty")
+	opts.duplicateAddressCheck = flags.Bool("duplicate-address-check", true, "before reporting pod setup success, ARP-probe the assigned address and fail setup (releasing the allocation and retrying) if a conflicting reply arrives; also send a gratuitous ARP on success so upstream caches update quickly after IP reuse")
+	opts.duplicateAddressCheckTimeout = flags.Duration("duplicate-address-check-timeout", 200*time.Millisecond, "how long the duplicate address check waits for a conflicting ARP reply")
+	opts.maintenanceFreezeAllowNewPods = flags.Bool("maintenance-freeze-allow-new-pods", false, "exempt setup of genuinely new pods from a cluster-wide maintenance freeze (see vnidctl freeze); existing pods and VNID transitions are still deferred until it lifts")
+	opts.kubeQPS = flags.Float32("kube-api-qps", 0, "QPS to use for the Kubernetes API client (0 uses the client library default)")
+	opts.kubeBurst = flags.Int("kube-api-burst", 0, "burst to allow for the Kubernetes API client (0 uses the client library default)")
+	opts.kubeUserAgent = flags.String("kube-api-user-agent", "", "user agent to report to the Kubernetes API server (empty uses the client library default)")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		flag.Set("logtostderr", "true")
+		runDiagnose(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-to-crd" {
+		flag.Set("logtostderr", "true")
+		runMigrateToCRD(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-from-openshift-sdn" {
+		flag.Set("logtostderr", "true")
+		runMigrateFromOpenshiftSDN(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-flannel-subnets" {
+		flag.Set("logtostderr", "true")
+		runImportFlannelSubnets(os.Args[2:])
+		return
+	}
+
 	flag.Set("logtostderr", "true")
 	flags.AddGoFlagSet(flag.CommandLine)
 	flags.Parse(os.Args)
@@ -71,29 +177,52 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *opts.preflightOnly {
+		if err := ksdn.RunPreflightCheck(); err != nil {
+			glog.Errorf("%v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	glog.Infof("Starting SDN daemon %v\n", version)
 
-	var kubeClient *client.Client
+	metrics.Listen(*opts.metricsBind)
+	ksdn.SetCrashDumpDir(*opts.crashDumpDir)
+
 	clientConfig := kubectl_util.DefaultClientConfig(flags)
-	if cfg, err := clientConfig.ClientConfig(); err != nil {
+	kubeCfg, err := kubeclient.BuildConfig(clientConfig)
+	if err != nil {
 		glog.Fatalf("Get kube config failed: %v", err)
-	} else {
-		kubeClient = client.NewOrDie(cfg)
 	}
-
-	cfg := &etcdv2.EtcdConfig{
-		Endpoints: strings.Split(*opts.etcdEndpoints, ","),
-		Keyfile:   *opts.etcdKeyfile,
-		Certfile:  *opts.etcdCertfile,
-		CAFile:    *opts.etcdCAFile,
-		Prefix:    *opts.etcdPrefix,
-		Username:  *opts.etcdUsername,
-		Password:  *opts.etcdPassword,
+	kubeclient.Configure(kubeCfg, *opts.kubeQPS, *opts.kubeBurst, *opts.kubeUserAgent)
+	kubeClient, err := kubeclient.NewClient(kubeCfg)
+	if err != nil {
+		glog.Fatalf("Create kube client failed: %v", err)
 	}
 
-	eClient, err := etcdv2.NewManager(cfg)
-	if err != nil {
-		glog.Fatalf("Create etcd client failed: %v", err)
+	var eClient etcdmanager.EtcdManager
+	switch *opts.etcdBackend {
+	case "crd":
+		eClient, err = crd.NewManager(kubeCfg, kubeClient, *opts.crdNamespace)
+		if err != nil {
+			glog.Fatalf("Create CRD backend failed: %v", err)
+		}
+	case "etcd":
+		eClient, err = etcdv2.NewManager(&etcdv2.EtcdConfig{
+			Endpoints: strings.Split(*opts.etcdEndpoints, ","),
+			Keyfile:   *opts.etcdKeyfile,
+			Certfile:  *opts.etcdCertfile,
+			CAFile:    *opts.etcdCAFile,
+			Prefix:    *opts.etcdPrefix,
+			Username:  *opts.etcdUsername,
+			Password:  *opts.etcdPassword,
+		})
+		if err != nil {
+			glog.Fatalf("Create etcd client failed: %v", err)
+		}
+	default:
+		glog.Fatalf("Unknown --etcd-backend %q, must be \"etcd\" or \"crd\"", *opts.etcdBackend)
 	}
 
 	sigs := make(chan os.Signal, 1)
@@ -113,7 +242,82 @@ func main() {
 
 	dClient := dockertools.ConnectToDockerOrDie(*opts.dEndpoint, 10*time.Second)
 
-	go ksdn.StartNode(kubeClient, eClient, dClient, *opts.network, hostname, ctx)
+	var alsoAcceptVNIDsNamespaces []string
+	if *opts.alsoAcceptVNIDsNamespaces != "" {
+		alsoAcceptVNIDsNamespaces = strings.Split(*opts.alsoAcceptVNIDsNamespaces, ",")
+	}
+	var accessibleFromNamespaces []string
+	if *opts.accessibleFromNamespaces != "" {
+		accessibleFromNamespaces = strings.Split(*opts.accessibleFromNamespaces, ",")
+	}
+	var podDeleteSafetyThreshold *intstr.IntOrString
+	if *opts.podDeleteSafetyThreshold != "" {
+		threshold, err := parseIntOrPercent(*opts.podDeleteSafetyThreshold)
+		if err != nil {
+			glog.Fatalf("Invalid --pod-delete-safety-threshold %q: %v", *opts.podDeleteSafetyThreshold, err)
+		}
+		podDeleteSafetyThreshold = &threshold
+	}
+	var egressRouterAllowedCIDRs []*net.IPNet
+	if *opts.egressRouterAllowedCIDRs != "" {
+		for _, cidrStr := range strings.Split(*opts.egressRouterAllowedCIDRs, ",") {
+			_, cidr, err := net.ParseCIDR(cidrStr)
+			if err != nil {
+				glog.Fatalf("Invalid --egress-router-allowed-cidrs %q: %v", cidrStr, err)
+			}
+			egressRouterAllowedCIDRs = append(egressRouterAllowedCIDRs, cidr)
+		}
+	}
+	var unmanagedNamespaces []string
+	if *opts.unmanagedNamespaces != "" {
+		unmanagedNamespaces = strings.Split(*opts.unmanagedNamespaces, ",")
+	}
+	go func() {
+		node, err := ksdn.NewNode(
+			ksdn.WithKubeClient(kubeClient),
+			ksdn.WithEtcdManager(eClient),
+			ksdn.WithDockerClient(dClient),
+			ksdn.WithNetwork(*opts.network),
+			ksdn.WithHostname(hostname),
+			ksdn.WithCRIEndpoint(*opts.criEndpoint),
+			ksdn.WithDryRun(*opts.dryRun),
+			ksdn.WithLazyServiceRules(*opts.lazyServices),
+			ksdn.WithAlsoAcceptVNIDsNamespaces(alsoAcceptVNIDsNamespaces),
+			ksdn.WithDNSService(*opts.dnsServiceNamespace, *opts.dnsServiceName),
+			ksdn.WithGloballyAccessibleServicesNamespaces(accessibleFromNamespaces),
+			ksdn.WithVxlanSource(*opts.vxlanSource),
+			ksdn.WithServiceRulesMode(*opts.serviceRulesMode),
+			ksdn.WithTCPMSSClamp(*opts.tcpMSSClamp),
+			ksdn.WithPrivilegedHelperSocket(*opts.privilegedHelperSocket),
+			ksdn.WithPodDeleteSafetyThreshold(podDeleteSafetyThreshold),
+			ksdn.WithVXLANIngressFilter(*opts.vxlanIngressFilter),
+			ksdn.WithHostNetworkAccess(*opts.hostNetworkAccess),
+			ksdn.WithPodEvictionGracePeriod(*opts.podEvictionGracePeriod),
+			ksdn.WithPodEvictionMaxAttempts(*opts.podEvictionMaxAttempts),
+			ksdn.WithTrafficAccountingInterval(*opts.trafficAccountingInterval),
+			ksdn.WithTrafficAccountingNamespaceLimit(*opts.trafficAccountingNamespaceLimit),
+			ksdn.WithEgressRouterAllowedCIDRs(egressRouterAllowedCIDRs),
+			ksdn.WithEgressRouterInterface(*opts.egressRouterInterface),
+			ksdn.WithVXLANChecksumWorkaround(*opts.vxlanChecksumWorkaround),
+			ksdn.WithUnmanagedNamespaces(unmanagedNamespaces),
+			ksdn.WithConnectivityProbe(*opts.connectivityProbe),
+			ksdn.WithConnectivityProbeInterval(*opts.connectivityProbeInterval),
+			ksdn.WithConnectivityProbeSampleSize(*opts.connectivityProbeSampleSize),
+			ksdn.WithVNIDTransitionGracePeriod(*opts.vnidTransitionGracePeriod),
+			ksdn.WithTrafficMirrorInterface(*opts.trafficMirrorInterface),
+			ksdn.WithDuplicateAddressDetection(*opts.duplicateAddressCheck, *opts.duplicateAddressCheckTimeout),
+			ksdn.WithMaintenanceFreezeAllowNewPods(*opts.maintenanceFreezeAllowNewPods),
+		)
+		if err != nil {
+			ksdn.WriteCrashDump("fatal", err.Error())
+			glog.Fatalf("%v", err)
+		}
+
+		if err := node.Start(ctx); err != nil {
+			node.WriteCrashDump("fatal", err.Error())
+			glog.Fatalf("%v", err)
+		}
+	}()
 
 	fn := func(str string) {
 		leader = str
@@ -141,7 +345,7 @@ func main() {
 
 	go utilwait.PollInfinite(10*time.Second, func() (bool, error) {
 		if leader == hostname {
-			err := ksdn.StartMaster(kubeClient, eClient, *opts.network, ctx)
+			err := ksdn.StartMaster(kubeClient, eClient, *opts.network, *opts.vnidAPIBind, unmanagedNamespaces, *opts.skipVNIDForUnmanaged, ctx)
 			if err != nil {
 				glog.Fatalf("Start master failed%v\n", err)
 			}
@@ -157,3 +361,20 @@ func main() {
 	signal.Stop(sigs)
 	cancel()
 }
+
+// parseIntOrPercent parses a --pod-delete-safety-threshold-style flag value
+// into an intstr.IntOrString: a trailing "%" gives a percentage, anything
+// else must be a plain non-negative integer count.
+func parseIntOrPercent(s string) (intstr.IntOrString, error) {
+	if strings.HasSuffix(s, "%") {
+		return intstr.FromString(s), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return intstr.IntOrString{}, fmt.Errorf("must be an integer count or a percentage like \"25%%\": %v", err)
+	}
+	if n < 0 {
+		return intstr.IntOrString{}, fmt.Errorf("must not be negative")
+	}
+	return intstr.FromInt(n), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+
+	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+
+	"k8s-ovs/pkg/etcdmanager/crd"
+	"k8s-ovs/pkg/etcdmanager/etcdv2"
+	"k8s-ovs/pkg/kubeclient"
+	"k8s-ovs/pkg/utils"
+)
+
+// runMigrateToCRD implements "k8s-ovs migrate-to-crd": a one-shot offline
+// tool that copies a network's HostSubnet/NetNamespace/ClusterNetwork
+// records from the etcd backend into the CRD backend (see
+// pkg/etcdmanager/crd), for clusters switching --etcd-backend from "etcd"
+// to "crd". It doesn't touch etcd and is safe to re-run, since the CRD
+// backend's Acquire* calls fail on an already-migrated record rather than
+// silently overwriting it.
+func runMigrateToCRD(args []string) {
+	fs := pflag.NewFlagSet("migrate-to-crd", pflag.ExitOnError)
+	network := fs.String("network", "", "network name to migrate, ex: (--network=test)")
+	crdNamespace := fs.String("crd-namespace", utils.SdnNamespace, "Kubernetes namespace to store CRD-backed records in")
+	etcdEndpoints := fs.String("etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
+	etcdPrefix := fs.String("etcd-prefix", "/k8s.ovs.com/ovs/network", "etcd prefix")
+	etcdKeyfile := fs.String("etcd-keyfile", "", "SSL key file used to secure etcd communication")
+	etcdCertfile := fs.String("etcd-certfile", "", "SSL certification file used to secure etcd communication")
+	etcdCAFile := fs.String("etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
+	etcdUsername := fs.String("etcd-username", "", "Username for BasicAuth to etcd")
+	etcdPassword := fs.String("etcd-password", "", "Password for BasicAuth to etcd")
+
+	clientConfig := kubectl_util.DefaultClientConfig(fs)
+	fs.Parse(args)
+
+	if *network == "" {
+		glog.Fatalf("--network is required")
+	}
+
+	kubeCfg, err := kubeclient.BuildConfig(clientConfig)
+	if err != nil {
+		glog.Fatalf("Get kube config failed: %v", err)
+	}
+	kubeClient, err := kubeclient.NewClient(kubeCfg)
+	if err != nil {
+		glog.Fatalf("Create kube client failed: %v", err)
+	}
+
+	eClient, err := etcdv2.NewManager(&etcdv2.EtcdConfig{
+		Endpoints: strings.Split(*etcdEndpoints, ","),
+		Keyfile:   *etcdKeyfile,
+		Certfile:  *etcdCertfile,
+		CAFile:    *etcdCAFile,
+		Prefix:    *etcdPrefix,
+		Username:  *etcdUsername,
+		Password:  *etcdPassword,
+	})
+	if err != nil {
+		glog.Fatalf("Create etcd client failed: %v", err)
+	}
+
+	crdManager, err := crd.NewManager(kubeCfg, kubeClient, *crdNamespace)
+	if err != nil {
+		glog.Fatalf("Create CRD backend failed: %v", err)
+	}
+
+	if err := crd.MigrateFromEtcd(context.Background(), eClient, crdManager.(*crd.Manager), *network); err != nil {
+		glog.Fatalf("Migration failed: %v", err)
+	}
+
+	glog.Infof("Migrated network %q from etcd to CRD backend in namespace %q", *network, *crdNamespace)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+
+	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+
+	"k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/etcdmanager/crd"
+	"k8s-ovs/pkg/etcdmanager/etcdv2"
+	"k8s-ovs/pkg/etcdmanager/osdnmigrate"
+	"k8s-ovs/pkg/kubeclient"
+	"k8s-ovs/pkg/utils"
+)
+
+// runMigrateFromOpenshiftSDN implements "k8s-ovs migrate-from-openshift-sdn":
+// a one-shot offline tool that converts an OpenShift SDN cluster's
+// HostSubnet/NetNamespace export files into k8s-ovs's etcd schema (see
+// pkg/etcdmanager/osdnmigrate), so a cluster moving off OpenShift SDN keeps
+// its existing VNID and subnet assignments. It always prints a dry-run
+// report first; pass --dry-run=false to actually write, and --overwrite to
+// replace records that already exist under the target network but disagree
+// with the import. It's safe to re-run: applying a plan only ever touches
+// records that are new or (with --overwrite) different from the import.
+func runMigrateFromOpenshiftSDN(args []string) {
+	fs := pflag.NewFlagSet("migrate-from-openshift-sdn", pflag.ExitOnError)
+	network := fs.String("network", "", "network name to migrate into, ex: (--network=test)")
+	hostSubnetsFile := fs.String("hostsubnets-file", "", "path to an \"oc get hostsubnets -o json\" export")
+	netNamespacesFile := fs.String("netnamespaces-file", "", "path to an \"oc get netnamespaces -o json\" export")
+	dryRun := fs.Bool("dry-run", true, "print the migration plan without writing anything")
+	overwrite := fs.Bool("overwrite", false, "replace existing records that disagree with the import (default is to fail and list them)")
+	etcdBackend := fs.String("etcd-backend", "etcd", "backend to migrate into: \"etcd\" or \"crd\"")
+	crdNamespace := fs.String("crd-namespace", utils.SdnNamespace, "Kubernetes namespace to store records in when --etcd-backend=crd")
+	etcdEndpoints := fs.String("etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
+	etcdPrefix := fs.String("etcd-prefix", "/k8s.ovs.com/ovs/network", "etcd prefix")
+	etcdKeyfile := fs.String("etcd-keyfile", "", "SSL key file used to secure etcd communication")
+	etcdCertfile := fs.String("etcd-certfile", "", "SSL certification file used to secure etcd communication")
+	etcdCAFile := fs.String("etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
+	etcdUsername := fs.String("etcd-username", "", "Username for BasicAuth to etcd")
+	etcdPassword := fs.String("etcd-password", "", "Password for BasicAuth to etcd")
+
+	clientConfig := kubectl_util.DefaultClientConfig(fs)
+	fs.Parse(args)
+
+	if *network == "" {
+		glog.Fatalf("--network is required")
+	}
+	if *hostSubnetsFile == "" || *netNamespacesFile == "" {
+		glog.Fatalf("--hostsubnets-file and --netnamespaces-file are required")
+	}
+
+	subnets, err := osdnmigrate.LoadHostSubnets(*hostSubnetsFile)
+	if err != nil {
+		glog.Fatalf("Loading HostSubnets failed: %v", err)
+	}
+	netnss, err := osdnmigrate.LoadNetNamespaces(*netNamespacesFile)
+	if err != nil {
+		glog.Fatalf("Loading NetNamespaces failed: %v", err)
+	}
+
+	var eClient etcdmanager.EtcdManager
+	switch *etcdBackend {
+	case "crd":
+		kubeCfg, err := kubeclient.BuildConfig(clientConfig)
+		if err != nil {
+			glog.Fatalf("Get kube config failed: %v", err)
+		}
+		kubeClient, err := kubeclient.NewClient(kubeCfg)
+		if err != nil {
+			glog.Fatalf("Create kube client failed: %v", err)
+		}
+		eClient, err = crd.NewManager(kubeCfg, kubeClient, *crdNamespace)
+		if err != nil {
+			glog.Fatalf("Create CRD backend failed: %v", err)
+		}
+	case "etcd":
+		eClient, err = etcdv2.NewManager(&etcdv2.EtcdConfig{
+			Endpoints: strings.Split(*etcdEndpoints, ","),
+			Keyfile:   *etcdKeyfile,
+			Certfile:  *etcdCertfile,
+			CAFile:    *etcdCAFile,
+			Prefix:    *etcdPrefix,
+			Username:  *etcdUsername,
+			Password:  *etcdPassword,
+		})
+		if err != nil {
+			glog.Fatalf("Create etcd client failed: %v", err)
+		}
+	default:
+		glog.Fatalf("Unknown --etcd-backend %q, must be \"etcd\" or \"crd\"", *etcdBackend)
+	}
+
+	ctx := context.Background()
+	plan, err := osdnmigrate.BuildPlan(ctx, eClient, *network, subnets, netnss)
+	if err != nil {
+		glog.Fatalf("Building migration plan failed: %v", err)
+	}
+
+	glog.Infof("Migration plan:\n%s", plan.Report())
+
+	if *dryRun {
+		glog.Infof("Dry run: nothing written. Pass --dry-run=false to apply.")
+		return
+	}
+
+	if err := plan.Apply(ctx, eClient, *overwrite); err != nil {
+		glog.Fatalf("Applying migration plan failed: %v", err)
+	}
+
+	glog.Infof("Migrated network %q from OpenShift SDN export", *network)
+}
@@ -0,0 +1,114 @@
+// Package crashdump writes best-effort diagnostics bundles when the node
+// daemon is about to exit abnormally, so the state needed to debug a crash
+// (flow dumps, vnid snapshot, recent events) isn't gone by the time anyone
+// looks at it.
+package crashdump
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// collectTimeout bounds how long a single collector may run. A collector
+// that hangs (e.g. an exec call against a wedged ovs-vswitchd) must never
+// prevent process exit.
+const collectTimeout = 5 * time.Second
+
+// maxBundles is how many past bundles are kept in dir; older ones are
+// pruned whenever a new bundle is written.
+const maxBundles = 10
+
+// Collector produces one named section of a diagnostics bundle. Errors are
+// recorded in the bundle rather than failing the whole dump.
+type Collector struct {
+	Name    string
+	Collect func() (string, error)
+}
+
+// Write runs every collector (each under its own timeout) and writes their
+// output as separate files under a new timestamped directory inside dir,
+// named after reason. It never returns an error: bundle creation is
+// best-effort and must not get in the way of the process exiting.
+func Write(dir string, reason string, collectors []Collector) {
+	if dir == "" {
+		return
+	}
+
+	bundleDir := filepath.Join(dir, fmt.Sprintf("%s-%d", reason, time.Now().UnixNano()))
+	if err := os.MkdirAll(bundleDir, 0755); err != nil {
+		glog.Errorf("crashdump: failed to create bundle dir %s: %v", bundleDir, err)
+		return
+	}
+
+	for _, c := range collectors {
+		out := runWithTimeout(c)
+		path := filepath.Join(bundleDir, c.Name+".txt")
+		if err := ioutil.WriteFile(path, []byte(out), 0644); err != nil {
+			glog.Errorf("crashdump: failed to write %s: %v", path, err)
+		}
+	}
+
+	glog.Infof("crashdump: wrote diagnostics bundle to %s", bundleDir)
+	prune(dir)
+}
+
+// runWithTimeout runs a single collector, giving up after collectTimeout so
+// a stuck collector can't hang bundle creation.
+func runWithTimeout(c Collector) string {
+	result := make(chan string, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result <- fmt.Sprintf("collector panicked: %v", r)
+			}
+		}()
+		out, err := c.Collect()
+		if err != nil {
+			result <- fmt.Sprintf("%s\n\nerror: %v", out, err)
+			return
+		}
+		result <- out
+	}()
+
+	select {
+	case out := <-result:
+		return out
+	case <-time.After(collectTimeout):
+		return fmt.Sprintf("collector %q timed out after %v", c.Name, collectTimeout)
+	}
+}
+
+// prune removes the oldest bundle directories under dir beyond maxBundles.
+func prune(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		glog.Errorf("crashdump: failed to list %s for pruning: %v", dir, err)
+		return
+	}
+
+	var bundles []os.FileInfo
+	for _, e := range entries {
+		if e.IsDir() {
+			bundles = append(bundles, e)
+		}
+	}
+	if len(bundles) <= maxBundles {
+		return
+	}
+
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].ModTime().Before(bundles[j].ModTime())
+	})
+	for _, b := range bundles[:len(bundles)-maxBundles] {
+		path := filepath.Join(dir, b.Name())
+		if err := os.RemoveAll(path); err != nil {
+			glog.Errorf("crashdump: failed to prune old bundle %s: %v", path, err)
+		}
+	}
+}
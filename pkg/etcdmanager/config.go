@@ -1,8 +1,12 @@
 package etcdmanager
 
 import (
-	"golang.org/x/net/context"
+	"fmt"
 	"time"
+
+	"golang.org/x/net/context"
+
+	"k8s-ovs/pkg/vnid"
 )
 
 type ClusterNetwork struct {
@@ -11,6 +15,50 @@ type ClusterNetwork struct {
 	HostSubnetLength uint32
 	ServiceNetwork   string
 	PluginName       string
+	// ReservedVNIDs is a comma-separated list of "base-max" VNID ranges
+	// (e.g. "100-199,500-509") hand-assigned outside the normal allocator,
+	// for cross-site consistency; see pkg/vnid.ParseReservedRanges.
+	ReservedVNIDs string
+	// DirectCIDRs is a comma-separated list of external CIDRs (e.g.
+	// on-prem ranges reachable from the node's own network) that nodes
+	// send out their local gateway, the same path any non-cluster
+	// destination takes, and exempt from source NAT so the pod's own IP
+	// reaches them; see ksdn.ParseDirectCIDRs.
+	DirectCIDRs string
+	// NoMasqueradeCIDRs is a comma-separated list of external CIDRs (e.g.
+	// a corporate network with routes back to the pod CIDR) that pod
+	// egress traffic should reach with its original pod source IP instead
+	// of being masqueraded to the node's; see ksdn.ParseNoMasqueradeCIDRs.
+	// Unlike DirectCIDRs, it only affects source NAT, not routing.
+	NoMasqueradeCIDRs string
+	// HealthCheckSourceRanges is a comma-separated list of external CIDRs
+	// (e.g. a cloud load balancer's well-known health-check source ranges)
+	// whose traffic to a NodePort or LoadBalancer service's own backend
+	// pods is admitted regardless of tenant isolation, so an external
+	// health check isn't dropped by the VNID check the way any other
+	// untrusted source would be; see ksdn.ParseHealthCheckSourceRanges.
+	HealthCheckSourceRanges string
+
+	// SFlowTargets is a comma-separated list of sFlow collector addresses
+	// ("host:port") to export the bridge's sampled traffic to. sFlow export
+	// is disabled if empty; see ksdn.ParseFlowExportConfig.
+	SFlowTargets string
+	// SFlowSampling is the sFlow sampling rate: 1 in every N packets.
+	SFlowSampling int
+	// SFlowPollingInterval is the sFlow counter polling interval, in seconds.
+	SFlowPollingInterval int
+	// SFlowAgentInterface names the interface whose address sFlow reports to
+	// collectors as the exporting agent's own address. Left empty, OVS
+	// picks one itself.
+	SFlowAgentInterface string
+
+	// NetFlowTargets is a comma-separated list of NetFlow collector
+	// addresses ("host:port"). NetFlow export is disabled if empty; see
+	// ksdn.ParseFlowExportConfig.
+	NetFlowTargets string
+	// NetFlowActiveTimeout is the NetFlow active flow expiry timeout, in
+	// seconds.
+	NetFlowActiveTimeout int
 }
 
 // HostSubnet encapsulates the inputs needed to define the container subnet network on a node
@@ -28,6 +76,50 @@ type NetNamespace struct {
 	NetID     uint32
 	Action    string
 	Namespace string
+
+	// Annotations and Labels mirror the metadata of the Kubernetes
+	// Namespace this record was assigned for at the time it was
+	// created, so that node-side features gated on namespace metadata
+	// (e.g. multicast, egress router) can be driven off the netns watch
+	// instead of a separate namespace watch. May be nil.
+	Annotations map[string]string
+	Labels      map[string]string
+}
+
+// Validate reports whether n is well-formed enough to deliver to a watcher
+// as a real event: a name, a NetID pkg/vnid considers well-formed, and (if
+// set) a recognized action. A backend that decodes a NetNamespace failing
+// this -- a truncated write, a NetID corrupted into something out of range
+// -- should quarantine it (see QuarantinedNetNamespace) instead of
+// delivering it, so a bad record can't propagate into flow generation.
+//
+// This can't catch everything: whether NetID 0 is legitimate depends on
+// whether NetName is exempt from tenant isolation, which this package has
+// no way to know. That check stays the master's job.
+func (n *NetNamespace) Validate() error {
+	if n.NetName == "" {
+		return fmt.Errorf("netnamespace has no name")
+	}
+	if err := vnid.ValidVNID(n.NetID); err != nil {
+		return fmt.Errorf("netnamespace %q: %v", n.NetName, err)
+	}
+	switch n.Action {
+	case "", vnid.GlobalPodNetwork, vnid.JoinPodNetwork, vnid.IsolatePodNetwork:
+	default:
+		return fmt.Errorf("netnamespace %q: unrecognized action %q", n.NetName, n.Action)
+	}
+	return nil
+}
+
+// QuarantinedNetNamespace records a NetNamespace value that failed
+// Validate and so was withheld from delivery to watchers. It's diagnostic
+// only -- it doesn't drive any live isolation state, which simply keeps
+// whatever the last known-good record was -- and is expected to be
+// inspected and cleared out-of-band with vnidctl.
+type QuarantinedNetNamespace struct {
+	NetName       string    `json:"netName"`
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
 }
 
 type (
@@ -38,6 +130,16 @@ type (
 		Subnet  HostSubnet   `json:"hostsubnet,omitempty"`
 		Network string       `json:"network,omitempty"`
 		NetNS   NetNamespace `json:"netnamespace,omitempty"`
+
+		// OldNetNS is the NetNamespace record's value immediately before
+		// this event, when the backend has it available: on EventAdded
+		// that means the record was already present and this is really an
+		// update, and on EventRemoved it's the value that just got
+		// deleted. It's the zero value when unknown -- an actual create,
+		// or a backend (like the CRD one) that has no way to look up the
+		// prior value -- so callers must not assume OldNetNS.NetName == ""
+		// means "this is a create" without also checking the source.
+		OldNetNS NetNamespace `json:"oldNetnamespace,omitempty"`
 	}
 )
 
@@ -73,6 +175,102 @@ type NetworkWatchResult struct {
 	Cursor   interface{} `json:"cursor,omitempty"`
 }
 
+// VNIDAuditEntry is a single append-only record of a NetNamespace's NetID
+// changing, kept for after-the-fact "who/what/when" questions.
+type VNIDAuditEntry struct {
+	Namespace string `json:"namespace"`
+	OldNetID  uint32 `json:"oldNetID"`
+	NewNetID  uint32 `json:"newNetID"`
+	// Reason is one of "auto-allocate", "annotation", "join", "gc".
+	Reason    string    `json:"reason"`
+	Actor     string    `json:"actor"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// DataplaneCompat records the rolling-upgrade compatibility window for the
+// node dataplane's flow table layout. Min is the oldest flow table version
+// any node in the cluster may still be running, so new nodes must keep
+// generating flows that interoperate with it; Target is the version the
+// rollout is converging on. AllNodesUpgraded starts false and is flipped by
+// the master once every node has reported Target in its NodeStatus (see
+// ksdn/compat.go), letting nodes drop their Min-compatibility shims and
+// reconcile onto Target.
+type DataplaneCompat struct {
+	Min              int
+	Target           int
+	AllNodesUpgraded bool
+}
+
+// BridgeCutoverPhase is where a single node's blue/green bridge cutover (see
+// ksdn/cutover.go) currently stands.
+type BridgeCutoverPhase string
+
+const (
+	// BridgeCutoverBuilding: the new bridge exists and has the cloned base
+	// flow table, but pod/tunnel ports are still on the old bridge.
+	BridgeCutoverBuilding BridgeCutoverPhase = "building"
+	// BridgeCutoverMigratingPorts: pod veth ports are being moved to the new
+	// bridge one at a time; MigratedPorts records which ones already moved.
+	BridgeCutoverMigratingPorts BridgeCutoverPhase = "migrating-ports"
+	// BridgeCutoverMigratingTunnel: every pod port has moved; only the
+	// tun0/vxlan0 ports (and the routes/addresses carried on tun0) are left
+	// to move before the old bridge can be torn down.
+	BridgeCutoverMigratingTunnel BridgeCutoverPhase = "migrating-tunnel"
+)
+
+// BridgeCutoverState is a single node's progress through a blue/green bridge
+// cutover, persisted so a crash or restart mid-cutover resumes instead of
+// leaving pods split across two bridges indefinitely, and so a rollback
+// (while the old bridge still exists) knows exactly what it needs to undo.
+// It's deleted from etcd once the cutover (or a rollback) finishes.
+type BridgeCutoverState struct {
+	NewBridge string
+	Phase     BridgeCutoverPhase
+	// MigratedPorts holds the pod veth ports (by OVS port name) already
+	// moved to NewBridge, in migration order, so a resumed cutover -- or a
+	// rollback -- knows which ones still need handling.
+	MigratedPorts []string
+}
+
+// VNIDTransitionState is a single node's pending grace-period cleanup for a
+// namespace's VNID transition (see ksdn/vnid_transition_drain.go): while it
+// exists, that node keeps Table 7/4 accept flows for OldNetID alongside
+// NetID so connections established under OldNetID keep draining naturally
+// instead of being cut off the instant the namespace re-tags, until
+// ExpiresAt, when the node removes them. Persisted per (network, host,
+// namespace) -- rather than shared cluster-wide, the way VNIDReservation
+// is -- so only the node that started a given transition ever acts on its
+// own record, and a restart mid-window resumes exactly where it left off.
+type VNIDTransitionState struct {
+	Namespace string    `json:"namespace"`
+	OldNetID  uint32    `json:"oldNetID"`
+	NetID     uint32    `json:"netID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// MaintenanceFreeze records a cluster-wide pause on dataplane mutations, set
+// (and cleared) via the master or vnidctl ahead of an underlay maintenance
+// window so a flapping etcd or API server during it can't amplify into flow
+// churn; see ksdn/maintenance_freeze.go, which is what nodes watch this
+// against.
+type MaintenanceFreeze struct {
+	Frozen bool `json:"frozen"`
+	// Reason is a free-form operator note (e.g. a maintenance ticket ID),
+	// written to each node's log when it sees the freeze take effect or
+	// expire. The node status record reports only whether the freeze is on,
+	// and the Event recordMaintenanceFreezeEvent records does not carry it.
+	Reason string `json:"reason,omitempty"`
+	// SetBy identifies who requested the freeze, for the same audit purpose.
+	SetBy string    `json:"setBy,omitempty"`
+	SetAt time.Time `json:"setAt"`
+	// ExpiresAt bounds how long the freeze may remain in effect before a
+	// node auto-clears its own view of it, so a forgotten freeze can't rot
+	// the cluster. Zero means no expiry was requested -- vnidctl refuses to
+	// set one without an explicit duration, so this should only be zero for
+	// records written before ExpiresAt existed.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
 type Lease struct {
 	Host       string
 	Attrs      HostSubnet
@@ -81,8 +279,47 @@ type Lease struct {
 	Asof uint64
 }
 
+// VNIDReservation holds a NetID set aside for a namespace that doesn't
+// exist yet, so the master's auto-create controller can honor it instead
+// of allocating a fresh one when the namespace is actually created. It
+// expires on its own if the namespace never shows up.
+type VNIDReservation struct {
+	Namespace string `json:"namespace"`
+	NetID     uint32 `json:"netID"`
+	// Auto is true if NetID was picked by the allocator rather than
+	// requested explicitly by the reservation's caller.
+	Auto      bool      `json:"auto"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// EndpointStatus is the health of one of an EtcdManager's backing endpoints,
+// as of the last health check.
+type EndpointStatus struct {
+	Endpoint string `json:"endpoint"`
+	Healthy  bool   `json:"healthy"`
+	// Current is true for the endpoint requests are currently steered
+	// toward first. Exactly one endpoint is Current at a time.
+	Current bool `json:"current"`
+}
+
 type EtcdManager interface {
 	GetNetworkConfig(ctx context.Context, network string) (*ClusterNetwork, error)
+	// GetDataplaneCompat returns the cluster's current flow table
+	// compatibility window, or nil, nil if none has been recorded yet (a
+	// fresh cluster with no rollout in progress).
+	GetDataplaneCompat(ctx context.Context, network string) (*DataplaneCompat, error)
+	// SetDataplaneCompat persists the compatibility window, creating or
+	// overwriting whatever is stored already. Only the master calls this.
+	SetDataplaneCompat(ctx context.Context, network string, compat *DataplaneCompat) error
+	// GetBridgeCutoverState returns host's in-progress blue/green bridge
+	// cutover state, or nil, nil if it isn't mid-cutover.
+	GetBridgeCutoverState(ctx context.Context, network string, host string) (*BridgeCutoverState, error)
+	// SetBridgeCutoverState persists host's cutover progress, creating or
+	// overwriting whatever is stored already.
+	SetBridgeCutoverState(ctx context.Context, network string, host string, state *BridgeCutoverState) error
+	// DeleteBridgeCutoverState clears host's cutover record once the cutover
+	// (or a rollback of it) has finished. Not an error if there is none.
+	DeleteBridgeCutoverState(ctx context.Context, network string, host string) error
 	AcquireSubnet(ctx context.Context, network string, host string, subnet *HostSubnet) error
 	GetSubnet(ctx context.Context, network string, host string) (*HostSubnet, error)
 	GetNetNamespace(ctx context.Context, network string, namespace string) (*NetNamespace, error)
@@ -95,4 +332,84 @@ type EtcdManager interface {
 	RevokeNetNamespace(ctx context.Context, network string, namespace string) error
 	WatchSubnets(ctx context.Context, network string, cursor interface{}) (SubnetWatchResult, error)
 	WatchNetNamespaces(ctx context.Context, network string, cursor interface{}) (NetNamespaceWatchResult, error)
+	// WatchLagStatus reports how far behind the manager's etcd watches are:
+	// the largest observed index lag across watches, and how long it's been
+	// since any watch last delivered an event.
+	WatchLagStatus() (indexLag uint64, lastEventAge time.Duration)
+	// EndpointStatus reports the health of each configured backing endpoint
+	// and which one is currently preferred, for exposing via metrics and the
+	// node status record. Implementations backed by a single fixed endpoint
+	// (or no independent notion of endpoints at all) may report a single
+	// always-healthy entry.
+	EndpointStatus() []EndpointStatus
+
+	// AppendVNIDAudit records a NetNamespace NetID change. Entries are kept
+	// per-namespace, oldest-first, and are pruned to maxVNIDAuditEntries so
+	// the log doesn't grow forever.
+	AppendVNIDAudit(ctx context.Context, network string, entry *VNIDAuditEntry) error
+	// ListVNIDAudit returns the recorded NetID changes for a namespace,
+	// oldest first.
+	ListVNIDAudit(ctx context.Context, network string, namespace string) ([]VNIDAuditEntry, error)
+
+	// ReserveVNID persists a pending VNID reservation so it survives a
+	// master restart. It's an error to overwrite an existing reservation
+	// for the same namespace; release it first.
+	ReserveVNID(ctx context.Context, network string, reservation *VNIDReservation) error
+	// GetVNIDReservation returns the pending reservation for namespace, if
+	// any; nil, nil if there is none.
+	GetVNIDReservation(ctx context.Context, network string, namespace string) (*VNIDReservation, error)
+	// ReleaseVNIDReservation removes a pending reservation, without
+	// affecting any live NetNamespace. It is not an error to release a
+	// reservation that doesn't exist.
+	ReleaseVNIDReservation(ctx context.Context, network string, namespace string) error
+	// ListVNIDReservations returns all pending reservations, used to
+	// re-seed the in-memory allocator on master startup and to sweep
+	// expired ones.
+	ListVNIDReservations(ctx context.Context, network string) ([]VNIDReservation, error)
+
+	// QuarantineNetNamespace persists a NetNamespace record that failed
+	// NetNamespace.Validate, replacing any existing quarantined record for
+	// the same NetName.
+	QuarantineNetNamespace(ctx context.Context, network string, record *QuarantinedNetNamespace) error
+	// ListQuarantinedNetNamespaces returns every quarantined record for
+	// network, for the master's startup consistency pass and for vnidctl.
+	ListQuarantinedNetNamespaces(ctx context.Context, network string) ([]QuarantinedNetNamespace, error)
+	// DeleteQuarantinedNetNamespace removes a quarantined record. It is not
+	// an error to delete one that doesn't exist.
+	DeleteQuarantinedNetNamespace(ctx context.Context, network string, netName string) error
+
+	// GetVNIDTransitionState returns host's pending grace-period cleanup for
+	// namespace's VNID transition, or nil, nil if it has none outstanding.
+	GetVNIDTransitionState(ctx context.Context, network string, host string, namespace string) (*VNIDTransitionState, error)
+	// SetVNIDTransitionState persists host's pending cleanup, creating or
+	// overwriting whatever is stored already -- a newer transition for the
+	// same namespace simply supersedes the old record.
+	SetVNIDTransitionState(ctx context.Context, network string, host string, namespace string, state *VNIDTransitionState) error
+	// DeleteVNIDTransitionState clears host's pending cleanup record for
+	// namespace, once its grace-period cleanup has run. Not an error to
+	// delete one that doesn't exist.
+	DeleteVNIDTransitionState(ctx context.Context, network string, host string, namespace string) error
+	// ListVNIDTransitionStates returns every pending cleanup host has
+	// recorded, so it can resume them all on startup.
+	ListVNIDTransitionStates(ctx context.Context, network string, host string) ([]VNIDTransitionState, error)
+
+	// GetMaintenanceFreeze returns network's current maintenance freeze
+	// record, or nil, nil if none has ever been set.
+	GetMaintenanceFreeze(ctx context.Context, network string) (*MaintenanceFreeze, error)
+	// SetMaintenanceFreeze persists the freeze record, creating or
+	// overwriting whatever is stored already.
+	SetMaintenanceFreeze(ctx context.Context, network string, freeze *MaintenanceFreeze) error
+
+	// GetNamespaceNetwork returns the name of the overlay network namespace
+	// has been explicitly assigned to, or "" if it has none -- meaning it
+	// belongs to the node's primary network. Unlike the rest of this
+	// interface the record isn't scoped under a single network's own tree,
+	// since it's what a node consults to decide which network's tree to
+	// look in for the namespace in the first place; see
+	// ksdn.KsdnNode.AdditionalNetworks.
+	GetNamespaceNetwork(ctx context.Context, namespace string) (string, error)
+	// SetNamespaceNetwork assigns namespace to network, creating or
+	// overwriting whatever assignment exists already. Passing "" clears the
+	// assignment, returning the namespace to the primary network.
+	SetNamespaceNetwork(ctx context.Context, namespace string, network string) error
 }
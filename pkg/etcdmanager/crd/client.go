@@ -0,0 +1,228 @@
+package crd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	restclient "k8s.io/kubernetes/pkg/client/restclient"
+)
+
+const (
+	apiGroup   = "k8s-ovs.com"
+	apiVersion = "v1"
+)
+
+// errNotFound is returned by restClient.get when the API server responds
+// 404; callers translate it the same way the etcd backend translates
+// etcdv2.IsErrEtcdKeyNotFound.
+type errNotFound struct {
+	url string
+}
+
+func (e *errNotFound) Error() string {
+	return fmt.Sprintf("object not found: %s", e.url)
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*errNotFound)
+	return ok
+}
+
+// restClient issues plain JSON HTTP requests against the dynamic API
+// endpoint a ThirdPartyResource registration causes the API server to
+// expose. It deliberately doesn't go through restclient.RESTClient/the
+// scheme+codec machinery: that machinery expects types registered with
+// api.Scheme, and hand-registering scheme conversions for objects that only
+// ever round-trip as opaque JSON would be more code than just doing the
+// HTTP calls directly.
+type restClient struct {
+	http    *http.Client
+	baseURL string
+}
+
+func newRESTClient(cfg *restclient.Config) (*restClient, error) {
+	rt, err := restclient.TransportFor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("build transport for CRD backend: %v", err)
+	}
+	return &restClient{
+		http:    &http.Client{Transport: rt},
+		baseURL: strings.TrimRight(cfg.Host, "/"),
+	}, nil
+}
+
+func (c *restClient) collectionURL(plural, namespace string) string {
+	return fmt.Sprintf("%s/apis/%s/%s/namespaces/%s/%s", c.baseURL, apiGroup, apiVersion, namespace, plural)
+}
+
+func (c *restClient) objectURL(plural, namespace, name string) string {
+	return c.collectionURL(plural, namespace) + "/" + name
+}
+
+// networkCollectionURL scopes a collection listing/watch to a single
+// network's records via the shared networkLabel.
+func (c *restClient) networkCollectionURL(plural, namespace, network string) string {
+	u := c.collectionURL(plural, namespace)
+	return addQuery(u, "labelSelector", networkLabel+"="+sanitizeLabel(network))
+}
+
+// networkHostCollectionURL further scopes networkCollectionURL down to a
+// single host's records via the shared hostLabel, for resources (like
+// VNIDTransitionState) kept per (network, host).
+func (c *restClient) networkHostCollectionURL(plural, namespace, network, host string) string {
+	u := c.collectionURL(plural, namespace)
+	return addQuery(u, "labelSelector", networkLabel+"="+sanitizeLabel(network)+","+hostLabel+"="+sanitizeLabel(host))
+}
+
+func (c *restClient) do(method, u string, body []byte) ([]byte, int, error) {
+	var reqBody *bytes.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return data, resp.StatusCode, nil
+}
+
+func (c *restClient) get(u string, into interface{}) error {
+	data, status, err := c.do("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return json.Unmarshal(data, into)
+	case http.StatusNotFound:
+		return &errNotFound{url: u}
+	default:
+		return fmt.Errorf("GET %s: %d: %s", u, status, string(data))
+	}
+}
+
+func (c *restClient) create(u string, body interface{}) error {
+	return c.write("POST", u, body, http.StatusOK, http.StatusCreated)
+}
+
+func (c *restClient) update(u string, body interface{}) error {
+	return c.write("PUT", u, body, http.StatusOK)
+}
+
+func (c *restClient) write(method, u string, body interface{}, okStatuses ...int) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	data, status, err := c.do(method, u, encoded)
+	if err != nil {
+		return err
+	}
+	for _, ok := range okStatuses {
+		if status == ok {
+			return nil
+		}
+	}
+	if status == http.StatusNotFound {
+		return &errNotFound{url: u}
+	}
+	return fmt.Errorf("%s %s: %d: %s", method, u, status, string(data))
+}
+
+func (c *restClient) delete(u string) error {
+	data, status, err := c.do("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	case http.StatusNotFound:
+		return &errNotFound{url: u}
+	default:
+		return fmt.Errorf("DELETE %s: %d: %s", u, status, string(data))
+	}
+}
+
+// watchEvent is the standard Kubernetes watch protocol envelope: a stream of
+// newline-delimited JSON objects of this shape.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watchStream is a live watch connection; call next() until it returns an
+// error (including on context cancellation, surfaced as a read error), then
+// Close().
+type watchStream struct {
+	resp   *http.Response
+	reader *bufio.Reader
+}
+
+func addQuery(u, key, value string) string {
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + key + "=" + url.QueryEscape(value)
+}
+
+func (c *restClient) watch(collectionURL, resourceVersion string) (*watchStream, error) {
+	u := addQuery(collectionURL, "watch", "true")
+	if resourceVersion != "" {
+		u = addQuery(u, "resourceVersion", resourceVersion)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("watch %s: %d: %s", u, resp.StatusCode, string(data))
+	}
+	return &watchStream{resp: resp, reader: bufio.NewReader(resp.Body)}, nil
+}
+
+func (w *watchStream) next() (*watchEvent, error) {
+	line, err := w.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var evt watchEvent
+	if err := json.Unmarshal(line, &evt); err != nil {
+		return nil, fmt.Errorf("decode watch event: %v", err)
+	}
+	return &evt, nil
+}
+
+func (w *watchStream) Close() {
+	w.resp.Body.Close()
+}
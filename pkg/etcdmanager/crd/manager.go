@@ -0,0 +1,679 @@
+package crd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	restclient "k8s.io/kubernetes/pkg/client/restclient"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+
+	. "k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/metrics"
+)
+
+// maxVNIDAuditEntries mirrors the etcd backend's retention limit; see
+// pkg/etcdmanager/etcdv2/registry.go.
+const maxVNIDAuditEntries = 100
+
+// Manager implements etcdmanager.EtcdManager against ThirdPartyResources
+// served by the Kubernetes API server kClient/cfg point at, instead of a
+// direct etcd connection.
+type Manager struct {
+	rc        *restClient
+	kClient   *client.Client
+	namespace string
+}
+
+// NewManager builds a CRD-backed EtcdManager. cfg and kClient must point at
+// the same API server; cfg is used to build the raw HTTP client this
+// backend talks to ThirdPartyResource endpoints with (including picking up
+// any token-refresh wrapping kubeclient.BuildConfig installed on it), while
+// kClient is used for the one-time ThirdPartyResource registration, which
+// already has a typed client. namespace is the Kubernetes namespace the
+// records are stored in - callers typically pass utils.SdnNamespace.
+func NewManager(cfg *restclient.Config, kClient *client.Client, namespace string) (EtcdManager, error) {
+	rc, err := newRESTClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureThirdPartyResources(kClient); err != nil {
+		return nil, err
+	}
+	return &Manager{rc: rc, kClient: kClient, namespace: namespace}, nil
+}
+
+func (m *Manager) GetNetworkConfig(ctx context.Context, network string) (*ClusterNetwork, error) {
+	var res clusterNetworkResource
+	if err := m.rc.get(m.rc.objectURL(clusterNetPlural, m.namespace, sanitizeLabel(network)), &res); err != nil {
+		return nil, err
+	}
+	cn := res.toClusterNetwork()
+	return &cn, nil
+}
+
+// SetNetworkConfig writes the network's ClusterNetwork object. It isn't
+// part of the EtcdManager interface - like the etcd backend, this config is
+// normally seeded once out-of-band before the master or any node starts -
+// but MigrateFromEtcd needs a way to carry an existing installation's
+// config over when switching backends. Only Name, Network,
+// HostSubnetLength, ServiceNetwork, PluginName, ReservedVNIDs, DirectCIDRs
+// and NoMasqueradeCIDRs are stored; HealthCheckSourceRanges and the sFlow
+// and NetFlow settings are dropped, and GetNetworkConfig never returns them.
+func (m *Manager) SetNetworkConfig(ctx context.Context, network string, cfg *ClusterNetwork) error {
+	res := &clusterNetworkResource{
+		typeMeta:          typeMeta{Kind: clusterNetKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta:        objectMeta{Name: sanitizeLabel(network)},
+		Name:              cfg.Name,
+		Network:           cfg.Network,
+		HostSubnetLength:  cfg.HostSubnetLength,
+		ServiceNetwork:    cfg.ServiceNetwork,
+		PluginName:        cfg.PluginName,
+		ReservedVNIDs:     cfg.ReservedVNIDs,
+		DirectCIDRs:       cfg.DirectCIDRs,
+		NoMasqueradeCIDRs: cfg.NoMasqueradeCIDRs,
+	}
+	return m.rc.create(m.rc.collectionURL(clusterNetPlural, m.namespace), res)
+}
+
+func (m *Manager) GetDataplaneCompat(ctx context.Context, network string) (*DataplaneCompat, error) {
+	var res dataplaneCompatResource
+	if err := m.rc.get(m.rc.objectURL(dataplaneCompatPlural, m.namespace, sanitizeLabel(network)), &res); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	compat := res.toDataplaneCompat()
+	return &compat, nil
+}
+
+// SetDataplaneCompat updates the compatibility window resource in place, or
+// creates it if this is the first rollout the cluster has ever recorded.
+func (m *Manager) SetDataplaneCompat(ctx context.Context, network string, compat *DataplaneCompat) error {
+	res := newDataplaneCompatResource(network, compat)
+	url := m.rc.objectURL(dataplaneCompatPlural, m.namespace, sanitizeLabel(network))
+	err := m.rc.update(url, res)
+	if isNotFound(err) {
+		return m.rc.create(m.rc.collectionURL(dataplaneCompatPlural, m.namespace), res)
+	}
+	return err
+}
+
+func (m *Manager) GetMaintenanceFreeze(ctx context.Context, network string) (*MaintenanceFreeze, error) {
+	var res maintenanceFreezeResource
+	if err := m.rc.get(m.rc.objectURL(maintenanceFreezePlural, m.namespace, sanitizeLabel(network)), &res); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	freeze, err := res.toMaintenanceFreeze()
+	if err != nil {
+		return nil, err
+	}
+	return &freeze, nil
+}
+
+// SetMaintenanceFreeze updates the freeze resource in place, or creates it if
+// this is the first time the cluster's maintenance freeze has been set.
+func (m *Manager) SetMaintenanceFreeze(ctx context.Context, network string, freeze *MaintenanceFreeze) error {
+	res := newMaintenanceFreezeResource(network, freeze)
+	url := m.rc.objectURL(maintenanceFreezePlural, m.namespace, sanitizeLabel(network))
+	err := m.rc.update(url, res)
+	if isNotFound(err) {
+		return m.rc.create(m.rc.collectionURL(maintenanceFreezePlural, m.namespace), res)
+	}
+	return err
+}
+
+func (m *Manager) GetNamespaceNetwork(ctx context.Context, namespace string) (string, error) {
+	var res namespaceNetworkResource
+	if err := m.rc.get(m.rc.objectURL(namespaceNetworkPlural, m.namespace, sanitizeLabel(namespace)), &res); err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return res.Network, nil
+}
+
+// SetNamespaceNetwork updates the assignment resource in place, or creates
+// it if this is the first assignment recorded for namespace. network == ""
+// deletes the resource, returning namespace to the primary network.
+func (m *Manager) SetNamespaceNetwork(ctx context.Context, namespace string, network string) error {
+	if network == "" {
+		err := m.rc.delete(m.rc.objectURL(namespaceNetworkPlural, m.namespace, sanitizeLabel(namespace)))
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	res := newNamespaceNetworkResource(namespace, network)
+	url := m.rc.objectURL(namespaceNetworkPlural, m.namespace, sanitizeLabel(namespace))
+	err := m.rc.update(url, res)
+	if isNotFound(err) {
+		return m.rc.create(m.rc.collectionURL(namespaceNetworkPlural, m.namespace), res)
+	}
+	return err
+}
+
+func (m *Manager) GetBridgeCutoverState(ctx context.Context, network string, host string) (*BridgeCutoverState, error) {
+	var res bridgeCutoverResource
+	if err := m.rc.get(m.rc.objectURL(bridgeCutoverPlural, m.namespace, subnetResourceName(network, host)), &res); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := res.toBridgeCutoverState()
+	return &state, nil
+}
+
+// SetBridgeCutoverState updates the cutover resource in place, or creates it
+// if this is host's first recorded cutover.
+func (m *Manager) SetBridgeCutoverState(ctx context.Context, network string, host string, state *BridgeCutoverState) error {
+	res := newBridgeCutoverResource(network, host, state)
+	url := m.rc.objectURL(bridgeCutoverPlural, m.namespace, subnetResourceName(network, host))
+	err := m.rc.update(url, res)
+	if isNotFound(err) {
+		return m.rc.create(m.rc.collectionURL(bridgeCutoverPlural, m.namespace), res)
+	}
+	return err
+}
+
+func (m *Manager) DeleteBridgeCutoverState(ctx context.Context, network string, host string) error {
+	err := m.rc.delete(m.rc.objectURL(bridgeCutoverPlural, m.namespace, subnetResourceName(network, host)))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) GetVNIDTransitionState(ctx context.Context, network string, host string, namespace string) (*VNIDTransitionState, error) {
+	var res vnidTransitionResource
+	if err := m.rc.get(m.rc.objectURL(vnidTransitionPlural, m.namespace, vnidTransitionResourceName(network, host, namespace)), &res); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state, err := res.toVNIDTransitionState()
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SetVNIDTransitionState updates the transition resource in place, or
+// creates it if this is host's first recorded transition for namespace.
+func (m *Manager) SetVNIDTransitionState(ctx context.Context, network string, host string, namespace string, state *VNIDTransitionState) error {
+	res := newVNIDTransitionResource(network, host, state)
+	url := m.rc.objectURL(vnidTransitionPlural, m.namespace, vnidTransitionResourceName(network, host, namespace))
+	err := m.rc.update(url, res)
+	if isNotFound(err) {
+		return m.rc.create(m.rc.collectionURL(vnidTransitionPlural, m.namespace), res)
+	}
+	return err
+}
+
+func (m *Manager) DeleteVNIDTransitionState(ctx context.Context, network string, host string, namespace string) error {
+	err := m.rc.delete(m.rc.objectURL(vnidTransitionPlural, m.namespace, vnidTransitionResourceName(network, host, namespace)))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) ListVNIDTransitionStates(ctx context.Context, network string, host string) ([]VNIDTransitionState, error) {
+	var list vnidTransitionList
+	if err := m.rc.get(m.rc.networkHostCollectionURL(vnidTransitionPlural, m.namespace, network, host), &list); err != nil {
+		return nil, err
+	}
+
+	states := make([]VNIDTransitionState, 0, len(list.Items))
+	for i := range list.Items {
+		state, err := list.Items[i].toVNIDTransitionState()
+		if err != nil {
+			glog.Warningf("Ignoring bad VNID transition state %s: %v", list.Items[i].Name, err)
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (m *Manager) AcquireSubnet(ctx context.Context, network string, host string, subnet *HostSubnet) error {
+	return m.rc.create(m.rc.collectionURL(hostSubnetPlural, m.namespace), newHostSubnetResource(network, host, subnet))
+}
+
+func (m *Manager) AcquireNetNamespace(ctx context.Context, network string, netns *NetNamespace) error {
+	return m.rc.create(m.rc.collectionURL(netNamespacePlural, m.namespace), newNetNamespaceResource(network, netns))
+}
+
+func (m *Manager) GetSubnet(ctx context.Context, network string, host string) (*HostSubnet, error) {
+	var res hostSubnetResource
+	if err := m.rc.get(m.rc.objectURL(hostSubnetPlural, m.namespace, subnetResourceName(network, host)), &res); err != nil {
+		return nil, err
+	}
+	hs := res.toHostSubnet()
+	return &hs, nil
+}
+
+func (m *Manager) GetNetNamespace(ctx context.Context, network string, namespace string) (*NetNamespace, error) {
+	var res netNamespaceResource
+	if err := m.rc.get(m.rc.objectURL(netNamespacePlural, m.namespace, netnsResourceName(network, namespace)), &res); err != nil {
+		return nil, err
+	}
+	n := res.toNetNamespace()
+	if err := n.Validate(); err != nil {
+		m.quarantineBadNetNamespace(network, namespace, err)
+		return nil, err
+	}
+	return &n, nil
+}
+
+// quarantineBadNetNamespace persists why a NetNamespace record was withheld
+// from delivery. Failures are logged but not returned: quarantining is
+// best-effort diagnostics and must never be the reason a read fails.
+func (m *Manager) quarantineBadNetNamespace(network, netname string, reason error) {
+	metrics.NetNamespaceQuarantined.Inc()
+	err := m.QuarantineNetNamespace(context.Background(), network, &QuarantinedNetNamespace{
+		NetName:       netname,
+		Reason:        reason.Error(),
+		QuarantinedAt: time.Now(),
+	})
+	if err != nil {
+		glog.Warningf("Failed to record quarantined netnamespace %s: %v", netname, err)
+	}
+}
+
+func (m *Manager) GetSubnets(ctx context.Context, network string) ([]HostSubnet, error) {
+	subnets, _, err := m.listSubnets(network)
+	return subnets, err
+}
+
+func (m *Manager) GetNetNamespaces(ctx context.Context, network string) ([]NetNamespace, error) {
+	netnss, _, err := m.listNetNamespaces(network)
+	return netnss, err
+}
+
+func (m *Manager) listSubnets(network string) ([]HostSubnet, string, error) {
+	var list hostSubnetList
+	if err := m.rc.get(m.rc.networkCollectionURL(hostSubnetPlural, m.namespace, network), &list); err != nil {
+		return nil, "", err
+	}
+	subnets := make([]HostSubnet, 0, len(list.Items))
+	for _, item := range list.Items {
+		subnets = append(subnets, item.toHostSubnet())
+	}
+	return subnets, list.Metadata.ResourceVersion, nil
+}
+
+func (m *Manager) listNetNamespaces(network string) ([]NetNamespace, string, error) {
+	var list netNamespaceList
+	if err := m.rc.get(m.rc.networkCollectionURL(netNamespacePlural, m.namespace, network), &list); err != nil {
+		return nil, "", err
+	}
+	netnss := make([]NetNamespace, 0, len(list.Items))
+	for _, item := range list.Items {
+		netns := item.toNetNamespace()
+		if err := netns.Validate(); err != nil {
+			glog.Warningf("Quarantining invalid netnamespace resource %s: %v", item.Name, err)
+			m.quarantineBadNetNamespace(network, netns.NetName, err)
+			continue
+		}
+		netnss = append(netnss, netns)
+	}
+	return netnss, list.Metadata.ResourceVersion, nil
+}
+
+func (m *Manager) RenewSubnet(ctx context.Context, network string, subnet *HostSubnet) error {
+	return m.rc.update(m.rc.objectURL(hostSubnetPlural, m.namespace, subnetResourceName(network, subnet.Host)), newHostSubnetResource(network, subnet.Host, subnet))
+}
+
+func (m *Manager) RenewNetNamespace(ctx context.Context, network string, netns *NetNamespace) error {
+	return m.rc.update(m.rc.objectURL(netNamespacePlural, m.namespace, netnsResourceName(network, netns.NetName)), newNetNamespaceResource(network, netns))
+}
+
+func (m *Manager) RevokeSubnet(ctx context.Context, network string, host string) error {
+	return m.rc.delete(m.rc.objectURL(hostSubnetPlural, m.namespace, subnetResourceName(network, host)))
+}
+
+func (m *Manager) RevokeNetNamespace(ctx context.Context, network string, namespace string) error {
+	return m.rc.delete(m.rc.objectURL(netNamespacePlural, m.namespace, netnsResourceName(network, namespace)))
+}
+
+// WatchLagStatus doesn't apply the same way it does to a direct etcd watch
+// (there's no local etcd index to fall behind); the API server's watch
+// bookmark/resourceVersion mechanism keeps its own history window. Report
+// zero rather than fabricate a number readiness checks would otherwise
+// treat as meaningful.
+func (m *Manager) WatchLagStatus() (uint64, time.Duration) {
+	return 0, 0
+}
+
+// EndpointStatus doesn't apply the same way it does to the etcd backend's
+// list of member endpoints: requests go through the API server client cfg
+// points at, whose own failover (if any) is outside this backend's
+// knowledge. Report the API server as a single always-current endpoint
+// rather than an empty list, so callers displaying this alongside the etcd
+// backend's output see one consistent shape.
+func (m *Manager) EndpointStatus() []EndpointStatus {
+	return []EndpointStatus{{Endpoint: "kubernetes-api", Healthy: true, Current: true}}
+}
+
+func (m *Manager) WatchSubnets(ctx context.Context, network string, cursor interface{}) (SubnetWatchResult, error) {
+	if cursor == nil {
+		return m.subnetsSnapshot(network)
+	}
+	rv, err := cursorToResourceVersion(cursor)
+	if err != nil {
+		return SubnetWatchResult{}, err
+	}
+
+	evt, newRV, err := m.watchOne(m.rc.networkCollectionURL(hostSubnetPlural, m.namespace, network), rv, decodeSubnetEvent)
+	if err != nil {
+		if isGoneErr(err) {
+			return m.subnetsSnapshot(network)
+		}
+		return SubnetWatchResult{}, err
+	}
+	return SubnetWatchResult{Events: []Event{*evt}, Cursor: newRV}, nil
+}
+
+func (m *Manager) WatchNetNamespaces(ctx context.Context, network string, cursor interface{}) (NetNamespaceWatchResult, error) {
+	if cursor == nil {
+		return m.netNamespacesSnapshot(network)
+	}
+	rv, err := cursorToResourceVersion(cursor)
+	if err != nil {
+		return NetNamespaceWatchResult{}, err
+	}
+
+	for {
+		evt, newRV, err := m.watchOne(m.rc.networkCollectionURL(netNamespacePlural, m.namespace, network), rv, decodeNetNamespaceEvent)
+		if err != nil {
+			if isGoneErr(err) {
+				return m.netNamespacesSnapshot(network)
+			}
+			return NetNamespaceWatchResult{}, err
+		}
+
+		if evt.Type == EventAdded {
+			if verr := evt.NetNS.Validate(); verr != nil {
+				// Don't deliver it, and don't return the error either: that
+				// would leave the caller re-requesting the same cursor and
+				// seeing the same bad record forever. Quarantine it and
+				// resume the watch from just past it instead.
+				glog.Warningf("Quarantining invalid netnamespace watch event: %v", verr)
+				m.quarantineBadNetNamespace(network, evt.NetNS.NetName, verr)
+				rv = newRV
+				continue
+			}
+		}
+
+		return NetNamespaceWatchResult{Events: []Event{*evt}, Cursor: newRV}, nil
+	}
+}
+
+func (m *Manager) subnetsSnapshot(network string) (SubnetWatchResult, error) {
+	subnets, rv, err := m.listSubnets(network)
+	if err != nil {
+		return SubnetWatchResult{}, fmt.Errorf("failed to retrieve subnets: %v", err)
+	}
+	return SubnetWatchResult{Snapshot: subnets, Cursor: rv}, nil
+}
+
+func (m *Manager) netNamespacesSnapshot(network string) (NetNamespaceWatchResult, error) {
+	netnss, rv, err := m.listNetNamespaces(network)
+	if err != nil {
+		return NetNamespaceWatchResult{}, fmt.Errorf("failed to retrieve NetNamespaces: %v", err)
+	}
+	return NetNamespaceWatchResult{Snapshot: netnss, Cursor: rv}, nil
+}
+
+// watchOne opens a watch starting just after resourceVersion, waits for the
+// next event, decodes it via decode, and returns it along with the
+// resourceVersion to resume from next time.
+//
+// Unlike the etcd backend's shared per-network demultiplexer (see
+// etcdv2/demux.go), this opens and closes one watch connection per call.
+// That's appreciably less efficient, but the callers here (one per node,
+// plus the master) poll at the rate namespaces and subnets actually change,
+// not per-pod, so the extra connection setup hasn't been worth the
+// complexity of a persistent shared watcher - revisit if that changes.
+func (m *Manager) watchOne(collectionURL, resourceVersion string, decode func(*watchEvent) (Event, error)) (*Event, string, error) {
+	stream, err := m.rc.watch(collectionURL, resourceVersion)
+	if err != nil {
+		return nil, "", err
+	}
+	defer stream.Close()
+
+	raw, err := stream.next()
+	if err != nil {
+		return nil, "", err
+	}
+	if raw.Type == "ERROR" {
+		return nil, "", &errGone{}
+	}
+
+	evt, err := decode(raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var meta objectMeta
+	switch raw.Type {
+	case "ADDED", "MODIFIED", "DELETED":
+		if err := json.Unmarshal(raw.Object, &struct {
+			Metadata *objectMeta `json:"metadata"`
+		}{&meta}); err != nil {
+			return nil, "", err
+		}
+	}
+	return &evt, meta.ResourceVersion, nil
+}
+
+func decodeSubnetEvent(raw *watchEvent) (Event, error) {
+	var res hostSubnetResource
+	if err := json.Unmarshal(raw.Object, &res); err != nil {
+		return Event{}, fmt.Errorf("decode HostSubnet watch event: %v", err)
+	}
+	et := EventAdded
+	if raw.Type == "DELETED" {
+		et = EventRemoved
+	}
+	return Event{Type: et, Subnet: res.toHostSubnet()}, nil
+}
+
+func decodeNetNamespaceEvent(raw *watchEvent) (Event, error) {
+	var res netNamespaceResource
+	if err := json.Unmarshal(raw.Object, &res); err != nil {
+		return Event{}, fmt.Errorf("decode NetNamespace watch event: %v", err)
+	}
+	et := EventAdded
+	if raw.Type == "DELETED" {
+		et = EventRemoved
+	}
+	return Event{Type: et, NetNS: res.toNetNamespace()}, nil
+}
+
+// errGone marks a watch that failed because its resourceVersion fell out of
+// the API server's history window, the CRD-backend equivalent of the etcd
+// backend's isIndexTooSmall.
+type errGone struct{}
+
+func (e *errGone) Error() string { return "watch resourceVersion too old" }
+
+func isGoneErr(err error) bool {
+	_, ok := err.(*errGone)
+	return ok
+}
+
+func cursorToResourceVersion(cursor interface{}) (string, error) {
+	rv, ok := cursor.(string)
+	if !ok {
+		return "", fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+	return rv, nil
+}
+
+func (m *Manager) AppendVNIDAudit(ctx context.Context, network string, entry *VNIDAuditEntry) error {
+	name := fmt.Sprintf("%s.%d", sanitizeLabel(entry.Namespace), entry.Timestamp.UnixNano())
+	res := &vnidAuditResource{
+		typeMeta: typeMeta{Kind: vnidAuditKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{
+			Name:   name,
+			Labels: map[string]string{networkLabel: sanitizeLabel(network), namespaceLabel: sanitizeLabel(entry.Namespace)},
+		},
+		Namespace: entry.Namespace,
+		OldNetID:  entry.OldNetID,
+		NewNetID:  entry.NewNetID,
+		Reason:    entry.Reason,
+		Actor:     entry.Actor,
+		Timestamp: entry.Timestamp.Format(time.RFC3339Nano),
+	}
+	if err := m.rc.create(m.rc.collectionURL(vnidAuditPlural, m.namespace), res); err != nil {
+		return err
+	}
+	m.pruneVNIDAudit(network, entry.Namespace)
+	return nil
+}
+
+// pruneVNIDAudit trims a namespace's audit log down to maxVNIDAuditEntries,
+// deleting the oldest entries first. Failures are ignored rather than
+// returned, since a failed prune shouldn't fail the audit write it follows.
+func (m *Manager) pruneVNIDAudit(network, namespace string) {
+	entries, err := m.ListVNIDAudit(context.Background(), network, namespace)
+	if err != nil || len(entries) <= maxVNIDAuditEntries {
+		return
+	}
+	excess := entries[:len(entries)-maxVNIDAuditEntries]
+	for _, e := range excess {
+		name := fmt.Sprintf("%s.%d", sanitizeLabel(namespace), e.Timestamp.UnixNano())
+		m.rc.delete(m.rc.objectURL(vnidAuditPlural, m.namespace, name))
+	}
+}
+
+func (m *Manager) ListVNIDAudit(ctx context.Context, network string, namespace string) ([]VNIDAuditEntry, error) {
+	u := m.rc.collectionURL(vnidAuditPlural, m.namespace)
+	u = addQuery(u, "labelSelector", namespaceLabel+"="+sanitizeLabel(namespace))
+	var list vnidAuditList
+	if err := m.rc.get(u, &list); err != nil {
+		return nil, err
+	}
+
+	entries := make([]VNIDAuditEntry, 0, len(list.Items))
+	for _, item := range list.Items {
+		ts, err := time.Parse(time.RFC3339Nano, item.Timestamp)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, VNIDAuditEntry{
+			Namespace: item.Namespace,
+			OldNetID:  item.OldNetID,
+			NewNetID:  item.NewNetID,
+			Reason:    item.Reason,
+			Actor:     item.Actor,
+			Timestamp: ts,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+	return entries, nil
+}
+
+func (m *Manager) ReserveVNID(ctx context.Context, network string, reservation *VNIDReservation) error {
+	return m.rc.create(m.rc.collectionURL(vnidReservationPlural, m.namespace), newVNIDReservationResource(network, reservation))
+}
+
+func (m *Manager) GetVNIDReservation(ctx context.Context, network string, namespace string) (*VNIDReservation, error) {
+	var res vnidReservationResource
+	if err := m.rc.get(m.rc.objectURL(vnidReservationPlural, m.namespace, netnsResourceName(network, namespace)), &res); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	reservation, err := res.toVNIDReservation()
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+func (m *Manager) ReleaseVNIDReservation(ctx context.Context, network string, namespace string) error {
+	err := m.rc.delete(m.rc.objectURL(vnidReservationPlural, m.namespace, netnsResourceName(network, namespace)))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) ListVNIDReservations(ctx context.Context, network string) ([]VNIDReservation, error) {
+	var list vnidReservationList
+	if err := m.rc.get(m.rc.networkCollectionURL(vnidReservationPlural, m.namespace, network), &list); err != nil {
+		return nil, err
+	}
+
+	reservations := make([]VNIDReservation, 0, len(list.Items))
+	for i := range list.Items {
+		reservation, err := list.Items[i].toVNIDReservation()
+		if err != nil {
+			glog.Warningf("Ignoring bad VNID reservation %s: %v", list.Items[i].Name, err)
+			continue
+		}
+		reservations = append(reservations, reservation)
+	}
+	return reservations, nil
+}
+
+// QuarantineNetNamespace upserts the quarantine record for record.NetName:
+// unlike ReserveVNID, a namespace can be quarantined repeatedly (each bad
+// write replaces the last diagnostic), so this updates in place if a record
+// already exists instead of erroring.
+func (m *Manager) QuarantineNetNamespace(ctx context.Context, network string, record *QuarantinedNetNamespace) error {
+	u := m.rc.objectURL(quarantinedNetNamespacePlural, m.namespace, netnsResourceName(network, record.NetName))
+	res := newQuarantinedNetNamespaceResource(network, record)
+
+	var existing quarantinedNetNamespaceResource
+	err := m.rc.get(u, &existing)
+	switch {
+	case err == nil:
+		return m.rc.update(u, res)
+	case isNotFound(err):
+		return m.rc.create(m.rc.collectionURL(quarantinedNetNamespacePlural, m.namespace), res)
+	default:
+		return err
+	}
+}
+
+func (m *Manager) ListQuarantinedNetNamespaces(ctx context.Context, network string) ([]QuarantinedNetNamespace, error) {
+	var list quarantinedNetNamespaceList
+	if err := m.rc.get(m.rc.networkCollectionURL(quarantinedNetNamespacePlural, m.namespace, network), &list); err != nil {
+		return nil, err
+	}
+
+	records := make([]QuarantinedNetNamespace, 0, len(list.Items))
+	for i := range list.Items {
+		record, err := list.Items[i].toQuarantinedNetNamespace()
+		if err != nil {
+			glog.Warningf("Ignoring bad quarantine record %s: %v", list.Items[i].Name, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (m *Manager) DeleteQuarantinedNetNamespace(ctx context.Context, network string, netname string) error {
+	err := m.rc.delete(m.rc.objectURL(quarantinedNetNamespacePlural, m.namespace, netnsResourceName(network, netname)))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package crd
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	. "k8s-ovs/pkg/etcdmanager"
+)
+
+// MigrateFromEtcd copies a network's ClusterNetwork config, HostSubnets and
+// NetNamespaces out of an etcd-backed EtcdManager and into dst, which is
+// expected to be a *Manager returned by NewManager. It's meant to be run
+// once, offline, while switching a cluster's --etcd-backend from "etcd" to
+// "crd"; it doesn't watch for further changes or delete anything from src.
+// The ClusterNetwork config is copied only as far as SetNetworkConfig stores
+// it: the health-check source ranges and flow export settings are not.
+func MigrateFromEtcd(ctx context.Context, src EtcdManager, dst *Manager, network string) error {
+	cfg, err := src.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return fmt.Errorf("read network config from etcd: %v", err)
+	}
+	if err := dst.SetNetworkConfig(ctx, network, cfg); err != nil {
+		return fmt.Errorf("write network config to CRD backend: %v", err)
+	}
+
+	subnets, err := src.GetSubnets(ctx, network)
+	if err != nil {
+		return fmt.Errorf("read subnets from etcd: %v", err)
+	}
+	for i := range subnets {
+		if err := dst.AcquireSubnet(ctx, network, subnets[i].Host, &subnets[i]); err != nil {
+			return fmt.Errorf("migrate subnet %s: %v", subnets[i].Host, err)
+		}
+	}
+
+	netnss, err := src.GetNetNamespaces(ctx, network)
+	if err != nil {
+		return fmt.Errorf("read NetNamespaces from etcd: %v", err)
+	}
+	for i := range netnss {
+		if err := dst.AcquireNetNamespace(ctx, network, &netnss[i]); err != nil {
+			return fmt.Errorf("migrate NetNamespace %s: %v", netnss[i].NetName, err)
+		}
+	}
+
+	return nil
+}
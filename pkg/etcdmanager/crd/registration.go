@@ -0,0 +1,44 @@
+package crd
+
+import (
+	"fmt"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// tprNames maps each kind this backend stores to the ThirdPartyResource
+// name the API server expects to register it under: "<hyphenated-kind>.<group>".
+var tprNames = map[string]string{
+	hostSubnetKind:              "host-subnet." + apiGroup,
+	netNamespaceKind:            "net-namespace." + apiGroup,
+	clusterNetKind:              "cluster-network." + apiGroup,
+	vnidAuditKind:               "vnid-audit." + apiGroup,
+	vnidReservationKind:         "vnid-reservation." + apiGroup,
+	quarantinedNetNamespaceKind: "quarantined-net-namespace." + apiGroup,
+	dataplaneCompatKind:         "dataplane-compat." + apiGroup,
+	bridgeCutoverKind:           "bridge-cutover." + apiGroup,
+	vnidTransitionKind:          "vnid-transition." + apiGroup,
+	maintenanceFreezeKind:       "maintenance-freeze." + apiGroup,
+	namespaceNetworkKind:        "namespace-network." + apiGroup,
+}
+
+// ensureThirdPartyResources registers the ThirdPartyResource kinds this
+// backend needs, tolerating ones that already exist (the master and every
+// node call this on startup, so races between them are expected).
+func ensureThirdPartyResources(kClient *client.Client) error {
+	for kind, name := range tprNames {
+		tpr := &extensions.ThirdPartyResource{
+			ObjectMeta:  api.ObjectMeta{Name: name},
+			Description: fmt.Sprintf("k8s-ovs %s records (see k8s-ovs/pkg/etcdmanager/crd)", kind),
+			Versions:    []extensions.APIVersion{{Name: apiVersion}},
+		}
+		_, err := kClient.Extensions().ThirdPartyResources().Create(tpr)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("register ThirdPartyResource %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package crd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "k8s-ovs/pkg/etcdmanager"
+)
+
+// typeMeta and objectMeta mirror unversioned.TypeMeta/api.ObjectMeta's wire
+// format, trimmed to the fields this backend actually reads or writes.
+type typeMeta struct {
+	Kind       string `json:"kind,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+type objectMeta struct {
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+const (
+	hostSubnetKind                = "HostSubnet"
+	hostSubnetPlural              = "hostsubnets"
+	netNamespaceKind              = "NetNamespace"
+	netNamespacePlural            = "netnamespaces"
+	clusterNetKind                = "ClusterNetwork"
+	clusterNetPlural              = "clusternetworks"
+	vnidAuditKind                 = "VNIDAudit"
+	vnidAuditPlural               = "vnidaudits"
+	vnidReservationKind           = "VNIDReservation"
+	vnidReservationPlural         = "vnidreservations"
+	quarantinedNetNamespaceKind   = "QuarantinedNetNamespace"
+	quarantinedNetNamespacePlural = "quarantinednetnamespaces"
+	dataplaneCompatKind           = "DataplaneCompat"
+	dataplaneCompatPlural         = "dataplanecompats"
+	bridgeCutoverKind             = "BridgeCutover"
+	bridgeCutoverPlural           = "bridgecutovers"
+	vnidTransitionKind            = "VNIDTransition"
+	vnidTransitionPlural          = "vnidtransitions"
+	maintenanceFreezeKind         = "MaintenanceFreeze"
+	maintenanceFreezePlural       = "maintenancefreezes"
+	namespaceNetworkKind          = "NamespaceNetwork"
+	namespaceNetworkPlural        = "namespacenetworks"
+
+	networkLabel   = "k8s-ovs.com/network"
+	namespaceLabel = "k8s-ovs.com/namespace"
+	hostLabel      = "k8s-ovs.com/host"
+)
+
+type hostSubnetResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Host    string `json:"host"`
+	HostIP  string `json:"hostIP"`
+	Subnet  string `json:"subnet"`
+	Assign  bool   `json:"assign"`
+	Network string `json:"network"`
+}
+
+type hostSubnetList struct {
+	typeMeta `json:",inline"`
+	Metadata objectMeta           `json:"metadata,omitempty"`
+	Items    []hostSubnetResource `json:"items"`
+}
+
+func newHostSubnetResource(network, host string, s *HostSubnet) *hostSubnetResource {
+	return &hostSubnetResource{
+		typeMeta: typeMeta{Kind: hostSubnetKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{
+			Name:   subnetResourceName(network, host),
+			Labels: map[string]string{networkLabel: sanitizeLabel(network)},
+		},
+		Host:    s.Host,
+		HostIP:  s.HostIP,
+		Subnet:  s.Subnet,
+		Assign:  s.Assign,
+		Network: network,
+	}
+}
+
+func (r *hostSubnetResource) toHostSubnet() HostSubnet {
+	return HostSubnet{Host: r.Host, HostIP: r.HostIP, Subnet: r.Subnet, Assign: r.Assign}
+}
+
+type netNamespaceResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	NetName   string `json:"netName"`
+	NetID     uint32 `json:"netID"`
+	Action    string `json:"action"`
+	Namespace string `json:"namespace"`
+	Network   string `json:"network"`
+
+	// NamespaceAnnotations and NamespaceLabels mirror NetNamespace's
+	// Annotations/Labels; named apart from objectMeta's own Labels, which
+	// carries this resource's own networkLabel selector rather than the
+	// source Namespace's metadata.
+	NamespaceAnnotations map[string]string `json:"namespaceAnnotations,omitempty"`
+	NamespaceLabels      map[string]string `json:"namespaceLabels,omitempty"`
+}
+
+type netNamespaceList struct {
+	typeMeta `json:",inline"`
+	Metadata objectMeta             `json:"metadata,omitempty"`
+	Items    []netNamespaceResource `json:"items"`
+}
+
+func newNetNamespaceResource(network string, n *NetNamespace) *netNamespaceResource {
+	return &netNamespaceResource{
+		typeMeta: typeMeta{Kind: netNamespaceKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{
+			Name:   netnsResourceName(network, n.NetName),
+			Labels: map[string]string{networkLabel: sanitizeLabel(network)},
+		},
+		NetName:              n.NetName,
+		NetID:                n.NetID,
+		Action:               n.Action,
+		Namespace:            n.Namespace,
+		Network:              network,
+		NamespaceAnnotations: n.Annotations,
+		NamespaceLabels:      n.Labels,
+	}
+}
+
+func (r *netNamespaceResource) toNetNamespace() NetNamespace {
+	return NetNamespace{
+		NetName:     r.NetName,
+		NetID:       r.NetID,
+		Action:      r.Action,
+		Namespace:   r.Namespace,
+		Annotations: r.NamespaceAnnotations,
+		Labels:      r.NamespaceLabels,
+	}
+}
+
+type clusterNetworkResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Name              string `json:"name"`
+	Network           string `json:"network"`
+	HostSubnetLength  uint32 `json:"hostSubnetLength"`
+	ServiceNetwork    string `json:"serviceNetwork"`
+	PluginName        string `json:"pluginName"`
+	ReservedVNIDs     string `json:"reservedVNIDs,omitempty"`
+	DirectCIDRs       string `json:"directCIDRs,omitempty"`
+	NoMasqueradeCIDRs string `json:"noMasqueradeCIDRs,omitempty"`
+}
+
+func (r *clusterNetworkResource) toClusterNetwork() ClusterNetwork {
+	return ClusterNetwork{
+		Name:              r.Name,
+		Network:           r.Network,
+		HostSubnetLength:  r.HostSubnetLength,
+		ServiceNetwork:    r.ServiceNetwork,
+		PluginName:        r.PluginName,
+		ReservedVNIDs:     r.ReservedVNIDs,
+		DirectCIDRs:       r.DirectCIDRs,
+		NoMasqueradeCIDRs: r.NoMasqueradeCIDRs,
+	}
+}
+
+type dataplaneCompatResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Min              int  `json:"min"`
+	Target           int  `json:"target"`
+	AllNodesUpgraded bool `json:"allNodesUpgraded"`
+}
+
+func newDataplaneCompatResource(network string, c *DataplaneCompat) *dataplaneCompatResource {
+	return &dataplaneCompatResource{
+		typeMeta:         typeMeta{Kind: dataplaneCompatKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta:       objectMeta{Name: sanitizeLabel(network)},
+		Min:              c.Min,
+		Target:           c.Target,
+		AllNodesUpgraded: c.AllNodesUpgraded,
+	}
+}
+
+func (r *dataplaneCompatResource) toDataplaneCompat() DataplaneCompat {
+	return DataplaneCompat{Min: r.Min, Target: r.Target, AllNodesUpgraded: r.AllNodesUpgraded}
+}
+
+type maintenanceFreezeResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Frozen    bool   `json:"frozen"`
+	Reason    string `json:"reason,omitempty"`
+	SetBy     string `json:"setBy,omitempty"`
+	SetAt     string `json:"setAt"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+func newMaintenanceFreezeResource(network string, f *MaintenanceFreeze) *maintenanceFreezeResource {
+	r := &maintenanceFreezeResource{
+		typeMeta:   typeMeta{Kind: maintenanceFreezeKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{Name: sanitizeLabel(network)},
+		Frozen:     f.Frozen,
+		Reason:     f.Reason,
+		SetBy:      f.SetBy,
+		SetAt:      f.SetAt.Format(time.RFC3339Nano),
+	}
+	if !f.ExpiresAt.IsZero() {
+		r.ExpiresAt = f.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	return r
+}
+
+func (r *maintenanceFreezeResource) toMaintenanceFreeze() (MaintenanceFreeze, error) {
+	setAt, err := time.Parse(time.RFC3339Nano, r.SetAt)
+	if err != nil {
+		return MaintenanceFreeze{}, fmt.Errorf("parse setAt: %v", err)
+	}
+	freeze := MaintenanceFreeze{Frozen: r.Frozen, Reason: r.Reason, SetBy: r.SetBy, SetAt: setAt}
+	if r.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339Nano, r.ExpiresAt)
+		if err != nil {
+			return MaintenanceFreeze{}, fmt.Errorf("parse expiresAt: %v", err)
+		}
+		freeze.ExpiresAt = expiresAt
+	}
+	return freeze, nil
+}
+
+// namespaceNetworkResource records a namespace's assignment to an additional
+// overlay network. Unlike every other resource in this file it's keyed by
+// namespace rather than by network, since it's what a node consults to
+// decide which network's records to look for the namespace in; see
+// KsdnNode.AdditionalNetworks.
+type namespaceNetworkResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Network string `json:"network"`
+}
+
+func newNamespaceNetworkResource(namespace string, network string) *namespaceNetworkResource {
+	return &namespaceNetworkResource{
+		typeMeta:   typeMeta{Kind: namespaceNetworkKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{Name: sanitizeLabel(namespace)},
+		Network:    network,
+	}
+}
+
+type bridgeCutoverResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	NewBridge     string   `json:"newBridge"`
+	Phase         string   `json:"phase"`
+	MigratedPorts []string `json:"migratedPorts,omitempty"`
+	Network       string   `json:"network"`
+}
+
+func newBridgeCutoverResource(network, host string, s *BridgeCutoverState) *bridgeCutoverResource {
+	return &bridgeCutoverResource{
+		typeMeta: typeMeta{Kind: bridgeCutoverKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{
+			Name:   subnetResourceName(network, host),
+			Labels: map[string]string{networkLabel: sanitizeLabel(network)},
+		},
+		NewBridge:     s.NewBridge,
+		Phase:         string(s.Phase),
+		MigratedPorts: s.MigratedPorts,
+		Network:       network,
+	}
+}
+
+func (r *bridgeCutoverResource) toBridgeCutoverState() BridgeCutoverState {
+	return BridgeCutoverState{NewBridge: r.NewBridge, Phase: BridgeCutoverPhase(r.Phase), MigratedPorts: r.MigratedPorts}
+}
+
+type vnidAuditResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Namespace string `json:"namespace"`
+	OldNetID  uint32 `json:"oldNetID"`
+	NewNetID  uint32 `json:"newNetID"`
+	Reason    string `json:"reason"`
+	Actor     string `json:"actor"`
+	Timestamp string `json:"timestamp"`
+}
+
+type vnidAuditList struct {
+	typeMeta `json:",inline"`
+	Metadata objectMeta          `json:"metadata,omitempty"`
+	Items    []vnidAuditResource `json:"items"`
+}
+
+type vnidReservationResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Namespace string `json:"namespace"`
+	NetID     uint32 `json:"netID"`
+	Auto      bool   `json:"auto"`
+	ExpiresAt string `json:"expiresAt"`
+	Network   string `json:"network"`
+}
+
+type vnidReservationList struct {
+	typeMeta `json:",inline"`
+	Metadata objectMeta                `json:"metadata,omitempty"`
+	Items    []vnidReservationResource `json:"items"`
+}
+
+func newVNIDReservationResource(network string, r *VNIDReservation) *vnidReservationResource {
+	return &vnidReservationResource{
+		typeMeta: typeMeta{Kind: vnidReservationKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{
+			Name:   netnsResourceName(network, r.Namespace),
+			Labels: map[string]string{networkLabel: sanitizeLabel(network)},
+		},
+		Namespace: r.Namespace,
+		NetID:     r.NetID,
+		Auto:      r.Auto,
+		ExpiresAt: r.ExpiresAt.Format(time.RFC3339Nano),
+		Network:   network,
+	}
+}
+
+func (r *vnidReservationResource) toVNIDReservation() (VNIDReservation, error) {
+	expiresAt, err := time.Parse(time.RFC3339Nano, r.ExpiresAt)
+	if err != nil {
+		return VNIDReservation{}, fmt.Errorf("parse expiresAt: %v", err)
+	}
+	return VNIDReservation{Namespace: r.Namespace, NetID: r.NetID, Auto: r.Auto, ExpiresAt: expiresAt}, nil
+}
+
+type vnidTransitionResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	Namespace string `json:"namespace"`
+	Host      string `json:"host"`
+	OldNetID  uint32 `json:"oldNetID"`
+	NetID     uint32 `json:"netID"`
+	ExpiresAt string `json:"expiresAt"`
+	Network   string `json:"network"`
+}
+
+type vnidTransitionList struct {
+	typeMeta `json:",inline"`
+	Metadata objectMeta               `json:"metadata,omitempty"`
+	Items    []vnidTransitionResource `json:"items"`
+}
+
+func newVNIDTransitionResource(network, host string, s *VNIDTransitionState) *vnidTransitionResource {
+	return &vnidTransitionResource{
+		typeMeta: typeMeta{Kind: vnidTransitionKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{
+			Name:   vnidTransitionResourceName(network, host, s.Namespace),
+			Labels: map[string]string{networkLabel: sanitizeLabel(network), hostLabel: sanitizeLabel(host)},
+		},
+		Namespace: s.Namespace,
+		Host:      host,
+		OldNetID:  s.OldNetID,
+		NetID:     s.NetID,
+		ExpiresAt: s.ExpiresAt.Format(time.RFC3339Nano),
+		Network:   network,
+	}
+}
+
+func (r *vnidTransitionResource) toVNIDTransitionState() (VNIDTransitionState, error) {
+	expiresAt, err := time.Parse(time.RFC3339Nano, r.ExpiresAt)
+	if err != nil {
+		return VNIDTransitionState{}, fmt.Errorf("parse expiresAt: %v", err)
+	}
+	return VNIDTransitionState{Namespace: r.Namespace, OldNetID: r.OldNetID, NetID: r.NetID, ExpiresAt: expiresAt}, nil
+}
+
+type quarantinedNetNamespaceResource struct {
+	typeMeta   `json:",inline"`
+	objectMeta `json:"metadata,omitempty"`
+
+	NetName       string `json:"netName"`
+	Reason        string `json:"reason"`
+	QuarantinedAt string `json:"quarantinedAt"`
+	Network       string `json:"network"`
+}
+
+type quarantinedNetNamespaceList struct {
+	typeMeta `json:",inline"`
+	Metadata objectMeta                        `json:"metadata,omitempty"`
+	Items    []quarantinedNetNamespaceResource `json:"items"`
+}
+
+func newQuarantinedNetNamespaceResource(network string, r *QuarantinedNetNamespace) *quarantinedNetNamespaceResource {
+	return &quarantinedNetNamespaceResource{
+		typeMeta: typeMeta{Kind: quarantinedNetNamespaceKind, APIVersion: apiGroup + "/" + apiVersion},
+		objectMeta: objectMeta{
+			Name:   netnsResourceName(network, r.NetName),
+			Labels: map[string]string{networkLabel: sanitizeLabel(network)},
+		},
+		NetName:       r.NetName,
+		Reason:        r.Reason,
+		QuarantinedAt: r.QuarantinedAt.Format(time.RFC3339Nano),
+		Network:       network,
+	}
+}
+
+func (r *quarantinedNetNamespaceResource) toQuarantinedNetNamespace() (QuarantinedNetNamespace, error) {
+	quarantinedAt, err := time.Parse(time.RFC3339Nano, r.QuarantinedAt)
+	if err != nil {
+		return QuarantinedNetNamespace{}, fmt.Errorf("parse quarantinedAt: %v", err)
+	}
+	return QuarantinedNetNamespace{NetName: r.NetName, Reason: r.Reason, QuarantinedAt: quarantinedAt}, nil
+}
+
+// sanitizeLabel makes network usable as a label value: lowercase, and
+// anything outside [-A-Za-z0-9_.] replaced with '-'.
+func sanitizeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, strings.ToLower(s))
+}
+
+// subnetResourceName and netnsResourceName build RFC1123-safe object names:
+// multiple networks can share the same Kubernetes namespace, so the
+// network name is folded into the object name rather than relied on to be
+// globally unique on its own.
+func subnetResourceName(network, host string) string {
+	return fmt.Sprintf("%s.%s", sanitizeLabel(network), sanitizeLabel(host))
+}
+
+func netnsResourceName(network, netName string) string {
+	return fmt.Sprintf("%s.%s", sanitizeLabel(network), sanitizeLabel(netName))
+}
+
+// vnidTransitionResourceName builds a VNIDTransitionState object's name:
+// unlike subnetResourceName/netnsResourceName, it's keyed by all three of
+// network, host and namespace, since two different nodes may each have
+// their own outstanding grace-period cleanup for the same namespace.
+func vnidTransitionResourceName(network, host, namespace string) string {
+	return fmt.Sprintf("%s.%s.%s", sanitizeLabel(network), sanitizeLabel(host), sanitizeLabel(namespace))
+}
@@ -0,0 +1,399 @@
+// Package etcdtest provides an in-memory fake implementation of
+// etcdmanager.EtcdManager, for tests that exercise code driven off it
+// without standing up a real etcd cluster or the CRD backend's API server
+// dependency.
+package etcdtest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "k8s-ovs/pkg/etcdmanager"
+)
+
+// Manager is a fake EtcdManager backed entirely by in-process maps. It has
+// no watch delivery: WatchSubnets/WatchNetNamespaces always return the
+// current snapshot, as if the caller's cursor were always out of range.
+// That's enough for tests of code that reads or writes through EtcdManager
+// directly (e.g. flow generation given a fixed NetNamespace/HostSubnet
+// set); it's not a fit for testing the watch/reconcile loops themselves.
+type Manager struct {
+	mu sync.Mutex
+
+	networkConfigs    map[string]*ClusterNetwork
+	dataplaneCompat   map[string]*DataplaneCompat
+	bridgeCutovers    map[string]*BridgeCutoverState
+	maintenanceFreeze map[string]*MaintenanceFreeze
+	namespaceNetworks map[string]string
+
+	subnets       map[string]map[string]HostSubnet   // network -> host -> subnet
+	netNamespaces map[string]map[string]NetNamespace // network -> namespace -> record
+
+	vnidAudit        map[string][]VNIDAuditEntry // "network/namespace" -> entries
+	vnidReservations map[string]map[string]VNIDReservation
+	quarantined      map[string]map[string]QuarantinedNetNamespace
+
+	vnidTransitions map[string]map[string]VNIDTransitionState // "network/host" -> namespace -> state
+
+	endpoints []EndpointStatus
+}
+
+var _ EtcdManager = (*Manager)(nil)
+
+// NewManager returns an empty fake Manager, ready for use.
+func NewManager() *Manager {
+	return &Manager{
+		networkConfigs:    make(map[string]*ClusterNetwork),
+		dataplaneCompat:   make(map[string]*DataplaneCompat),
+		bridgeCutovers:    make(map[string]*BridgeCutoverState),
+		maintenanceFreeze: make(map[string]*MaintenanceFreeze),
+		namespaceNetworks: make(map[string]string),
+		subnets:           make(map[string]map[string]HostSubnet),
+		netNamespaces:     make(map[string]map[string]NetNamespace),
+		vnidAudit:         make(map[string][]VNIDAuditEntry),
+		vnidReservations:  make(map[string]map[string]VNIDReservation),
+		quarantined:       make(map[string]map[string]QuarantinedNetNamespace),
+		vnidTransitions:   make(map[string]map[string]VNIDTransitionState),
+		endpoints:         []EndpointStatus{{Endpoint: "fake", Healthy: true, Current: true}},
+	}
+}
+
+// SetNetworkConfig seeds the ClusterNetwork a test's GetNetworkConfig calls
+// should see. Not part of EtcdManager -- like the real backends, this is
+// normally provisioned out-of-band -- but fixtures need a way to set it up.
+func (m *Manager) SetNetworkConfig(network string, cfg *ClusterNetwork) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.networkConfigs[network] = cfg
+}
+
+// SetEndpointStatus overrides what EndpointStatus reports; defaults to a
+// single always-healthy "fake" endpoint.
+func (m *Manager) SetEndpointStatus(status []EndpointStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoints = status
+}
+
+func (m *Manager) GetNetworkConfig(ctx context.Context, network string) (*ClusterNetwork, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg, ok := m.networkConfigs[network]
+	if !ok {
+		return nil, fmt.Errorf("no network config for %q", network)
+	}
+	return cfg, nil
+}
+
+func (m *Manager) GetDataplaneCompat(ctx context.Context, network string) (*DataplaneCompat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dataplaneCompat[network], nil
+}
+
+func (m *Manager) SetDataplaneCompat(ctx context.Context, network string, compat *DataplaneCompat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dataplaneCompat[network] = compat
+	return nil
+}
+
+func (m *Manager) GetMaintenanceFreeze(ctx context.Context, network string) (*MaintenanceFreeze, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.maintenanceFreeze[network], nil
+}
+
+func (m *Manager) SetMaintenanceFreeze(ctx context.Context, network string, freeze *MaintenanceFreeze) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maintenanceFreeze[network] = freeze
+	return nil
+}
+
+func (m *Manager) GetNamespaceNetwork(ctx context.Context, namespace string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.namespaceNetworks[namespace], nil
+}
+
+func (m *Manager) SetNamespaceNetwork(ctx context.Context, namespace string, network string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if network == "" {
+		delete(m.namespaceNetworks, namespace)
+		return nil
+	}
+	m.namespaceNetworks[namespace] = network
+	return nil
+}
+
+func (m *Manager) GetBridgeCutoverState(ctx context.Context, network string, host string) (*BridgeCutoverState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bridgeCutovers[network+"/"+host], nil
+}
+
+func (m *Manager) SetBridgeCutoverState(ctx context.Context, network string, host string, state *BridgeCutoverState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bridgeCutovers[network+"/"+host] = state
+	return nil
+}
+
+func (m *Manager) DeleteBridgeCutoverState(ctx context.Context, network string, host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bridgeCutovers, network+"/"+host)
+	return nil
+}
+
+func (m *Manager) GetVNIDTransitionState(ctx context.Context, network string, host string, namespace string) (*VNIDTransitionState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.vnidTransitions[network+"/"+host][namespace]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (m *Manager) SetVNIDTransitionState(ctx context.Context, network string, host string, namespace string, state *VNIDTransitionState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := network + "/" + host
+	if m.vnidTransitions[key] == nil {
+		m.vnidTransitions[key] = make(map[string]VNIDTransitionState)
+	}
+	m.vnidTransitions[key][namespace] = *state
+	return nil
+}
+
+func (m *Manager) DeleteVNIDTransitionState(ctx context.Context, network string, host string, namespace string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.vnidTransitions[network+"/"+host], namespace)
+	return nil
+}
+
+func (m *Manager) ListVNIDTransitionStates(ctx context.Context, network string, host string) ([]VNIDTransitionState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make([]VNIDTransitionState, 0, len(m.vnidTransitions[network+"/"+host]))
+	for _, state := range m.vnidTransitions[network+"/"+host] {
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (m *Manager) AcquireSubnet(ctx context.Context, network string, host string, subnet *HostSubnet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subnets[network][host]; ok {
+		return fmt.Errorf("subnet for host %q already exists", host)
+	}
+	if m.subnets[network] == nil {
+		m.subnets[network] = make(map[string]HostSubnet)
+	}
+	m.subnets[network][host] = *subnet
+	return nil
+}
+
+func (m *Manager) GetSubnet(ctx context.Context, network string, host string) (*HostSubnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.subnets[network][host]
+	if !ok {
+		return nil, fmt.Errorf("no subnet for host %q", host)
+	}
+	return &s, nil
+}
+
+func (m *Manager) GetSubnets(ctx context.Context, network string) ([]HostSubnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subnets := make([]HostSubnet, 0, len(m.subnets[network]))
+	for _, s := range m.subnets[network] {
+		subnets = append(subnets, s)
+	}
+	return subnets, nil
+}
+
+func (m *Manager) RenewSubnet(ctx context.Context, network string, subnet *HostSubnet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subnets[network] == nil {
+		m.subnets[network] = make(map[string]HostSubnet)
+	}
+	m.subnets[network][subnet.Host] = *subnet
+	return nil
+}
+
+func (m *Manager) RevokeSubnet(ctx context.Context, network string, host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subnets[network], host)
+	return nil
+}
+
+func (m *Manager) GetNetNamespace(ctx context.Context, network string, namespace string) (*NetNamespace, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.netNamespaces[network][namespace]
+	if !ok {
+		return nil, fmt.Errorf("no netnamespace %q", namespace)
+	}
+	return &n, nil
+}
+
+func (m *Manager) GetNetNamespaces(ctx context.Context, network string) ([]NetNamespace, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	netnss := make([]NetNamespace, 0, len(m.netNamespaces[network]))
+	for _, n := range m.netNamespaces[network] {
+		netnss = append(netnss, n)
+	}
+	return netnss, nil
+}
+
+func (m *Manager) AcquireNetNamespace(ctx context.Context, network string, attrs *NetNamespace) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.netNamespaces[network][attrs.NetName]; ok {
+		return fmt.Errorf("netnamespace %q already exists", attrs.NetName)
+	}
+	if m.netNamespaces[network] == nil {
+		m.netNamespaces[network] = make(map[string]NetNamespace)
+	}
+	m.netNamespaces[network][attrs.NetName] = *attrs
+	return nil
+}
+
+func (m *Manager) RenewNetNamespace(ctx context.Context, network string, netns *NetNamespace) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.netNamespaces[network] == nil {
+		m.netNamespaces[network] = make(map[string]NetNamespace)
+	}
+	m.netNamespaces[network][netns.NetName] = *netns
+	return nil
+}
+
+func (m *Manager) RevokeNetNamespace(ctx context.Context, network string, namespace string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.netNamespaces[network], namespace)
+	return nil
+}
+
+// WatchSubnets always returns the current snapshot; see Manager's doc comment.
+func (m *Manager) WatchSubnets(ctx context.Context, network string, cursor interface{}) (SubnetWatchResult, error) {
+	subnets, err := m.GetSubnets(ctx, network)
+	if err != nil {
+		return SubnetWatchResult{}, err
+	}
+	return SubnetWatchResult{Snapshot: subnets, Cursor: "0"}, nil
+}
+
+// WatchNetNamespaces always returns the current snapshot; see Manager's doc comment.
+func (m *Manager) WatchNetNamespaces(ctx context.Context, network string, cursor interface{}) (NetNamespaceWatchResult, error) {
+	netnss, err := m.GetNetNamespaces(ctx, network)
+	if err != nil {
+		return NetNamespaceWatchResult{}, err
+	}
+	return NetNamespaceWatchResult{Snapshot: netnss, Cursor: "0"}, nil
+}
+
+func (m *Manager) WatchLagStatus() (uint64, time.Duration) {
+	return 0, 0
+}
+
+func (m *Manager) EndpointStatus() []EndpointStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]EndpointStatus(nil), m.endpoints...)
+}
+
+func (m *Manager) AppendVNIDAudit(ctx context.Context, network string, entry *VNIDAuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := network + "/" + entry.Namespace
+	m.vnidAudit[key] = append(m.vnidAudit[key], *entry)
+	return nil
+}
+
+func (m *Manager) ListVNIDAudit(ctx context.Context, network string, namespace string) ([]VNIDAuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]VNIDAuditEntry(nil), m.vnidAudit[network+"/"+namespace]...), nil
+}
+
+func (m *Manager) ReserveVNID(ctx context.Context, network string, reservation *VNIDReservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.vnidReservations[network][reservation.Namespace]; ok {
+		return fmt.Errorf("reservation for namespace %q already exists", reservation.Namespace)
+	}
+	if m.vnidReservations[network] == nil {
+		m.vnidReservations[network] = make(map[string]VNIDReservation)
+	}
+	m.vnidReservations[network][reservation.Namespace] = *reservation
+	return nil
+}
+
+func (m *Manager) GetVNIDReservation(ctx context.Context, network string, namespace string) (*VNIDReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.vnidReservations[network][namespace]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (m *Manager) ReleaseVNIDReservation(ctx context.Context, network string, namespace string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.vnidReservations[network], namespace)
+	return nil
+}
+
+func (m *Manager) ListVNIDReservations(ctx context.Context, network string) ([]VNIDReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reservations := make([]VNIDReservation, 0, len(m.vnidReservations[network]))
+	for _, r := range m.vnidReservations[network] {
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+func (m *Manager) QuarantineNetNamespace(ctx context.Context, network string, record *QuarantinedNetNamespace) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.quarantined[network] == nil {
+		m.quarantined[network] = make(map[string]QuarantinedNetNamespace)
+	}
+	m.quarantined[network][record.NetName] = *record
+	return nil
+}
+
+func (m *Manager) ListQuarantinedNetNamespaces(ctx context.Context, network string) ([]QuarantinedNetNamespace, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := make([]QuarantinedNetNamespace, 0, len(m.quarantined[network]))
+	for _, r := range m.quarantined[network] {
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func (m *Manager) DeleteQuarantinedNetNamespace(ctx context.Context, network string, netName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.quarantined[network], netName)
+	return nil
+}
@@ -0,0 +1,111 @@
+package etcdv2
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "k8s-ovs/pkg/etcdmanager"
+)
+
+// watchKind identifies which resource type a demultiplexed watch event
+// belongs to.
+type watchKind int
+
+const (
+	watchKindNone watchKind = iota
+	watchKindSubnet
+	watchKindNetNamespace
+)
+
+// demuxEvent carries either a classified watch event or a watch error from
+// a networkDemux to a per-type consumer.
+type demuxEvent struct {
+	evt   Event
+	index uint64
+	err   error
+}
+
+// networkDemux runs a single long-poll etcd watch against a network's whole
+// key prefix and classifies each event by key, dispatching it to whichever
+// per-type consumer it belongs to. This lets Manager.WatchSubnets and
+// Manager.WatchNetNamespaces share one etcd connection, one resume index,
+// and one backoff loop, instead of each keeping their own as they did
+// before this consolidation, while their exported signatures don't change.
+//
+// A demux is seeded with the resume index of whichever type first requests
+// an incremental watch for the network; KsdnNode.Start/StartMaster always start
+// the subnet watch before the netns watch, so in practice that's always the
+// (earlier, and therefore safe to use) subnet index.
+type networkDemux struct {
+	registry Registry
+	network  string
+
+	subnetCh chan demuxEvent
+	netnsCh  chan demuxEvent
+	resyncCh chan uint64
+}
+
+func newNetworkDemux(ctx context.Context, registry Registry, network string, since uint64) *networkDemux {
+	d := &networkDemux{
+		registry: registry,
+		network:  network,
+		subnetCh: make(chan demuxEvent),
+		netnsCh:  make(chan demuxEvent),
+		resyncCh: make(chan uint64, 1),
+	}
+	go d.run(ctx, since)
+	return d
+}
+
+// resync tells the demux to resume from a fresher index than the one it's
+// currently retrying, after a consumer has recovered from an "index too
+// small" error by taking a new snapshot of its own resource type.
+func (d *networkDemux) resync(since uint64) {
+	select {
+	case d.resyncCh <- since:
+	default:
+	}
+}
+
+func (d *networkDemux) run(ctx context.Context, since uint64) {
+	for {
+		evt, kind, index, err := d.registry.watchNetwork(ctx, d.network, since)
+		if err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return
+			}
+
+			d.broadcast(ctx, demuxEvent{err: err})
+
+			select {
+			case since = <-d.resyncCh:
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		since = index
+
+		switch kind {
+		case watchKindSubnet:
+			d.send(ctx, d.subnetCh, demuxEvent{evt: evt, index: index})
+		case watchKindNetNamespace:
+			d.send(ctx, d.netnsCh, demuxEvent{evt: evt, index: index})
+		}
+	}
+}
+
+func (d *networkDemux) broadcast(ctx context.Context, de demuxEvent) {
+	d.send(ctx, d.subnetCh, de)
+	d.send(ctx, d.netnsCh, de)
+}
+
+func (d *networkDemux) send(ctx context.Context, ch chan demuxEvent, de demuxEvent) {
+	select {
+	case ch <- de:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,157 @@
+package etcdv2
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	. "k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/metrics"
+)
+
+const (
+	endpointHealthCheckInterval = 10 * time.Second
+	endpointHealthCheckTimeout  = 3 * time.Second
+)
+
+// endpointMonitor periodically probes each of a multi-endpoint EtcdConfig's
+// members and steers the shared etcd.Client away from the ones that are
+// down, independent of etcd.Client's own per-request failover (which only
+// discovers a dead endpoint by trying it). Only constructed when there's
+// more than one endpoint to choose between; see newEtcdSubnetRegistry.
+type endpointMonitor struct {
+	endpoints []string
+	http      *http.Client
+
+	mu      sync.RWMutex
+	healthy map[string]bool
+	current string
+}
+
+func newEndpointMonitor(cfg *EtcdConfig) (*endpointMonitor, error) {
+	var tlsConfig *tls.Config
+	if cfg.Certfile != "" || cfg.Keyfile != "" || cfg.CAFile != "" {
+		tlsInfo := transport.TLSInfo{CertFile: cfg.Certfile, KeyFile: cfg.Keyfile, CAFile: cfg.CAFile}
+		c, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = c
+	}
+
+	healthy := map[string]bool{}
+	for _, ep := range cfg.Endpoints {
+		healthy[ep] = true
+	}
+
+	return &endpointMonitor{
+		endpoints: cfg.Endpoints,
+		http: &http.Client{
+			Timeout:   endpointHealthCheckTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		healthy: healthy,
+		current: cfg.Endpoints[0],
+	}, nil
+}
+
+// run checks every endpoint immediately, then on endpointHealthCheckInterval
+// until ctx is cancelled. setEndpoints is called with the currently-healthy
+// subset (etcd.Client.SetEndpoints) after every check.
+func (m *endpointMonitor) run(ctx context.Context, setEndpoints func([]string) error) {
+	m.check(setEndpoints)
+
+	ticker := time.NewTicker(endpointHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check(setEndpoints)
+		}
+	}
+}
+
+// check probes every endpoint, updates the health metrics and re-steers the
+// client via setEndpoints, logging when the preferred endpoint changes.
+func (m *endpointMonitor) check(setEndpoints func([]string) error) {
+	var active []string
+	healthy := map[string]bool{}
+	for _, ep := range m.endpoints {
+		ok := m.probe(ep)
+		healthy[ep] = ok
+		metric := float64(0)
+		if ok {
+			metric = 1
+			active = append(active, ep)
+		}
+		metrics.EtcdEndpointHealthy.WithLabelValues(ep).Set(metric)
+	}
+
+	// If nothing looks healthy, fall back to the full list rather than
+	// handing the client an empty endpoint set: a bad health check is more
+	// likely than every member being down at once.
+	if len(active) == 0 {
+		active = append([]string{}, m.endpoints...)
+	}
+
+	m.mu.Lock()
+	changed := active[0] != m.current
+	m.current = active[0]
+	m.healthy = healthy
+	m.mu.Unlock()
+
+	for _, ep := range m.endpoints {
+		metric := float64(0)
+		if ep == active[0] {
+			metric = 1
+		}
+		metrics.EtcdEndpointCurrent.WithLabelValues(ep).Set(metric)
+	}
+
+	if changed {
+		glog.Infof("etcd endpoint monitor: now preferring %s", active[0])
+	}
+	if err := setEndpoints(active); err != nil {
+		glog.Warningf("etcd endpoint monitor: failed to update client endpoints: %v", err)
+	}
+}
+
+// probe reports whether endpoint answered its /health check.
+func (m *endpointMonitor) probe(endpoint string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), endpointHealthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", endpoint+"/health", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := m.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// status returns a snapshot of the last check's results for every endpoint.
+func (m *endpointMonitor) status() []EndpointStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	statuses := make([]EndpointStatus, 0, len(m.endpoints))
+	for _, ep := range m.endpoints {
+		statuses = append(statuses, EndpointStatus{
+			Endpoint: ep,
+			Healthy:  m.healthy[ep],
+			Current:  ep == m.current,
+		})
+	}
+	return statuses
+}
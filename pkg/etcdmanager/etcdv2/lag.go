@@ -0,0 +1,78 @@
+package etcdv2
+
+import (
+	"sync"
+	"time"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// watchLag tracks, for a single named etcd watch (subnets, netnamespaces),
+// how far the last delivered event's etcd index is behind the most recently
+// observed store index, and how long ago the last event was delivered.
+type watchLag struct {
+	mu            sync.Mutex
+	name          string
+	deliveredIdx  uint64
+	currentIdx    uint64
+	lastEventTime time.Time
+}
+
+func newWatchLag(name string) *watchLag {
+	return &watchLag{name: name}
+}
+
+// observeEvent records that a watch event carrying the given etcd index was
+// just delivered to consumers.
+func (w *watchLag) observeEvent(index uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deliveredIdx = index
+	if index > w.currentIdx {
+		w.currentIdx = index
+	}
+	w.lastEventTime = time.Now()
+	w.report()
+}
+
+// observeCurrentIndex records the etcd index seen from a fresh read of the
+// store (eg. during a snapshot reset), independent of whether it was
+// delivered as a watch event.
+func (w *watchLag) observeCurrentIndex(index uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if index > w.currentIdx {
+		w.currentIdx = index
+	}
+	w.report()
+}
+
+// report must be called with mu held.
+func (w *watchLag) report() {
+	lag := int64(w.currentIdx) - int64(w.deliveredIdx)
+	if lag < 0 {
+		lag = 0
+	}
+	metrics.EtcdWatchLagIndex.WithLabelValues(w.name).Set(float64(lag))
+	if !w.lastEventTime.IsZero() {
+		metrics.EtcdWatchLastEventAge.WithLabelValues(w.name).Set(time.Since(w.lastEventTime).Seconds())
+	}
+}
+
+// status returns the current index lag and the time since the last
+// delivered event (zero if no event has ever been delivered).
+func (w *watchLag) status() (uint64, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lag := uint64(0)
+	if w.currentIdx > w.deliveredIdx {
+		lag = w.currentIdx - w.deliveredIdx
+	}
+
+	var age time.Duration
+	if !w.lastEventTime.IsZero() {
+		age = time.Since(w.lastEventTime)
+	}
+	return lag, age
+}
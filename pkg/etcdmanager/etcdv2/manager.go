@@ -17,6 +17,8 @@ package etcdv2
 import (
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/golang/glog"
@@ -27,6 +29,12 @@ import (
 
 type Manager struct {
 	registry Registry
+
+	subnetLag *watchLag
+	netnsLag  *watchLag
+
+	demuxMu sync.Mutex
+	demuxes map[string]*networkDemux // by network
 }
 
 type watchCursor struct {
@@ -71,10 +79,28 @@ func NewManager(config *EtcdConfig) (EtcdManager, error) {
 
 func newManager(r Registry) EtcdManager {
 	return &Manager{
-		registry: r,
+		registry:  r,
+		subnetLag: newWatchLag("subnets"),
+		netnsLag:  newWatchLag("netnamespaces"),
+		demuxes:   make(map[string]*networkDemux),
 	}
 }
 
+// networkDemuxFor returns the network's shared watch demultiplexer, creating
+// it (seeded to resume from since) if this is the first incremental watch
+// request for the network.
+func (m *Manager) networkDemuxFor(ctx context.Context, network string, since uint64) *networkDemux {
+	m.demuxMu.Lock()
+	defer m.demuxMu.Unlock()
+
+	if d, ok := m.demuxes[network]; ok {
+		return d
+	}
+	d := newNetworkDemux(ctx, m.registry, network, since)
+	m.demuxes[network] = d
+	return d
+}
+
 func (m *Manager) GetNetworkConfig(ctx context.Context, network string) (*ClusterNetwork, error) {
 	cfg, err := m.registry.getNetworkConfig(ctx, network)
 	if err != nil {
@@ -84,6 +110,58 @@ func (m *Manager) GetNetworkConfig(ctx context.Context, network string) (*Cluste
 	return ParseClusterNetConfig(cfg)
 }
 
+func (m *Manager) GetDataplaneCompat(ctx context.Context, network string) (*DataplaneCompat, error) {
+	return m.registry.getDataplaneCompat(ctx, network)
+}
+
+func (m *Manager) SetDataplaneCompat(ctx context.Context, network string, compat *DataplaneCompat) error {
+	return m.registry.setDataplaneCompat(ctx, network, compat)
+}
+
+func (m *Manager) GetMaintenanceFreeze(ctx context.Context, network string) (*MaintenanceFreeze, error) {
+	return m.registry.getMaintenanceFreeze(ctx, network)
+}
+
+func (m *Manager) SetMaintenanceFreeze(ctx context.Context, network string, freeze *MaintenanceFreeze) error {
+	return m.registry.setMaintenanceFreeze(ctx, network, freeze)
+}
+
+func (m *Manager) GetNamespaceNetwork(ctx context.Context, namespace string) (string, error) {
+	return m.registry.getNamespaceNetwork(ctx, namespace)
+}
+
+func (m *Manager) SetNamespaceNetwork(ctx context.Context, namespace string, network string) error {
+	return m.registry.setNamespaceNetwork(ctx, namespace, network)
+}
+
+func (m *Manager) GetBridgeCutoverState(ctx context.Context, network string, host string) (*BridgeCutoverState, error) {
+	return m.registry.getBridgeCutoverState(ctx, network, host)
+}
+
+func (m *Manager) SetBridgeCutoverState(ctx context.Context, network string, host string, state *BridgeCutoverState) error {
+	return m.registry.setBridgeCutoverState(ctx, network, host, state)
+}
+
+func (m *Manager) DeleteBridgeCutoverState(ctx context.Context, network string, host string) error {
+	return m.registry.deleteBridgeCutoverState(ctx, network, host)
+}
+
+func (m *Manager) GetVNIDTransitionState(ctx context.Context, network string, host string, namespace string) (*VNIDTransitionState, error) {
+	return m.registry.getVNIDTransitionState(ctx, network, host, namespace)
+}
+
+func (m *Manager) SetVNIDTransitionState(ctx context.Context, network string, host string, namespace string, state *VNIDTransitionState) error {
+	return m.registry.setVNIDTransitionState(ctx, network, host, namespace, state)
+}
+
+func (m *Manager) DeleteVNIDTransitionState(ctx context.Context, network string, host string, namespace string) error {
+	return m.registry.deleteVNIDTransitionState(ctx, network, host, namespace)
+}
+
+func (m *Manager) ListVNIDTransitionStates(ctx context.Context, network string, host string) ([]VNIDTransitionState, error) {
+	return m.registry.listVNIDTransitionStates(ctx, network, host)
+}
+
 func (m *Manager) AcquireSubnet(ctx context.Context, network string, host string, subnet *HostSubnet) error {
 	_, err := m.registry.createSubnet(ctx, network, host, subnet, 0)
 	return err
@@ -132,6 +210,65 @@ func (m *Manager) RevokeNetNamespace(ctx context.Context, network string, namesp
 	return m.registry.deleteNetNamespace(ctx, network, namespace)
 }
 
+func (m *Manager) AppendVNIDAudit(ctx context.Context, network string, entry *VNIDAuditEntry) error {
+	return m.registry.appendVNIDAudit(ctx, network, entry)
+}
+
+func (m *Manager) ListVNIDAudit(ctx context.Context, network string, namespace string) ([]VNIDAuditEntry, error) {
+	return m.registry.listVNIDAudit(ctx, network, namespace)
+}
+
+func (m *Manager) ReserveVNID(ctx context.Context, network string, reservation *VNIDReservation) error {
+	return m.registry.reserveVNID(ctx, network, reservation)
+}
+
+func (m *Manager) GetVNIDReservation(ctx context.Context, network string, namespace string) (*VNIDReservation, error) {
+	return m.registry.getVNIDReservation(ctx, network, namespace)
+}
+
+func (m *Manager) ReleaseVNIDReservation(ctx context.Context, network string, namespace string) error {
+	return m.registry.releaseVNIDReservation(ctx, network, namespace)
+}
+
+func (m *Manager) ListVNIDReservations(ctx context.Context, network string) ([]VNIDReservation, error) {
+	return m.registry.listVNIDReservations(ctx, network)
+}
+
+func (m *Manager) QuarantineNetNamespace(ctx context.Context, network string, record *QuarantinedNetNamespace) error {
+	return m.registry.quarantineNetNamespace(ctx, network, record)
+}
+
+func (m *Manager) ListQuarantinedNetNamespaces(ctx context.Context, network string) ([]QuarantinedNetNamespace, error) {
+	return m.registry.listQuarantinedNetNamespaces(ctx, network)
+}
+
+func (m *Manager) DeleteQuarantinedNetNamespace(ctx context.Context, network string, netname string) error {
+	return m.registry.deleteQuarantinedNetNamespace(ctx, network, netname)
+}
+
+// WatchLagStatus returns the worst-case index lag and event staleness across
+// all of the manager's etcd watches, for use by readiness checks.
+func (m *Manager) WatchLagStatus() (uint64, time.Duration) {
+	subnetIdxLag, subnetAge := m.subnetLag.status()
+	netnsIdxLag, netnsAge := m.netnsLag.status()
+
+	idxLag := subnetIdxLag
+	if netnsIdxLag > idxLag {
+		idxLag = netnsIdxLag
+	}
+	age := subnetAge
+	if netnsAge > age {
+		age = netnsAge
+	}
+	return idxLag, age
+}
+
+// EndpointStatus returns the health of each configured etcd endpoint and
+// which one is currently preferred.
+func (m *Manager) EndpointStatus() []EndpointStatus {
+	return m.registry.endpointStatus()
+}
+
 func getNextIndex(cursor interface{}) (uint64, error) {
 	nextIndex := uint64(0)
 
@@ -160,21 +297,33 @@ func (m *Manager) WatchSubnets(ctx context.Context, network string, cursor inter
 		return SubnetWatchResult{}, err
 	}
 
-	evt, index, err := m.registry.watchSubnets(ctx, network, nextIndex)
-
-	switch {
-	case err == nil:
-		return SubnetWatchResult{
-			Events: []Event{evt},
-			Cursor: watchCursor{index},
-		}, nil
-
-	case isIndexTooSmall(err):
-		glog.Warning("Watch of subnets failed because etcd index outside history window")
-		return m.subnetsWatchReset(ctx, network)
+	d := m.networkDemuxFor(ctx, network, nextIndex)
+	select {
+	case res := <-d.subnetCh:
+		switch {
+		case res.err == nil:
+			m.subnetLag.observeEvent(res.index)
+			return SubnetWatchResult{
+				Events: []Event{res.evt},
+				Cursor: watchCursor{res.index},
+			}, nil
+
+		case isIndexTooSmall(res.err):
+			glog.Warning("Watch of subnets failed because etcd index outside history window")
+			wr, err := m.subnetsWatchReset(ctx, network)
+			if err == nil {
+				if wc, ok := wr.Cursor.(watchCursor); ok {
+					d.resync(wc.index)
+				}
+			}
+			return wr, err
+
+		default:
+			return SubnetWatchResult{}, res.err
+		}
 
-	default:
-		return SubnetWatchResult{}, err
+	case <-ctx.Done():
+		return SubnetWatchResult{}, ctx.Err()
 	}
 }
 
@@ -188,21 +337,33 @@ func (m *Manager) WatchNetNamespaces(ctx context.Context, network string, cursor
 		return NetNamespaceWatchResult{}, err
 	}
 
-	evt, index, err := m.registry.watchNetNamespaces(ctx, network, nextIndex)
-
-	switch {
-	case err == nil:
-		return NetNamespaceWatchResult{
-			Events: []Event{evt},
-			Cursor: watchCursor{index},
-		}, nil
-
-	case isIndexTooSmall(err):
-		glog.Warning("Watch of NetNamespaces failed because etcd index outside history window")
-		return m.netNamespacesWatchReset(ctx, network)
+	d := m.networkDemuxFor(ctx, network, nextIndex)
+	select {
+	case res := <-d.netnsCh:
+		switch {
+		case res.err == nil:
+			m.netnsLag.observeEvent(res.index)
+			return NetNamespaceWatchResult{
+				Events: []Event{res.evt},
+				Cursor: watchCursor{res.index},
+			}, nil
+
+		case isIndexTooSmall(res.err):
+			glog.Warning("Watch of NetNamespaces failed because etcd index outside history window")
+			wr, err := m.netNamespacesWatchReset(ctx, network)
+			if err == nil {
+				if wc, ok := wr.Cursor.(watchCursor); ok {
+					d.resync(wc.index)
+				}
+			}
+			return wr, err
+
+		default:
+			return NetNamespaceWatchResult{}, res.err
+		}
 
-	default:
-		return NetNamespaceWatchResult{}, err
+	case <-ctx.Done():
+		return NetNamespaceWatchResult{}, ctx.Err()
 	}
 }
 
@@ -220,6 +381,7 @@ func (m *Manager) subnetsWatchReset(ctx context.Context, network string) (Subnet
 		return wr, fmt.Errorf("failed to retrieve subnet subnets: %v", err)
 	}
 
+	m.subnetLag.observeCurrentIndex(index)
 	wr.Cursor = watchCursor{index}
 	wr.Snapshot = subnets
 	return wr, nil
@@ -234,6 +396,7 @@ func (m *Manager) netNamespacesWatchReset(ctx context.Context, network string) (
 		return wr, fmt.Errorf("failed to retrieve NetNamespaces: %v", err)
 	}
 
+	m.netnsLag.observeCurrentIndex(index)
 	wr.Cursor = watchCursor{index}
 	wr.Snapshot = netNSs
 	return wr, nil
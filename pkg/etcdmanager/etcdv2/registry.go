@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"path"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,6 +30,7 @@ import (
 	"golang.org/x/net/context"
 
 	. "k8s-ovs/pkg/etcdmanager"
+	"k8s-ovs/pkg/metrics"
 )
 
 var (
@@ -37,6 +39,13 @@ var (
 
 type Registry interface {
 	getNetworkConfig(ctx context.Context, network string) (string, error)
+	getNamespaceNetwork(ctx context.Context, namespace string) (string, error)
+	setNamespaceNetwork(ctx context.Context, namespace string, network string) error
+	getDataplaneCompat(ctx context.Context, network string) (*DataplaneCompat, error)
+	setDataplaneCompat(ctx context.Context, network string, compat *DataplaneCompat) error
+	getBridgeCutoverState(ctx context.Context, network string, host string) (*BridgeCutoverState, error)
+	setBridgeCutoverState(ctx context.Context, network string, host string, state *BridgeCutoverState) error
+	deleteBridgeCutoverState(ctx context.Context, network string, host string) error
 	getSubnets(ctx context.Context, network string) ([]HostSubnet, uint64, error)
 	getNetNamespaces(ctx context.Context, network string) ([]NetNamespace, uint64, error)
 	getSubnet(ctx context.Context, network string, host string) (*HostSubnet, uint64, error)
@@ -47,10 +56,25 @@ type Registry interface {
 	updateNetNamespace(ctx context.Context, network string, namespace string, attrs *NetNamespace, ttl time.Duration, asof uint64) (time.Time, error)
 	deleteSubnet(ctx context.Context, network string, host string) error
 	deleteNetNamespace(ctx context.Context, network string, namespace string) error
-	watchSubnets(ctx context.Context, network string, since uint64) (Event, uint64, error)
-	watchNetNamespaces(ctx context.Context, network string, since uint64) (Event, uint64, error)
+	watchNetwork(ctx context.Context, network string, since uint64) (Event, watchKind, uint64, error)
 	getNetworks(ctx context.Context) ([]string, uint64, error)
 	//	watchNetworks(ctx context.Context, since uint64) (Event, uint64, error)
+	appendVNIDAudit(ctx context.Context, network string, entry *VNIDAuditEntry) error
+	listVNIDAudit(ctx context.Context, network string, namespace string) ([]VNIDAuditEntry, error)
+	reserveVNID(ctx context.Context, network string, reservation *VNIDReservation) error
+	getVNIDReservation(ctx context.Context, network string, namespace string) (*VNIDReservation, error)
+	releaseVNIDReservation(ctx context.Context, network string, namespace string) error
+	listVNIDReservations(ctx context.Context, network string) ([]VNIDReservation, error)
+	quarantineNetNamespace(ctx context.Context, network string, record *QuarantinedNetNamespace) error
+	listQuarantinedNetNamespaces(ctx context.Context, network string) ([]QuarantinedNetNamespace, error)
+	deleteQuarantinedNetNamespace(ctx context.Context, network string, netname string) error
+	getVNIDTransitionState(ctx context.Context, network string, host string, namespace string) (*VNIDTransitionState, error)
+	setVNIDTransitionState(ctx context.Context, network string, host string, namespace string, state *VNIDTransitionState) error
+	deleteVNIDTransitionState(ctx context.Context, network string, host string, namespace string) error
+	listVNIDTransitionStates(ctx context.Context, network string, host string) ([]VNIDTransitionState, error)
+	getMaintenanceFreeze(ctx context.Context, network string) (*MaintenanceFreeze, error)
+	setMaintenanceFreeze(ctx context.Context, network string, freeze *MaintenanceFreeze) error
+	endpointStatus() []EndpointStatus
 }
 
 type EtcdConfig struct {
@@ -63,17 +87,24 @@ type EtcdConfig struct {
 	Password  string
 }
 
-type etcdNewFunc func(c *EtcdConfig) (etcd.KeysAPI, error)
+type etcdNewFunc func(c *EtcdConfig) (etcd.Client, error)
 
 type etcdSubnetRegistry struct {
 	cliNewFunc   etcdNewFunc
 	mux          sync.Mutex
+	rawCli       etcd.Client
 	cli          etcd.KeysAPI
 	etcdCfg      *EtcdConfig
 	networkRegex *regexp.Regexp
+
+	// endpoints health-checks each of etcdCfg.Endpoints independently of the
+	// request/response path and steers rawCli's active endpoint list away
+	// from the ones that are down; see endpoint_health.go. nil when etcdCfg
+	// lists a single endpoint, since there's nothing to fail over to.
+	endpoints *endpointMonitor
 }
 
-func newEtcdClient(c *EtcdConfig) (etcd.KeysAPI, error) {
+func newEtcdClient(c *EtcdConfig) (etcd.Client, error) {
 	tlsInfo := transport.TLSInfo{
 		CertFile: c.Certfile,
 		KeyFile:  c.Keyfile,
@@ -85,17 +116,12 @@ func newEtcdClient(c *EtcdConfig) (etcd.KeysAPI, error) {
 		return nil, err
 	}
 
-	cli, err := etcd.New(etcd.Config{
+	return etcd.New(etcd.Config{
 		Endpoints: c.Endpoints,
 		Transport: t,
 		Username:  c.Username,
 		Password:  c.Password,
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	return etcd.NewKeysAPI(cli), nil
 }
 
 func newEtcdSubnetRegistry(config *EtcdConfig, cliNewFunc etcdNewFunc) (Registry, error) {
@@ -110,14 +136,38 @@ func newEtcdSubnetRegistry(config *EtcdConfig, cliNewFunc etcdNewFunc) (Registry
 	}
 
 	var err error
-	r.cli, err = r.cliNewFunc(config)
+	r.rawCli, err = r.cliNewFunc(config)
 	if err != nil {
 		return nil, err
 	}
+	r.cli = etcd.NewKeysAPI(r.rawCli)
+
+	if len(config.Endpoints) > 1 {
+		monitor, err := newEndpointMonitor(config)
+		if err != nil {
+			return nil, err
+		}
+		r.endpoints = monitor
+		go monitor.run(context.Background(), r.rawCli.SetEndpoints)
+	}
 
 	return r, nil
 }
 
+// endpointStatus reports the health of every configured endpoint and which
+// one requests are currently steered toward first; see endpoint_health.go.
+// A single-endpoint configuration (nothing to fail over to) always reports
+// that one endpoint as both healthy and current, without running any checks.
+func (esr *etcdSubnetRegistry) endpointStatus() []EndpointStatus {
+	if esr.endpoints == nil {
+		if len(esr.etcdCfg.Endpoints) == 0 {
+			return nil
+		}
+		return []EndpointStatus{{Endpoint: esr.etcdCfg.Endpoints[0], Healthy: true, Current: true}}
+	}
+	return esr.endpoints.status()
+}
+
 func (esr *etcdSubnetRegistry) getNetworkConfig(ctx context.Context, network string) (string, error) {
 	key := path.Join(esr.etcdCfg.Prefix, network, "config")
 	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
@@ -127,6 +177,194 @@ func (esr *etcdSubnetRegistry) getNetworkConfig(ctx context.Context, network str
 	return resp.Node.Value, nil
 }
 
+func (esr *etcdSubnetRegistry) getDataplaneCompat(ctx context.Context, network string) (*DataplaneCompat, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "dataplane-compat")
+	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	compat := &DataplaneCompat{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), compat); err != nil {
+		return nil, err
+	}
+	return compat, nil
+}
+
+func (esr *etcdSubnetRegistry) setDataplaneCompat(ctx context.Context, network string, compat *DataplaneCompat) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "dataplane-compat")
+	value, err := json.Marshal(compat)
+	if err != nil {
+		return err
+	}
+	_, err = esr.client().Set(ctx, key, string(value), nil)
+	return err
+}
+
+func (esr *etcdSubnetRegistry) getMaintenanceFreeze(ctx context.Context, network string) (*MaintenanceFreeze, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "maintenance-freeze")
+	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	freeze := &MaintenanceFreeze{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), freeze); err != nil {
+		return nil, err
+	}
+	return freeze, nil
+}
+
+func (esr *etcdSubnetRegistry) setMaintenanceFreeze(ctx context.Context, network string, freeze *MaintenanceFreeze) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "maintenance-freeze")
+	value, err := json.Marshal(freeze)
+	if err != nil {
+		return err
+	}
+	_, err = esr.client().Set(ctx, key, string(value), nil)
+	return err
+}
+
+// namespaceNetworksDir holds namespace-to-additional-network assignments.
+// Unlike every other key in this file it isn't scoped under a network's own
+// prefix, since it's what tells a node which network's tree a namespace
+// belongs to in the first place; see KsdnNode.AdditionalNetworks.
+const namespaceNetworksDir = "namespace-networks"
+
+func (esr *etcdSubnetRegistry) getNamespaceNetwork(ctx context.Context, namespace string) (string, error) {
+	key := path.Join(esr.etcdCfg.Prefix, namespaceNetworksDir, namespace)
+	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return resp.Node.Value, nil
+}
+
+func (esr *etcdSubnetRegistry) setNamespaceNetwork(ctx context.Context, namespace string, network string) error {
+	key := path.Join(esr.etcdCfg.Prefix, namespaceNetworksDir, namespace)
+	if network == "" {
+		_, err := esr.client().Delete(ctx, key, nil)
+		if err != nil {
+			if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+	_, err := esr.client().Set(ctx, key, network, nil)
+	return err
+}
+
+func (esr *etcdSubnetRegistry) getBridgeCutoverState(ctx context.Context, network string, host string) (*BridgeCutoverState, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "bridge-cutover", host)
+	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	state := &BridgeCutoverState{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (esr *etcdSubnetRegistry) setBridgeCutoverState(ctx context.Context, network string, host string, state *BridgeCutoverState) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "bridge-cutover", host)
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = esr.client().Set(ctx, key, string(value), nil)
+	return err
+}
+
+func (esr *etcdSubnetRegistry) deleteBridgeCutoverState(ctx context.Context, network string, host string) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "bridge-cutover", host)
+	_, err := esr.client().Delete(ctx, key, nil)
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (esr *etcdSubnetRegistry) getVNIDTransitionState(ctx context.Context, network, host, namespace string) (*VNIDTransitionState, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "vnid-transitions", host, namespace)
+	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	state := &VNIDTransitionState{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (esr *etcdSubnetRegistry) setVNIDTransitionState(ctx context.Context, network, host, namespace string, state *VNIDTransitionState) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "vnid-transitions", host, namespace)
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = esr.client().Set(ctx, key, string(value), nil)
+	return err
+}
+
+func (esr *etcdSubnetRegistry) deleteVNIDTransitionState(ctx context.Context, network, host, namespace string) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "vnid-transitions", host, namespace)
+	_, err := esr.client().Delete(ctx, key, nil)
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (esr *etcdSubnetRegistry) listVNIDTransitionStates(ctx context.Context, network, host string) ([]VNIDTransitionState, error) {
+	dir := path.Join(esr.etcdCfg.Prefix, network, "vnid-transitions", host)
+	resp, err := esr.client().Get(ctx, dir, &etcd.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return []VNIDTransitionState{}, nil
+		}
+		return nil, err
+	}
+
+	states := make([]VNIDTransitionState, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		var state VNIDTransitionState
+		if err := json.Unmarshal([]byte(node.Value), &state); err != nil {
+			glog.Warningf("Ignoring bad VNID transition state %s: %v", node.Key, err)
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
 // GetSubnets queries etcd to get a list of currently allocated subnets for a given network.
 // It returns the subnets along with the "as-of" etcd-index that can be used as the starting
 // point for etcd watch.
@@ -173,7 +411,13 @@ func (esr *etcdSubnetRegistry) getNetNamespaces(ctx context.Context, network str
 	for _, node := range resp.Node.Nodes {
 		netNS := &NetNamespace{}
 		if err := json.Unmarshal([]byte(node.Value), netNS); err != nil {
-			glog.Warningf("Ignoring bad netnamespace node: %v", err)
+			glog.Warningf("Quarantining unparseable netnamespace node %s: %v", node.Key, err)
+			esr.quarantineBadNetNamespace(ctx, network, path.Base(node.Key), err)
+			continue
+		}
+		if err := netNS.Validate(); err != nil {
+			glog.Warningf("Quarantining invalid netnamespace node %s: %v", node.Key, err)
+			esr.quarantineBadNetNamespace(ctx, network, netNS.NetName, err)
 			continue
 		}
 		netNSs = append(netNSs, *netNS)
@@ -182,6 +426,20 @@ func (esr *etcdSubnetRegistry) getNetNamespaces(ctx context.Context, network str
 	return netNSs, resp.Index, nil
 }
 
+// quarantineBadNetNamespace persists why a NetNamespace record was withheld
+// from delivery. Failures are logged but not returned: quarantining is
+// best-effort diagnostics and must never be the reason a read fails.
+func (esr *etcdSubnetRegistry) quarantineBadNetNamespace(ctx context.Context, network string, netname string, reason error) {
+	metrics.NetNamespaceQuarantined.Inc()
+	if err := esr.quarantineNetNamespace(ctx, network, &QuarantinedNetNamespace{
+		NetName:       netname,
+		Reason:        reason.Error(),
+		QuarantinedAt: time.Now(),
+	}); err != nil {
+		glog.Warningf("Failed to record quarantined netnamespace %s: %v", netname, err)
+	}
+}
+
 func (esr *etcdSubnetRegistry) getSubnet(ctx context.Context, network string, host string) (*HostSubnet, uint64, error) {
 	key := path.Join(esr.etcdCfg.Prefix, network, "subnets", host)
 	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
@@ -202,6 +460,11 @@ func (esr *etcdSubnetRegistry) getNetNamespace(ctx context.Context, network stri
 
 	netNS := &NetNamespace{}
 	if err := json.Unmarshal([]byte(resp.Node.Value), netNS); err != nil {
+		esr.quarantineBadNetNamespace(ctx, network, namespace, err)
+		return nil, 0, err
+	}
+	if err := netNS.Validate(); err != nil {
+		esr.quarantineBadNetNamespace(ctx, network, namespace, err)
 		return nil, 0, err
 	}
 
@@ -316,34 +579,222 @@ func (esr *etcdSubnetRegistry) deleteNetNamespace(ctx context.Context, network s
 	return err
 }
 
-func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, network string, since uint64) (Event, uint64, error) {
-	key := path.Join(esr.etcdCfg.Prefix, network, "subnets")
-	opts := &etcd.WatcherOptions{
-		AfterIndex: since,
-		Recursive:  true,
+// maxVNIDAuditEntries bounds how many audit entries are retained per
+// namespace; appendVNIDAudit prunes the oldest entries beyond this.
+const maxVNIDAuditEntries = 100
+
+func (esr *etcdSubnetRegistry) appendVNIDAudit(ctx context.Context, network string, entry *VNIDAuditEntry) error {
+	dir := path.Join(esr.etcdCfg.Prefix, network, "audit", "vnid", entry.Namespace)
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
 	}
-	e, err := esr.client().Watcher(key, opts).Next(ctx)
+	if _, err := esr.client().CreateInOrder(ctx, dir, string(value), nil); err != nil {
+		return err
+	}
+
+	esr.pruneVNIDAudit(ctx, dir)
+	return nil
+}
+
+// pruneVNIDAudit trims a namespace's audit log down to maxVNIDAuditEntries,
+// oldest first. Failures are logged but not returned: pruning is best-effort
+// and must never cause an audit write to fail.
+func (esr *etcdSubnetRegistry) pruneVNIDAudit(ctx context.Context, dir string) {
+	resp, err := esr.client().Get(ctx, dir, &etcd.GetOptions{Recursive: true, Sort: true})
 	if err != nil {
-		return Event{}, 0, err
+		glog.Warningf("Failed to list VNID audit log at %s for pruning: %v", dir, err)
+		return
 	}
 
-	evt, err := parseSubnetWatchResponse(e)
-	return evt, e.Node.ModifiedIndex, err
+	excess := len(resp.Node.Nodes) - maxVNIDAuditEntries
+	for i := 0; i < excess; i++ {
+		if _, err := esr.client().Delete(ctx, resp.Node.Nodes[i].Key, nil); err != nil {
+			glog.Warningf("Failed to prune VNID audit entry %s: %v", resp.Node.Nodes[i].Key, err)
+		}
+	}
 }
 
-func (esr *etcdSubnetRegistry) watchNetNamespaces(ctx context.Context, network string, since uint64) (Event, uint64, error) {
-	key := path.Join(esr.etcdCfg.Prefix, network, "netnamespaces")
-	opts := &etcd.WatcherOptions{
-		AfterIndex: since,
-		Recursive:  true,
+func (esr *etcdSubnetRegistry) listVNIDAudit(ctx context.Context, network string, namespace string) ([]VNIDAuditEntry, error) {
+	dir := path.Join(esr.etcdCfg.Prefix, network, "audit", "vnid", namespace)
+	resp, err := esr.client().Get(ctx, dir, &etcd.GetOptions{Recursive: true, Sort: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return []VNIDAuditEntry{}, nil
+		}
+		return nil, err
 	}
-	e, err := esr.client().Watcher(key, opts).Next(ctx)
+
+	entries := make([]VNIDAuditEntry, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		var entry VNIDAuditEntry
+		if err := json.Unmarshal([]byte(node.Value), &entry); err != nil {
+			glog.Warningf("Ignoring bad VNID audit entry %s: %v", node.Key, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (esr *etcdSubnetRegistry) reserveVNID(ctx context.Context, network string, reservation *VNIDReservation) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "reservations", "vnid", reservation.Namespace)
+	value, err := json.Marshal(reservation)
 	if err != nil {
-		return Event{}, 0, err
+		return err
 	}
 
-	evt, err := parseNetNamespaceWatchResponse(e)
-	return evt, e.Node.ModifiedIndex, err
+	_, err = esr.client().Set(ctx, key, string(value), &etcd.SetOptions{
+		PrevExist: etcd.PrevNoExist,
+	})
+	return err
+}
+
+func (esr *etcdSubnetRegistry) getVNIDReservation(ctx context.Context, network string, namespace string) (*VNIDReservation, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "reservations", "vnid", namespace)
+	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	reservation := &VNIDReservation{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), reservation); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func (esr *etcdSubnetRegistry) releaseVNIDReservation(ctx context.Context, network string, namespace string) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "reservations", "vnid", namespace)
+	_, err := esr.client().Delete(ctx, key, nil)
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (esr *etcdSubnetRegistry) listVNIDReservations(ctx context.Context, network string) ([]VNIDReservation, error) {
+	dir := path.Join(esr.etcdCfg.Prefix, network, "reservations", "vnid")
+	resp, err := esr.client().Get(ctx, dir, &etcd.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return []VNIDReservation{}, nil
+		}
+		return nil, err
+	}
+
+	reservations := make([]VNIDReservation, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		var reservation VNIDReservation
+		if err := json.Unmarshal([]byte(node.Value), &reservation); err != nil {
+			glog.Warningf("Ignoring bad VNID reservation %s: %v", node.Key, err)
+			continue
+		}
+		reservations = append(reservations, reservation)
+	}
+	return reservations, nil
+}
+
+func (esr *etcdSubnetRegistry) quarantineNetNamespace(ctx context.Context, network string, record *QuarantinedNetNamespace) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "quarantine", "netnamespaces", record.NetName)
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = esr.client().Set(ctx, key, string(value), nil)
+	return err
+}
+
+func (esr *etcdSubnetRegistry) listQuarantinedNetNamespaces(ctx context.Context, network string) ([]QuarantinedNetNamespace, error) {
+	dir := path.Join(esr.etcdCfg.Prefix, network, "quarantine", "netnamespaces")
+	resp, err := esr.client().Get(ctx, dir, &etcd.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return []QuarantinedNetNamespace{}, nil
+		}
+		return nil, err
+	}
+
+	records := make([]QuarantinedNetNamespace, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		var record QuarantinedNetNamespace
+		if err := json.Unmarshal([]byte(node.Value), &record); err != nil {
+			glog.Warningf("Ignoring unparseable quarantine record %s: %v", node.Key, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (esr *etcdSubnetRegistry) deleteQuarantinedNetNamespace(ctx context.Context, network string, netname string) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "quarantine", "netnamespaces", netname)
+	_, err := esr.client().Delete(ctx, key, nil)
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// watchNetwork performs a single long-poll watch against the whole network
+// prefix (subnets, netnamespaces, config, audit, ...) instead of a single
+// resource type's subtree, and classifies whatever event comes back by key.
+// This is what lets subnets and netnamespaces share one etcd connection, one
+// resume index and one backoff loop (see networkDemux) instead of each
+// polling etcd independently. Events under keys that aren't one of the
+// watched types (config, audit) are skipped over without being returned.
+func (esr *etcdSubnetRegistry) watchNetwork(ctx context.Context, network string, since uint64) (Event, watchKind, uint64, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network)
+	for {
+		opts := &etcd.WatcherOptions{
+			AfterIndex: since,
+			Recursive:  true,
+		}
+		e, err := esr.client().Watcher(key, opts).Next(ctx)
+		if err != nil {
+			return Event{}, watchKindNone, 0, err
+		}
+
+		switch {
+		// Matched against the network's own subnets/ and netnamespaces/
+		// directories, so records under e.g. quarantine/netnamespaces/ fall
+		// through to the default case like any other unwatched key.
+		case strings.Contains(e.Node.Key, key+"/subnets/"):
+			evt, err := parseSubnetWatchResponse(e)
+			return evt, watchKindSubnet, e.Node.ModifiedIndex, err
+
+		case strings.Contains(e.Node.Key, key+"/netnamespaces/"):
+			evt, err := parseNetNamespaceWatchResponse(e)
+			if err == nil && evt.Type == EventAdded {
+				err = evt.NetNS.Validate()
+			}
+			if err != nil {
+				// A record that won't decode or doesn't validate must not
+				// stall this watch: since a corrupt write never changes,
+				// returning the error here would have the demux retry the
+				// same index forever, wedging both subnet and netnamespace
+				// delivery for the whole network. Quarantine it and move on.
+				glog.Warningf("Quarantining bad netnamespace watch event at %s: %v", e.Node.Key, err)
+				esr.quarantineBadNetNamespace(ctx, network, path.Base(e.Node.Key), err)
+				since = e.Node.ModifiedIndex
+				continue
+			}
+			return evt, watchKindNetNamespace, e.Node.ModifiedIndex, nil
+
+		default:
+			since = e.Node.ModifiedIndex
+		}
+	}
 }
 
 // GetNetworks queries etcd to get a list of network names.  It returns the
@@ -377,19 +828,19 @@ func (esr *etcdSubnetRegistry) getNetworks(ctx context.Context) ([]string, uint6
 }
 
 /*
-func (esr *etcdSubnetRegistry) watchNetworks(ctx context.Context, since uint64) (Event, uint64, error) {
-	key := esr.etcdCfg.Prefix
-	opts := &etcd.WatcherOptions{
-		AfterIndex: since,
-		Recursive:  true,
-	}
-	e, err := esr.client().Watcher(key, opts).Next(ctx)
-	if err != nil {
-		return Event{}, 0, err
-	}
+	func (esr *etcdSubnetRegistry) watchNetworks(ctx context.Context, since uint64) (Event, uint64, error) {
+		key := esr.etcdCfg.Prefix
+		opts := &etcd.WatcherOptions{
+			AfterIndex: since,
+			Recursive:  true,
+		}
+		e, err := esr.client().Watcher(key, opts).Next(ctx)
+		if err != nil {
+			return Event{}, 0, err
+		}
 
-	return esr.parseNetworkWatchResponse(e)
-}
+		return esr.parseNetworkWatchResponse(e)
+	}
 */
 func (esr *etcdSubnetRegistry) client() etcd.KeysAPI {
 	esr.mux.Lock()
@@ -401,21 +852,20 @@ func (esr *etcdSubnetRegistry) resetClient() {
 	esr.mux.Lock()
 	defer esr.mux.Unlock()
 
-	var err error
-	esr.cli, err = newEtcdClient(esr.etcdCfg)
+	rawCli, err := newEtcdClient(esr.etcdCfg)
 	if err != nil {
 		panic(fmt.Errorf("resetClient: error recreating etcd client: %v", err))
 	}
+	esr.rawCli = rawCli
+	esr.cli = etcd.NewKeysAPI(rawCli)
 }
 
 func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 	switch resp.Action {
 	case "delete", "expire":
 		return Event{
-			EventRemoved,
-			HostSubnet{Host: resp.Node.Key},
-			"",
-			NetNamespace{},
+			Type:   EventRemoved,
+			Subnet: HostSubnet{Host: resp.Node.Key},
 		}, nil
 
 	default:
@@ -425,24 +875,36 @@ func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 			return Event{}, err
 		}
 
-		evt := Event{
-			EventAdded,
-			*subnet,
-			"",
-			NetNamespace{},
-		}
-		return evt, nil
+		return Event{Type: EventAdded, Subnet: *subnet}, nil
 	}
 }
 
+// previousNetNamespace decodes resp.PrevNode, if any, into a NetNamespace,
+// for populating Event.OldNetNS. It returns the zero value and false if
+// there's no previous node (a plain create) or it fails to decode (a
+// truncated or otherwise malformed record, no worse off than not knowing).
+func previousNetNamespace(resp *etcd.Response) (NetNamespace, bool) {
+	if resp.PrevNode == nil {
+		return NetNamespace{}, false
+	}
+	var old NetNamespace
+	if err := json.Unmarshal([]byte(resp.PrevNode.Value), &old); err != nil {
+		return NetNamespace{}, false
+	}
+	return old, true
+}
+
 func parseNetNamespaceWatchResponse(resp *etcd.Response) (Event, error) {
 	switch resp.Action {
 	case "delete", "expire":
+		old, ok := previousNetNamespace(resp)
+		if !ok {
+			old = NetNamespace{NetName: resp.Node.Key}
+		}
 		return Event{
-			EventRemoved,
-			HostSubnet{},
-			"",
-			NetNamespace{NetName: resp.Node.Key},
+			Type:     EventRemoved,
+			NetNS:    old,
+			OldNetNS: old,
 		}, nil
 
 	default:
@@ -452,11 +914,9 @@ func parseNetNamespaceWatchResponse(resp *etcd.Response) (Event, error) {
 			return Event{}, err
 		}
 
-		evt := Event{
-			EventAdded,
-			HostSubnet{},
-			"",
-			*netns,
+		evt := Event{Type: EventAdded, NetNS: *netns}
+		if old, ok := previousNetNamespace(resp); ok {
+			evt.OldNetNS = old
 		}
 		return evt, nil
 	}
@@ -473,12 +933,7 @@ func (esr *etcdSubnetRegistry) parseNetworkWatchResponse(resp *etcd.Response) (E
 
 	switch resp.Action {
 	case "delete":
-		evt = Event{
-			EventRemoved,
-			HostSubnet{},
-			netname,
-			NetNamespace{},
-		}
+		evt = Event{Type: EventRemoved, Network: netname}
 
 	default:
 		if !isConfig {
@@ -491,12 +946,7 @@ func (esr *etcdSubnetRegistry) parseNetworkWatchResponse(resp *etcd.Response) (E
 			return Event{}, index, err
 		}
 
-		evt = Event{
-			EventAdded,
-			HostSubnet{},
-			netname,
-			NetNamespace{},
-		}
+		evt = Event{Type: EventAdded, Network: netname}
 	}
 
 	return evt, index, nil
@@ -0,0 +1,244 @@
+// Package flannelimport imports flannel's per-node subnet leases into
+// k8s-ovs's etcd schema, for clusters migrating off flannel that want to
+// keep their nodes' existing pod subnets rather than re-IP every node
+// during the switch.
+//
+// Flannel keeps its leases in its own etcd tree (default prefix
+// "/coreos.com/network"), independent of whatever backend k8s-ovs itself
+// migrates into, so this package talks to that etcd cluster directly with
+// its own client instead of going through the destination EtcdManager.
+//
+// A flannel lease only carries the node's PublicIP, not its Kubernetes node
+// name, so imported HostSubnet records are seeded with Host set to the
+// lease's PublicIP as a placeholder; master.addNode overwrites Host with
+// the real node name (without touching Subnet) the first time it sees a
+// matching Node, so this corrects itself as soon as the master's node watch
+// runs.
+package flannelimport
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/pkg/transport"
+	"golang.org/x/net/context"
+
+	. "k8s-ovs/pkg/etcdmanager"
+)
+
+// EtcdConfig points at the etcd cluster flannel itself uses, which is often
+// not the same cluster (or prefix) k8s-ovs is migrating into.
+type EtcdConfig struct {
+	Endpoints []string
+	Prefix    string // default "/coreos.com/network"
+	Keyfile   string
+	Certfile  string
+	CAFile    string
+}
+
+// ReadLeases connects to a flannel etcd cluster and returns every subnet
+// lease found under cfg.Prefix + "/subnets".
+func ReadLeases(ctx context.Context, cfg *EtcdConfig) ([]HostSubnet, error) {
+	t, err := transport.NewTransport(transport.TLSInfo{
+		CertFile: cfg.Certfile,
+		KeyFile:  cfg.Keyfile,
+		CAFile:   cfg.CAFile,
+	}, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("build transport for flannel etcd: %v", err)
+	}
+
+	cli, err := etcd.New(etcd.Config{Endpoints: cfg.Endpoints, Transport: t})
+	if err != nil {
+		return nil, fmt.Errorf("connect to flannel etcd: %v", err)
+	}
+	kapi := etcd.NewKeysAPI(cli)
+
+	dir := cfg.Prefix + "/subnets"
+	resp, err := kapi.Get(ctx, dir, &etcd.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		return nil, fmt.Errorf("list flannel leases at %s: %v", dir, err)
+	}
+
+	leases := make([]HostSubnet, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		subnet, err := subnetFromLeaseKey(node.Key)
+		if err != nil {
+			return nil, fmt.Errorf("parse flannel lease key %s: %v", node.Key, err)
+		}
+		publicIP, err := publicIPFromLeaseValue(node.Value)
+		if err != nil {
+			return nil, fmt.Errorf("parse flannel lease at %s: %v", node.Key, err)
+		}
+		leases = append(leases, HostSubnet{
+			Host:   publicIP,
+			HostIP: publicIP,
+			Subnet: subnet,
+			Assign: true,
+		})
+	}
+	return leases, nil
+}
+
+// subnetFromLeaseKey reverses flannel's subnet key encoding, e.g.
+// ".../subnets/10.244.5.0-24" -> "10.244.5.0/24".
+func subnetFromLeaseKey(key string) (string, error) {
+	base := key[strings.LastIndex(key, "/")+1:]
+	idx := strings.LastIndex(base, "-")
+	if idx < 0 {
+		return "", fmt.Errorf("not a flannel subnet key")
+	}
+	cidr := base[:idx] + "/" + base[idx+1:]
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return "", fmt.Errorf("not a valid subnet: %v", err)
+	}
+	return cidr, nil
+}
+
+// publicIPFromLeaseValue extracts the PublicIP attribute flannel stores as
+// the lease value's JSON, without pulling in flannel's own (unvendored)
+// lease-attrs type.
+func publicIPFromLeaseValue(value string) (string, error) {
+	var attrs struct {
+		PublicIP string `json:"PublicIP"`
+	}
+	if err := json.Unmarshal([]byte(value), &attrs); err != nil {
+		return "", err
+	}
+	if attrs.PublicIP == "" {
+		return "", fmt.Errorf("lease has no PublicIP")
+	}
+	return attrs.PublicIP, nil
+}
+
+// SubnetConflict records an incoming lease that disagrees with a HostSubnet
+// record already present under the target network.
+type SubnetConflict struct {
+	Incoming HostSubnet
+	Existing HostSubnet
+}
+
+// Plan is the result of validating flannel's leases against a target
+// network's config and existing records, before anything is written. Apply
+// only ever touches New (always) and Conflicts (only with overwrite), so
+// re-running ReadLeases/BuildPlan/Apply against an unchanged flannel
+// installation finds nothing left to do.
+type Plan struct {
+	Network string
+
+	NewSubnets      []HostSubnet
+	ConflictSubnets []SubnetConflict
+	InvalidLeases   []error
+}
+
+// BuildPlan validates leases against network's cluster config and its
+// existing records in dst, sorting each into "new" (write freely),
+// "conflict" (differs from an existing record; needs --overwrite), or
+// already-imported (identical to an existing record; silently dropped, the
+// idempotency case) -- or "invalid" if the lease doesn't fit the cluster
+// config at all, which Apply can never fix regardless of --overwrite.
+func BuildPlan(ctx context.Context, dst EtcdManager, network string, leases []HostSubnet) (*Plan, error) {
+	cfg, err := dst.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, fmt.Errorf("read target cluster network config: %v", err)
+	}
+	_, clusterNet, err := net.ParseCIDR(cfg.Network)
+	if err != nil {
+		return nil, fmt.Errorf("target cluster network %q is not a valid CIDR: %v", cfg.Network, err)
+	}
+
+	plan := &Plan{Network: network}
+
+	for _, lease := range leases {
+		if err := validateLease(&lease, clusterNet, cfg.HostSubnetLength); err != nil {
+			plan.InvalidLeases = append(plan.InvalidLeases, fmt.Errorf("lease for %s: %v", lease.HostIP, err))
+			continue
+		}
+
+		existing, err := dst.GetSubnet(ctx, network, lease.HostIP)
+		switch {
+		case err == nil:
+			if *existing != lease {
+				plan.ConflictSubnets = append(plan.ConflictSubnets, SubnetConflict{Incoming: lease, Existing: *existing})
+			}
+		default:
+			// Not found (or unreadable, which AcquireSubnet will surface
+			// properly on Apply): treat as new.
+			plan.NewSubnets = append(plan.NewSubnets, lease)
+		}
+	}
+
+	return plan, nil
+}
+
+// validateLease checks that lease's fields are usable at all and that its
+// CIDR belongs to clusterNet at exactly hostSubnetLength host bits, the way
+// a subnet allocated by k8s-ovs's own SubnetAllocator would.
+func validateLease(lease *HostSubnet, clusterNet *net.IPNet, hostSubnetLength uint32) error {
+	if net.ParseIP(lease.HostIP) == nil {
+		return fmt.Errorf("invalid host IP %q", lease.HostIP)
+	}
+	ip, ipnet, err := net.ParseCIDR(lease.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %v", lease.Subnet, err)
+	}
+	if !clusterNet.Contains(ip) {
+		return fmt.Errorf("subnet %s is not part of cluster network %s", lease.Subnet, clusterNet.String())
+	}
+	maskSize, bits := ipnet.Mask.Size()
+	if uint32(bits-maskSize) != hostSubnetLength {
+		return fmt.Errorf("subnet %s has host capacity for %d bits, cluster is configured for %d", lease.Subnet, bits-maskSize, hostSubnetLength)
+	}
+	return nil
+}
+
+// Report renders a human-readable dry-run summary of the plan.
+func (p *Plan) Report() string {
+	s := fmt.Sprintf("Network %q:\n", p.Network)
+	s += fmt.Sprintf("  HostSubnets: %d new, %d conflicting, %d invalid\n", len(p.NewSubnets), len(p.ConflictSubnets), len(p.InvalidLeases))
+	for _, c := range p.ConflictSubnets {
+		s += fmt.Sprintf("    conflict: host %s: incoming %+v, existing %+v\n", c.Incoming.HostIP, c.Incoming, c.Existing)
+	}
+	for _, err := range p.InvalidLeases {
+		s += fmt.Sprintf("    invalid: %v\n", err)
+	}
+	return s
+}
+
+// HasConflicts reports whether applying p without overwrite would leave
+// records out.
+func (p *Plan) HasConflicts() bool {
+	return len(p.ConflictSubnets) > 0
+}
+
+// Apply writes p's new records, and -- only if overwrite is true -- its
+// conflicting records, via dst. It refuses outright if p has conflicts and
+// overwrite is false, so a caller can't partially apply a plan it hasn't
+// actually looked at.
+func (p *Plan) Apply(ctx context.Context, dst EtcdManager, overwrite bool) error {
+	if p.HasConflicts() && !overwrite {
+		return fmt.Errorf("%d lease(s) conflict with existing HostSubnet records; rerun with --overwrite to replace them", len(p.ConflictSubnets))
+	}
+
+	for i := range p.NewSubnets {
+		subnet := p.NewSubnets[i]
+		if err := dst.AcquireSubnet(ctx, p.Network, subnet.HostIP, &subnet); err != nil {
+			return fmt.Errorf("create HostSubnet for %s: %v", subnet.HostIP, err)
+		}
+	}
+
+	if overwrite {
+		for i := range p.ConflictSubnets {
+			subnet := p.ConflictSubnets[i].Incoming
+			if err := dst.RenewSubnet(ctx, p.Network, &subnet); err != nil {
+				return fmt.Errorf("overwrite HostSubnet for %s: %v", subnet.HostIP, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+// Package osdnmigrate converts a OpenShift SDN cluster's HostSubnet and
+// NetNamespace objects into k8s-ovs's etcd schema, for clusters moving off
+// OpenShift SDN that want to keep their existing VNID and subnet
+// assignments (so captures, firewall rules and debugging habits taken
+// against those values stay valid).
+//
+// OpenShift's actual API client isn't vendored here, so input is read from
+// export files instead of a live API server -- e.g.
+//
+//	oc get hostsubnets -o json > hostsubnets.json
+//	oc get netnamespaces -o json > netnamespaces.json
+//
+// OpenShift's multitenant join/isolate relationships between projects are
+// carried as annotations with their own encoding, not translated by this
+// package; re-apply `oc adm pod-network join-projects`-equivalent state
+// with k8s-ovs's own tooling after migrating.
+package osdnmigrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+
+	"golang.org/x/net/context"
+
+	. "k8s-ovs/pkg/etcdmanager"
+)
+
+// osdnObjectMeta mirrors the subset of OpenShift's ObjectMeta wire format
+// this package reads.
+type osdnObjectMeta struct {
+	Name string `json:"name"`
+}
+
+// osdnHostSubnet mirrors OpenShift SDN's HostSubnet wire format, trimmed to
+// the fields needed to reconstruct a k8s-ovs HostSubnet.
+type osdnHostSubnet struct {
+	Metadata osdnObjectMeta `json:"metadata"`
+	Host     string         `json:"host"`
+	HostIP   string         `json:"hostIP"`
+	Subnet   string         `json:"subnet"`
+}
+
+type osdnHostSubnetList struct {
+	Items []osdnHostSubnet `json:"items"`
+}
+
+// osdnNetNamespace mirrors OpenShift SDN's NetNamespace wire format,
+// trimmed to the fields needed to reconstruct a k8s-ovs NetNamespace.
+type osdnNetNamespace struct {
+	Metadata osdnObjectMeta `json:"metadata"`
+	NetName  string         `json:"netname"`
+	NetID    uint32         `json:"netid"`
+}
+
+type osdnNetNamespaceList struct {
+	Items []osdnNetNamespace `json:"items"`
+}
+
+// LoadHostSubnets reads and converts an "oc get hostsubnets -o json" export.
+func LoadHostSubnets(path string) ([]HostSubnet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", path, err)
+	}
+	var list osdnHostSubnetList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	subnets := make([]HostSubnet, 0, len(list.Items))
+	for _, item := range list.Items {
+		host := item.Host
+		if host == "" {
+			host = item.Metadata.Name
+		}
+		subnets = append(subnets, HostSubnet{
+			Host:   host,
+			HostIP: item.HostIP,
+			Subnet: item.Subnet,
+			Assign: true,
+		})
+	}
+	return subnets, nil
+}
+
+// LoadNetNamespaces reads and converts an "oc get netnamespaces -o json" export.
+func LoadNetNamespaces(path string) ([]NetNamespace, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", path, err)
+	}
+	var list osdnNetNamespaceList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	netnss := make([]NetNamespace, 0, len(list.Items))
+	for _, item := range list.Items {
+		netname := item.NetName
+		if netname == "" {
+			netname = item.Metadata.Name
+		}
+		netnss = append(netnss, NetNamespace{
+			NetName: netname,
+			NetID:   item.NetID,
+		})
+	}
+	return netnss, nil
+}
+
+// SubnetConflict records an incoming HostSubnet that disagrees with a
+// record already present under the target network.
+type SubnetConflict struct {
+	Incoming HostSubnet
+	Existing HostSubnet
+}
+
+// NetNamespaceConflict records an incoming NetNamespace that disagrees with
+// a record already present under the target network.
+type NetNamespaceConflict struct {
+	Incoming NetNamespace
+	Existing NetNamespace
+}
+
+// Plan is the result of validating an OpenShift SDN export against a
+// target network's config and existing records, before anything is
+// written. Apply only ever touches New (always) and Conflicts (only with
+// overwrite), so re-running BuildPlan/Apply against an export that's
+// already been migrated finds nothing left to do.
+type Plan struct {
+	Network string
+
+	NewSubnets      []HostSubnet
+	ConflictSubnets []SubnetConflict
+	InvalidSubnets  []error
+
+	NewNetNamespaces      []NetNamespace
+	ConflictNetNamespaces []NetNamespaceConflict
+	InvalidNetNamespaces  []error
+}
+
+// BuildPlan validates subnets and netnss against network's cluster config
+// and its existing records in dst, sorting each into "new" (write freely),
+// "conflict" (differs from an existing record; needs --overwrite), or
+// already-migrated (identical to an existing record; silently dropped, the
+// idempotency case) -- or "invalid" if it doesn't fit the cluster config at
+// all, which Apply can never fix regardless of --overwrite.
+func BuildPlan(ctx context.Context, dst EtcdManager, network string, subnets []HostSubnet, netnss []NetNamespace) (*Plan, error) {
+	cfg, err := dst.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, fmt.Errorf("read target cluster network config: %v", err)
+	}
+	_, clusterNet, err := net.ParseCIDR(cfg.Network)
+	if err != nil {
+		return nil, fmt.Errorf("target cluster network %q is not a valid CIDR: %v", cfg.Network, err)
+	}
+
+	plan := &Plan{Network: network}
+
+	for _, subnet := range subnets {
+		if err := validateSubnet(&subnet, clusterNet, cfg.HostSubnetLength); err != nil {
+			plan.InvalidSubnets = append(plan.InvalidSubnets, fmt.Errorf("host %s: %v", subnet.Host, err))
+			continue
+		}
+
+		existing, err := dst.GetSubnet(ctx, network, subnet.HostIP)
+		switch {
+		case err == nil:
+			if *existing != subnet {
+				plan.ConflictSubnets = append(plan.ConflictSubnets, SubnetConflict{Incoming: subnet, Existing: *existing})
+			}
+		default:
+			// Not found (or unreadable, which AcquireSubnet will surface
+			// properly on Apply): treat as new.
+			plan.NewSubnets = append(plan.NewSubnets, subnet)
+		}
+	}
+
+	for _, netns := range netnss {
+		if err := netns.Validate(); err != nil {
+			plan.InvalidNetNamespaces = append(plan.InvalidNetNamespaces, err)
+			continue
+		}
+
+		existing, err := dst.GetNetNamespace(ctx, network, netns.NetName)
+		switch {
+		case err == nil:
+			if !reflect.DeepEqual(*existing, netns) {
+				plan.ConflictNetNamespaces = append(plan.ConflictNetNamespaces, NetNamespaceConflict{Incoming: netns, Existing: *existing})
+			}
+		default:
+			plan.NewNetNamespaces = append(plan.NewNetNamespaces, netns)
+		}
+	}
+
+	return plan, nil
+}
+
+// validateSubnet checks that subnet's fields are usable at all and that its
+// CIDR belongs to clusterNet at exactly hostSubnetLength host bits, the way
+// a subnet allocated by k8s-ovs's own SubnetAllocator would.
+func validateSubnet(subnet *HostSubnet, clusterNet *net.IPNet, hostSubnetLength uint32) error {
+	if subnet.Host == "" {
+		return fmt.Errorf("no host name")
+	}
+	if net.ParseIP(subnet.HostIP) == nil {
+		return fmt.Errorf("invalid host IP %q", subnet.HostIP)
+	}
+	ip, ipnet, err := net.ParseCIDR(subnet.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %v", subnet.Subnet, err)
+	}
+	if !clusterNet.Contains(ip) {
+		return fmt.Errorf("subnet %s is not part of cluster network %s", subnet.Subnet, clusterNet.String())
+	}
+	maskSize, bits := ipnet.Mask.Size()
+	if uint32(bits-maskSize) != hostSubnetLength {
+		return fmt.Errorf("subnet %s has host capacity for %d bits, cluster is configured for %d", subnet.Subnet, bits-maskSize, hostSubnetLength)
+	}
+	return nil
+}
+
+// Report renders a human-readable dry-run summary of the plan.
+func (p *Plan) Report() string {
+	s := fmt.Sprintf("Network %q:\n", p.Network)
+	s += fmt.Sprintf("  HostSubnets: %d new, %d conflicting, %d invalid\n", len(p.NewSubnets), len(p.ConflictSubnets), len(p.InvalidSubnets))
+	for _, c := range p.ConflictSubnets {
+		s += fmt.Sprintf("    conflict: host %s: incoming %+v, existing %+v\n", c.Incoming.Host, c.Incoming, c.Existing)
+	}
+	for _, err := range p.InvalidSubnets {
+		s += fmt.Sprintf("    invalid: %v\n", err)
+	}
+	s += fmt.Sprintf("  NetNamespaces: %d new, %d conflicting, %d invalid\n", len(p.NewNetNamespaces), len(p.ConflictNetNamespaces), len(p.InvalidNetNamespaces))
+	for _, c := range p.ConflictNetNamespaces {
+		s += fmt.Sprintf("    conflict: namespace %s: incoming %+v, existing %+v\n", c.Incoming.NetName, c.Incoming, c.Existing)
+	}
+	for _, err := range p.InvalidNetNamespaces {
+		s += fmt.Sprintf("    invalid: %v\n", err)
+	}
+	return s
+}
+
+// HasConflicts reports whether applying p without overwrite would leave
+// records out.
+func (p *Plan) HasConflicts() bool {
+	return len(p.ConflictSubnets) > 0 || len(p.ConflictNetNamespaces) > 0
+}
+
+// Apply writes p's new records, and -- only if overwrite is true -- its
+// conflicting records, via dst. It refuses outright if p has conflicts and
+// overwrite is false, so a caller can't partially apply a plan it hasn't
+// actually looked at.
+func (p *Plan) Apply(ctx context.Context, dst EtcdManager, overwrite bool) error {
+	if p.HasConflicts() && !overwrite {
+		return fmt.Errorf("%d HostSubnet(s) and %d NetNamespace(s) conflict with existing records; rerun with --overwrite to replace them", len(p.ConflictSubnets), len(p.ConflictNetNamespaces))
+	}
+
+	for i := range p.NewSubnets {
+		subnet := p.NewSubnets[i]
+		if err := dst.AcquireSubnet(ctx, p.Network, subnet.HostIP, &subnet); err != nil {
+			return fmt.Errorf("create HostSubnet for host %s: %v", subnet.Host, err)
+		}
+	}
+	for i := range p.NewNetNamespaces {
+		netns := p.NewNetNamespaces[i]
+		if err := dst.AcquireNetNamespace(ctx, p.Network, &netns); err != nil {
+			return fmt.Errorf("create NetNamespace %s: %v", netns.NetName, err)
+		}
+	}
+
+	if overwrite {
+		for i := range p.ConflictSubnets {
+			subnet := p.ConflictSubnets[i].Incoming
+			if err := dst.RenewSubnet(ctx, p.Network, &subnet); err != nil {
+				return fmt.Errorf("overwrite HostSubnet for host %s: %v", subnet.Host, err)
+			}
+		}
+		for i := range p.ConflictNetNamespaces {
+			netns := p.ConflictNetNamespaces[i].Incoming
+			if err := dst.RenewNetNamespace(ctx, p.Network, &netns); err != nil {
+				return fmt.Errorf("overwrite NetNamespace %s: %v", netns.NetName, err)
+			}
+		}
+	}
+
+	return nil
+}
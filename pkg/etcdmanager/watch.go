@@ -20,6 +20,8 @@ import (
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+
+	"k8s-ovs/pkg/metrics"
 )
 
 // WatchSubnets performs a long term watch of the given network's subnets
@@ -77,13 +79,13 @@ func (sw *subnetWatcher) reset(subnets []HostSubnet) []Event {
 
 		if !found {
 			// new subnet
-			batch = append(batch, Event{EventAdded, ns, "", NetNamespace{}})
+			batch = append(batch, Event{Type: EventAdded, Subnet: ns})
 		}
 	}
 
 	// everything left in sm.subnets has been deleted
 	for _, s := range sw.subnets {
-		batch = append(batch, Event{EventRemoved, s, "", NetNamespace{}})
+		batch = append(batch, Event{Type: EventRemoved, Subnet: s})
 	}
 
 	// copy the subnets over (caution: don't just assign a slice)
@@ -113,25 +115,25 @@ func (sw *subnetWatcher) add(subnet *HostSubnet) Event {
 	for i, s := range sw.subnets {
 		if s.Host == subnet.Host {
 			sw.subnets[i] = *subnet
-			return Event{EventAdded, *subnet, "", NetNamespace{}}
+			return Event{Type: EventAdded, Subnet: *subnet}
 		}
 	}
 
 	sw.subnets = append(sw.subnets, *subnet)
 
-	return Event{EventAdded, sw.subnets[len(sw.subnets)-1], "", NetNamespace{}}
+	return Event{Type: EventAdded, Subnet: sw.subnets[len(sw.subnets)-1]}
 }
 
 func (sw *subnetWatcher) remove(subnet *HostSubnet) Event {
 	for i, s := range sw.subnets {
 		if s.Host == subnet.Host {
 			sw.subnets = deleteSubnet(sw.subnets, i)
-			return Event{EventRemoved, s, "", NetNamespace{}}
+			return Event{Type: EventRemoved, Subnet: s}
 		}
 	}
 
 	glog.Errorf("Removed subnet (%s) was not found", subnet.Host)
-	return Event{EventRemoved, *subnet, "", NetNamespace{}}
+	return Event{Type: EventRemoved, Subnet: *subnet}
 }
 
 func deleteSubnet(s []HostSubnet, i int) []HostSubnet {
@@ -217,14 +219,14 @@ func (nw *netnamespaceWatcher) reset(netnss []NetNamespace) []Event {
 		}
 
 		if !found {
-			// new subnet
-			batch = append(batch, Event{EventAdded, HostSubnet{}, "", ns})
+			// new netnamespace
+			batch = append(batch, Event{Type: EventAdded, NetNS: ns})
 		}
 	}
 
-	// everything left in sm.subnets has been deleted
+	// everything left in nw.netnss has been deleted
 	for _, s := range nw.netnss {
-		batch = append(batch, Event{EventRemoved, HostSubnet{}, "", s})
+		batch = append(batch, Event{Type: EventRemoved, NetNS: s, OldNetNS: s})
 	}
 
 	// copy the subnets over (caution: don't just assign a slice)
@@ -254,24 +256,24 @@ func (nw *netnamespaceWatcher) add(netns *NetNamespace) Event {
 	for i, n := range nw.netnss {
 		if n.NetName == netns.NetName {
 			nw.netnss[i] = *netns
-			return Event{EventAdded, HostSubnet{}, "", *netns}
+			return Event{Type: EventAdded, NetNS: *netns, OldNetNS: n}
 		}
 	}
 	nw.netnss = append(nw.netnss, *netns)
 
-	return Event{EventAdded, HostSubnet{}, "", nw.netnss[len(nw.netnss)-1]}
+	return Event{Type: EventAdded, NetNS: nw.netnss[len(nw.netnss)-1]}
 }
 
 func (nw *netnamespaceWatcher) remove(netns *NetNamespace) Event {
 	for i, n := range nw.netnss {
 		if n.NetName == netns.NetName {
 			nw.netnss = deleteNetNS(nw.netnss, i)
-			return Event{EventRemoved, HostSubnet{}, "", n}
+			return Event{Type: EventRemoved, NetNS: n, OldNetNS: n}
 		}
 	}
 
 	glog.Errorf("Removed netns (%s) was not found", netns.NetName)
-	return Event{EventRemoved, HostSubnet{}, "", *netns}
+	return Event{Type: EventRemoved, NetNS: *netns, OldNetNS: *netns}
 }
 
 func deleteNetNS(n []NetNamespace, i int) []NetNamespace {
@@ -292,6 +294,7 @@ func RunNetnsWatch(ctx context.Context, sm EtcdManager, network string, receiver
 	defer wg.Wait()
 
 	for {
+		metrics.NetnsEventQueueDepth.Set(float64(len(receiver)))
 		select {
 		case evtBatch := <-receiver:
 			handle(evtBatch)
@@ -0,0 +1,86 @@
+package kubeclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api/errors"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+
+	restclient "k8s.io/kubernetes/pkg/client/restclient"
+	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+)
+
+// inClusterTokenFile is where the service account admission controller
+// mounts a pod's token; kubelet keeps it up to date across rotations, so
+// re-reading it on every request is enough to survive a rotation without a
+// restart.
+const inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// BuildConfig resolves the REST config used to talk to the API server: the
+// in-cluster service account config (CA plus a token re-read from disk on
+// every request, so a rotated token is picked up without a restart) when
+// running inside a cluster, or the kubeconfig/flag-based config from
+// clientConfig otherwise. Both the node and master leader-election paths in
+// main.go call this, so there's exactly one place deciding which source
+// wins instead of each picking its own.
+func BuildConfig(clientConfig clientcmd.ClientConfig) (*restclient.Config, error) {
+	if cfg, err := restclient.InClusterConfig(); err == nil {
+		cfg.WrapTransport = wrapWithTokenRefresh(inClusterTokenFile, cfg.WrapTransport)
+		return cfg, nil
+	}
+
+	cfg, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("no credentials found: %v", err)
+	}
+	return cfg, nil
+}
+
+// NewClient builds a Client from cfg and confirms the API server actually
+// accepts its credentials, so a bad token or rejected certificate is
+// reported clearly at startup instead of surfacing as a generic connection
+// failure from whatever the first real request happens to be.
+func NewClient(cfg *restclient.Config) (*client.Client, error) {
+	c, err := client.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("build client: %v", err)
+	}
+
+	if _, err := c.Discovery().ServerVersion(); err != nil {
+		if errors.IsUnauthorized(err) || errors.IsForbidden(err) {
+			return nil, fmt.Errorf("credentials rejected by API server: %v", err)
+		}
+		return nil, fmt.Errorf("failed to contact API server: %v", err)
+	}
+	return c, nil
+}
+
+// wrapWithTokenRefresh returns a WrapTransport func that re-reads tokenFile
+// before every request and sets it as the bearer token, chaining to next
+// (which may be nil) for anything else already wrapping the transport.
+func wrapWithTokenRefresh(tokenFile string, next func(http.RoundTripper) http.RoundTripper) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		if next != nil {
+			rt = next(rt)
+		}
+		return &tokenRefreshingRoundTripper{tokenFile: tokenFile, rt: rt}
+	}
+}
+
+// tokenRefreshingRoundTripper sets the Authorization header from the
+// current contents of tokenFile on every request, instead of the bearer
+// token baked into the Config at startup.
+type tokenRefreshingRoundTripper struct {
+	tokenFile string
+	rt        http.RoundTripper
+}
+
+func (t *tokenRefreshingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if token, err := ioutil.ReadFile(t.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return t.rt.RoundTrip(req)
+}
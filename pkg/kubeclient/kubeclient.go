@@ -0,0 +1,52 @@
+// Package kubeclient configures the shared REST client config used to talk
+// to the Kubernetes API server, so every caller applies the same QPS/burst
+// limits and user agent instead of each construction site picking its own
+// (unthrottled) defaults.
+package kubeclient
+
+import (
+	"time"
+
+	restclient "k8s.io/kubernetes/pkg/client/restclient"
+	"k8s.io/kubernetes/pkg/util/flowcontrol"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// Configure applies qps/burst/userAgent to cfg in place. A qps or burst of
+// zero falls back to the client library's own defaults, matching what
+// leaving them unset would otherwise do.
+//
+// It also installs a rate limiter that records how long API calls spend
+// waiting for a token, so throttling shows up in metrics instead of just as
+// unexplained latency during mass namespace transitions and the like.
+func Configure(cfg *restclient.Config, qps float32, burst int, userAgent string) {
+	if qps <= 0 {
+		qps = restclient.DefaultQPS
+	}
+	if burst <= 0 {
+		burst = restclient.DefaultBurst
+	}
+
+	cfg.QPS = qps
+	cfg.Burst = burst
+	if userAgent != "" {
+		cfg.UserAgent = userAgent
+	}
+	// Config.RateLimiter, when set, takes priority over QPS/Burst in the
+	// client library, so we need our own limiter rather than leaving this
+	// nil once we want to observe wait time.
+	cfg.RateLimiter = &observedRateLimiter{RateLimiter: flowcontrol.NewTokenBucketRateLimiter(qps, burst)}
+}
+
+// observedRateLimiter wraps a flowcontrol.RateLimiter to record how long
+// Accept() blocks its caller.
+type observedRateLimiter struct {
+	flowcontrol.RateLimiter
+}
+
+func (r *observedRateLimiter) Accept() {
+	start := time.Now()
+	r.RateLimiter.Accept()
+	metrics.KubeClientThrottleSeconds.Observe(time.Since(start).Seconds())
+}
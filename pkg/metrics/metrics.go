@@ -0,0 +1,422 @@
+// Package metrics exposes a Prometheus /metrics HTTP endpoint for the node
+// process, along with the first SDN-specific collectors. Other packages
+// (vnid map, flow layer, watches, pod setup) register their own collectors
+// with the default Prometheus registry using the metrics.Namespace prefix.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace is the common Prometheus metric namespace prefix for all
+// k8s-ovs collectors.
+const Namespace = "k8s_ovs"
+
+var (
+	// PodSetupLatency tracks how long CNI ADD pod setup takes end-to-end.
+	PodSetupLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "pod",
+		Name:      "setup_latency_seconds",
+		Help:      "Latency in seconds of pod network setup (CNI ADD).",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// ActivePodPorts tracks the number of OVS ports currently allocated to pods.
+	ActivePodPorts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "pod",
+		Name:      "active_ports",
+		Help:      "Number of pod network ports currently set up on the node.",
+	})
+
+	// EventQueueDepth tracks the number of pending deltas in a watcher's
+	// event queue, labelled by resource kind (Nodes, Namespaces, Services, Pods, ...).
+	EventQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "eventqueue",
+		Name:      "depth",
+		Help:      "Number of pending deltas in the event queue, by resource kind.",
+	}, []string{"resource"})
+
+	// EventQueueProcessed counts deltas handled by a watcher's process function,
+	// labelled by resource kind and delta type (Added/Updated/Deleted/Sync).
+	EventQueueProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "eventqueue",
+		Name:      "processed_total",
+		Help:      "Number of deltas successfully processed, by resource kind and delta type.",
+	}, []string{"resource", "type"})
+
+	// EventQueueErrors counts deltas whose process function returned an error,
+	// labelled by resource kind and delta type.
+	EventQueueErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "eventqueue",
+		Name:      "errors_total",
+		Help:      "Number of deltas whose processing failed, by resource kind and delta type.",
+	}, []string{"resource", "type"})
+
+	// EventQueueHandlerLatency tracks how long the process function takes per
+	// delta, labelled by resource kind.
+	EventQueueHandlerLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "eventqueue",
+		Name:      "handler_latency_seconds",
+		Help:      "Latency in seconds of processing a single delta, by resource kind.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resource"})
+
+	// NetnsEventQueueDepth tracks the number of pending batches on the netns
+	// event channel shared by the master and node NetNamespace watches.
+	NetnsEventQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "eventqueue",
+		Name:      "netns_depth",
+		Help:      "Number of pending NetNamespace event batches awaiting processing.",
+	})
+
+	// EtcdWatchLagIndex tracks how many etcd index numbers a watch is behind
+	// the store's current index, labelled by watch name (subnets, netnamespaces).
+	EtcdWatchLagIndex = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "etcd",
+		Name:      "watch_lag_index",
+		Help:      "How many etcd index numbers a watch is behind the store's current index.",
+	}, []string{"watch"})
+
+	// EtcdWatchLastEventAge tracks the wall-clock age, in seconds, of the last
+	// event delivered by a watch, labelled by watch name.
+	EtcdWatchLastEventAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "etcd",
+		Name:      "watch_last_event_age_seconds",
+		Help:      "Seconds since a watch last delivered an event.",
+	}, []string{"watch"})
+
+	// EtcdEndpointHealthy tracks the last health-check result for each
+	// configured etcd endpoint, labelled by endpoint address: 1 if it
+	// answered healthy, 0 otherwise.
+	EtcdEndpointHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "etcd",
+		Name:      "endpoint_healthy",
+		Help:      "Whether an etcd endpoint's last health check succeeded (1) or not (0).",
+	}, []string{"endpoint"})
+
+	// EtcdEndpointCurrent tracks which etcd endpoint requests are currently
+	// steered toward first, labelled by endpoint address: 1 for the current
+	// endpoint, 0 for all others.
+	EtcdEndpointCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "etcd",
+		Name:      "endpoint_current",
+		Help:      "Whether an etcd endpoint is the one currently preferred for requests (1) or not (0).",
+	}, []string{"endpoint"})
+
+	// FlowTableCount tracks the number of flows installed in a single
+	// OpenFlow table, labelled by table number.
+	FlowTableCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "flow",
+		Name:      "table_count",
+		Help:      "Number of flows installed in an OpenFlow table, by table number.",
+	}, []string{"table"})
+
+	// FlowCount tracks the total number of flows on the bridge, labelled by
+	// whether they carry the plugin's own cookie or a foreign one (installed
+	// by some other controller or by hand).
+	FlowCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "flow",
+		Name:      "count",
+		Help:      "Total number of flows on the bridge, by cookie ownership (ours/foreign).",
+	}, []string{"cookie"})
+
+	// OVSExecQueueDepth tracks the number of ovs-vsctl/ovs-ofctl invocations
+	// currently waiting for a concurrency slot.
+	OVSExecQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "ovs",
+		Name:      "exec_queue_depth",
+		Help:      "Number of OVS command executions currently waiting for a concurrency slot.",
+	})
+
+	// OVSExecWaitSeconds tracks how long an ovs-vsctl/ovs-ofctl invocation
+	// waited for a concurrency slot before it was allowed to run.
+	OVSExecWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "ovs",
+		Name:      "exec_wait_seconds",
+		Help:      "Time an OVS command execution waited for a concurrency slot before running.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// OVSCircuitBreakerOpen tracks whether the OVS command circuit breaker is
+	// currently open (1) or closed (0), so a datapath outage that trips it is
+	// visible without scraping logs.
+	OVSCircuitBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "ovs",
+		Name:      "circuit_breaker_open",
+		Help:      "Whether the OVS command circuit breaker is open (1) or closed (0).",
+	})
+
+	// KubeClientThrottleSeconds tracks how long a Kubernetes API call waited
+	// on the client's QPS/burst rate limiter before it was allowed to fire.
+	KubeClientThrottleSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "kubeclient",
+		Name:      "throttle_wait_seconds",
+		Help:      "Time a Kubernetes API call waited on the client-side rate limiter before running.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// VNIDReservedUnexpected counts VNIDs observed by a node's NetNamespace
+	// watch that fall within a configured reserved range (see
+	// pkg/vnid.ReservedRanges); the node has no way to tell whether the
+	// master arrived at one of these through auto-allocation or an explicit
+	// assignment, so any occurrence is suspicious enough to count.
+	VNIDReservedUnexpected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "vnid",
+		Name:      "reserved_unexpected_total",
+		Help:      "Number of times a node observed a VNID in a reserved range via its NetNamespace watch.",
+	})
+
+	// NetNamespaceQuarantined counts NetNamespace records withheld from
+	// delivery because they failed NetNamespace.Validate; see
+	// pkg/etcdmanager.QuarantinedNetNamespace.
+	NetNamespaceQuarantined = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "vnid",
+		Name:      "netnamespace_quarantined_total",
+		Help:      "Number of NetNamespace records withheld from delivery for failing validation.",
+	})
+
+	// VXLANIngressDropped tracks the cumulative number of encapsulated
+	// packets dropped by Table 1's VXLAN ingress filter for arriving from a
+	// tunnel source outside the current HostSubnet list; see
+	// ksdn.vxlanIngressDefaultAction. Zero, and absent from the flow table
+	// entirely, whenever the filter is disabled.
+	VXLANIngressDropped = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "vxlan",
+		Name:      "ingress_dropped_packets",
+		Help:      "Cumulative packets dropped by the VXLAN ingress filter for arriving from an unrecognized tunnel source.",
+	})
+
+	// VXLANChecksumWorkaroundApplied is 1 if this node detected (or was
+	// told, via --vxlan-checksum-workaround=enabled) a VXLAN checksum
+	// offload defect on its underlay interface and disabled tx checksum
+	// offload for it, 0 otherwise; see ksdn.resolveVXLANChecksumWorkaround.
+	// Also mirrored into the node's SDN status annotation, so fleets can be
+	// audited either way.
+	VXLANChecksumWorkaroundApplied = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "vxlan",
+		Name:      "checksum_workaround_applied",
+		Help:      "1 if this node disabled tx checksum offload on its underlay interface to work around a known VXLAN checksum offload defect, 0 otherwise.",
+	})
+
+	// MassPodDeleteHeld counts times a node's pod delete safety valve held
+	// back a NetNamespace-triggered pod deletion for exceeding its
+	// configured threshold; see ksdn.podDeleteGuard.
+	MassPodDeleteHeld = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "pod",
+		Name:      "mass_delete_held_total",
+		Help:      "Number of times a mass pod deletion was held back by the safety threshold.",
+	})
+
+	// PodNetworkTransitionFailures counts times a namespace's VNID
+	// transition failed outright and was handed to the retry queue; see
+	// ksdn.podNetworkRetryQueue. A namespace stuck retrying keeps incrementing
+	// this on every attempt, so it also tracks how degraded things are, not
+	// just distinct occurrences.
+	PodNetworkTransitionFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "vnid",
+		Name:      "pod_network_transition_failures_total",
+		Help:      "Number of times applying a namespace's VNID transition failed and was queued for retry.",
+	})
+
+	// VNIDConflictsDetected counts NetNamespace add events a node held back
+	// for re-verification against etcd because they looked like corrupt or
+	// racing data (e.g. oscillating rapidly between two netids) rather than
+	// a legitimate change; see ksdn.vnidConflictDetector. Distinct from
+	// NetNamespaceQuarantined, which is the master rejecting a malformed
+	// record outright -- this is the node catching a well-formed record it
+	// doesn't trust yet.
+	VNIDConflictsDetected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "vnid",
+		Name:      "conflicts_detected_total",
+		Help:      "Number of NetNamespace assignments a node held back to re-verify against etcd as a possible conflict.",
+	})
+
+	// PodEvictionHeld counts pods updatePodNetwork gave up evicting after
+	// repeated PodDisruptionBudget rejections; see ksdn.evictPodWithRetry.
+	// The pod is left running rather than force-deleted.
+	PodEvictionHeld = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "pod",
+		Name:      "eviction_held_total",
+		Help:      "Number of pod evictions abandoned after repeated PodDisruptionBudget rejections.",
+	})
+
+	// TrafficAccountedBytes and TrafficAccountedPackets accumulate the byte
+	// and packet counts read off table 4's per-tenant service rules,
+	// labelled by namespace, for chargeback; see ksdn.trafficAccountant. A
+	// namespace still short of its own service traffic, or one dropped for
+	// exceeding the accountant's label cardinality limit, simply never gets
+	// a series here rather than reporting zero.
+	TrafficAccountedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "traffic",
+		Name:      "accounted_bytes_total",
+		Help:      "Bytes of overlay service traffic accounted to a namespace's VNID, by namespace.",
+	}, []string{"namespace"})
+
+	TrafficAccountedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "traffic",
+		Name:      "accounted_packets_total",
+		Help:      "Packets of overlay service traffic accounted to a namespace's VNID, by namespace.",
+	}, []string{"namespace"})
+
+	// EgressRouterPodsActive counts pods this node has configured as egress
+	// routers (macvlan leg, address and forwarding rules installed); see
+	// ksdn.setUpEgressRouter. It's a counter, not a gauge, since pod
+	// deletion cleans the router state up as part of netns teardown rather
+	// than through a matching decrement call.
+	EgressRouterPodsActive = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "pod",
+		Name:      "egress_router_configured_total",
+		Help:      "Number of pods this node has configured as an egress router.",
+	})
+
+	// TrafficAccountingNamespacesDropped counts distinct VNIDs the traffic
+	// accountant has seen flow stats for but never exported, because doing
+	// so would have exceeded its configured label cardinality limit; see
+	// WithTrafficAccountingNamespaceLimit.
+	TrafficAccountingNamespacesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "traffic",
+		Name:      "accounting_namespaces_dropped_total",
+		Help:      "Number of distinct VNIDs seen by the traffic accountant but not exported due to the label cardinality limit.",
+	})
+
+	// ConnectivityProbeSuccess tracks the result of the last overlay
+	// connectivity probe sent to a peer node's HostSubnet gateway, labelled
+	// by peer node IP: 1 if the echo was received before the timeout, 0
+	// otherwise; see ksdn.connectivityProber.
+	ConnectivityProbeSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "connectivity",
+		Name:      "probe_success",
+		Help:      "Whether the last overlay connectivity probe to a peer node succeeded (1) or not (0), by peer node IP.",
+	}, []string{"peer"})
+
+	// ConnectivityProbeLatencySeconds tracks the round-trip time of the last
+	// successful overlay connectivity probe to a peer, labelled by peer node
+	// IP. It's left unset (not zeroed) after a failed probe, so a stale
+	// latency reading is distinguishable from a fast one.
+	ConnectivityProbeLatencySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "connectivity",
+		Name:      "probe_latency_seconds",
+		Help:      "Round-trip time of the last successful overlay connectivity probe to a peer node, by peer node IP.",
+	}, []string{"peer"})
+
+	// ConnectivityProbeFailuresTotal counts overlay connectivity probes that
+	// timed out without an echo, labelled by peer node IP.
+	ConnectivityProbeFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "connectivity",
+		Name:      "probe_failures_total",
+		Help:      "Number of overlay connectivity probes to a peer node that timed out without an echo, by peer node IP.",
+	}, []string{"peer"})
+
+	// MaintenanceFreezeActive is 1 while this node considers the cluster's
+	// dataplane frozen for maintenance (mutating FlowBackend calls refused,
+	// VNID transitions queued rather than applied), 0 otherwise; see
+	// ksdn.maintenanceFreezeState.
+	MaintenanceFreezeActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "maintenance",
+		Name:      "freeze_active",
+		Help:      "1 if this node currently has the dataplane frozen for maintenance, 0 otherwise.",
+	})
+
+	// MaintenanceFreezePendingNamespaces counts namespaces with a VNID
+	// transition currently queued because it arrived during a maintenance
+	// freeze, waiting to be collapsed and applied on unfreeze.
+	MaintenanceFreezePendingNamespaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "maintenance",
+		Name:      "freeze_pending_namespaces",
+		Help:      "Number of namespaces with a VNID transition queued behind the current maintenance freeze.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PodSetupLatency)
+	prometheus.MustRegister(ActivePodPorts)
+	prometheus.MustRegister(EventQueueDepth)
+	prometheus.MustRegister(EventQueueProcessed)
+	prometheus.MustRegister(EventQueueErrors)
+	prometheus.MustRegister(EventQueueHandlerLatency)
+	prometheus.MustRegister(NetnsEventQueueDepth)
+	prometheus.MustRegister(EtcdWatchLagIndex)
+	prometheus.MustRegister(EtcdWatchLastEventAge)
+	prometheus.MustRegister(EtcdEndpointHealthy)
+	prometheus.MustRegister(EtcdEndpointCurrent)
+	prometheus.MustRegister(FlowTableCount)
+	prometheus.MustRegister(FlowCount)
+	prometheus.MustRegister(OVSExecQueueDepth)
+	prometheus.MustRegister(OVSExecWaitSeconds)
+	prometheus.MustRegister(OVSCircuitBreakerOpen)
+	prometheus.MustRegister(KubeClientThrottleSeconds)
+	prometheus.MustRegister(VNIDReservedUnexpected)
+	prometheus.MustRegister(NetNamespaceQuarantined)
+	prometheus.MustRegister(VXLANIngressDropped)
+	prometheus.MustRegister(VXLANChecksumWorkaroundApplied)
+	prometheus.MustRegister(MassPodDeleteHeld)
+	prometheus.MustRegister(PodNetworkTransitionFailures)
+	prometheus.MustRegister(VNIDConflictsDetected)
+	prometheus.MustRegister(PodEvictionHeld)
+	prometheus.MustRegister(EgressRouterPodsActive)
+	prometheus.MustRegister(TrafficAccountedBytes)
+	prometheus.MustRegister(TrafficAccountedPackets)
+	prometheus.MustRegister(TrafficAccountingNamespacesDropped)
+	prometheus.MustRegister(ConnectivityProbeSuccess)
+	prometheus.MustRegister(ConnectivityProbeLatencySeconds)
+	prometheus.MustRegister(ConnectivityProbeFailuresTotal)
+	prometheus.MustRegister(MaintenanceFreezeActive)
+	prometheus.MustRegister(MaintenanceFreezePendingNamespaces)
+}
+
+// Listen starts the /metrics HTTP endpoint on bindAddress (e.g. "127.0.0.1:9101").
+// If bindAddress is empty, the endpoint is not started; this keeps metrics off
+// by default so operators must opt in.
+func Listen(bindAddress string) {
+	if bindAddress == "" {
+		glog.V(5).Info("Metrics endpoint disabled (no bind address configured)")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+
+	go func() {
+		glog.Infof("Starting metrics listener on %s", bindAddress)
+		if err := http.ListenAndServe(bindAddress, mux); err != nil {
+			glog.Errorf("Metrics listener on %s exited: %v", bindAddress, err)
+		}
+	}()
+}
@@ -0,0 +1,280 @@
+package ovs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FlowMod is a single flow modification: an add (Actions set) or a delete
+// match (Actions left empty). Table and Cookie are carried as their own
+// fields rather than baked into Match/Actions, so a FlowBackend that isn't
+// backed by ovs-ofctl never has to parse them back out of formatted flow
+// syntax. Match and Actions themselves are still plain OVS match/action
+// syntax fragments (e.g. "ip, nw_dst=10.0.0.0/8", "goto_table:5") -- turning
+// every one of k8s-ovs's hand-written flows into a fully structured
+// match/action representation is a much larger project than this interface.
+type FlowMod struct {
+	Table    int
+	Cookie   uint64
+	Priority int
+	Match    string
+	Actions  string
+
+	// Namespace is the mod's owning namespace, if any -- set by callers like
+	// AddServiceRules/DeleteServiceRules that have one, left empty for
+	// cluster-wide base-pipeline flows. It plays no part in flowString or
+	// matchString; it exists so a DryRunFlowBackend can group what it
+	// recorded by namespace.
+	Namespace string
+}
+
+func (m FlowMod) flowString() string {
+	s := fmt.Sprintf("table=%d", m.Table)
+	if m.Cookie != 0 {
+		s += fmt.Sprintf(", cookie=%#x", m.Cookie)
+	}
+	if m.Priority != 0 {
+		s += fmt.Sprintf(", priority=%d", m.Priority)
+	}
+	if m.Match != "" {
+		s += ", " + m.Match
+	}
+	s += ", actions=" + m.Actions
+	return s
+}
+
+func (m FlowMod) matchString() string {
+	s := fmt.Sprintf("table=%d", m.Table)
+	if m.Cookie != 0 {
+		s += fmt.Sprintf(", cookie=%#x", m.Cookie)
+	}
+	if m.Priority != 0 {
+		s += fmt.Sprintf(", priority=%d", m.Priority)
+	}
+	if m.Match != "" {
+		s += ", " + m.Match
+	}
+	return s
+}
+
+// FlowTransaction is the handle FlowBackend.Bundle passes to its function;
+// each flow mod made through it goes to the backend as it is made.
+type FlowTransaction interface {
+	AddFlow(mod FlowMod)
+	DelFlow(mod FlowMod)
+}
+
+// FlowBackend is the flow-programming and port/QoS surface that KsdnNode's
+// SetupSDN, AddServiceRules/DeleteServiceRules and pod setup call through,
+// instead of talking to ovs-ofctl/ovs-vsctl directly. That indirection is
+// what lets a different datapath -- a native OpenFlow client, or a fake for
+// tests -- stand in for the default exec-based Interface without any of
+// those callers changing.
+type FlowBackend interface {
+	// Bundle runs fn, applying every flow mod it makes through the
+	// FlowTransaction it's given, and returns fn's error if it fails. Mods
+	// already made before fn returned an error are not rolled back.
+	Bundle(fn func(FlowTransaction) error) error
+
+	// AddFlows and DelFlows are Bundle wrapped up for callers that only need
+	// to add or delete flows, not both, in one go.
+	AddFlows(mods ...FlowMod) error
+	DelFlows(mods ...FlowMod) error
+
+	// StreamFlows calls fn with every flow currently on the bridge, already
+	// parsed into a Flow so callers never parse dump-flows output
+	// themselves. fn returns false to stop iterating early.
+	StreamFlows(fn func(Flow) bool) error
+
+	// DumpTableAggregate returns the number of flows installed in table.
+	DumpTableAggregate(table int) (uint64, error)
+
+	// AddBridge and DeleteBridge create and remove the backend's bridge.
+	AddBridge(properties ...string) error
+	DeleteBridge() error
+
+	// AddPort and DelPort attach and detach a bridge port, such as a veth
+	// end or the plugin's own tun/vxlan devices.
+	AddPort(port string, ofportRequest int, properties ...string) (int, error)
+	DelPort(port string) error
+
+	// ListPorts returns the names of every port currently attached to the
+	// bridge, including the plugin's own tun/vxlan devices. Used by the
+	// bridge cutover code (see ksdn/cutover.go) to enumerate what still
+	// needs migrating to the new bridge without keeping its own registry of
+	// every port it has ever added.
+	ListPorts() ([]string, error)
+
+	// GetOfPort returns the ofport number of port, which must already be a
+	// bridge port -- whether added through AddPort or, as with the per-pod
+	// setup script, directly via ovs-vsctl.
+	GetOfPort(port string) (int, error)
+
+	// SetQoS applies ingress/egress rate limits, in kbit/s (0 meaning
+	// unlimited), to port.
+	SetQoS(port string, ingressKbps, egressKbps int) error
+
+	// SetFlowExport reconciles the bridge's sFlow and NetFlow export
+	// configuration against sflow/netflow, creating or updating the
+	// corresponding OVSDB record if non-nil, clearing it if nil. It's meant
+	// to be called on every sync tick with the cluster's current desired
+	// configuration, so it also repairs a record an operator deleted by
+	// hand; see ksdn/flow_export.go.
+	SetFlowExport(sflow *SFlowConfig, netflow *NetFlowConfig) error
+}
+
+// SFlowConfig is the bridge's desired sFlow export configuration.
+type SFlowConfig struct {
+	// Targets are sFlow collector addresses, "host:port".
+	Targets []string
+	// Sampling is the 1-in-N packet sampling rate.
+	Sampling int
+	// PollingInterval is the counter polling interval, in seconds.
+	PollingInterval int
+	// AgentInterface names the interface whose address is reported to
+	// collectors as the agent's own address. Left unset, OVS picks one
+	// itself.
+	AgentInterface string
+}
+
+// NetFlowConfig is the bridge's desired NetFlow export configuration.
+type NetFlowConfig struct {
+	// Targets are NetFlow collector addresses, "host:port".
+	Targets []string
+	// ActiveTimeout is the active flow expiry timeout, in seconds.
+	ActiveTimeout int
+}
+
+// RawDumper is implemented by FlowBackends that can hand back their raw
+// ovs-ofctl text output, for the small amount of diagnostics and
+// version-marker code (see alreadySetUp, dumpFlows) that only ever
+// substring-searches it and gains nothing from a parsed Flow. The default
+// exec-based Interface implements it; FakeFlowBackend doesn't, since it
+// never talks to a real bridge.
+type RawDumper interface {
+	Show() (string, error)
+	DumpFlows() ([]string, error)
+}
+
+// flowTransaction adapts a *Transaction, whose AddFlow/DeleteFlows take a
+// pre-formatted flow string, to the FlowMod-based FlowTransaction interface.
+type flowTransaction struct {
+	tx *Transaction
+}
+
+func (ft *flowTransaction) AddFlow(mod FlowMod) {
+	ft.tx.AddFlow(mod.flowString())
+}
+
+func (ft *flowTransaction) DelFlow(mod FlowMod) {
+	ft.tx.DeleteFlows(mod.matchString())
+}
+
+// Bundle implements FlowBackend.Bundle for the default exec-based backend by
+// opening a Transaction, running fn against an adapter for it, and ending
+// the transaction.
+func (ovsif *Interface) Bundle(fn func(FlowTransaction) error) error {
+	ft := &flowTransaction{tx: ovsif.NewTransaction()}
+	if err := fn(ft); err != nil {
+		return err
+	}
+	return ft.tx.EndTransaction()
+}
+
+// AddFlows implements FlowBackend.AddFlows.
+func (ovsif *Interface) AddFlows(mods ...FlowMod) error {
+	return ovsif.Bundle(func(tx FlowTransaction) error {
+		for _, mod := range mods {
+			tx.AddFlow(mod)
+		}
+		return nil
+	})
+}
+
+// DelFlows implements FlowBackend.DelFlows.
+func (ovsif *Interface) DelFlows(mods ...FlowMod) error {
+	return ovsif.Bundle(func(tx FlowTransaction) error {
+		for _, mod := range mods {
+			tx.DelFlow(mod)
+		}
+		return nil
+	})
+}
+
+// DelPort implements FlowBackend.DelPort; it's the same operation as
+// DeletePort, just named to match the FlowBackend interface.
+func (ovsif *Interface) DelPort(port string) error {
+	return ovsif.DeletePort(port)
+}
+
+// SetQoS implements FlowBackend.SetQoS. Ingress limiting is a property of
+// the port's Interface; egress limiting requires a separate linux-htb QoS
+// record attached to the Port. A limit of 0 clears that direction's ceiling.
+func (ovsif *Interface) SetQoS(port string, ingressKbps, egressKbps int) error {
+	_, err := ovsif.exec(OVS_VSCTL, "set", "Interface", port, fmt.Sprintf("ingress_policing_rate=%d", ingressKbps))
+	if err != nil {
+		return err
+	}
+
+	if egressKbps == 0 {
+		_, err = ovsif.exec(OVS_VSCTL, "clear", "Port", port, "qos")
+		return err
+	}
+
+	_, err = ovsif.exec(OVS_VSCTL,
+		"--", "set", "Port", port, "qos=@newqos",
+		"--", "--id=@newqos", "create", "QoS", "type=linux-htb",
+		fmt.Sprintf("other-config:max-rate=%d", egressKbps*1000))
+	return err
+}
+
+// quotedStringSet renders vals as an OVSDB set-of-strings argument for
+// ovs-vsctl, e.g. []string{"10.0.0.1:6343"} -> `"10.0.0.1:6343"`.
+func quotedStringSet(vals []string) string {
+	quoted := make([]string, len(vals))
+	for i, v := range vals {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// SetFlowExport implements FlowBackend.SetFlowExport by creating (or
+// replacing) the bridge's sFlow/NetFlow OVSDB record for each non-nil
+// argument, and clearing it for each nil one.
+func (ovsif *Interface) SetFlowExport(sflow *SFlowConfig, netflow *NetFlowConfig) error {
+	if sflow == nil {
+		if _, err := ovsif.exec(OVS_VSCTL, "clear", "Bridge", ovsif.bridge, "sflow"); err != nil {
+			return fmt.Errorf("Error clearing sFlow export: %v", err)
+		}
+	} else {
+		args := []string{
+			"--", "set", "Bridge", ovsif.bridge, "sflow=@sflow",
+			"--", "--id=@sflow", "create", "sFlow",
+			fmt.Sprintf("targets=%s", quotedStringSet(sflow.Targets)),
+			fmt.Sprintf("sampling=%d", sflow.Sampling),
+			fmt.Sprintf("polling=%d", sflow.PollingInterval),
+		}
+		if sflow.AgentInterface != "" {
+			args = append(args, fmt.Sprintf("agent=%s", sflow.AgentInterface))
+		}
+		if _, err := ovsif.exec(OVS_VSCTL, args...); err != nil {
+			return fmt.Errorf("Error setting sFlow export: %v", err)
+		}
+	}
+
+	if netflow == nil {
+		if _, err := ovsif.exec(OVS_VSCTL, "clear", "Bridge", ovsif.bridge, "netflow"); err != nil {
+			return fmt.Errorf("Error clearing NetFlow export: %v", err)
+		}
+		return nil
+	}
+	_, err := ovsif.exec(OVS_VSCTL,
+		"--", "set", "Bridge", ovsif.bridge, "netflow=@netflow",
+		"--", "--id=@netflow", "create", "NetFlow",
+		fmt.Sprintf("targets=%s", quotedStringSet(netflow.Targets)),
+		fmt.Sprintf("active-timeout=%d", netflow.ActiveTimeout))
+	if err != nil {
+		return fmt.Errorf("Error setting NetFlow export: %v", err)
+	}
+	return nil
+}
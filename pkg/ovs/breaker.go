@@ -0,0 +1,166 @@
+package ovs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s-ovs/pkg/metrics"
+)
+
+// ovsBreakerFailureThreshold is how many consecutive exec failures open the
+// breaker.
+const ovsBreakerFailureThreshold = 5
+
+// ovsBreakerProbeInterval is how long the breaker keeps failing calls fast
+// after opening before it lets one through again as a probe.
+const ovsBreakerProbeInterval = 10 * time.Second
+
+// ErrDatapathUnavailable is returned instead of the underlying exec error
+// while the circuit breaker is open, so a caller doesn't pay another
+// multi-second exec timeout for an OVS that's already known to be down.
+var ErrDatapathUnavailable = fmt.Errorf("datapath unavailable: OVS circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker trips after ovsBreakerFailureThreshold consecutive exec
+// failures, so a dead ovsdb-server/ovs-vswitchd doesn't leave the node
+// hammering it with hopeless commands -- and paying their exec timeout --
+// on every flow operation. Once open, it periodically lets a single call
+// through as a probe; a successful probe closes the breaker again and calls
+// onRecover, so the caller can reconcile whatever flow state was missed
+// while it was open.
+type circuitBreaker struct {
+	onRecover func()
+
+	lock            sync.Mutex
+	state           breakerState
+	consecutiveFail int
+	nextProbe       time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{state: breakerClosed}
+}
+
+// allow reports whether a call may proceed: always when closed, never when
+// open except for the one call due at nextProbe, which moves the breaker to
+// half-open (so a second concurrent caller doesn't also probe) and is let
+// through.
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Now().Before(b.nextProbe) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	default: // breakerHalfOpen
+		return false
+	}
+}
+
+// recordResult updates the breaker's state after a call allow let through,
+// err being that call's result.
+func (b *circuitBreaker) recordResult(err error) {
+	b.lock.Lock()
+
+	if err == nil {
+		b.consecutiveFail = 0
+		recovered := b.state != breakerClosed
+		b.setState(breakerClosed)
+		b.lock.Unlock()
+		if recovered && b.onRecover != nil {
+			go b.onRecover()
+		}
+		return
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.nextProbe = time.Now().Add(ovsBreakerProbeInterval)
+		b.setState(breakerOpen)
+	case breakerClosed:
+		b.consecutiveFail++
+		if b.consecutiveFail >= ovsBreakerFailureThreshold {
+			b.nextProbe = time.Now().Add(ovsBreakerProbeInterval)
+			b.setState(breakerOpen)
+		}
+	}
+	b.lock.Unlock()
+}
+
+// setState transitions to state, logging and updating the metric exactly
+// once per transition. b.lock must be held.
+func (b *circuitBreaker) setState(state breakerState) {
+	if state == b.state {
+		return
+	}
+	glog.Warningf("OVS circuit breaker transitioning from %s to %s", b.state, state)
+	b.state = state
+	if state == breakerClosed {
+		metrics.OVSCircuitBreakerOpen.Set(0)
+	} else {
+		metrics.OVSCircuitBreakerOpen.Set(1)
+	}
+}
+
+// open reports whether the breaker is currently refusing calls (open or
+// half-open, since a half-open breaker only lets its one probe through).
+func (b *circuitBreaker) open() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state != breakerClosed
+}
+
+// CircuitBreakerAware is implemented by FlowBackends that guard their calls
+// with a circuit breaker, which the default exec-based Interface does, and by
+// FreezeFlowBackend, which delegates to the backend it wraps. FakeFlowBackend and the dry-run backend don't need
+// one, since neither ever fails the way a real OVS command can.
+type CircuitBreakerAware interface {
+	// DatapathAvailable reports whether the backend's circuit breaker is
+	// currently closed, for use by readiness checks.
+	DatapathAvailable() bool
+
+	// SetOnRecover registers fn to be called, in its own goroutine, each
+	// time the breaker closes again after having been open.
+	SetOnRecover(fn func())
+}
+
+// DatapathAvailable implements CircuitBreakerAware.
+func (ovsif *Interface) DatapathAvailable() bool {
+	return !ovsif.breaker.open()
+}
+
+// SetOnRecover implements CircuitBreakerAware.
+func (ovsif *Interface) SetOnRecover(fn func()) {
+	ovsif.breaker.lock.Lock()
+	defer ovsif.breaker.lock.Unlock()
+	ovsif.breaker.onRecover = fn
+}
@@ -0,0 +1,198 @@
+package ovs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TableFeature returns a short human-readable name for the SDN feature
+// implemented by OpenFlow table, matching the table layout SetupSDN installs.
+func TableFeature(table int) string {
+	switch table {
+	case 0:
+		return "initial dispatch"
+	case 1:
+		return "vxlan ingress filtering"
+	case 2:
+		return "container IP/MAC validation"
+	case 3:
+		return "service dispatch"
+	case 4:
+		return "service rules"
+	case 5:
+		return "routing"
+	case 6:
+		return "arp to local container"
+	case 7:
+		return "ip to local container"
+	case 8:
+		return "to-remote-container (tunnel egress)"
+	case 9:
+		return "egress network policy"
+	case 253:
+		return "version marker"
+	default:
+		return fmt.Sprintf("table %d", table)
+	}
+}
+
+// DryRunMutation is one flow, port, QoS or bridge change a DryRunFlowBackend
+// recorded instead of applying.
+type DryRunMutation struct {
+	// Namespace is the mutation's owning namespace, if any (see
+	// FlowMod.Namespace). Empty for cluster-wide base-pipeline flows and for
+	// port/QoS/bridge mutations, which aren't namespace-scoped.
+	Namespace string
+
+	// Feature is a human-readable classification of what this mutation
+	// implements -- TableFeature's result for flow mods.
+	Feature string
+
+	// Description is the actual flow-mod string that would have been sent to
+	// ovs-ofctl, or a short sentence for port/QoS/bridge mutations.
+	Description string
+}
+
+// DryRunFlowBackend is a FlowBackend that records every mutation it's asked
+// to make -- rendered as the flow-mod string plus a human-readable
+// classification -- instead of applying it. That lets the same code that
+// drives a real bridge (SetupSDN, AddServiceRules, the VNID event handlers,
+// ...) run unmodified against a DryRunFlowBackend to report exactly what it
+// would have done.
+//
+// Reads (StreamFlows, DumpTableAggregate) are served from what's been
+// recorded so far in the same session, the same way FakeFlowBackend serves
+// them, so a caller that reads back its own writes within one dry run sees
+// consistent state. A DryRunFlowBackend is safe for concurrent use, matching
+// FakeFlowBackend and the real Interface.
+type DryRunFlowBackend struct {
+	fake *FakeFlowBackend
+
+	lock      sync.Mutex
+	Mutations []DryRunMutation
+}
+
+// NewDryRunFlowBackend returns an empty DryRunFlowBackend ready for use.
+func NewDryRunFlowBackend() *DryRunFlowBackend {
+	return &DryRunFlowBackend{fake: NewFakeFlowBackend()}
+}
+
+func (d *DryRunFlowBackend) record(namespace, feature, description string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.Mutations = append(d.Mutations, DryRunMutation{Namespace: namespace, Feature: feature, Description: description})
+}
+
+// dryRunFlowTransaction records flow mods made through it, then replays them
+// to an underlying fake transaction so DryRunFlowBackend's reads stay
+// consistent with what's been recorded.
+type dryRunFlowTransaction struct {
+	backend *DryRunFlowBackend
+	fake    FlowTransaction
+}
+
+func (ft *dryRunFlowTransaction) AddFlow(mod FlowMod) {
+	ft.backend.record(mod.Namespace, TableFeature(mod.Table), "add-flow "+mod.flowString())
+	ft.fake.AddFlow(mod)
+}
+
+func (ft *dryRunFlowTransaction) DelFlow(mod FlowMod) {
+	ft.backend.record(mod.Namespace, TableFeature(mod.Table), "del-flows "+mod.matchString())
+	ft.fake.DelFlow(mod)
+}
+
+// Bundle implements FlowBackend.Bundle.
+func (d *DryRunFlowBackend) Bundle(fn func(FlowTransaction) error) error {
+	return d.fake.Bundle(func(fakeTx FlowTransaction) error {
+		return fn(&dryRunFlowTransaction{backend: d, fake: fakeTx})
+	})
+}
+
+// AddFlows implements FlowBackend.AddFlows.
+func (d *DryRunFlowBackend) AddFlows(mods ...FlowMod) error {
+	return d.Bundle(func(tx FlowTransaction) error {
+		for _, mod := range mods {
+			tx.AddFlow(mod)
+		}
+		return nil
+	})
+}
+
+// DelFlows implements FlowBackend.DelFlows.
+func (d *DryRunFlowBackend) DelFlows(mods ...FlowMod) error {
+	return d.Bundle(func(tx FlowTransaction) error {
+		for _, mod := range mods {
+			tx.DelFlow(mod)
+		}
+		return nil
+	})
+}
+
+// StreamFlows implements FlowBackend.StreamFlows from what's been recorded so
+// far, like FakeFlowBackend.StreamFlows.
+func (d *DryRunFlowBackend) StreamFlows(fn func(Flow) bool) error {
+	return d.fake.StreamFlows(fn)
+}
+
+// DumpTableAggregate implements FlowBackend.DumpTableAggregate from what's
+// been recorded so far, like FakeFlowBackend.DumpTableAggregate.
+func (d *DryRunFlowBackend) DumpTableAggregate(table int) (uint64, error) {
+	return d.fake.DumpTableAggregate(table)
+}
+
+// AddBridge implements FlowBackend.AddBridge.
+func (d *DryRunFlowBackend) AddBridge(properties ...string) error {
+	d.record("", "bridge setup", fmt.Sprintf("add-br, properties=%v", properties))
+	return d.fake.AddBridge(properties...)
+}
+
+// DeleteBridge implements FlowBackend.DeleteBridge.
+func (d *DryRunFlowBackend) DeleteBridge() error {
+	d.record("", "bridge setup", "del-br")
+	return d.fake.DeleteBridge()
+}
+
+// AddPort implements FlowBackend.AddPort.
+func (d *DryRunFlowBackend) AddPort(port string, ofportRequest int, properties ...string) (int, error) {
+	d.record("", "port setup", fmt.Sprintf("add-port %s, properties=%v", port, properties))
+	return d.fake.AddPort(port, ofportRequest, properties...)
+}
+
+// DelPort implements FlowBackend.DelPort.
+func (d *DryRunFlowBackend) DelPort(port string) error {
+	d.record("", "port setup", fmt.Sprintf("del-port %s", port))
+	return d.fake.DelPort(port)
+}
+
+// GetOfPort implements FlowBackend.GetOfPort from what's been recorded so
+// far, like FakeFlowBackend.GetOfPort.
+func (d *DryRunFlowBackend) GetOfPort(port string) (int, error) {
+	return d.fake.GetOfPort(port)
+}
+
+// ListPorts implements FlowBackend.ListPorts from what's been recorded so
+// far, like FakeFlowBackend.ListPorts.
+func (d *DryRunFlowBackend) ListPorts() ([]string, error) {
+	return d.fake.ListPorts()
+}
+
+// SetQoS implements FlowBackend.SetQoS.
+func (d *DryRunFlowBackend) SetQoS(port string, ingressKbps, egressKbps int) error {
+	d.record("", "qos", fmt.Sprintf("set qos on port %s: ingress=%dkbps, egress=%dkbps", port, ingressKbps, egressKbps))
+	return d.fake.SetQoS(port, ingressKbps, egressKbps)
+}
+
+// SetFlowExport implements FlowBackend.SetFlowExport.
+func (d *DryRunFlowBackend) SetFlowExport(sflow *SFlowConfig, netflow *NetFlowConfig) error {
+	if sflow == nil {
+		d.record("", "flow export", "clear sFlow export")
+	} else {
+		d.record("", "flow export", fmt.Sprintf("set sFlow export: targets=%v, sampling=%d, polling=%d", sflow.Targets, sflow.Sampling, sflow.PollingInterval))
+	}
+	if netflow == nil {
+		d.record("", "flow export", "clear NetFlow export")
+	} else {
+		d.record("", "flow export", fmt.Sprintf("set NetFlow export: targets=%v, active-timeout=%d", netflow.Targets, netflow.ActiveTimeout))
+	}
+	return d.fake.SetFlowExport(sflow, netflow)
+}
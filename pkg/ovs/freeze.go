@@ -0,0 +1,168 @@
+package ovs
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrFrozen is returned by FreezeFlowBackend's mutating methods while frozen.
+var ErrFrozen = errors.New("dataplane mutations frozen for maintenance")
+
+// FreezeFlowBackend wraps another FlowBackend and, while frozen, refuses
+// every call that would change the dataplane -- flow mods, port/bridge/QoS
+// changes, flow export config -- returning ErrFrozen instead of forwarding
+// them. Reads (StreamFlows, DumpTableAggregate, ListPorts, GetOfPort) always
+// pass through, since a maintenance freeze only needs to stop the SDN from
+// making changes, not from observing current state.
+//
+// This lets ksdn's event handlers keep running unmodified during a freeze --
+// they still call node.ovs.AddFlows/DelFlows etc. the normal way and just
+// get ErrFrozen back, the same as any other flow-mod failure -- instead of
+// every call site needing its own freeze check.
+type FreezeFlowBackend struct {
+	backend FlowBackend
+
+	lock   sync.Mutex
+	frozen bool
+}
+
+// NewFreezeFlowBackend returns a FreezeFlowBackend wrapping backend, initially
+// unfrozen.
+func NewFreezeFlowBackend(backend FlowBackend) *FreezeFlowBackend {
+	return &FreezeFlowBackend{backend: backend}
+}
+
+// SetFrozen changes whether mutations are currently refused.
+func (f *FreezeFlowBackend) SetFrozen(frozen bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.frozen = frozen
+}
+
+// Frozen reports whether mutations are currently being refused.
+func (f *FreezeFlowBackend) Frozen() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.frozen
+}
+
+func (f *FreezeFlowBackend) checkFrozen() error {
+	if f.Frozen() {
+		return ErrFrozen
+	}
+	return nil
+}
+
+// Bundle implements FlowBackend.Bundle.
+func (f *FreezeFlowBackend) Bundle(fn func(FlowTransaction) error) error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.Bundle(fn)
+}
+
+// AddFlows implements FlowBackend.AddFlows.
+func (f *FreezeFlowBackend) AddFlows(mods ...FlowMod) error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.AddFlows(mods...)
+}
+
+// DelFlows implements FlowBackend.DelFlows.
+func (f *FreezeFlowBackend) DelFlows(mods ...FlowMod) error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.DelFlows(mods...)
+}
+
+// StreamFlows implements FlowBackend.StreamFlows, always passing through.
+func (f *FreezeFlowBackend) StreamFlows(fn func(Flow) bool) error {
+	return f.backend.StreamFlows(fn)
+}
+
+// DumpTableAggregate implements FlowBackend.DumpTableAggregate, always
+// passing through.
+func (f *FreezeFlowBackend) DumpTableAggregate(table int) (uint64, error) {
+	return f.backend.DumpTableAggregate(table)
+}
+
+// AddBridge implements FlowBackend.AddBridge.
+func (f *FreezeFlowBackend) AddBridge(properties ...string) error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.AddBridge(properties...)
+}
+
+// DeleteBridge implements FlowBackend.DeleteBridge.
+func (f *FreezeFlowBackend) DeleteBridge() error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.DeleteBridge()
+}
+
+// AddPort implements FlowBackend.AddPort.
+func (f *FreezeFlowBackend) AddPort(port string, ofportRequest int, properties ...string) (int, error) {
+	if err := f.checkFrozen(); err != nil {
+		return 0, err
+	}
+	return f.backend.AddPort(port, ofportRequest, properties...)
+}
+
+// DelPort implements FlowBackend.DelPort.
+func (f *FreezeFlowBackend) DelPort(port string) error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.DelPort(port)
+}
+
+// GetOfPort implements FlowBackend.GetOfPort, always passing through.
+func (f *FreezeFlowBackend) GetOfPort(port string) (int, error) {
+	return f.backend.GetOfPort(port)
+}
+
+// ListPorts implements FlowBackend.ListPorts, always passing through.
+func (f *FreezeFlowBackend) ListPorts() ([]string, error) {
+	return f.backend.ListPorts()
+}
+
+// SetQoS implements FlowBackend.SetQoS.
+func (f *FreezeFlowBackend) SetQoS(port string, ingressKbps, egressKbps int) error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.SetQoS(port, ingressKbps, egressKbps)
+}
+
+// SetFlowExport implements FlowBackend.SetFlowExport.
+func (f *FreezeFlowBackend) SetFlowExport(sflow *SFlowConfig, netflow *NetFlowConfig) error {
+	if err := f.checkFrozen(); err != nil {
+		return err
+	}
+	return f.backend.SetFlowExport(sflow, netflow)
+}
+
+// DatapathAvailable implements CircuitBreakerAware by delegating to the
+// wrapped backend when it's breaker-aware (the real Interface), so wrapping
+// it in a FreezeFlowBackend doesn't hide its circuit breaker from readiness
+// checks. Backends without one (FakeFlowBackend, DryRunFlowBackend) are
+// reported as always available, matching what callers see with no wrapper at
+// all.
+func (f *FreezeFlowBackend) DatapathAvailable() bool {
+	if cb, ok := f.backend.(CircuitBreakerAware); ok {
+		return cb.DatapathAvailable()
+	}
+	return true
+}
+
+// SetOnRecover implements CircuitBreakerAware by delegating to the wrapped
+// backend when it's breaker-aware; a no-op otherwise.
+func (f *FreezeFlowBackend) SetOnRecover(fn func()) {
+	if cb, ok := f.backend.(CircuitBreakerAware); ok {
+		cb.SetOnRecover(fn)
+	}
+}
@@ -2,12 +2,17 @@
 package ovs
 
 import (
+	"bufio"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 
+	"k8s-ovs/pkg/metrics"
+
 	"k8s.io/kubernetes/pkg/util/exec"
 )
 
@@ -16,9 +21,63 @@ const (
 	OVS_VSCTL = "ovs-vsctl"
 )
 
+// maxConcurrentExec bounds how many ovs-vsctl/ovs-ofctl processes may be
+// running at once across all bridges, so a burst of flow programming (e.g.
+// a large pod churn) can't fork-bomb the node.
+const maxConcurrentExec = 8
+
+// execLimiter is the global concurrency bound shared by every Interface.
+// It's a plain buffered channel, which gives FIFO-ish fairness for free:
+// callers block in the order they arrive, so a large batch of adds can't
+// starve a single pod setup that queues up behind it.
+var execLimiter = make(chan struct{}, maxConcurrentExec)
+
+// acquireExecSlot blocks until a concurrency slot is free, recording how
+// long the caller waited. The returned function releases the slot.
+func acquireExecSlot() func() {
+	metrics.OVSExecQueueDepth.Inc()
+	start := time.Now()
+	execLimiter <- struct{}{}
+	metrics.OVSExecQueueDepth.Dec()
+	metrics.OVSExecWaitSeconds.Observe(time.Since(start).Seconds())
+	return func() { <-execLimiter }
+}
+
+// isMutatingOp reports whether an ovs-vsctl/ovs-ofctl invocation changes
+// bridge state (as opposed to just querying it), based on its subcommand.
+func isMutatingOp(cmd string, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch cmd {
+	case OVS_VSCTL:
+		switch args[0] {
+		case "add-br", "del-br", "add-port", "del-port", "--may-exist", "--if-exists", "set", "clear", "--":
+			return true
+		}
+	case OVS_OFCTL:
+		switch args[0] {
+		case "add-flow", "del-flows":
+			return true
+		}
+	}
+	return false
+}
+
 type Interface struct {
 	execer exec.Interface
 	bridge string
+
+	// mu serializes mutating operations against this bridge, so concurrent
+	// flow/port programming from multiple goroutines can't race with each
+	// other; read-only queries (dump-flows, show, ...) aren't serialized.
+	mu sync.Mutex
+
+	// breaker fast-fails exec once ovsdb-server/ovs-vswitchd has failed
+	// ovsBreakerFailureThreshold calls in a row, instead of letting every
+	// caller pay its own exec timeout against a datapath that's already
+	// known to be down; see breaker.go.
+	breaker *circuitBreaker
 }
 
 // New returns a new ovs.Interface
@@ -30,16 +89,29 @@ func New(execer exec.Interface, bridge string) (*Interface, error) {
 		return nil, fmt.Errorf("OVS is not installed")
 	}
 
-	return &Interface{execer: execer, bridge: bridge}, nil
+	return &Interface{execer: execer, bridge: bridge, breaker: newCircuitBreaker()}, nil
 }
 
 func (ovsif *Interface) exec(cmd string, args ...string) (string, error) {
+	if isMutatingOp(cmd, args) {
+		ovsif.mu.Lock()
+		defer ovsif.mu.Unlock()
+	}
+
+	if !ovsif.breaker.allow() {
+		return "", ErrDatapathUnavailable
+	}
+
+	release := acquireExecSlot()
+	defer release()
+
 	if cmd == OVS_OFCTL {
 		args = append([]string{"-O", "OpenFlow13"}, args...)
 	}
 	glog.V(5).Infof("Executing: %s %s", cmd, strings.Join(args, " "))
 
 	output, err := ovsif.execer.Command(cmd, args...).CombinedOutput()
+	ovsif.breaker.recordResult(err)
 	if err != nil {
 		glog.V(5).Infof("Error executing %s: %s", cmd, string(output))
 		return "", err
@@ -94,14 +166,10 @@ func (ovsif *Interface) AddPort(port string, ofportRequest int, properties ...st
 	if err != nil {
 		return -1, err
 	}
-	ofportStr, err := ovsif.exec(OVS_VSCTL, "get", "Interface", port, "ofport")
+	ofport, err := ovsif.GetOfPort(port)
 	if err != nil {
 		return -1, err
 	}
-	ofport, err := strconv.Atoi(ofportStr)
-	if err != nil {
-		return -1, fmt.Errorf("Could not parse allocated ofport %q: %v", ofportStr, err)
-	}
 	if ofportRequest > 0 && ofportRequest != ofport {
 		return -1, fmt.Errorf("Allocated ofport (%d) did not match request (%d)", ofport, ofportRequest)
 	}
@@ -115,6 +183,31 @@ func (ovsif *Interface) DeletePort(port string) error {
 	return err
 }
 
+// ListPorts implements FlowBackend.ListPorts.
+func (ovsif *Interface) ListPorts() ([]string, error) {
+	out, err := ovsif.exec(OVS_VSCTL, "list-ports", ovsif.bridge)
+	if err != nil {
+		return nil, err
+	}
+	if out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// GetOfPort implements FlowBackend.GetOfPort.
+func (ovsif *Interface) GetOfPort(port string) (int, error) {
+	ofportStr, err := ovsif.exec(OVS_VSCTL, "get", "Interface", port, "ofport")
+	if err != nil {
+		return -1, err
+	}
+	ofport, err := strconv.Atoi(ofportStr)
+	if err != nil {
+		return -1, fmt.Errorf("Could not parse ofport %q for port %q: %v", ofportStr, port, err)
+	}
+	return ofport, nil
+}
+
 type Transaction struct {
 	ovsif *Interface
 	err   error
@@ -162,6 +255,33 @@ func (tx *Transaction) EndTransaction() error {
 	return err
 }
 
+// DumpTableAggregate returns the number of flows installed in the given
+// OpenFlow table, using "ovs-ofctl dump-aggregate" which is much cheaper
+// than dumping and counting the individual flows.
+func (ovsif *Interface) DumpTableAggregate(table int) (uint64, error) {
+	out, err := ovsif.exec(OVS_OFCTL, "dump-aggregate", ovsif.bridge, fmt.Sprintf("table=%d", table))
+	if err != nil {
+		return 0, err
+	}
+
+	// Output looks like:
+	// NXST_AGGREGATE reply (xid=0x2): packet_count=0 byte_count=0 flow_count=3
+	const marker = "flow_count="
+	idx := strings.Index(out, marker)
+	if idx < 0 {
+		return 0, fmt.Errorf("unexpected dump-aggregate output: %q", out)
+	}
+	rest := out[idx+len(marker):]
+	if end := strings.IndexAny(rest, " \n"); end >= 0 {
+		rest = rest[:end]
+	}
+	count, err := strconv.ParseUint(rest, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse flow_count from %q: %v", out, err)
+	}
+	return count, nil
+}
+
 // DumpFlows dumps the flow table for the bridge and returns it as an array of
 // strings, one per flow.
 func (ovsif *Interface) DumpFlows() ([]string, error) {
@@ -179,3 +299,139 @@ func (ovsif *Interface) DumpFlows() ([]string, error) {
 	}
 	return flows, nil
 }
+
+// Show returns the raw "ovs-ofctl show" output for the bridge (port list,
+// link state, capabilities), for use by diagnostics.
+func (ovsif *Interface) Show() (string, error) {
+	return ovsif.exec(OVS_OFCTL, "show", ovsif.bridge)
+}
+
+// Flow is a single flow parsed out of "ovs-ofctl dump-flows" output.
+type Flow struct {
+	Cookie   uint64
+	Table    int
+	Priority int
+	Match    string // comma-separated match fields, e.g. "ip,nw_dst=10.128.0.0/23"
+	Actions  string
+	NPackets uint64 // cumulative packets matched since the flow was installed
+	NBytes   uint64 // cumulative bytes matched since the flow was installed
+	Raw      string // the flow's un-parsed dump-flows line
+}
+
+// flowStatsFields are dump-flows fields that describe a flow's runtime
+// stats rather than its match, and are left out of Flow.Match.
+var flowStatsFields = map[string]bool{
+	"duration":      true,
+	"n_packets":     true,
+	"n_bytes":       true,
+	"idle_age":      true,
+	"hard_age":      true,
+	"idle_timeout":  true,
+	"hard_timeout":  true,
+	"send_flow_rem": true,
+}
+
+// ParseFlow parses a single line of "ovs-ofctl dump-flows" output. It
+// reports false if the line isn't a flow line (e.g. the "NXST_FLOW reply"
+// header) or doesn't have the fields a flow line always has.
+func ParseFlow(line string) (Flow, bool) {
+	line = strings.TrimSpace(line)
+	actionsIdx := strings.Index(line, "actions=")
+	if actionsIdx < 0 || !strings.Contains(line, "cookie=") {
+		return Flow{}, false
+	}
+
+	flow := Flow{
+		Raw:     line,
+		Actions: strings.TrimSpace(line[actionsIdx+len("actions="):]),
+	}
+
+	var haveCookie, haveTable bool
+	var match []string
+	head := strings.TrimRight(line[:actionsIdx], ", ")
+	for _, field := range strings.Split(head, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, val := field, ""
+		if idx := strings.Index(field, "="); idx >= 0 {
+			key, val = field[:idx], field[idx+1:]
+		}
+
+		switch key {
+		case "cookie":
+			cookie, err := strconv.ParseUint(strings.TrimPrefix(val, "0x"), 16, 64)
+			if err != nil {
+				return Flow{}, false
+			}
+			flow.Cookie = cookie
+			haveCookie = true
+		case "table":
+			table, err := strconv.Atoi(val)
+			if err != nil {
+				return Flow{}, false
+			}
+			flow.Table = table
+			haveTable = true
+		case "priority":
+			// priority isn't present on every flow (e.g. table-miss flows
+			// omit it and default to 0), so it's not required like cookie
+			// and table are.
+			if priority, err := strconv.Atoi(val); err == nil {
+				flow.Priority = priority
+			}
+		case "n_packets":
+			if n, err := strconv.ParseUint(val, 10, 64); err == nil {
+				flow.NPackets = n
+			}
+		case "n_bytes":
+			if n, err := strconv.ParseUint(val, 10, 64); err == nil {
+				flow.NBytes = n
+			}
+		default:
+			if !flowStatsFields[key] {
+				match = append(match, field)
+			}
+		}
+	}
+	if !haveCookie || !haveTable {
+		return Flow{}, false
+	}
+
+	flow.Match = strings.Join(match, ",")
+	return flow, true
+}
+
+// StreamFlows dumps the bridge's flow table and parses it a line at a time,
+// calling fn for each successfully parsed flow; fn returns false to stop
+// iteration early, letting a caller that's filtering (e.g. by cookie) skip
+// parsing and allocating for the rest of a very large table.
+//
+// The exec.Cmd abstraction used by this package only exposes
+// Output/CombinedOutput, not a live stdout pipe, so dump-flows' output is
+// still read into memory in one piece; what StreamFlows avoids is the
+// second, caller-side pass of splitting and re-parsing the whole table that
+// DumpFlows would otherwise force on every consumer, which is what actually
+// shows up as allocation and GC pressure on nodes with very large tables.
+func (ovsif *Interface) StreamFlows(fn func(Flow) bool) error {
+	out, err := ovsif.exec(OVS_OFCTL, "dump-flows", ovsif.bridge)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	// A flow line with many match fields can be considerably longer than
+	// bufio's 64KB default token size.
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		flow, ok := ParseFlow(scanner.Text())
+		if !ok {
+			continue
+		}
+		if !fn(flow) {
+			break
+		}
+	}
+	return scanner.Err()
+}
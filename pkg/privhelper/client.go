@@ -0,0 +1,135 @@
+package privhelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	kexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+// requestTimeout bounds a single exec/lookpath round trip to the helper.
+// Flow/port programming and iptables reconciliation are all local,
+// sub-second operations; this is meant to catch a wedged helper, not to
+// bound anything that's expected to take a while.
+const requestTimeout = 30 * time.Second
+
+// Client is a privhelper.Server client that implements
+// k8s.io/kubernetes/pkg/util/exec.Interface, so it can be used as a drop-in
+// replacement for kexec.New() wherever this daemon shells out to
+// ovs-vsctl/ovs-ofctl/iptables/ip/k8s-sdn-ovs.
+type Client struct {
+	http       http.Client
+	socketPath string
+}
+
+var _ kexec.Interface = &Client{}
+
+// NewClient returns a Client that dials socketPath for every call.
+func NewClient(socketPath string) *Client {
+	return &Client{
+		socketPath: socketPath,
+		http: http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.DialTimeout("unix", socketPath, requestTimeout)
+				},
+			},
+			Timeout: requestTimeout,
+		},
+	}
+}
+
+func (c *Client) url(route string) string {
+	return "http://privhelper/" + Version + route
+}
+
+func (c *Client) post(route string, body, out interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Post(c.url(route), "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("privileged helper request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read privileged helper response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("privileged helper returned %s: %s", resp.Status, string(data))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// LookPath implements exec.Interface.
+func (c *Client) LookPath(file string) (string, error) {
+	var result LookPathResult
+	if err := c.post("/lookpath", LookPathRequest{File: file}, &result); err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf(result.Error)
+	}
+	return result.Path, nil
+}
+
+// Command implements exec.Interface.
+func (c *Client) Command(cmd string, args ...string) kexec.Cmd {
+	return &remoteCmd{client: c, path: cmd, args: args}
+}
+
+// remoteCmd implements exec.Cmd by sending the invocation to the helper and
+// blocking for its response; the helper, not this process, is what actually
+// runs the command.
+type remoteCmd struct {
+	client *Client
+	path   string
+	args   []string
+	stdin  []byte
+	stdout io.Writer
+}
+
+func (c *remoteCmd) CombinedOutput() ([]byte, error) {
+	var result ExecResult
+	if err := c.client.post("/exec", ExecRequest{Path: c.path, Args: c.args, Stdin: c.stdin}, &result); err != nil {
+		return nil, err
+	}
+	if c.stdout != nil && len(result.Output) > 0 {
+		c.stdout.Write(result.Output)
+	}
+	if result.Error != "" {
+		return result.Output, fmt.Errorf(result.Error)
+	}
+	return result.Output, nil
+}
+
+func (c *remoteCmd) Output() ([]byte, error) {
+	return c.CombinedOutput()
+}
+
+func (c *remoteCmd) SetDir(dir string) {
+	// The helper always runs with a fixed working directory; every command
+	// this daemon shells out to is invoked with absolute paths and needs no
+	// particular cwd, so there's nothing meaningful to forward here.
+}
+
+func (c *remoteCmd) SetStdin(in io.Reader) {
+	data, err := ioutil.ReadAll(in)
+	if err == nil {
+		c.stdin = data
+	}
+}
+
+func (c *remoteCmd) SetStdout(out io.Writer) {
+	c.stdout = out
+}
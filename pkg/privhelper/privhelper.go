@@ -0,0 +1,63 @@
+// Package privhelper defines the protocol between the node daemon and a
+// small helper process that performs its privileged operations: OVS
+// bridge/port/flow programming, iptables rule management, and the
+// k8s-sdn-ovs veth setup script. Splitting these out means the daemon
+// itself -- watches, caches, flow computation -- can run with drastically
+// reduced capabilities, and the helper only ever runs a narrow, validated
+// set of commands (see ValidateExec).
+//
+// Like the admin API, this is JSON-over-HTTP served on a unix socket:
+// there's no cross-host caller to justify anything heavier, and filesystem
+// permissions on the socket (root-only directory, 0600 socket) are the
+// authentication boundary. Unlike the admin API this is not meant to be
+// hand-driven; Client is the only supported caller.
+//
+// This only covers the OVS/ip/iptables/script commands the daemon runs via
+// kexec.Interface (see ksdn.KsdnNode.execer). It does not cover pod network
+// namespace manipulation: pod_linux.go's ns.WithNetNSPath and
+// pod_arp_check.go's duplicate-address check both still call directly into
+// netlink and setns(2) in-process, since neither has an executable-argv
+// shape ValidateExec's allowlist model can validate. A node routed through
+// WithPrivilegedHelperSocket therefore still needs CAP_SYS_ADMIN/
+// CAP_NET_ADMIN to enter pod netns's itself -- it is not a fully
+// unprivileged daemon, just one with a much narrower set of privileged
+// operations running in-process.
+package privhelper
+
+const (
+	// DefaultSocketPath is the default unix domain socket the helper
+	// listens on.
+	DefaultSocketPath = "/var/run/k8s-ovs/privhelper.sock"
+
+	// Version is the current protocol version, and the URL prefix every
+	// route is served under.
+	Version = "v1"
+)
+
+// ExecRequest is the JSON body of an exec call: a single program invocation,
+// with optional data to write to its stdin (used by iptables-restore).
+type ExecRequest struct {
+	Path  string   `json:"path"`
+	Args  []string `json:"args,omitempty"`
+	Stdin []byte   `json:"stdin,omitempty"`
+}
+
+// ExecResult is the response to an exec call: the combined stdout+stderr a
+// direct os/exec.Cmd.CombinedOutput() call would have returned. A non-nil
+// Error means either validation rejected the request or the command itself
+// exited non-zero; Output may still be populated in the latter case.
+type ExecResult struct {
+	Output []byte `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// LookPathRequest is the JSON body of a lookpath call.
+type LookPathRequest struct {
+	File string `json:"file"`
+}
+
+// LookPathResult is the response to a lookpath call.
+type LookPathResult struct {
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
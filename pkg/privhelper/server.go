@@ -0,0 +1,121 @@
+package privhelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	utilruntime "k8s.io/kubernetes/pkg/util/runtime"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// Server serves the privileged helper API on a unix domain socket. It never
+// runs anything the daemon asks for without checking it against cfg first.
+type Server struct {
+	http.Server
+	cfg  Config
+	path string
+}
+
+// NewServer returns a Server that will only execute commands cfg allows,
+// listening on socketPath once started.
+func NewServer(socketPath string, cfg Config) *Server {
+	router := mux.NewRouter()
+
+	s := &Server{
+		Server: http.Server{Handler: router},
+		cfg:    cfg,
+		path:   socketPath,
+	}
+
+	router.NotFoundHandler = http.HandlerFunc(http.NotFound)
+	prefix := "/" + Version
+	router.HandleFunc(prefix+"/exec", s.handleExec).Methods("POST")
+	router.HandleFunc(prefix+"/lookpath", s.handleLookPath).Methods("POST")
+	return s
+}
+
+// Start creates the helper socket, with the same root-only directory and
+// 0600 socket permissions the admin API uses, and begins serving requests
+// in the background.
+func (s *Server) Start() error {
+	dirName := path.Dir(s.path)
+	if err := os.RemoveAll(dirName); err != nil {
+		return fmt.Errorf("failed to remove old privileged helper socket dir: %v", err)
+	}
+	if err := os.MkdirAll(dirName, 0700); err != nil {
+		return fmt.Errorf("failed to create privileged helper socket directory: %v", err)
+	}
+
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on privileged helper socket: %v", err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to set privileged helper socket mode: %v", err)
+	}
+
+	s.SetKeepAlivesEnabled(false)
+	go utilwait.Forever(func() {
+		if err := s.Serve(l); err != nil {
+			utilruntime.HandleError(fmt.Errorf("privileged helper Serve() failed: %v", err))
+		}
+	}, 0)
+	return nil
+}
+
+func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
+	var req ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidateExec(s.cfg, req.Path, req.Args); err != nil {
+		glog.Warningf("Rejected privileged helper exec request %s %v: %v", req.Path, req.Args, err)
+		writeJSON(w, ExecResult{Error: err.Error()})
+		return
+	}
+
+	cmd := exec.Command(req.Path, req.Args...)
+	if len(req.Stdin) > 0 {
+		cmd.Stdin = bytes.NewReader(req.Stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	result := ExecResult{Output: output}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	writeJSON(w, result)
+}
+
+func (s *Server) handleLookPath(w http.ResponseWriter, r *http.Request) {
+	var req LookPathRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resolved, err := exec.LookPath(req.File)
+	result := LookPathResult{Path: resolved}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	writeJSON(w, result)
+}
+
+func writeJSON(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Warningf("Error writing privileged helper response: %v", err)
+	}
+}
@@ -0,0 +1,594 @@
+package privhelper
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ifaceNameRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+	netnsPathRe = regexp.MustCompile(`^/[a-zA-Z0-9_./@-]+$`)
+	macRe       = regexp.MustCompile(`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`)
+	podIPRe     = regexp.MustCompile(`^[0-9a-fA-F.:]+$`)
+	vnidRe      = regexp.MustCompile(`^-?[0-9]+$`)
+	bandwidthRe = regexp.MustCompile(`^[0-9]*[a-zA-Z]*$`)
+	cidrRe      = regexp.MustCompile(`^[0-9a-fA-F.:]+(/[0-9]{1,3})?$`)
+
+	// ovsIDRe matches ovs-vsctl's "--id=@name" named-uuid syntax, used to
+	// thread a just-created row (QoS/sFlow/NetFlow) into the same
+	// invocation's "set" command; see validateOVSVsctlCommand.
+	ovsIDRe = regexp.MustCompile(`^--id=@[a-zA-Z0-9_]+$`)
+	// ovsAssignRe matches the "column[:key]=value" arguments our own
+	// AddBridge/AddPort/SetQoS/SetFlowExport calls pass to ovs-vsctl
+	// set/create -- see validateOVSVsctlAssign.
+	ovsAssignRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*(:[a-zA-Z0-9_-]+)?=[a-zA-Z0-9@._:,"=/\[\]-]*$`)
+)
+
+// ValidateInterfaceName reports whether name is safe to pass to ip/ovs-vsctl
+// as an interface name: no path separators or shell metacharacters, and
+// within the kernel's 15-byte IFNAMSIZ limit.
+func ValidateInterfaceName(name string) error {
+	if !ifaceNameRe.MatchString(name) {
+		return fmt.Errorf("invalid interface name %q", name)
+	}
+	return nil
+}
+
+// ValidateNetnsPath reports whether path looks like a plausible network
+// namespace handle: an absolute path with no ".." traversal or whitespace.
+func ValidateNetnsPath(path string) error {
+	if !netnsPathRe.MatchString(path) || strings.Contains(path, "..") {
+		return fmt.Errorf("invalid netns path %q", path)
+	}
+	return nil
+}
+
+// Config bounds what the helper server will actually execute. It's supplied
+// by the daemon's own startup flags, not by the request, so a compromised
+// daemon process can't widen its own leash by asking nicely.
+type Config struct {
+	// Bridge is the only OVS bridge ovs-vsctl/ovs-ofctl commands may name.
+	Bridge string
+	// AllowedCookie is the only OpenFlow cookie a flow string naming one
+	// explicitly may use.
+	AllowedCookie uint64
+	// SDNScriptPath is the absolute path of the k8s-sdn-ovs veth setup
+	// script the helper is willing to run.
+	SDNScriptPath string
+	// AllowedIPTablesTables and AllowedIPTablesChains bound which
+	// "-t"/"-A"/"-C"/"-D"/"-I" arguments an iptables invocation may use.
+	AllowedIPTablesTables []string
+	AllowedIPTablesChains []string
+}
+
+// ValidateExec reports whether cfg permits executing path with args. Only a
+// fixed allowlist of programs (identified by basename, since callers pass
+// resolved absolute paths as well as bare names looked up on $PATH) is
+// considered at all; everything else is rejected outright.
+func ValidateExec(cfg Config, path string, args []string) error {
+	switch filepath.Base(path) {
+	case "ovs-vsctl":
+		return validateOVSVsctl(cfg, args)
+	case "ovs-ofctl":
+		return validateOVSOfctl(cfg, args)
+	case "ip":
+		return validateIP(cfg, args)
+	case "iptables":
+		return validateIPTables(cfg, args)
+	case "iptables-save":
+		return validateIPTablesSave(args)
+	case "iptables-restore":
+		// This daemon never calls Restore/RestoreAll -- iptables-restore can
+		// flush and replace whole tables, so there's no fixed shape to
+		// allowlist it against; reject it outright rather than trying.
+		return fmt.Errorf("execution of iptables-restore is not permitted")
+	case filepath.Base(cfg.SDNScriptPath):
+		return validateSDNScript(args)
+	default:
+		return fmt.Errorf("execution of %q is not permitted", path)
+	}
+}
+
+// validateOVSVsctl is a true allowlist of the ovs-vsctl invocations this
+// daemon's own code (pkg/ovs) actually issues: add-br/del-br/add-port/
+// del-port/list-ports/get on our own bridge, and the set/clear/create
+// commands AddBridge/AddPort/SetQoS/SetFlowExport use to configure it and
+// its QoS/sFlow/NetFlow rows. Anything else -- including set-manager,
+// set-controller, set-ssl, emer-reset, or any command carrying a --db flag
+// that would repoint the invocation at a different ovsdb -- falls through
+// every case below and is rejected, rather than only being rejected if it
+// happens to collide with a small denylist.
+func validateOVSVsctl(cfg Config, args []string) error {
+	for _, cmd := range splitOVSCommands(args) {
+		if len(cmd) == 0 {
+			// A leading or doubled "--" separator, e.g. SetQoS's egress path
+			// starts its argv with "--"; nothing to validate.
+			continue
+		}
+		if err := validateOVSVsctlCommand(cfg, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitOVSCommands splits args on ovs-vsctl's own "--" command separator,
+// its documented way of chaining multiple operations into one invocation.
+func splitOVSCommands(args []string) [][]string {
+	commands := [][]string{{}}
+	for _, arg := range args {
+		if arg == "--" {
+			commands = append(commands, []string{})
+			continue
+		}
+		last := len(commands) - 1
+		commands[last] = append(commands[last], arg)
+	}
+	return commands
+}
+
+func validateOVSVsctlCommand(cfg Config, args []string) error {
+	switch {
+	case args[0] == "--if-exists" || args[0] == "--may-exist":
+		args = args[1:]
+	case ovsIDRe.MatchString(args[0]):
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("empty ovs-vsctl command")
+	}
+
+	switch args[0] {
+	case "add-br", "del-br":
+		if len(args) != 2 || args[1] != cfg.Bridge {
+			return fmt.Errorf("ovs-vsctl %s only permitted on bridge %q", args[0], cfg.Bridge)
+		}
+	case "add-port", "del-port":
+		if len(args) != 3 || args[1] != cfg.Bridge {
+			return fmt.Errorf("ovs-vsctl %s only permitted on bridge %q", args[0], cfg.Bridge)
+		}
+		return ValidateInterfaceName(args[2])
+	case "list-ports":
+		if len(args) != 2 || args[1] != cfg.Bridge {
+			return fmt.Errorf("ovs-vsctl list-ports only permitted on bridge %q", cfg.Bridge)
+		}
+	case "get":
+		if len(args) != 4 || args[1] != "Interface" || args[3] != "ofport" {
+			return fmt.Errorf("ovs-vsctl get is only permitted for Interface ofport")
+		}
+		return ValidateInterfaceName(args[2])
+	case "set":
+		return validateOVSVsctlSet(cfg, args[1:])
+	case "clear":
+		return validateOVSVsctlClear(cfg, args[1:])
+	case "create":
+		return validateOVSVsctlCreate(args[1:])
+	default:
+		return fmt.Errorf("ovs-vsctl command %q is not permitted", args[0])
+	}
+	return nil
+}
+
+func validateOVSVsctlSet(cfg Config, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("ovs-vsctl set requires a table, a record and at least one column")
+	}
+	table, record := args[0], args[1]
+	switch table {
+	case "Bridge":
+		if record != cfg.Bridge {
+			return fmt.Errorf("ovs-vsctl set Bridge only permitted for %q", cfg.Bridge)
+		}
+	case "Interface", "Port":
+		if err := ValidateInterfaceName(record); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("ovs-vsctl set table %q is not permitted", table)
+	}
+	return validateOVSVsctlAssigns(args[2:])
+}
+
+func validateOVSVsctlClear(cfg Config, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("ovs-vsctl clear requires a table, a record and a column")
+	}
+	table, record, column := args[0], args[1], args[2]
+	switch table {
+	case "Bridge":
+		if record != cfg.Bridge {
+			return fmt.Errorf("ovs-vsctl clear Bridge only permitted for %q", cfg.Bridge)
+		}
+		if column != "sflow" && column != "netflow" {
+			return fmt.Errorf("ovs-vsctl clear Bridge column %q is not permitted", column)
+		}
+	case "Port":
+		if err := ValidateInterfaceName(record); err != nil {
+			return err
+		}
+		if column != "qos" {
+			return fmt.Errorf("ovs-vsctl clear Port column %q is not permitted", column)
+		}
+	default:
+		return fmt.Errorf("ovs-vsctl clear table %q is not permitted", table)
+	}
+	return nil
+}
+
+func validateOVSVsctlCreate(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("ovs-vsctl create requires a table")
+	}
+	switch args[0] {
+	case "QoS", "sFlow", "NetFlow":
+	default:
+		return fmt.Errorf("ovs-vsctl create table %q is not permitted", args[0])
+	}
+	return validateOVSVsctlAssigns(args[1:])
+}
+
+// validateOVSVsctlAssigns checks each "column[:key]=value" argument against
+// ovsAssignRe -- it doesn't attempt to bound values any tighter than that,
+// since AddPort/SetFlowExport's own properties carry admin-supplied
+// hostnames and CIDRs, but it does keep the whole invocation to key=value
+// pairs on the table/record already validated by the caller.
+func validateOVSVsctlAssigns(assigns []string) error {
+	for _, assign := range assigns {
+		if !ovsAssignRe.MatchString(assign) {
+			return fmt.Errorf("ovs-vsctl argument %q is not permitted", assign)
+		}
+	}
+	return nil
+}
+
+func validateOVSOfctl(cfg Config, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("ovs-ofctl requires a subcommand and bridge argument")
+	}
+	switch args[0] {
+	case "add-flow", "del-flows", "dump-aggregate", "dump-flows", "show":
+	default:
+		return fmt.Errorf("ovs-ofctl subcommand %q is not permitted", args[0])
+	}
+	if args[1] != cfg.Bridge {
+		return fmt.Errorf("ovs-ofctl only permitted on bridge %q", cfg.Bridge)
+	}
+	if args[0] == "add-flow" || args[0] == "del-flows" {
+		if len(args) < 3 {
+			return fmt.Errorf("%s requires a flow argument", args[0])
+		}
+		return validateFlowString(cfg, args[2])
+	}
+	return nil
+}
+
+// validateFlowString restricts an OpenFlow flow string to our own cookie,
+// when it names one explicitly (the daemon's own flow code never does,
+// relying on OVS's default cookie of 0, but a helper caller shouldn't be
+// able to plant flows tagged as belonging to some other controller).
+func validateFlowString(cfg Config, flow string) error {
+	if strings.ContainsAny(flow, "\x00\n\r") {
+		return fmt.Errorf("invalid flow string")
+	}
+	idx := strings.Index(flow, "cookie=")
+	if idx < 0 {
+		return nil
+	}
+	rest := flow[idx+len("cookie="):]
+	if end := strings.IndexByte(rest, ','); end >= 0 {
+		rest = rest[:end]
+	}
+	cookie, err := strconv.ParseUint(rest, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid flow cookie %q: %v", rest, err)
+	}
+	if cookie != cfg.AllowedCookie {
+		return fmt.Errorf("flow cookie %#x is not the k8s-ovs cookie", cookie)
+	}
+	return nil
+}
+
+// validateIP is a true allowlist of the "ip" invocations pkg/ipcmd actually
+// issues for TUN/host-side device configuration: link/addr/route add, del
+// and show against an interface passing ValidateInterfaceName, plus the
+// fixed set of trailing arguments (mtu, up, master, proto kernel, scope
+// link) those calls use. Everything else -- ip netns entirely, and any
+// route argument this daemon doesn't itself emit, notably "via" a
+// caller-chosen gateway -- falls through and is rejected.
+func validateIP(cfg Config, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("ip requires an object and a command")
+	}
+	switch args[0] {
+	case "link":
+		return validateIPLink(args[1:])
+	case "addr":
+		return validateIPAddrOrRoute(args[1:], false)
+	case "route":
+		return validateIPAddrOrRoute(args[1:], true)
+	default:
+		return fmt.Errorf("ip object %q is not permitted", args[0])
+	}
+}
+
+func validateIPLink(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("ip link requires a command and an interface")
+	}
+	verb, rest := args[0], args[1:]
+	switch verb {
+	case "add", "del", "set", "show":
+	default:
+		return fmt.Errorf("ip link %q is not permitted", verb)
+	}
+	if err := ValidateInterfaceName(rest[0]); err != nil {
+		return err
+	}
+	rest = rest[1:]
+
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case "up", "down", "nomaster":
+		case "mtu":
+			if i+1 >= len(rest) {
+				return fmt.Errorf("ip link mtu requires a value")
+			}
+			if _, err := strconv.Atoi(rest[i+1]); err != nil {
+				return fmt.Errorf("invalid mtu %q", rest[i+1])
+			}
+			i++
+		case "master":
+			if i+1 >= len(rest) {
+				return fmt.Errorf("ip link master requires an interface")
+			}
+			if err := ValidateInterfaceName(rest[i+1]); err != nil {
+				return err
+			}
+			i++
+		default:
+			return fmt.Errorf("ip link argument %q is not permitted", rest[i])
+		}
+	}
+	return nil
+}
+
+func validateIPAddrOrRoute(args []string, isRoute bool) error {
+	if len(args) < 1 {
+		return fmt.Errorf("requires a command")
+	}
+	verb, rest := args[0], args[1:]
+	switch verb {
+	case "add", "del":
+		if len(rest) < 1 {
+			return fmt.Errorf("ip %s requires a destination", verb)
+		}
+		if rest[0] != "default" && !cidrRe.MatchString(rest[0]) {
+			return fmt.Errorf("invalid destination %q", rest[0])
+		}
+		rest = rest[1:]
+	case "show":
+	default:
+		return fmt.Errorf("ip command %q is not permitted", verb)
+	}
+
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case "dev":
+			if i+1 >= len(rest) {
+				return fmt.Errorf("ip dev requires an interface")
+			}
+			if err := ValidateInterfaceName(rest[i+1]); err != nil {
+				return err
+			}
+			i++
+		case "proto":
+			if !isRoute || i+1 >= len(rest) || rest[i+1] != "kernel" {
+				return fmt.Errorf("ip proto argument is not permitted")
+			}
+			i++
+		case "scope":
+			if !isRoute || i+1 >= len(rest) || rest[i+1] != "link" {
+				return fmt.Errorf("ip scope argument is not permitted")
+			}
+			i++
+		default:
+			return fmt.Errorf("ip argument %q is not permitted", rest[i])
+		}
+	}
+	return nil
+}
+
+// validateIPTables is a true allowlist of the iptables invocations
+// NodeIPTables.syncIPTableRules actually issues via EnsureRule(Prepend|
+// Append, ...): an optional wait flag, an -A/-C/-D/-I op against an allowed
+// chain, -t against an allowed table, and a rule body restricted to the
+// fixed shapes getStaticNodeIPTablesRules emits. Anything else -- notably
+// a -j target other than the four this daemon's own rules use, or any flag
+// this validator doesn't explicitly recognize -- falls through and is
+// rejected.
+func validateIPTables(cfg Config, args []string) error {
+	if len(args) > 0 && (args[0] == "-w" || args[0] == "-w2") {
+		args = args[1:]
+	}
+	if len(args) < 4 {
+		return fmt.Errorf("iptables command is too short")
+	}
+
+	op, chain, args := args[0], args[1], args[2:]
+	switch op {
+	case "-A", "-C", "-D", "-I":
+	default:
+		return fmt.Errorf("iptables operation %q is not permitted", op)
+	}
+	if !stringInSlice(chain, cfg.AllowedIPTablesChains) {
+		return fmt.Errorf("iptables chain %q is not permitted", chain)
+	}
+
+	if args[0] != "-t" {
+		return fmt.Errorf("iptables command must specify a table")
+	}
+	if !stringInSlice(args[1], cfg.AllowedIPTablesTables) {
+		return fmt.Errorf("iptables table %q is not permitted", args[1])
+	}
+
+	return validateIPTablesRuleArgs(args[2:])
+}
+
+// iptablesCommentRe bounds a "-m comment --comment" value to the character
+// set getStaticNodeIPTablesRules' own comment strings use.
+var iptablesCommentRe = regexp.MustCompile(`^[a-zA-Z0-9 ,._-]{1,64}$`)
+
+// iptablesPortListRe matches a "-m multiport --dports" value: one or more
+// comma-separated port numbers, the only shape VXLAN_PORT produces.
+var iptablesPortListRe = regexp.MustCompile(`^[0-9]+(,[0-9]+)*$`)
+
+// validateIPTablesRuleArgs is a true allowlist of the rule bodies
+// getStaticNodeIPTablesRules emits: an optional "!"-negated -s/-d CIDR, -i
+// on an interface, -p tcp|udp with --tcp-flags, -m comment/-m multiport,
+// and a -j target restricted to MASQUERADE/ACCEPT/RETURN/TCPMSS (with
+// TCPMSS's --set-mss bound to a number). No -j DNAT/SNAT/REDIRECT, no
+// --to-destination, and no other -m module is accepted.
+func validateIPTablesRuleArgs(args []string) error {
+	// hasCriterion tracks whether a -s/-d/-i/-p or -m multiport token (not
+	// -m comment, which matches nothing) has been consumed before -j, so a rule matching everything (e.g. "-j ACCEPT" with no
+	// other criteria, the classic denylist-evasion shape) is rejected --
+	// none of getStaticNodeIPTablesRules' rules omit a match criterion.
+	hasCriterion := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "!":
+		case "-s", "-d":
+			if i+1 >= len(args) || !cidrRe.MatchString(args[i+1]) {
+				return fmt.Errorf("iptables %s requires a CIDR argument", args[i])
+			}
+			i++
+			hasCriterion = true
+		case "-i":
+			if i+1 >= len(args) {
+				return fmt.Errorf("iptables -i requires an interface")
+			}
+			if err := ValidateInterfaceName(args[i+1]); err != nil {
+				return err
+			}
+			i++
+			hasCriterion = true
+		case "-p":
+			if i+1 >= len(args) || (args[i+1] != "tcp" && args[i+1] != "udp") {
+				return fmt.Errorf("iptables -p protocol is not permitted")
+			}
+			i++
+			hasCriterion = true
+		case "--tcp-flags":
+			if i+2 >= len(args) || args[i+1] != "SYN,RST" || args[i+2] != "SYN" {
+				return fmt.Errorf("iptables --tcp-flags argument is not permitted")
+			}
+			i += 2
+		case "-m":
+			if i+1 >= len(args) {
+				return fmt.Errorf("iptables -m requires a module")
+			}
+			switch args[i+1] {
+			case "comment":
+				if i+3 >= len(args) || args[i+2] != "--comment" || !iptablesCommentRe.MatchString(args[i+3]) {
+					return fmt.Errorf("iptables -m comment argument is not permitted")
+				}
+				i += 3
+			case "multiport":
+				if i+3 >= len(args) || args[i+2] != "--dports" || !iptablesPortListRe.MatchString(args[i+3]) {
+					return fmt.Errorf("iptables -m multiport argument is not permitted")
+				}
+				i += 3
+				hasCriterion = true
+			default:
+				return fmt.Errorf("iptables -m module %q is not permitted", args[i+1])
+			}
+		case "-j":
+			if !hasCriterion {
+				return fmt.Errorf("iptables -j requires a preceding match criterion")
+			}
+			if i+1 >= len(args) {
+				return fmt.Errorf("iptables -j requires a target")
+			}
+			target := args[i+1]
+			switch target {
+			case "MASQUERADE", "ACCEPT", "RETURN":
+				i++
+			case "TCPMSS":
+				if i+3 >= len(args) || args[i+2] != "--set-mss" {
+					return fmt.Errorf("iptables -j TCPMSS requires --set-mss")
+				}
+				if _, err := strconv.Atoi(args[i+3]); err != nil {
+					return fmt.Errorf("invalid --set-mss value %q", args[i+3])
+				}
+				i += 3
+			default:
+				return fmt.Errorf("iptables target %q is not permitted", target)
+			}
+		default:
+			return fmt.Errorf("iptables argument %q is not permitted", args[i])
+		}
+	}
+	return nil
+}
+
+// validateIPTablesSave is a true allowlist of the iptables-save invocations
+// NodeIPTables.Dump actually issues via SaveAll: no arguments at all.
+// Save(table), which would add "-t table", is never called from this
+// codebase, so it isn't allowlisted either.
+func validateIPTablesSave(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("iptables-save arguments are not permitted")
+	}
+	return nil
+}
+
+// validateSDNScript validates arguments against the k8s-sdn-ovs script's own
+// calling convention (see pod_linux.go): a subcommand followed by a fixed
+// number of positional interface/MAC/IP/vnid/bandwidth arguments.
+func validateSDNScript(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("k8s-sdn-ovs requires a subcommand")
+	}
+
+	var wantArgs int
+	switch args[0] {
+	case "setup", "update":
+		wantArgs = 6
+	case "teardown":
+		wantArgs = 5
+	default:
+		return fmt.Errorf("k8s-sdn-ovs subcommand %q is not permitted", args[0])
+	}
+	if len(args) != wantArgs {
+		return fmt.Errorf("k8s-sdn-ovs %s expects %d arguments, got %d", args[0], wantArgs-1, len(args)-1)
+	}
+
+	if err := ValidateInterfaceName(args[1]); err != nil {
+		return err
+	}
+	if !macRe.MatchString(args[2]) {
+		return fmt.Errorf("invalid MAC address %q", args[2])
+	}
+	if !podIPRe.MatchString(args[3]) {
+		return fmt.Errorf("invalid pod IP %q", args[3])
+	}
+	if !vnidRe.MatchString(args[4]) {
+		return fmt.Errorf("invalid vnid %q", args[4])
+	}
+	if len(args) > 5 && !bandwidthRe.MatchString(args[5]) {
+		return fmt.Errorf("invalid bandwidth %q", args[5])
+	}
+	return nil
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 
 	"k8s.io/kubernetes/pkg/registry/service/allocator"
+
+	"k8s-ovs/pkg/vnid"
 )
 
 // Interface manages the allocation of netids out of a range.
@@ -24,6 +26,10 @@ var (
 type Allocator struct {
 	netIDRange *NetIDRange
 	alloc      allocator.Interface
+
+	// reserved is skipped by AllocateNext, but still honored by an explicit
+	// Allocate call; see SetReservedRanges.
+	reserved vnid.ReservedRanges
 }
 
 // Allocator implements allocator Interface
@@ -49,6 +55,14 @@ func (r *Allocator) Free() int {
 	return r.alloc.Free()
 }
 
+// SetReservedRanges sets the VNID ranges AllocateNext must skip, e.g. from
+// the cluster's configured ReservedVNIDs. Not safe to call concurrently
+// with Allocate/AllocateNext/Release; set it once right after New/NewInMemory,
+// before the allocator is shared with other goroutines.
+func (r *Allocator) SetReservedRanges(reserved vnid.ReservedRanges) {
+	r.reserved = reserved
+}
+
 // Allocate attempts to reserve the provided netid. ErrNotInRange or
 // ErrAllocated will be returned if the netid is not valid for this range
 // or has already been reserved.
@@ -68,17 +82,32 @@ func (r *Allocator) Allocate(id uint32) error {
 	return nil
 }
 
-// AllocateNext reserves one of the netids from the pool. ErrFull may
-// be returned if there are no netids left.
+// AllocateNext reserves one of the netids from the pool, skipping any
+// netid in a reserved range (see SetReservedRanges) since those are only
+// handed out via an explicit Allocate call. ErrFull may be returned if
+// there are no unreserved netids left.
 func (r *Allocator) AllocateNext() (uint32, error) {
-	offset, ok, err := r.alloc.AllocateNext()
-	if err != nil {
-		return 0, err
-	}
-	if !ok {
-		return 0, ErrFull
+	for attempt := uint32(0); attempt < r.netIDRange.Size; attempt++ {
+		offset, ok, err := r.alloc.AllocateNext()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, ErrFull
+		}
+
+		id := r.netIDRange.Base + uint32(offset)
+		if len(r.reserved) == 0 || !r.reserved.IsReserved(id) {
+			return id, nil
+		}
+
+		// id is reserved for explicit assignment only; give it back and try
+		// the next free slot instead.
+		if err := r.alloc.Release(int(offset)); err != nil {
+			return 0, err
+		}
 	}
-	return r.netIDRange.Base + uint32(offset), nil
+	return 0, ErrFull
 }
 
 // Release releases the netid back to the pool. Releasing an
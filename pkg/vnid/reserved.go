@@ -0,0 +1,122 @@
+package vnid
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Range is an inclusive band of VNIDs, [Base, Base+Size-1].
+type Range struct {
+	Base uint32
+	Size uint32
+}
+
+// Contains reports whether id falls within r.
+func (r Range) Contains(id uint32) bool {
+	return id >= r.Base && (id-r.Base) < r.Size
+}
+
+func (r Range) String() string {
+	if r.Size == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r.Base, r.Base+r.Size-1)
+}
+
+func rangesOverlap(a, b Range) bool {
+	aMax := a.Base + a.Size - 1
+	bMax := b.Base + b.Size - 1
+	return a.Base <= bMax && b.Base <= aMax
+}
+
+// ReservedRanges is a set of VNID ranges hand-assigned outside the normal
+// allocator (e.g. for cross-site consistency): the master's allocator skips
+// them for automatic allocation, and nodes warn when they see one that
+// wasn't explicitly assigned; see IsReserved and ValidateAssignment.
+type ReservedRanges []Range
+
+// ParseReservedRanges parses a comma-separated list of "base-max" ranges
+// (e.g. "100-199,500-509"), as stored in ClusterNetwork.ReservedVNIDs. An
+// empty spec returns a nil, disabled ReservedRanges. Every range must fall
+// within [MinVNID, MaxVNID] and no two ranges may overlap.
+func ParseReservedRanges(spec string) (ReservedRanges, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var ranges ReservedRanges
+	for _, token := range strings.Split(spec, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		r, err := parseRange(token)
+		if err != nil {
+			return nil, err
+		}
+		for _, existing := range ranges {
+			if rangesOverlap(existing, r) {
+				return nil, fmt.Errorf("reserved VNID ranges %s and %s overlap", existing, r)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parseRange(token string) (Range, error) {
+	parts := strings.SplitN(token, "-", 2)
+	if len(parts) != 2 {
+		return Range{}, fmt.Errorf("invalid reserved VNID range %q, must be \"base-max\"", token)
+	}
+
+	base, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid reserved VNID range %q: %v", token, err)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid reserved VNID range %q: %v", token, err)
+	}
+	if max < base {
+		return Range{}, fmt.Errorf("invalid reserved VNID range %q: max is less than base", token)
+	}
+	if uint32(base) < MinVNID || uint32(max) > MaxVNID {
+		return Range{}, fmt.Errorf("reserved VNID range %q must fall within %d-%d", token, MinVNID, MaxVNID)
+	}
+
+	return Range{Base: uint32(base), Size: uint32(max-base) + 1}, nil
+}
+
+// IsReserved reports whether id falls within any reserved range.
+func (rr ReservedRanges) IsReserved(id uint32) bool {
+	for _, r := range rr {
+		if r.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAssignment reports whether id may be assigned the way source
+// describes: any id may be assigned explicitly, but an auto-allocated id
+// must not fall within a reserved range.
+func (rr ReservedRanges) ValidateAssignment(id uint32, source AssignmentSource) error {
+	if source == AutoAllocated && rr.IsReserved(id) {
+		return fmt.Errorf("VNID %d falls within a reserved range and cannot be auto-allocated", id)
+	}
+	return nil
+}
+
+// AssignmentSource distinguishes an automatically allocated VNID from one
+// an explicit request (annotation, reservation, admin API call) asked for
+// by number, for ValidateAssignment.
+type AssignmentSource int
+
+const (
+	AutoAllocated AssignmentSource = iota
+	ExplicitlyAssigned
+)
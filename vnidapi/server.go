@@ -0,0 +1,165 @@
+package vnidapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	utilruntime "k8s.io/kubernetes/pkg/util/runtime"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
+)
+
+// Handlers are the master-side implementations the VNID API dispatches to.
+// Every field is required.
+type Handlers struct {
+	// Authenticate validates a bearer token against the Kubernetes API
+	// server's TokenReview API, returning whether it identifies a known
+	// user. It's called once per request before any handler below runs.
+	Authenticate func(token string) (bool, error)
+
+	// QueryVNID returns a namespace's current or reserved VNID. found is
+	// false if the namespace doesn't exist and has no pending reservation.
+	QueryVNID func(namespace string) (info VNIDInfo, found bool, err error)
+
+	// ReserveVNID reserves netID (or, if zero, an automatically allocated
+	// VNID) for namespace, for ttl if the namespace doesn't already exist.
+	ReserveVNID func(namespace string, netID uint32, ttl time.Duration) (*Reservation, error)
+
+	// ReleaseReservation releases a pending reservation for namespace. It
+	// is not an error to release one that doesn't exist.
+	ReleaseReservation func(namespace string) error
+}
+
+// Server serves the VNID API on a TCP address.
+type Server struct {
+	http.Server
+	handlers Handlers
+	addr     string
+}
+
+// NewServer returns a Server for handlers, listening on addr once started.
+func NewServer(addr string, handlers Handlers) *Server {
+	router := mux.NewRouter()
+
+	s := &Server{
+		Server:   http.Server{Handler: router},
+		handlers: handlers,
+		addr:     addr,
+	}
+
+	router.NotFoundHandler = http.HandlerFunc(http.NotFound)
+	prefix := "/" + Version
+	router.HandleFunc(prefix+"/namespaces/{namespace}/vnid", s.authenticated(s.handleQueryVNID)).Methods("GET")
+	router.HandleFunc(prefix+"/namespaces/{namespace}/vnid/reservation", s.authenticated(s.handleReserve)).Methods("POST")
+	router.HandleFunc(prefix+"/namespaces/{namespace}/vnid/reservation", s.authenticated(s.handleRelease)).Methods("DELETE")
+	return s
+}
+
+// Start begins serving requests in the background.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on VNID API address %q: %v", s.addr, err)
+	}
+
+	s.SetKeepAlivesEnabled(false)
+	go utilwait.Forever(func() {
+		if err := s.Serve(l); err != nil {
+			utilruntime.HandleError(fmt.Errorf("VNID API Serve() failed: %v", err))
+		}
+	}, 0)
+	return nil
+}
+
+// authenticated wraps h so it only runs once the request's bearer token has
+// been validated via s.handlers.Authenticate.
+func (s *Server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		ok, err := s.handlers.Authenticate(token)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("token review failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, prefix)
+}
+
+func (s *Server) handleQueryVNID(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	info, found, err := s.handlers.QueryVNID(namespace)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	writeResult(w, info, nil)
+}
+
+func (s *Server) handleReserve(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	var req ReserveRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("JSON unmarshal error: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl := DefaultReservationTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	reservation, err := s.handlers.ReserveVNID(namespace, req.NetID, ttl)
+	writeResult(w, reservation, err)
+}
+
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	err := s.handlers.ReleaseReservation(namespace)
+	writeResult(w, struct{}{}, err)
+}
+
+func writeResult(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Warningf("Error writing VNID API response: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+// Package vnidapi defines the master's VNID provisioning API: a way for
+// something outside the cluster (an external provisioning system that needs
+// to key firewall rules on a namespace's VNI before the namespace exists) to
+// query, reserve and release VNIDs without touching etcd or the CRD backend
+// directly.
+//
+// Unlike the node-local admin API (see package adminapi), callers here
+// aren't necessarily co-located with the master, so a unix socket and
+// filesystem-permission trust boundary don't apply. Instead every request
+// carries a Kubernetes bearer token in its Authorization header, which the
+// server validates with the API server's TokenReview API -- the API server
+// stays the one authority on credentials, as it is for the daemon's own
+// bearer token in package kubeclient, rather than inventing a separate
+// credential scheme.
+//
+// The API is versioned by URL prefix ("/v1/...") with the same additive
+// backward-compatibility contract as the admin API.
+package vnidapi
+
+import "time"
+
+const (
+	// Version is the current VNID API version, and the URL prefix every
+	// route below is served under.
+	Version = "v1"
+
+	// DefaultReservationTTL is how long a reservation is honored, waiting
+	// for its namespace to be created, if the caller doesn't ask for a
+	// different TTL.
+	DefaultReservationTTL = 24 * time.Hour
+)
+
+// VNIDInfo is the result of querying a namespace's VNID.
+type VNIDInfo struct {
+	Namespace string `json:"namespace"`
+	NetID     uint32 `json:"netID"`
+	// Reserved is true if NetID belongs to a pending reservation rather
+	// than a namespace that already exists.
+	Reserved bool `json:"reserved"`
+}
+
+// ReserveRequest is the JSON body of a reserve call.
+type ReserveRequest struct {
+	// NetID requests a specific VNID; if zero, one is allocated
+	// automatically.
+	NetID uint32 `json:"netID,omitempty"`
+	// TTLSeconds bounds how long the reservation is honored if the
+	// namespace never appears. DefaultReservationTTL is used if zero.
+	TTLSeconds uint32 `json:"ttlSeconds,omitempty"`
+}
+
+// Reservation is the response to a reserve call.
+type Reservation struct {
+	Namespace string    `json:"namespace"`
+	NetID     uint32    `json:"netID"`
+	Auto      bool      `json:"auto"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}